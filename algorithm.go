@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A fingerprint algorithm producing a sub-fingerprint for each frame of audio.
+// The index, search and codecs work with any algorithm through this, so that
+// variants can be tried side by side. Sub-fingerprints hold up to
+// `MaxSubFingerprintSizeBits` bits, with those past the width of the algorithm
+// always zero.
+type fingerprint_algorithm interface {
+	// the name used to select the algorithm and to record it in an index
+	name() string
+
+	// the number of bits of each sub-fingerprint, a multiple of eight (8)
+	subFingerprintSizeBits() int
+
+	// the number of bits that differ between two sub-fingerprints
+	distance(left sub_fingerprint, right sub_fingerprint) int
+
+	// extracts a fingerprint from audio
+	extract(id string, audio pcm) fingerprint
+
+	// the search parameters suited to the algorithm
+	defaultSearchParams() search_params
+}
+
+// The Philips algorithm [1], with sub-fingerprints of the given number of bits
+// from as many plus one (1) frequency bands.
+type philips_algorithm struct {
+	algorithmName string
+	bits          int
+}
+
+var (
+	philips   fingerprint_algorithm = philips_algorithm{PhilipsAlgorithm, 32}
+	philips64 fingerprint_algorithm = philips_algorithm{Philips64Algorithm, 64}
+)
+
+func (a philips_algorithm) name() string {
+	return a.algorithmName
+}
+
+func (a philips_algorithm) subFingerprintSizeBits() int {
+	return a.bits
+}
+
+func (a philips_algorithm) distance(left sub_fingerprint, right sub_fingerprint) int {
+	return left.hammingDistanceTo(right)
+}
+
+func (a philips_algorithm) extract(id string, audio pcm) fingerprint {
+	return extractFingerprint(id, audio, a.bits)
+}
+
+func (a philips_algorithm) defaultSearchParams() search_params {
+	return search_params{
+		algorithm:            a,
+		blockSize:            FingerprintBlockSize,
+		stepSize:             FingerprintBlockSize,
+		approxSearchStrategy: "none",
+		maxHammingDistance:   DefaultMaxHammingDistance,
+		mihSubstrings:        DefaultMultiIndexSubstrings,
+		lshTables:            DefaultLSHTables,
+		lshBits:              DefaultLSHBits,
+		ber:                  DefaultBitErrorRate,
+		minOverlap:           1.0,
+		trailingBlock:        false,
+		speedFactors:         DefaultSpeedFactors,
+	}
+}
+
+// The number of bytes of each sub-fingerprint of the algorithm.
+func subFingerprintSizeBytes(alg fingerprint_algorithm) int {
+	return alg.subFingerprintSizeBits() / BitsPerByte
+}
+
+var fingerprintAlgorithms = map[string]fingerprint_algorithm{
+	philips.name():   philips,
+	philips64.name(): philips64,
+}
+
+// Finds a fingerprint algorithm by name. Indexes persisted before there was a
+// choice of algorithm have no name, and are Philips. Landmark fingerprints are
+// not an algorithm of sub-fingerprints, so are only supported by the commands
+// that handle them separately.
+func newFingerprintAlgorithm(name string) (fingerprint_algorithm, error) {
+	if name == "" {
+		return philips, nil
+	}
+
+	if name == LandmarkAlgorithm {
+		return nil, fmt.Errorf("The %s algorithm is only supported by the extract, build, query and serve commands", name)
+	}
+
+	alg, found := fingerprintAlgorithms[name]
+	if !found {
+		return nil, fmt.Errorf("Unknown fingerprint algorithm: %s", name)
+	}
+
+	return alg, nil
+}
+
+// The names of the fingerprint algorithms, for use in flag descriptions.
+func fingerprintAlgorithmNames() string {
+	var names []string
+	for name := range fingerprintAlgorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return strings.Join(names, ", ")
+}
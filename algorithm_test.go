@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"testing"
+)
+
+func TestNewFingerprintAlgorithm(t *testing.T) {
+	fixtures := []struct {
+		name     string
+		expected fingerprint_algorithm
+	}{
+		{"", philips}, // indexes persisted before there was a choice
+		{"philips", philips},
+		{"philips64", philips64},
+	}
+
+	for i, fixture := range fixtures {
+		got, err := newFingerprintAlgorithm(fixture.name)
+		if err != nil {
+			t.Fatalf("[%d] Finding algorithm failed when it should not have: %s", i, err)
+		}
+
+		if got.name() != fixture.expected.name() {
+			t.Errorf("[%d] Expected algorithm %s but got %s", i, fixture.expected.name(), got.name())
+		}
+	}
+
+	for _, name := range []string{"landmark", "unknown"} {
+		if _, err := newFingerprintAlgorithm(name); err == nil {
+			t.Errorf("Expected an error finding algorithm %s", name)
+		}
+	}
+}
+
+func TestSearchParamsForAlgorithm(t *testing.T) {
+	params := defaultSearchParams()
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	params.registerFlags(flags)
+	if err := flags.Parse([]string{"-ber", "0.2", "-block_size", "64"}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := params.forAlgorithm(philips64, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.algorithm.name() != philips64.name() {
+		t.Errorf("Expected algorithm %s but got %s", philips64.name(), got.algorithm.name())
+	}
+
+	// flags set explicitly are kept, others are the defaults of the algorithm
+	if got.ber != 0.2 || got.blockSize != 64 {
+		t.Errorf("Expected flags to be kept but got BER %f and block size %d", got.ber, got.blockSize)
+	}
+
+	if expected := philips64.defaultSearchParams().stepSize; got.stepSize != expected {
+		t.Errorf("Expected step size %d but got %d", expected, got.stepSize)
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+)
+
+// Mono audio as PCM samples normalised to [-1, 1].
+type pcm struct {
+	sampleRate int
+	samples    []float64
+}
+
+func (audio pcm) duration() float64 {
+	return float64(len(audio.samples)) / float64(audio.sampleRate)
+}
+
+// Extracts a segment of audio given the start and duration in seconds. The
+// segment is clipped to the end of the audio.
+func (audio pcm) segment(start float64, duration float64) pcm {
+	from := int(start * float64(audio.sampleRate))
+	to := from + int(duration*float64(audio.sampleRate))
+
+	if from > len(audio.samples) {
+		from = len(audio.samples)
+	}
+	if to > len(audio.samples) {
+		to = len(audio.samples)
+	}
+
+	samples := make([]float64, to-from)
+	copy(samples, audio.samples[from:to])
+
+	return pcm{audio.sampleRate, samples}
+}
+
+// Mean power of the samples.
+func (audio pcm) power() float64 {
+	if len(audio.samples) == 0 {
+		return 0.0
+	}
+
+	sum := 0.0
+	for _, s := range audio.samples {
+		sum += s * s
+	}
+	return sum / float64(len(audio.samples))
+}
+
+// Reads 16-bit PCM audio from a WAV stream, mixing down to mono if there is
+// more than one channel.
+func readWAV(r io.Reader) (pcm, error) {
+	var riff [12]byte
+	if _, err := io.ReadFull(r, riff[:]); err != nil {
+		return pcm{}, err
+	}
+
+	if string(riff[0:4]) != "RIFF" || string(riff[8:12]) != "WAVE" {
+		return pcm{}, fmt.Errorf("Not a RIFF WAVE stream")
+	}
+
+	channels, sampleRate, bitsPerSample := 0, 0, 0
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if err == io.EOF {
+				err = fmt.Errorf("WAV stream has no data chunk")
+			}
+			return pcm{}, err
+		}
+
+		id := string(header[0:4])
+		size := int64(binary.LittleEndian.Uint32(header[4:8]))
+
+		switch id {
+		case "fmt ":
+			var format [16]byte
+			if size < int64(len(format)) {
+				return pcm{}, fmt.Errorf("WAV format chunk is too short: %d", size)
+			}
+
+			if _, err := io.ReadFull(r, format[:]); err != nil {
+				return pcm{}, err
+			}
+
+			if audioFormat := binary.LittleEndian.Uint16(format[0:2]); audioFormat != 1 {
+				return pcm{}, fmt.Errorf("Only uncompressed PCM WAV is supported, but format was %d", audioFormat)
+			}
+
+			channels = int(binary.LittleEndian.Uint16(format[2:4]))
+			sampleRate = int(binary.LittleEndian.Uint32(format[4:8]))
+			bitsPerSample = int(binary.LittleEndian.Uint16(format[14:16]))
+
+			if _, err := io.CopyN(ioutil.Discard, r, size-int64(len(format))+size%2); err != nil {
+				return pcm{}, err
+			}
+
+		case "data":
+			if channels < 1 || bitsPerSample != 16 {
+				return pcm{}, fmt.Errorf("Only 16-bit WAV is supported, but found %d channels of %d bits", channels, bitsPerSample)
+			}
+
+			buf := make([]byte, size)
+			n, err := io.ReadFull(r, buf)
+			if err != nil && err != io.ErrUnexpectedEOF {
+				return pcm{}, err
+			}
+			buf = buf[:n] // tolerate truncated data chunks
+
+			frames := len(buf) / (2 * channels)
+			samples := make([]float64, frames)
+			for i := range samples {
+				sum := 0.0
+				for c := 0; c < channels; c++ {
+					j := (i*channels + c) * 2
+					sum += float64(int16(binary.LittleEndian.Uint16(buf[j:]))) / 32768.0
+				}
+				samples[i] = sum / float64(channels)
+			}
+
+			return pcm{sampleRate, samples}, nil
+
+		default:
+			if _, err := io.CopyN(ioutil.Discard, r, size+size%2); err != nil {
+				return pcm{}, err
+			}
+		}
+	}
+}
+
+func readWAVFile(path string) (pcm, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return pcm{}, err
+	}
+	defer f.Close()
+
+	return readWAV(bufio.NewReader(f))
+}
+
+// Writes mono audio as a 16-bit PCM WAV stream, clipping samples to [-1, 1].
+func writeWAV(w io.Writer, audio pcm) error {
+	dataSize := uint32(len(audio.samples) * 2)
+
+	header := make([]byte, 44)
+	copy(header[0:4], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:8], 36+dataSize)
+	copy(header[8:12], "WAVE")
+	copy(header[12:16], "fmt ")
+	binary.LittleEndian.PutUint32(header[16:20], 16)
+	binary.LittleEndian.PutUint16(header[20:22], 1) // PCM
+	binary.LittleEndian.PutUint16(header[22:24], 1) // mono
+	binary.LittleEndian.PutUint32(header[24:28], uint32(audio.sampleRate))
+	binary.LittleEndian.PutUint32(header[28:32], uint32(audio.sampleRate*2))
+	binary.LittleEndian.PutUint16(header[32:34], 2)
+	binary.LittleEndian.PutUint16(header[34:36], 16)
+	copy(header[36:40], "data")
+	binary.LittleEndian.PutUint32(header[40:44], dataSize)
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	data := make([]byte, dataSize)
+	for i, s := range audio.samples {
+		binary.LittleEndian.PutUint16(data[i*2:], uint16(quantize16(s)))
+	}
+
+	_, err := w.Write(data)
+	return err
+}
+
+func quantize16(s float64) int16 {
+	v := math.Floor(s*32768.0 + 0.5)
+	if v > math.MaxInt16 {
+		v = math.MaxInt16
+	} else if v < math.MinInt16 {
+		v = math.MinInt16
+	}
+
+	return int16(v)
+}
+
+// Creates the kernel of a windowed-sinc low-pass FIR filter with the cutoff
+// given as a fraction of the sample rate. The number of taps should be odd.
+func lowPassKernel(cutoff float64, taps int) []float64 {
+	kernel := make([]float64, taps)
+	middle := taps / 2
+
+	sum := 0.0
+	for i := range kernel {
+		n := float64(i - middle)
+
+		sinc := 2.0 * cutoff
+		if n != 0 {
+			sinc = math.Sin(2.0*math.Pi*cutoff*n) / (math.Pi * n)
+		}
+
+		hamming := 0.54 - 0.46*math.Cos(2.0*math.Pi*float64(i)/float64(taps-1))
+		kernel[i] = sinc * hamming
+		sum += kernel[i]
+	}
+
+	// unity gain at DC
+	for i := range kernel {
+		kernel[i] /= sum
+	}
+
+	return kernel
+}
+
+// Creates the kernel of a band-pass FIR filter between two cutoffs, each given
+// as a fraction of the sample rate.
+func bandPassKernel(low float64, high float64, taps int) []float64 {
+	lowKernel := lowPassKernel(low, taps)
+	kernel := lowPassKernel(high, taps)
+	for i := range kernel {
+		kernel[i] -= lowKernel[i]
+	}
+
+	return kernel
+}
+
+// Filters the samples with an FIR kernel, keeping the output aligned with the
+// input and of the same length.
+func convolve(samples []float64, kernel []float64) []float64 {
+	filtered := make([]float64, len(samples))
+	middle := len(kernel) / 2
+
+	for i := range filtered {
+		sum := 0.0
+		for k, h := range kernel {
+			j := i + middle - k
+			if j >= 0 && j < len(samples) {
+				sum += h * samples[j]
+			}
+		}
+		filtered[i] = sum
+	}
+
+	return filtered
+}
+
+// Resamples audio by interpolating at positions `factor` samples apart, so a
+// factor above one shortens the audio. When shortening, the audio is first
+// low-pass filtered to avoid aliasing.
+func interpolate(samples []float64, factor float64) []float64 {
+	if factor > 1.0 {
+		samples = convolve(samples, lowPassKernel(0.5/factor*0.95, 63))
+	}
+
+	size := int(float64(len(samples)) / factor)
+	interpolated := make([]float64, size)
+	for i := range interpolated {
+		position := float64(i) * factor
+		j := int(position)
+		frac := position - float64(j)
+
+		if j+1 < len(samples) {
+			interpolated[i] = samples[j]*(1.0-frac) + samples[j+1]*frac
+		} else if j < len(samples) {
+			interpolated[i] = samples[j]
+		}
+	}
+
+	return interpolated
+}
+
+// Resamples audio to a different sample rate.
+func resample(audio pcm, sampleRate int) pcm {
+	if audio.sampleRate == sampleRate {
+		return audio
+	}
+
+	factor := float64(audio.sampleRate) / float64(sampleRate)
+	return pcm{sampleRate, interpolate(audio.samples, factor)}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func sineWave(sampleRate int, freq float64, duration float64) pcm {
+	samples := make([]float64, int(float64(sampleRate)*duration))
+	for i := range samples {
+		samples[i] = 0.5 * math.Sin(2.0*math.Pi*freq*float64(i)/float64(sampleRate))
+	}
+
+	return pcm{sampleRate, samples}
+}
+
+func TestWriteAndReadWAV(t *testing.T) {
+	audio := sineWave(8000, 440, 0.1)
+
+	var buf bytes.Buffer
+	if err := writeWAV(&buf, audio); err != nil {
+		t.Fatalf("Writing WAV failed when it should not have: %s", err)
+	}
+
+	got, err := readWAV(&buf)
+	if err != nil {
+		t.Fatalf("Reading WAV failed when it should not have: %s", err)
+	}
+
+	if audio.sampleRate != got.sampleRate {
+		t.Errorf("Expected sample rate %d but was %d", audio.sampleRate, got.sampleRate)
+	}
+
+	if len(audio.samples) != len(got.samples) {
+		t.Fatalf("Expected %d samples but was %d", len(audio.samples), len(got.samples))
+	}
+
+	for i, s := range audio.samples {
+		if math.Abs(s-got.samples[i]) > 1.0/32768.0 {
+			t.Errorf("[%d] Expected sample %f but was %f", i, s, got.samples[i])
+		}
+	}
+}
+
+func TestReadWAVNotRIFF(t *testing.T) {
+	if _, err := readWAV(bytes.NewReader([]byte("not a wave file"))); err == nil {
+		t.Errorf("Expected an error reading something that is not a WAV")
+	}
+}
+
+func TestResample(t *testing.T) {
+	audio := sineWave(44100, 1000, 1.0)
+
+	got := resample(audio, 8000)
+	if got.sampleRate != 8000 || math.Abs(float64(len(got.samples)-8000)) > 1 {
+		t.Fatalf("Expected about 8000 samples at 8000 Hz but got %d at %d Hz", len(got.samples), got.sampleRate)
+	}
+
+	// the tone survives and keeps its power
+	if math.Abs(audio.power()-got.power()) > 0.01 {
+		t.Errorf("Expected power %f but was %f", audio.power(), got.power())
+	}
+
+	// a tone above the new Nyquist frequency is filtered out
+	if high := resample(sineWave(44100, 6000, 1.0), 8000); high.power() > 0.01 {
+		t.Errorf("Expected tone above Nyquist frequency to be filtered but power was %f", high.power())
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// Synthetic corpora are generated once per size and shared between
+// benchmarks, so generation is not part of any measurement.
+var benchmarkCorpora = make(map[int][]fingerprint)
+var benchmarkIndexes = make(map[int]index)
+
+func benchmarkCorpus(b *testing.B, size int) ([]fingerprint, index) {
+	if corpus, found := benchmarkCorpora[size]; found {
+		return corpus, benchmarkIndexes[size]
+	}
+
+	p := defaultCorpusParams()
+	p.size = size
+	p.minLength = 500
+	p.maxLength = 1500
+
+	corpus, err := generateCorpus(p)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	benchmarkCorpora[size] = corpus
+	benchmarkIndexes[size] = buildIndex(philips, corpus)
+
+	return corpus, benchmarkIndexes[size]
+}
+
+// Creates queries from random segments of the corpus with uniform bit errors
+// at the given BER, typical of a degraded recording. Fingerprints shorter than
+// the queries are skipped.
+func benchmarkQueries(corpus []fingerprint, n int, length int, ber float64) []fingerprint {
+	rng := rand.New(rand.NewSource(1))
+	distort := uniformBitErrorDistortion(philips, ber)
+
+	queries := make([]fingerprint, n)
+	for i := range queries {
+		fp := corpus[rng.Intn(len(corpus))]
+		for len(fp.sfps) < length {
+			fp = corpus[rng.Intn(len(corpus))]
+		}
+		start := rng.Intn(len(fp.sfps) - length + 1)
+		sfps, _ := distort(rng, fp.sfps[start:start+length])
+		queries[i] = fingerprint{fp.id, sfps, fingerprint_meta{}, 0}
+	}
+
+	return queries
+}
+
+func benchmarkBuildIndex(b *testing.B, size int) {
+	corpus, _ := benchmarkCorpus(b, size)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		buildIndex(philips, corpus)
+	}
+}
+
+func BenchmarkBuildIndex100(b *testing.B)  { benchmarkBuildIndex(b, 100) }
+func BenchmarkBuildIndex1000(b *testing.B) { benchmarkBuildIndex(b, 1000) }
+func BenchmarkBuildIndex5000(b *testing.B) { benchmarkBuildIndex(b, 5000) }
+
+func benchmarkSearchBySubFingerprint(b *testing.B, size int) {
+	corpus, idx := benchmarkCorpus(b, size)
+
+	// half of the keys are in the index, half are random
+	rng := rand.New(rand.NewSource(1))
+	keys := randomSubFingerprints(philips, 1, 1024)
+	for i := 0; i < len(keys); i += 2 {
+		fp := corpus[rng.Intn(len(corpus))]
+		keys[i] = fp.sfps[rng.Intn(len(fp.sfps))]
+	}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		searchBySubFingerprint(keys[i%len(keys)], 0, idx, nil)
+	}
+}
+
+func BenchmarkSearchBySubFingerprint100(b *testing.B)  { benchmarkSearchBySubFingerprint(b, 100) }
+func BenchmarkSearchBySubFingerprint1000(b *testing.B) { benchmarkSearchBySubFingerprint(b, 1000) }
+func BenchmarkSearchBySubFingerprint5000(b *testing.B) { benchmarkSearchBySubFingerprint(b, 5000) }
+
+func benchmarkFlipAllBitsUntil(b *testing.B, n int) {
+	sfp := sub_fingerprint{0xde, 0xad, 0xbe, 0xef}
+
+	for i := 0; i < b.N; i++ {
+		sfp.flipAllBitsUntil(philips, n)
+	}
+}
+
+func BenchmarkFlipAllBitsUntil1(b *testing.B) { benchmarkFlipAllBitsUntil(b, 1) }
+func BenchmarkFlipAllBitsUntil2(b *testing.B) { benchmarkFlipAllBitsUntil(b, 2) }
+func BenchmarkFlipAllBitsUntil3(b *testing.B) { benchmarkFlipAllBitsUntil(b, 3) }
+
+func benchmarkSearchByFingerprintBlock(b *testing.B, strategy approximate_search_strategy) {
+	corpus, idx := benchmarkCorpus(b, 1000)
+	queries := benchmarkQueries(corpus, 16, FingerprintBlockSize, 0.1)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		queryFpb := fingerprint_block(queries[i%len(queries)].sfps)
+		if _, err := searchByFingerprintBlock(queryFpb, strategy, idx, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSearchByFingerprintBlockNone(b *testing.B) {
+	benchmarkSearchByFingerprintBlock(b, noopApproximateSearchStrategy())
+}
+
+func BenchmarkSearchByFingerprintBlockFlip1(b *testing.B) {
+	benchmarkSearchByFingerprintBlock(b, flipAllApproximateSearchStrategy(philips, 1))
+}
+
+func BenchmarkSearchByFingerprintBlockFlip2(b *testing.B) {
+	benchmarkSearchByFingerprintBlock(b, flipAllApproximateSearchStrategy(philips, 2))
+}
+
+func BenchmarkSearchByFingerprintBlockFlip3(b *testing.B) {
+	benchmarkSearchByFingerprintBlock(b, flipAllApproximateSearchStrategy(philips, 3))
+}
+
+func benchmarkSearchByFingerprintBlockMultiIndex(b *testing.B, n int) {
+	_, idx := benchmarkCorpus(b, 1000)
+	strategy, err := multiIndexApproximateSearchStrategy(philips, idx, DefaultMultiIndexSubstrings, n)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	benchmarkSearchByFingerprintBlock(b, strategy)
+}
+
+func BenchmarkSearchByFingerprintBlockMultiIndex1(b *testing.B) {
+	benchmarkSearchByFingerprintBlockMultiIndex(b, 1)
+}
+
+func BenchmarkSearchByFingerprintBlockMultiIndex2(b *testing.B) {
+	benchmarkSearchByFingerprintBlockMultiIndex(b, 2)
+}
+
+func BenchmarkSearchByFingerprintBlockMultiIndex3(b *testing.B) {
+	benchmarkSearchByFingerprintBlockMultiIndex(b, 3)
+}
+
+func BenchmarkSearchByFingerprintBlockLSH(b *testing.B) {
+	corpus, idx := benchmarkCorpus(b, 1000)
+	queries := benchmarkQueries(corpus, 16, FingerprintBlockSize, 0.1)
+	generator, err := lshCandidateGenerator(philips, idx, FingerprintBlockSize, DefaultLSHTables, DefaultLSHBits)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		queryFpb := fingerprint_block(queries[i%len(queries)].sfps)
+		if _, err := generator(queryFpb); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFilterCandidatesByBER(b *testing.B) {
+	corpus, idx := benchmarkCorpus(b, 1000)
+	queries := benchmarkQueries(corpus, 16, FingerprintBlockSize, 0.1)
+
+	blocks := make([]fingerprint_block, len(queries))
+	candidates := make([][]candidate, len(queries))
+	for i, queryFp := range queries {
+		blocks[i] = fingerprint_block(queryFp.sfps)
+		candidates[i], _ = searchByFingerprintBlock(blocks[i], flipAllApproximateSearchStrategy(philips, 1), idx, nil)
+	}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		j := i % len(queries)
+		filterCandidatesByBER(philips, blocks[j], candidates[j], DefaultBitErrorRate, 1.0)
+	}
+}
+
+func benchmarkSearchByFingerprint(b *testing.B, size int) {
+	corpus, idx := benchmarkCorpus(b, size)
+	queries := benchmarkQueries(corpus, 16, 2*FingerprintBlockSize, 0.1)
+	strategy := flipAllApproximateSearchStrategy(philips, DefaultMaxHammingDistance)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		queryFp := queries[i%len(queries)]
+		_, err := searchByFingerprint(
+			philips,
+			queryFp,
+			FingerprintBlockSize,
+			FingerprintBlockSize,
+			strategy,
+			DefaultBitErrorRate,
+			1.0,
+			false,
+			idx,
+		)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSearchByFingerprint100(b *testing.B)  { benchmarkSearchByFingerprint(b, 100) }
+func BenchmarkSearchByFingerprint1000(b *testing.B) { benchmarkSearchByFingerprint(b, 1000) }
+func BenchmarkSearchByFingerprint5000(b *testing.B) { benchmarkSearchByFingerprint(b, 5000) }
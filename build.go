@@ -0,0 +1,130 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Builds an index offline from a directory of serialized index fingerprints and
+// writes the persisted index. Each file in the directory can either be a
+// length-delimited stream of index fingerprints or a single index fingerprint.
+// With the landmark algorithm, the files are of index landmark fingerprints
+// instead.
+func buildCommand(args []string) {
+	flags := flag.NewFlagSet("build", flag.ExitOnError)
+	in := flags.String("in", "", "directory of serialized IndexFingerprint files")
+	out := flags.String("out", "", "path to write the index to")
+	algorithm := flags.String("algorithm", PhilipsAlgorithm, "fingerprint algorithm: "+fingerprintAlgorithmNames()+" or landmark")
+	batchSize := flags.Int("batch.size", 1000, "number of fingerprints indexed per batch")
+	parallelism := flags.Int("parallelism", runtime.NumCPU(), "number of batches indexed in parallel")
+	lshTables := flags.Int("lsh_tables", 0, "number of LSH tables of fingerprint blocks to index, or none when zero (0)")
+	lshBits := flags.Int("lsh_bits", DefaultLSHBits, "number of bits sampled from a block to hash it in each LSH table")
+	blockSize := flags.Int("block_size", FingerprintBlockSize, "number of sub-fingerprints in the blocks of the LSH tables")
+	flags.Parse(args)
+
+	if *in == "" || *out == "" {
+		log.Fatal("Both -in and -out must be provided")
+	}
+
+	if *algorithm == LandmarkAlgorithm {
+		buildLandmarkIndexFile(*in, *out)
+		return
+	}
+
+	alg, err := newFingerprintAlgorithm(*algorithm)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	corpus, err := readIndexFingerprintDir(alg, *in)
+	if err != nil {
+		log.Fatalf("Failed reading fingerprints: %s", err)
+	}
+
+	idx, err := buildIndexInBatches(alg, corpus, *batchSize, *parallelism, func(indexed int) {
+		log.Printf("Indexed %d/%d fingerprints", indexed, len(corpus))
+	})
+	if err != nil {
+		log.Fatalf("Failed building index: %s", err)
+	}
+
+	if *lshTables > 0 {
+		log.Printf("Indexing %d LSH tables of blocks of %d sub-fingerprints", *lshTables, *blockSize)
+		idx.lsh, err = buildLSHIndex(alg, idx, *blockSize, *lshTables, *lshBits)
+		if err != nil {
+			log.Fatalf("Failed building LSH tables: %s", err)
+		}
+	}
+
+	log.Printf("Writing index of %d sub-fingerprints to: %s", idx.size(), *out)
+	if err := writeIndexFile(*out, alg, corpus, idx); err != nil {
+		log.Fatalf("Failed writing index: %s", err)
+	}
+}
+
+// Builds a landmark index from a directory of serialized index landmark
+// fingerprints and writes the persisted index.
+func buildLandmarkIndexFile(in string, out string) {
+	var corpus []landmark_fingerprint
+	err := forEachIndexFingerprintFile(in, func(path string) (int, error) {
+		lfps, err := readIndexLandmarkFingerprintFile(path)
+		corpus = append(corpus, lfps...)
+		return len(corpus), err
+	})
+	if err != nil {
+		log.Fatalf("Failed reading landmark fingerprints: %s", err)
+	}
+
+	idx := buildLandmarkIndex(corpus)
+
+	log.Printf("Writing landmark index of %d hashes to: %s", len(idx), out)
+	if err := writeLandmarkIndexFile(out, corpus); err != nil {
+		log.Fatalf("Failed writing index: %s", err)
+	}
+}
+
+// Reads all fingerprints of the algorithm from the files in a directory, in
+// file name order. Sub-directories and hidden files are skipped.
+func readIndexFingerprintDir(alg fingerprint_algorithm, dir string) ([]fingerprint, error) {
+	var corpus []fingerprint
+	err := forEachIndexFingerprintFile(dir, func(path string) (int, error) {
+		fps, err := readIndexFingerprintFile(alg, path)
+		corpus = append(corpus, fps...)
+		return len(corpus), err
+	})
+
+	return corpus, err
+}
+
+// Calls `read` with the path of each file in a directory, in file name order,
+// logging progress with the total number of fingerprints read so far as
+// returned by `read`. Sub-directories and hidden files are skipped.
+func forEachIndexFingerprintFile(dir string, read func(path string) (int, error)) error {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	// only count the files that are read, so that progress reaches the total
+	var files []string
+	for _, info := range infos {
+		if !info.IsDir() && !strings.HasPrefix(info.Name(), ".") {
+			files = append(files, info.Name())
+		}
+	}
+
+	for i, file := range files {
+		total, err := read(filepath.Join(dir, file))
+		if err != nil {
+			return err
+		}
+
+		log.Printf("Read %d fingerprints from %d/%d files", total, i+1, len(files))
+	}
+
+	return nil
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	MaxDelimitedMessageSizeBytes = 64 * 1024 * 1024 // guards against reading garbage lengths
+)
+
+// Creates a fingerprint from the protocol buffer message used when indexing.
+// The stream of sub-fingerprints must contain exactly the number of
+// sub-fingerprints stated in the message, each of the width of the algorithm.
+func newFingerprintFromIndexFingerprint(alg fingerprint_algorithm, ifp *IndexFingerprint) (fingerprint, error) {
+	size := int(ifp.GetSize())
+	stream := ifp.GetStream()
+	sfpSize := subFingerprintSizeBytes(alg)
+
+	if expected := size * sfpSize; len(stream) != expected {
+		err := fmt.Errorf(
+			"Fingerprint %s has a stream of %d bytes, but %d sub-fingerprints (%d bytes) were expected",
+			ifp.GetId(),
+			len(stream),
+			size,
+			expected,
+		)
+		return fingerprint{}, err
+	}
+
+	sfps := make([]sub_fingerprint, size)
+	for i := range sfps {
+		copy(sfps[i][:sfpSize], stream[i*sfpSize:])
+	}
+
+	meta := fingerprint_meta{ifp.GetFrameHop(), int(ifp.GetSampleRate()), nil}
+	for _, field := range ifp.GetFields() {
+		if meta.fields == nil {
+			meta.fields = make(map[string]string, len(ifp.GetFields()))
+		}
+		meta.fields[field.GetKey()] = field.GetValue()
+	}
+
+	return fingerprint{ifp.GetId(), sfps, meta, 0}, nil
+}
+
+// Creates the protocol buffer message used when indexing from a fingerprint,
+// with sub-fingerprints of the width of the algorithm.
+func newIndexFingerprint(alg fingerprint_algorithm, fp fingerprint) *IndexFingerprint {
+	sfpSize := subFingerprintSizeBytes(alg)
+	stream := make([]byte, 0, len(fp.sfps)*sfpSize)
+	for _, sfp := range fp.sfps {
+		stream = append(stream, sfp[:sfpSize]...)
+	}
+
+	ifp := &IndexFingerprint{
+		Id:     proto.String(fp.id),
+		Size:   proto.Uint32(uint32(len(fp.sfps))),
+		Stream: stream,
+	}
+
+	if fp.meta.frameHop > 0 {
+		ifp.FrameHop = proto.Float64(fp.meta.frameHop)
+	}
+	if fp.meta.sampleRate > 0 {
+		ifp.SampleRate = proto.Uint32(uint32(fp.meta.sampleRate))
+	}
+
+	// fields in key order, so that the message is the same every time
+	keys := make([]string, 0, len(fp.meta.fields))
+	for key := range fp.meta.fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		ifp.Fields = append(ifp.Fields, &IndexFingerprint_Field{
+			Key:   proto.String(key),
+			Value: proto.String(fp.meta.fields[key]),
+		})
+	}
+
+	return ifp
+}
+
+// Reads a single length-delimited protocol buffer message from the reader. The
+// message is prefixed with its size as a varint, the same as `writeDelimitedTo`
+// in the Java and C++ protocol buffer libraries. When there are no more
+// messages, `io.EOF` is returned.
+func readDelimited(r *bufio.Reader, msg proto.Message) error {
+	buf, err := readDelimitedBytes(r)
+	if err != nil {
+		return err
+	}
+
+	return proto.Unmarshal(buf, msg)
+}
+
+// Reads the bytes of a single length-delimited message from the reader,
+// without decoding it, so that a message that can't be decoded leaves the
+// reader at the start of the next.
+func readDelimitedBytes(r *bufio.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if size > MaxDelimitedMessageSizeBytes {
+		return nil, fmt.Errorf("Delimited message size %d exceeds the maximum of %d bytes", size, MaxDelimitedMessageSizeBytes)
+	}
+
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+// Writes a single length-delimited protocol buffer message to the writer.
+func writeDelimited(w io.Writer, msg proto.Message) error {
+	buf, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	size := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(size, uint64(len(buf)))
+	if _, err := w.Write(size[:n]); err != nil {
+		return err
+	}
+
+	_, err = w.Write(buf)
+	return err
+}
+
+// Reads all fingerprints from a file of serialized index fingerprints of the
+// algorithm. The file can either be a length-delimited stream of index
+// fingerprints or contain a single index fingerprint.
+func readIndexFingerprintFile(alg fingerprint_algorithm, path string) ([]fingerprint, error) {
+	var fps []fingerprint
+	err := readMessageFile(
+		path,
+		"index fingerprint",
+		func() proto.Message { return new(IndexFingerprint) },
+		func(msg proto.Message) error {
+			fp, err := newFingerprintFromIndexFingerprint(alg, msg.(*IndexFingerprint))
+			if err != nil {
+				return err
+			}
+			fps = append(fps, fp)
+			return nil
+		},
+	)
+
+	return fps, err
+}
+
+// Reads all messages from a file that can either be a length-delimited stream
+// of messages or contain a single message, calling `add` with each message in
+// turn. A stream is tried first and if the first message can't be read, the
+// file is read again as a single message. The name of the message is used in
+// errors.
+func readMessageFile(
+	path string,
+	name string,
+	newMsg func() proto.Message,
+	add func(msg proto.Message) error) error {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+
+	first := newMsg()
+	if err := readDelimited(r, first); err != nil {
+		if err == io.EOF {
+			return nil // empty file
+		}
+
+		// not a stream, try as a single message
+		if _, err := f.Seek(0, 0); err != nil {
+			return err
+		}
+
+		buf, err := ioutil.ReadAll(f)
+		if err != nil {
+			return err
+		}
+
+		msg := newMsg()
+		if err := proto.Unmarshal(buf, msg); err != nil {
+			return fmt.Errorf("File %s is neither a stream of nor a single %s: %s", path, name, err)
+		}
+
+		return add(msg)
+	}
+
+	if err := add(first); err != nil {
+		return err
+	}
+
+	for {
+		msg := newMsg()
+		if err := readDelimited(r, msg); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("Failed reading stream of %ss from %s: %s", name, path, err)
+		}
+
+		if err := add(msg); err != nil {
+			return err
+		}
+	}
+}
+
+// Creates a fingerprint from the protocol buffer message used when searching.
+// Each sub-fingerprint value must be exactly the size of a sub-fingerprint of
+// the algorithm.
+func newFingerprintFromQueryFingerprint(alg fingerprint_algorithm, id string, qfp *QueryFingerprint) (fingerprint, error) {
+	sfpSize := subFingerprintSizeBytes(alg)
+	sfps := make([]sub_fingerprint, len(qfp.GetSubFingerprints()))
+	for i, qsfp := range qfp.GetSubFingerprints() {
+		value := qsfp.GetValue()
+		if len(value) != sfpSize {
+			err := fmt.Errorf(
+				"Sub-fingerprint %d is of %d bytes, but %d bytes were expected",
+				i,
+				len(value),
+				sfpSize,
+			)
+			return fingerprint{}, err
+		}
+		copy(sfps[i][:], value)
+	}
+
+	return fingerprint{id, sfps, fingerprint_meta{}, 0}, nil
+}
+
+// Reads a query fingerprint of the algorithm from a file containing a single
+// serialized query fingerprint. The file name is used as the ID of the
+// fingerprint.
+func readQueryFingerprintFile(alg fingerprint_algorithm, path string) (fingerprint, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fingerprint{}, err
+	}
+
+	qfp := new(QueryFingerprint)
+	if err := proto.Unmarshal(buf, qfp); err != nil {
+		return fingerprint{}, err
+	}
+
+	return newFingerprintFromQueryFingerprint(alg, filepath.Base(path), qfp)
+}
+
+// Creates the protocol buffer message used when searching from a fingerprint,
+// with sub-fingerprints of the width of the algorithm and the ID of the
+// fingerprint as the ID of the query.
+func newQueryFingerprint(alg fingerprint_algorithm, fp fingerprint) *QueryFingerprint {
+	sfpSize := subFingerprintSizeBytes(alg)
+	qfp := &QueryFingerprint{
+		SubFingerprints: make([]*QueryFingerprint_QuerySubFingerprint, len(fp.sfps)),
+	}
+
+	for i, sfp := range fp.sfps {
+		value := make([]byte, sfpSize)
+		copy(value, sfp[:sfpSize])
+		qfp.SubFingerprints[i] = &QueryFingerprint_QuerySubFingerprint{Value: value}
+	}
+
+	if fp.id != "" {
+		qfp.Id = proto.String(fp.id)
+	}
+
+	return qfp
+}
+
+// Creates a landmark fingerprint from the protocol buffer message used when
+// indexing. There must be a time for each hash.
+func newLandmarkFingerprintFromIndexLandmarkFingerprint(ilfp *IndexLandmarkFingerprint) (landmark_fingerprint, error) {
+	landmarks, err := newLandmarks(ilfp.GetHashes(), ilfp.GetTimes())
+	if err != nil {
+		return landmark_fingerprint{}, fmt.Errorf("Landmark fingerprint %s: %s", ilfp.GetId(), err)
+	}
+
+	return landmark_fingerprint{ilfp.GetId(), landmarks}, nil
+}
+
+// Creates a landmark fingerprint from the protocol buffer message used when
+// searching. There must be a time for each hash.
+func newLandmarkFingerprintFromQueryLandmarkFingerprint(id string, qlfp *QueryLandmarkFingerprint) (landmark_fingerprint, error) {
+	landmarks, err := newLandmarks(qlfp.GetHashes(), qlfp.GetTimes())
+	if err != nil {
+		return landmark_fingerprint{}, err
+	}
+
+	return landmark_fingerprint{id, landmarks}, nil
+}
+
+func newLandmarks(hashes []uint32, times []uint32) ([]landmark, error) {
+	if len(hashes) != len(times) {
+		return nil, fmt.Errorf("There are %d hashes but %d times", len(hashes), len(times))
+	}
+
+	landmarks := make([]landmark, len(hashes))
+	for i, hash := range hashes {
+		landmarks[i] = landmark{landmark_hash(hash), int(times[i])}
+	}
+
+	return landmarks, nil
+}
+
+func landmarkHashesAndTimes(lfp landmark_fingerprint) ([]uint32, []uint32) {
+	hashes := make([]uint32, len(lfp.landmarks))
+	times := make([]uint32, len(lfp.landmarks))
+	for i, l := range lfp.landmarks {
+		hashes[i] = uint32(l.hash)
+		times[i] = uint32(l.time)
+	}
+
+	return hashes, times
+}
+
+// Creates the protocol buffer message used when indexing from a landmark
+// fingerprint.
+func newIndexLandmarkFingerprint(lfp landmark_fingerprint) *IndexLandmarkFingerprint {
+	hashes, times := landmarkHashesAndTimes(lfp)
+	return &IndexLandmarkFingerprint{
+		Id:     proto.String(lfp.id),
+		Hashes: hashes,
+		Times:  times,
+	}
+}
+
+// Creates the protocol buffer message used when searching from a landmark
+// fingerprint.
+func newQueryLandmarkFingerprint(lfp landmark_fingerprint) *QueryLandmarkFingerprint {
+	hashes, times := landmarkHashesAndTimes(lfp)
+	return &QueryLandmarkFingerprint{
+		Hashes: hashes,
+		Times:  times,
+	}
+}
+
+// Reads all landmark fingerprints from a file of serialized index landmark
+// fingerprints, either a length-delimited stream or a single message.
+func readIndexLandmarkFingerprintFile(path string) ([]landmark_fingerprint, error) {
+	var lfps []landmark_fingerprint
+	err := readMessageFile(
+		path,
+		"index landmark fingerprint",
+		func() proto.Message { return new(IndexLandmarkFingerprint) },
+		func(msg proto.Message) error {
+			lfp, err := newLandmarkFingerprintFromIndexLandmarkFingerprint(msg.(*IndexLandmarkFingerprint))
+			if err != nil {
+				return err
+			}
+			lfps = append(lfps, lfp)
+			return nil
+		},
+	)
+
+	return lfps, err
+}
+
+// Reads a query landmark fingerprint from a file containing a single serialized
+// query landmark fingerprint. The file name is used as the ID of the
+// fingerprint.
+func readQueryLandmarkFingerprintFile(path string) (landmark_fingerprint, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return landmark_fingerprint{}, err
+	}
+
+	qlfp := new(QueryLandmarkFingerprint)
+	if err := proto.Unmarshal(buf, qlfp); err != nil {
+		return landmark_fingerprint{}, err
+	}
+
+	return newLandmarkFingerprintFromQueryLandmarkFingerprint(filepath.Base(path), qlfp)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/golang/protobuf/proto"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestIndexFingerprintRoundTrip(t *testing.T) {
+	for i, fp := range buildTestCorpus() {
+		got, err := newFingerprintFromIndexFingerprint(philips, newIndexFingerprint(philips, fp))
+		if err != nil {
+			t.Fatalf("[%d] Conversion failed when it should not have: %s", i, err)
+		}
+
+		if fp.id != got.id {
+			t.Errorf("[%d] Expected ID %s but was %s", i, fp.id, got.id)
+		}
+
+		if len(fp.sfps) != len(got.sfps) {
+			t.Fatalf("[%d] Expected %d sub-fingerprints but was %d", i, len(fp.sfps), len(got.sfps))
+		}
+
+		for j, expected := range fp.sfps {
+			if expected != got.sfps[j] {
+				t.Errorf("[%d][%d] Expected sub-fingerprint %v but was %v", i, j, expected, got.sfps[j])
+			}
+		}
+	}
+}
+
+// Sub-fingerprints of 64-bit algorithms are streamed as eight (8) bytes each,
+// so a stream of one algorithm can't be read as the other.
+func TestIndexFingerprintRoundTrip64(t *testing.T) {
+	fp := fingerprint{"0001", randomSubFingerprints(philips64, 1, 10), fingerprint_meta{}, 0}
+
+	ifp := newIndexFingerprint(philips64, fp)
+	if expected, got := 10*8, len(ifp.GetStream()); expected != got {
+		t.Fatalf("Expected a stream of %d bytes but was %d", expected, got)
+	}
+
+	got, err := newFingerprintFromIndexFingerprint(philips64, ifp)
+	if err != nil {
+		t.Fatalf("Conversion failed when it should not have: %s", err)
+	}
+
+	for i, expected := range fp.sfps {
+		if expected != got.sfps[i] {
+			t.Errorf("[%d] Expected sub-fingerprint %v but was %v", i, expected, got.sfps[i])
+		}
+	}
+
+	if _, err := newFingerprintFromIndexFingerprint(philips, ifp); err == nil {
+		t.Errorf("Expected an error reading a 64-bit stream as 32-bit sub-fingerprints")
+	}
+}
+
+// The frame hop, sample rate and fields are optional, and fingerprints without
+// a frame hop are timed as with the Philips defaults.
+func TestIndexFingerprintMetaRoundTrip(t *testing.T) {
+	fixtures := []struct {
+		meta     fingerprint_meta
+		frameHop float64
+	}{
+		{fingerprint_meta{0.01, 44100, map[string]string{"title": "Song", "isrc": "GBAYE0601498"}}, 0.01},
+		{fingerprint_meta{}, 64.0 / 5512.0},
+	}
+
+	for i, fixture := range fixtures {
+		fp := fingerprint{"0001", randomSubFingerprints(philips, 1, 10), fixture.meta, 0}
+		buf, err := proto.Marshal(newIndexFingerprint(philips, fp))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ifp := &IndexFingerprint{}
+		if err := proto.Unmarshal(buf, ifp); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := newFingerprintFromIndexFingerprint(philips, ifp)
+		if err != nil {
+			t.Fatalf("[%d] Conversion failed when it should not have: %s", i, err)
+		}
+
+		if !reflect.DeepEqual(fixture.meta, got.meta) {
+			t.Errorf("[%d] Expected metadata %v but was %v", i, fixture.meta, got.meta)
+		}
+
+		if expected, seconds := 100*fixture.frameHop, got.meta.seconds(100); expected != seconds {
+			t.Errorf("[%d] Expected 100 sub-fingerprints to be %fs but were %fs", i, expected, seconds)
+		}
+	}
+}
+
+func TestNewFingerprintFromIndexFingerprintWithWrongSize(t *testing.T) {
+	ifp := &IndexFingerprint{
+		Id:     proto.String("0001"),
+		Size:   proto.Uint32(2),
+		Stream: []byte{0, 0, 0, 0, 1},
+	}
+
+	if _, err := newFingerprintFromIndexFingerprint(philips, ifp); err == nil {
+		t.Errorf("Expected an error for a stream that does not match the size")
+	}
+}
+
+func TestReadIndexFingerprintFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sherlock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	corpus := buildTestCorpus()
+
+	// stream of all fingerprints
+	var stream bytes.Buffer
+	for _, fp := range corpus {
+		if err := writeDelimited(&stream, newIndexFingerprint(philips, fp)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	streamPath := filepath.Join(dir, "stream")
+	if err := ioutil.WriteFile(streamPath, stream.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// single fingerprint
+	single, err := proto.Marshal(newIndexFingerprint(philips, corpus[2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	singlePath := filepath.Join(dir, "single")
+	if err := ioutil.WriteFile(singlePath, single, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fixtures := []struct {
+		path     string
+		expected []string
+	}{
+		{streamPath, []string{"0001", "0002", "0003"}},
+		{singlePath, []string{"0003"}},
+	}
+
+	for i, fixture := range fixtures {
+		fps, err := readIndexFingerprintFile(philips, fixture.path)
+		if err != nil {
+			t.Fatalf("[%d] Reading failed when it should not have: %s", i, err)
+		}
+
+		if len(fixture.expected) != len(fps) {
+			t.Fatalf("[%d] Expected %d fingerprints but got %d", i, len(fixture.expected), len(fps))
+		}
+
+		for j, expected := range fixture.expected {
+			if expected != fps[j].id {
+				t.Errorf("[%d][%d] Expected ID %s but was %s", i, j, expected, fps[j].id)
+			}
+		}
+	}
+}
+
+func TestReadDelimitedTruncated(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeDelimited(&buf, newIndexFingerprint(philips, buildTestCorpus()[0])); err != nil {
+		t.Fatal(err)
+	}
+
+	truncated := bufio.NewReader(bytes.NewReader(buf.Bytes()[:buf.Len()-1]))
+	if err := readDelimited(truncated, new(IndexFingerprint)); err == nil {
+		t.Errorf("Expected an error reading a truncated message")
+	}
+}
+
+func TestNewFingerprintFromQueryFingerprint(t *testing.T) {
+	qfp := &QueryFingerprint{
+		SubFingerprints: []*QueryFingerprint_QuerySubFingerprint{
+			&QueryFingerprint_QuerySubFingerprint{Value: []byte{0, 0, 1, 0}},
+			&QueryFingerprint_QuerySubFingerprint{Value: []byte{1, 8, 0, 0}},
+		},
+	}
+
+	fp, err := newFingerprintFromQueryFingerprint(philips, "query", qfp)
+	if err != nil {
+		t.Fatalf("Conversion failed when it should not have: %s", err)
+	}
+
+	expected := []sub_fingerprint{
+		sub_fingerprint{0, 0, 1, 0},
+		sub_fingerprint{1, 8, 0, 0},
+	}
+	if len(expected) != len(fp.sfps) {
+		t.Fatalf("Expected %d sub-fingerprints but was %d", len(expected), len(fp.sfps))
+	}
+
+	for i, e := range expected {
+		if e != fp.sfps[i] {
+			t.Errorf("[%d] Expected sub-fingerprint %v but was %v", i, e, fp.sfps[i])
+		}
+	}
+
+	qfp.SubFingerprints[1].Value = []byte{1, 8, 0}
+	if _, err := newFingerprintFromQueryFingerprint(philips, "query", qfp); err == nil {
+		t.Errorf("Expected an error for a sub-fingerprint of the wrong size")
+	}
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+const (
+	DefaultDedupMinWindows = 2
+)
+
+// The duplicates found of a single fingerprint of the corpus, as the segments
+// of it overlapping other fingerprints. A fingerprint whose search failed, such
+// as one shorter than a block, has the error and no duplicates. The checkpoint
+// of `dedup` is a line of JSON of each fingerprint searched, following a
+// header.
+type duplicate_record struct {
+	Id         string           `json:"id"`
+	Duplicates []segment_report `json:"duplicates"`
+	Error      string           `json:"error,omitempty"`
+}
+
+// Report of duplicates across a corpus, as printed by the `dedup` command.
+// Only fingerprints with duplicates are listed, and components are the groups
+// of fingerprints connected by duplicates in either direction. Fingerprints
+// whose search failed are counted as having no duplicates.
+type dedup_report struct {
+	Fingerprints int                `json:"fingerprints"`
+	Failed       int                `json:"failed"`
+	Duplicates   []duplicate_record `json:"duplicates"`
+	Components   [][]string         `json:"components"`
+}
+
+type duplicate_records_by_id []duplicate_record
+
+func (s duplicate_records_by_id) Len() int           { return len(s) }
+func (s duplicate_records_by_id) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s duplicate_records_by_id) Less(i, j int) bool { return s[i].Id < s[j].Id }
+
+type components_by_first_id [][]string
+
+func (s components_by_first_id) Len() int           { return len(s) }
+func (s components_by_first_id) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s components_by_first_id) Less(i, j int) bool { return s[i][0] < s[j][0] }
+
+// Searches the index with a fingerprint of the corpus the index was built
+// from, finding the segments of it that overlap other fingerprints. The
+// fingerprint itself is excluded, and segments found by fewer than the minimum
+// number of windows are dropped.
+func findDuplicates(
+	params search_params,
+	generator candidate_generator,
+	fp *fingerprint,
+	minWindows int,
+	maxDrift int) ([]segment, error) {
+
+	results, err := params.searchWindowsWith(*fp, generator)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range results {
+		var others []candidate
+		for _, c := range results[i].candidates {
+			if c.fp != fp {
+				others = append(others, c)
+			}
+		}
+		results[i].candidates = others
+	}
+
+	var duplicates []segment
+	for _, s := range mergeWindowMatchesByReference(params.algorithm, *fp, results, maxDrift) {
+		if s.windows >= minWindows {
+			duplicates = append(duplicates, s)
+		}
+	}
+
+	return duplicates, nil
+}
+
+// Searches the index with every fingerprint of its corpus, other than those
+// already done, running the given number of searches in parallel. Each record
+// is passed to `record` as it completes, from a single goroutine, so it can be
+// written to a checkpoint, and one whose search fails is recorded with the
+// error and no duplicates rather than stopping the others. The progress
+// function, if provided, is called with the number of fingerprints searched so
+// far.
+func runDedup(
+	corpus []fingerprint,
+	params search_params,
+	idx index,
+	minWindows int,
+	maxDrift int,
+	parallelism int,
+	done map[string]bool,
+	record func(r duplicate_record) error,
+	progress func(searched int)) error {
+
+	if parallelism < 1 {
+		return fmt.Errorf("Parallelism must be greater than or equal to one: %d", parallelism)
+	}
+
+	if minWindows < 1 {
+		return fmt.Errorf("Minimum number of windows must be greater than or equal to one: %d", minWindows)
+	}
+
+	generator, err := params.candidateGenerator(idx)
+	if err != nil {
+		return err
+	}
+
+	var remaining []int
+	for i := range corpus {
+		if !done[corpus[i].id] {
+			remaining = append(remaining, i)
+		}
+	}
+
+	jobs := make(chan int, len(remaining))
+	for _, i := range remaining {
+		jobs <- i
+	}
+	close(jobs)
+
+	records := make(chan duplicate_record)
+	for w := 0; w < parallelism; w++ {
+		go func() {
+			for i := range jobs {
+				fp := &corpus[i]
+				duplicates, err := findDuplicates(params, generator, fp, minWindows, maxDrift)
+
+				r := duplicate_record{fp.id, make([]segment_report, len(duplicates)), ""}
+				for j, s := range duplicates {
+					r.Duplicates[j] = newSegmentReport(fp.meta, s)
+				}
+				if err != nil {
+					r.Error = fmt.Sprintf("Search with fingerprint %s failed: %s", fp.id, err)
+				}
+				records <- r
+			}
+		}()
+	}
+
+	var firstErr error
+	for searched := len(corpus) - len(remaining) + 1; searched <= len(corpus); searched++ {
+		r := <-records
+		if firstErr == nil {
+			firstErr = record(r)
+		}
+
+		if progress != nil {
+			progress(searched)
+		}
+	}
+
+	return firstErr
+}
+
+// The first line of the checkpoint of `dedup`, recording the index and the
+// parameters the records were searched with, so that a checkpoint is only
+// resumed with the same. The parameters are by the names of their flags.
+type duplicate_checkpoint_header struct {
+	Index  string            `json:"index"`
+	Params map[string]string `json:"params"`
+}
+
+func newDuplicateCheckpointHeader(
+	indexPath string,
+	params search_params,
+	minWindows int,
+	maxDrift int) (duplicate_checkpoint_header, error) {
+
+	path, err := filepath.Abs(indexPath)
+	if err != nil {
+		return duplicate_checkpoint_header{}, err
+	}
+
+	values := params.flagValues()
+	values["algorithm"] = params.algorithm.name()
+	values["min_windows"] = strconv.Itoa(minWindows)
+	values["timeline.max_drift"] = strconv.Itoa(maxDrift)
+
+	return duplicate_checkpoint_header{path, values}, nil
+}
+
+// Determines if a checkpoint of the other header can be resumed with this
+// one, being of the same index and parameters, or returns the difference.
+func (h duplicate_checkpoint_header) resumes(other duplicate_checkpoint_header) error {
+	if h.Index != other.Index {
+		return fmt.Errorf("Checkpoint is of index %s, not %s", other.Index, h.Index)
+	}
+
+	names := make(map[string]bool)
+	for name := range h.Params {
+		names[name] = true
+	}
+	for name := range other.Params {
+		names[name] = true
+	}
+
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	for _, name := range sorted {
+		if h.Params[name] != other.Params[name] {
+			return fmt.Errorf("Checkpoint was searched with %s of %q, not %q", name, other.Params[name], h.Params[name])
+		}
+	}
+
+	return nil
+}
+
+// Reads the header and records of a checkpoint, if there is one, along with
+// the size of the complete lines read. A last line without a newline was cut
+// short, for example by the job being killed, and is not read. A checkpoint
+// without a complete header has neither header nor records.
+func readDuplicateCheckpoint(path string) (*duplicate_checkpoint_header, []duplicate_record, int64, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil, 0, nil
+	}
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer f.Close()
+
+	var header *duplicate_checkpoint_header
+	var records []duplicate_record
+	var size int64
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, 0, err
+		}
+
+		if header == nil {
+			header = &duplicate_checkpoint_header{}
+			if err := json.Unmarshal(line, header); err != nil || header.Index == "" {
+				return nil, nil, 0, fmt.Errorf("Invalid checkpoint header, which may be of an older version: %v", err)
+			}
+		} else {
+			var record duplicate_record
+			if err := json.Unmarshal(line, &record); err != nil {
+				return nil, nil, 0, fmt.Errorf("Invalid checkpoint record at byte %d: %s", size, err)
+			}
+			records = append(records, record)
+		}
+		size += int64(len(line))
+	}
+
+	return header, records, size, nil
+}
+
+// Opens a checkpoint to append records to, dropping any last line that was cut
+// short. The header is written to a checkpoint without one, of a size of zero.
+func openDuplicateCheckpoint(path string, size int64, header duplicate_checkpoint_header) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if size == 0 {
+		if err := json.NewEncoder(f).Encode(header); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	return f, nil
+}
+
+// The records of fingerprints of the corpus, dropping any of others, such as
+// those removed from the index since the checkpoint was written.
+func duplicateRecordsOf(corpus []fingerprint, records []duplicate_record) []duplicate_record {
+	ids := make(map[string]bool, len(corpus))
+	for i := range corpus {
+		ids[corpus[i].id] = true
+	}
+
+	var kept []duplicate_record
+	for _, r := range records {
+		if ids[r.Id] {
+			kept = append(kept, r)
+		}
+	}
+
+	return kept
+}
+
+// Groups fingerprints into the connected components of the graph of
+// duplicates, treating each duplicate as an edge in both directions. Only
+// components of more than one fingerprint are returned, each sorted by ID and
+// ordered by their first ID.
+func duplicateComponents(records []duplicate_record) [][]string {
+	parents := make(map[string]string)
+	var find func(id string) string
+	find = func(id string) string {
+		parent, found := parents[id]
+		if !found {
+			parents[id] = id
+			return id
+		}
+		if parent == id {
+			return id
+		}
+
+		root := find(parent)
+		parents[id] = root
+		return root
+	}
+
+	for _, r := range records {
+		for _, d := range r.Duplicates {
+			if left, right := find(r.Id), find(d.Id); left != right {
+				parents[left] = right
+			}
+		}
+	}
+
+	groups := make(map[string][]string)
+	for id := range parents {
+		root := find(id)
+		groups[root] = append(groups[root], id)
+	}
+
+	components := make([][]string, 0, len(groups))
+	for _, ids := range groups {
+		if len(ids) > 1 {
+			sort.Strings(ids)
+			components = append(components, ids)
+		}
+	}
+	sort.Sort(components_by_first_id(components))
+
+	return components
+}
+
+func newDedupReport(fingerprints int, records []duplicate_record) dedup_report {
+	report := dedup_report{fingerprints, 0, []duplicate_record{}, duplicateComponents(records)}
+	for _, r := range records {
+		if r.Error != "" {
+			report.Failed++
+		}
+		if len(r.Duplicates) > 0 {
+			report.Duplicates = append(report.Duplicates, r)
+		}
+	}
+	sort.Sort(duplicate_records_by_id(report.Duplicates))
+
+	return report
+}
+
+// Writes the report as human-readable tables of the duplicate segments of
+// each fingerprint and of the components.
+func (report dedup_report) writeText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "%d fingerprints searched, %d failed, %d with duplicates in %d components\n\n", report.Fingerprints, report.Failed, len(report.Duplicates), len(report.Components))
+
+	fmt.Fprintln(tw, "ID\tDUPLICATE\tSTART\tEND\tDUPLICATE START\tDUPLICATE END\tWINDOWS\tBER\tSPEED")
+	for _, r := range report.Duplicates {
+		for _, d := range r.Duplicates {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%d\t%d\t%.4f\t%g\n", r.Id, d.Id, d.QueryStart, d.QueryEnd, d.ReferenceStart, d.ReferenceEnd, d.Windows, d.BER, d.Speed)
+		}
+	}
+
+	fmt.Fprintln(tw, "\nCOMPONENT\tSIZE\tIDS")
+	for i, ids := range report.Components {
+		fmt.Fprintf(tw, "%d\t%d\t%s\n", i+1, len(ids), strings.Join(ids, " "))
+	}
+
+	return tw.Flush()
+}
+
+// Finds duplicates and near-duplicates across the corpus of an index, such as
+// re-releases and remasters, by searching the index with every fingerprint of
+// its corpus. Progress is written to a checkpoint as each fingerprint is
+// searched, so that an interrupted job resumes where it left off.
+func dedupCommand(args []string) {
+	flags := flag.NewFlagSet("dedup", flag.ExitOnError)
+	indexPath := flags.String("index", "", "path to the index to search")
+	checkpointPath := flags.String("checkpoint", "", "path to a checkpoint file to resume from and record progress to")
+	output := flags.String("output", "text", "output format: text or json")
+	parallelism := flags.Int("parallelism", runtime.NumCPU(), "number of fingerprints searched in parallel")
+	minWindows := flags.Int("min_windows", DefaultDedupMinWindows, "minimum number of windows of a duplicate segment")
+	maxDrift := flags.Int("timeline.max_drift", DefaultTimelineMaxDrift, "maximum drift in alignment, in sub-fingerprints, between windows merged into a duplicate segment")
+	params := defaultSearchParams()
+	params.registerFlags(flags)
+	flags.Parse(args)
+
+	if *indexPath == "" {
+		log.Fatal("An -index must be provided")
+	}
+
+	alg, corpus, idx, err := readIndexFile(*indexPath)
+	if err != nil {
+		log.Fatalf("Failed reading index: %s", err)
+	}
+	params, err = params.forAlgorithm(alg, flags)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var records []duplicate_record
+	done := make(map[string]bool)
+	record := func(r duplicate_record) error {
+		records = append(records, r)
+		return nil
+	}
+
+	if *checkpointPath != "" {
+		header, err := newDuplicateCheckpointHeader(*indexPath, params, *minWindows, *maxDrift)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		found, read, size, err := readDuplicateCheckpoint(*checkpointPath)
+		if err != nil {
+			log.Fatalf("Failed reading checkpoint: %s", err)
+		}
+		if found != nil {
+			if err := header.resumes(*found); err != nil {
+				log.Fatalf("Can not resume from checkpoint: %s", err)
+			}
+		}
+
+		records = duplicateRecordsOf(corpus, read)
+		if dropped := len(read) - len(records); dropped > 0 {
+			log.Printf("Dropped %d fingerprints of checkpoint not in the index", dropped)
+		}
+		for _, r := range records {
+			done[r.Id] = true
+		}
+		log.Printf("Resuming from %d fingerprints in checkpoint: %s", len(records), *checkpointPath)
+
+		f, err := openDuplicateCheckpoint(*checkpointPath, size, header)
+		if err != nil {
+			log.Fatalf("Failed opening checkpoint: %s", err)
+		}
+		defer f.Close()
+
+		record = func(r duplicate_record) error {
+			var line bytes.Buffer
+			if err := json.NewEncoder(&line).Encode(r); err != nil {
+				return err
+			}
+			if _, err := f.Write(line.Bytes()); err != nil {
+				return err
+			}
+			records = append(records, r)
+			return nil
+		}
+	}
+
+	logged := func(r duplicate_record) error {
+		if r.Error != "" {
+			log.Print(r.Error)
+		}
+		return record(r)
+	}
+
+	err = runDedup(corpus, params, idx, *minWindows, *maxDrift, *parallelism, done, logged, func(searched int) {
+		if searched%100 == 0 || searched == len(corpus) {
+			log.Printf("Searched %d/%d fingerprints", searched, len(corpus))
+		}
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	report := newDedupReport(len(corpus), records)
+
+	switch *output {
+	case "text":
+		err = report.writeText(os.Stdout)
+	case "json":
+		err = json.NewEncoder(os.Stdout).Encode(report)
+	default:
+		err = fmt.Errorf("Unknown output format: %s", *output)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
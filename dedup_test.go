@@ -0,0 +1,207 @@
+package main
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// A corpus with a remaster of one fingerprint, an edit containing part of it
+// and a re-release of another, each with some bit errors.
+func buildDuplicateTestCorpus(t *testing.T) []fingerprint {
+	p := defaultCorpusParams()
+	p.size, p.minLength, p.maxLength, p.segmentLength = 16, 1000, 2000, 256
+	p.silenceFraction, p.repeatFraction, p.sharedFraction = 0, 0, 0
+	corpus, err := generateCorpus(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	distort := func(sfps []sub_fingerprint, seed int64) []sub_fingerprint {
+		distorted, _ := uniformBitErrorDistortion(philips, 0.05)(rand.New(rand.NewSource(seed)), sfps)
+		return distorted
+	}
+
+	corpus[5].sfps = distort(corpus[2].sfps, 1)
+	corpus[7].sfps = append(corpus[7].sfps[:300], distort(corpus[2].sfps[200:800], 2)...)
+	corpus[12].sfps = distort(corpus[11].sfps, 3)
+
+	return corpus
+}
+
+func TestRunDedup(t *testing.T) {
+	corpus := buildDuplicateTestCorpus(t)
+	corpus[14].sfps = corpus[14].sfps[:100] // shorter than a block
+	idx := buildIndex(philips, corpus)
+	params := defaultSearchParams()
+	params.blockSize, params.stepSize = 128, 64
+
+	var records []duplicate_record
+	record := func(r duplicate_record) error {
+		records = append(records, r)
+		return nil
+	}
+
+	err := runDedup(corpus, params, idx, DefaultDedupMinWindows, DefaultTimelineMaxDrift, 3, map[string]bool{}, record, nil)
+	if err != nil {
+		t.Fatalf("Dedup failed when it should not have: %s", err)
+	}
+
+	if len(corpus) != len(records) {
+		t.Fatalf("Expected a record of each of %d fingerprints but got %d", len(corpus), len(records))
+	}
+
+	// a fingerprint that can't be searched has no duplicates
+	report := newDedupReport(len(corpus), records)
+	if report.Failed != 1 {
+		t.Errorf("Expected a failed search of %s but was %d failed", corpus[14].id, report.Failed)
+	}
+	for _, r := range records {
+		if (r.Error != "") != (r.Id == corpus[14].id) || (r.Error != "" && len(r.Duplicates) > 0) {
+			t.Errorf("Expected only %s to fail, with no duplicates, but was %v", corpus[14].id, r)
+		}
+	}
+
+	expected := [][]string{
+		{corpus[2].id, corpus[5].id, corpus[7].id},
+		{corpus[11].id, corpus[12].id},
+	}
+	if !reflect.DeepEqual(expected, report.Components) {
+		t.Errorf("Expected components %v but got %v", expected, report.Components)
+	}
+
+	// the edit is aligned with the part of the original it contains
+	for _, r := range report.Duplicates {
+		if r.Id != corpus[7].id {
+			continue
+		}
+
+		found := false
+		for _, d := range r.Duplicates {
+			if d.Id == corpus[2].id && d.ReferenceStart-d.QueryStart == 200-300 {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Expected %s to be a duplicate of %s at offset %d: %v", r.Id, corpus[2].id, -100, r.Duplicates)
+		}
+	}
+}
+
+func TestDuplicateCheckpoint(t *testing.T) {
+	corpus := buildDuplicateTestCorpus(t)
+	idx := buildIndex(philips, corpus)
+	params := defaultSearchParams()
+	params.blockSize, params.stepSize = 128, 64
+
+	dir, err := ioutil.TempDir("", "sherlock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoint.jsonl")
+
+	header, err := newDuplicateCheckpointHeader("index.gob", params, DefaultDedupMinWindows, DefaultTimelineMaxDrift)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a checkpoint cut short within its header is started again
+	if err := ioutil.WriteFile(path, []byte(`{"index":`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if found, records, size, err := readDuplicateCheckpoint(path); err != nil || found != nil || records != nil || size != 0 {
+		t.Fatalf("Expected nothing read of a checkpoint cut short in its header: %v", err)
+	}
+	f, err := openDuplicateCheckpoint(path, 0, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a checkpoint of half the corpus, with a last line cut short
+	half := corpus[:len(corpus)/2]
+	err = runDedup(half, params, idx, DefaultDedupMinWindows, DefaultTimelineMaxDrift, 2, map[string]bool{}, func(r duplicate_record) error {
+		_, err := f.WriteString(`{"id":"` + r.Id + `","duplicates":[]}` + "\n")
+		return err
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"id":"cut`)
+	f.Close()
+
+	found, records, size, err := readDuplicateCheckpoint(path)
+	if err != nil {
+		t.Fatalf("Reading checkpoint failed when it should not have: %s", err)
+	}
+	info, _ := os.Stat(path)
+	if found == nil || !reflect.DeepEqual(header, *found) || len(half) != len(records) || size != info.Size()-int64(len(`{"id":"cut`)) {
+		t.Fatalf("Expected the header and %d records but got %v and %d in %d bytes", len(half), found, len(records), size)
+	}
+
+	// only a checkpoint of the same index and parameters is resumed
+	other := params
+	other.ber = 0.2
+	for i, fixture := range []struct {
+		indexPath  string
+		params     search_params
+		minWindows int
+		resumes    bool
+	}{
+		{"index.gob", params, DefaultDedupMinWindows, true},
+		{"other.gob", params, DefaultDedupMinWindows, false},
+		{"index.gob", other, DefaultDedupMinWindows, false},
+		{"index.gob", params, DefaultDedupMinWindows + 1, false},
+	} {
+		h, _ := newDuplicateCheckpointHeader(fixture.indexPath, fixture.params, fixture.minWindows, DefaultTimelineMaxDrift)
+		if err := h.resumes(*found); (err == nil) != fixture.resumes {
+			t.Errorf("[%d] Expected resuming %t but was %v", i, fixture.resumes, err)
+		}
+	}
+
+	f, err = openDuplicateCheckpoint(path, size, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// resuming only searches the rest of the corpus
+	done := make(map[string]bool)
+	for _, r := range records {
+		done[r.Id] = true
+	}
+
+	searched := 0
+	err = runDedup(corpus, params, idx, DefaultDedupMinWindows, DefaultTimelineMaxDrift, 2, done, func(r duplicate_record) error {
+		searched++
+		if done[r.Id] {
+			t.Errorf("Expected %s not to be searched again", r.Id)
+		}
+		_, err := f.WriteString(`{"id":"` + r.Id + `","duplicates":[]}` + "\n")
+		return err
+	}, nil)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := len(corpus) - len(half); expected != searched {
+		t.Errorf("Expected %d fingerprints searched but got %d", expected, searched)
+	}
+
+	_, records, _, err = readDuplicateCheckpoint(path)
+	if err != nil || len(corpus) != len(records) {
+		t.Errorf("Expected %d records in the checkpoint but got %d: %v", len(corpus), len(records), err)
+	}
+
+	// records of fingerprints no longer in the index are dropped
+	if kept := duplicateRecordsOf(corpus[1:], records); len(kept) != len(corpus)-1 {
+		t.Errorf("Expected %d records of the corpus but got %d", len(corpus)-1, len(kept))
+	}
+
+	if found, records, size, err := readDuplicateCheckpoint(filepath.Join(dir, "missing")); err != nil || found != nil || records != nil || size != 0 {
+		t.Errorf("Expected no records when there is no checkpoint")
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A distortion of a sequence of sub-fingerprints, simulating at the level of
+// the fingerprint the bit errors and timing changes that a channel introduces
+// to audio. Distortions return a new sequence along with the number of
+// sub-fingerprints removed from the start of the sequence, so that the ground
+// truth offset of a query can be kept track of. All randomness comes from the
+// given source, so distortions are reproducible given a seed.
+type distortion func(rng *rand.Rand, sfps []sub_fingerprint) ([]sub_fingerprint, int)
+
+func copySubFingerprints(sfps []sub_fingerprint) []sub_fingerprint {
+	c := make([]sub_fingerprint, len(sfps))
+	copy(c, sfps)
+	return c
+}
+
+// Flips every bit within the width of the algorithm independently with the
+// given probability, giving a uniform bit error rate.
+func uniformBitErrorDistortion(alg fingerprint_algorithm, ber float64) distortion {
+	return func(rng *rand.Rand, sfps []sub_fingerprint) ([]sub_fingerprint, int) {
+		distorted := copySubFingerprints(sfps)
+		for i := range distorted {
+			for bit := 0; bit < alg.subFingerprintSizeBits(); bit++ {
+				if rng.Float64() < ber {
+					distorted[i] = distorted[i].flipBit(bit)
+				}
+			}
+		}
+
+		return distorted, 0
+	}
+}
+
+// Introduces bit errors in bursts of consecutive sub-fingerprints using a two
+// state (Gilbert-Elliott) model. Outside of a burst there are no errors, while
+// within a burst every bit is flipped with probability `burstBer`. Bursts last
+// `burstLength` sub-fingerprints on average and occur often enough that the
+// overall bit error rate is `ber`, which must be less than `burstBer`.
+func burstBitErrorDistortion(alg fingerprint_algorithm, ber float64, burstBer float64, burstLength float64) distortion {
+	inBurst := ber / burstBer // stationary probability of being in a burst
+	leave := 1.0 / burstLength
+	enter := inBurst / (1.0 - inBurst) * leave
+
+	return func(rng *rand.Rand, sfps []sub_fingerprint) ([]sub_fingerprint, int) {
+		distorted := copySubFingerprints(sfps)
+		burst := rng.Float64() < inBurst
+
+		for i := range distorted {
+			if burst {
+				for bit := 0; bit < alg.subFingerprintSizeBits(); bit++ {
+					if rng.Float64() < burstBer {
+						distorted[i] = distorted[i].flipBit(bit)
+					}
+				}
+				burst = rng.Float64() >= leave
+			} else {
+				burst = rng.Float64() < enter
+			}
+		}
+
+		return distorted, 0
+	}
+}
+
+// Flips only the designated unreliable bits, each with the given probability.
+// These are the bits whose energy differences are closest to zero, which the
+// Philips paper notes are the most likely to flip.
+func unreliableBitErrorDistortion(bits []int, ber float64) distortion {
+	return func(rng *rand.Rand, sfps []sub_fingerprint) ([]sub_fingerprint, int) {
+		distorted := copySubFingerprints(sfps)
+		for i := range distorted {
+			for _, bit := range bits {
+				if rng.Float64() < ber {
+					distorted[i] = distorted[i].flipBit(bit)
+				}
+			}
+		}
+
+		return distorted, 0
+	}
+}
+
+// Simulates shifting the audio by a fraction of a frame. Each bit of a
+// sub-fingerprint takes the value of the same bit in the next sub-fingerprint
+// with a probability of the shift fraction, since energy differences drift
+// towards those of the next frame. The last sub-fingerprint is unchanged.
+func frameShiftDistortion(alg fingerprint_algorithm, fraction float64) distortion {
+	return func(rng *rand.Rand, sfps []sub_fingerprint) ([]sub_fingerprint, int) {
+		distorted := copySubFingerprints(sfps)
+		for i := 0; i+1 < len(sfps); i++ {
+			for bit := 0; bit < alg.subFingerprintSizeBits(); bit++ {
+				if rng.Float64() < fraction && bitAt(sfps[i], bit) != bitAt(sfps[i+1], bit) {
+					distorted[i] = distorted[i].flipBit(bit)
+				}
+			}
+		}
+
+		return distorted, 0
+	}
+}
+
+// The value of a single bit of a sub-fingerprint, indexed the same as when
+// flipping bits.
+func bitAt(sfp sub_fingerprint, i int) bool {
+	return sfp[i/BitsPerByte]&(1<<uint(BitsPerByte-1-i%BitsPerByte)) != 0
+}
+
+// Simulates a change in tempo by a factor, where a factor above one speeds up
+// the audio, dropping sub-fingerprints, and below one slows it down,
+// duplicating sub-fingerprints. The start of the sequence stays aligned, but
+// the phase at which sub-fingerprints are dropped or duplicated is random.
+func tempoDistortion(factor float64) distortion {
+	return func(rng *rand.Rand, sfps []sub_fingerprint) ([]sub_fingerprint, int) {
+		phase := rng.Float64()
+		size := int(float64(len(sfps)) / factor)
+
+		distorted := make([]sub_fingerprint, 0, size)
+		for i := 0; i < size; i++ {
+			j := int(math.Floor(float64(i)*factor + phase))
+			if j >= len(sfps) {
+				break
+			}
+			distorted = append(distorted, sfps[j])
+		}
+
+		return distorted, 0
+	}
+}
+
+// Crops the sequence to a random length between the minimum and maximum, at
+// a random position.
+func cropDistortion(minLength int, maxLength int) distortion {
+	return func(rng *rand.Rand, sfps []sub_fingerprint) ([]sub_fingerprint, int) {
+		min, max := minLength, maxLength
+		if max > len(sfps) {
+			max = len(sfps)
+		}
+		if min > max {
+			min = max
+		}
+
+		length := min + rng.Intn(max-min+1)
+		start := rng.Intn(len(sfps) - length + 1)
+
+		return copySubFingerprints(sfps[start : start+length]), start
+	}
+}
+
+// Applies distortions in order to a sequence of sub-fingerprints, returning
+// the distorted sequence and the total number of sub-fingerprints removed from
+// the start.
+func applyDistortions(rng *rand.Rand, sfps []sub_fingerprint, distortions []distortion) ([]sub_fingerprint, int) {
+	removed := 0
+	for _, d := range distortions {
+		var n int
+		sfps, n = d(rng, sfps)
+		removed += n
+	}
+
+	return sfps, removed
+}
+
+// Generates labelled queries by taking segments of the given length from
+// random fingerprints in the corpus, at random offsets, and distorting them.
+// The same seed always generates the same queries from the same corpus.
+func generateDistortedQueries(
+	corpus []fingerprint,
+	n int,
+	length int,
+	seed int64,
+	distortions []distortion) ([]labelled_query, error) {
+
+	var eligible []*fingerprint
+	for i := range corpus {
+		if len(corpus[i].sfps) >= length {
+			eligible = append(eligible, &corpus[i])
+		}
+	}
+
+	if len(eligible) == 0 {
+		return nil, fmt.Errorf("No fingerprints in the corpus are at least the query length: %d", length)
+	}
+
+	rng := rand.New(rand.NewSource(seed))
+	queries := make([]labelled_query, n)
+	for i := range queries {
+		fp := eligible[rng.Intn(len(eligible))]
+		offset := rng.Intn(len(fp.sfps) - length + 1)
+
+		sfps, removed := applyDistortions(rng, copySubFingerprints(fp.sfps[offset:offset+length]), distortions)
+		offset += removed
+
+		queries[i] = labelled_query{
+			fingerprint{fmt.Sprintf("%06d", i), sfps, fp.meta, 0},
+			fp.id,
+			offset,
+		}
+	}
+
+	return queries, nil
+}
+
+// Writes labelled queries as query fingerprint files of the algorithm along with
+// a CSV file of labels, as read by the `eval` command.
+func writeLabelledQueries(alg fingerprint_algorithm, dir string, queries []labelled_query) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	labels := [][]string{{"query", "id", "offset"}}
+	for _, query := range queries {
+		name := query.fp.id + ".pb"
+
+		buf, err := proto.Marshal(newQueryFingerprint(alg, query.fp))
+		if err != nil {
+			return err
+		}
+
+		if err := ioutil.WriteFile(filepath.Join(dir, name), buf, 0644); err != nil {
+			return err
+		}
+
+		labels = append(labels, []string{name, query.id, strconv.Itoa(query.offset)})
+	}
+
+	// quoted as needed, since IDs may contain commas, quotes or newlines
+	return writeFile(filepath.Join(dir, "labels.csv"), func(w io.Writer) error {
+		return csv.NewWriter(w).WriteAll(labels)
+	})
+}
+
+// Parses a comma separated list of bit positions within the sub-fingerprints of
+// the algorithm.
+func parseBits(alg fingerprint_algorithm, s string) ([]int, error) {
+	var bits []int
+	if s == "" {
+		return bits, nil
+	}
+
+	for _, field := range strings.Split(s, ",") {
+		bit, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, err
+		}
+
+		if bit < 0 || bit >= alg.subFingerprintSizeBits() {
+			return nil, fmt.Errorf("Bit position does not exist: %d", bit)
+		}
+		bits = append(bits, bit)
+	}
+
+	return bits, nil
+}
+
+// Generates a labelled query set from an index by distorting segments of the
+// indexed fingerprints, for use with the `eval` and `sweep` commands.
+// Distortions are applied in the order of the flags below, and are disabled
+// when left at their zero values.
+func distortCommand(args []string) {
+	flags := flag.NewFlagSet("distort", flag.ExitOnError)
+	indexPath := flags.String("index", "", "path to the index to take fingerprints from")
+	out := flags.String("out", "", "directory to write query fingerprints and labels.csv to")
+	n := flags.Int("n", 100, "number of queries to generate")
+	length := flags.Int("length", FingerprintBlockSize*2, "number of sub-fingerprints taken for each query")
+	seed := flags.Int64("seed", 1, "seed of the random number generator")
+	cropMin := flags.Int("crop.min", 0, "minimum length of a random crop")
+	cropMax := flags.Int("crop.max", 0, "maximum length of a random crop")
+	tempo := flags.Float64("tempo", 0, "tempo change factor, for example 1.02 to speed up by 2%")
+	shift := flags.Float64("shift", 0, "time shift as a fraction of a frame")
+	ber := flags.Float64("ber", 0, "uniform bit error rate")
+	burstBer := flags.Float64("burst.ber", 0, "overall bit error rate of bursty errors")
+	burstBitBer := flags.Float64("burst.bit_ber", 0.5, "bit error rate within a burst")
+	burstLength := flags.Float64("burst.length", 8, "mean number of sub-fingerprints in a burst")
+	unreliableBits := flags.String("unreliable.bits", "", "comma separated positions of unreliable bits")
+	unreliableBer := flags.Float64("unreliable.ber", 0.5, "bit error rate of unreliable bits")
+	flags.Parse(args)
+
+	if *indexPath == "" || *out == "" {
+		log.Fatal("Both -index and -out must be provided")
+	}
+
+	alg, corpus, _, err := readIndexFile(*indexPath)
+	if err != nil {
+		log.Fatalf("Failed reading index: %s", err)
+	}
+
+	var distortions []distortion
+	if *cropMax > 0 {
+		distortions = append(distortions, cropDistortion(*cropMin, *cropMax))
+	}
+	if *tempo > 0 {
+		distortions = append(distortions, tempoDistortion(*tempo))
+	}
+	if *shift > 0 {
+		distortions = append(distortions, frameShiftDistortion(alg, *shift))
+	}
+	if *ber > 0 {
+		distortions = append(distortions, uniformBitErrorDistortion(alg, *ber))
+	}
+	if *burstBer > 0 {
+		if *burstBer >= *burstBitBer {
+			log.Fatal("Overall bit error rate of bursts must be less than the bit error rate within a burst")
+		}
+		distortions = append(distortions, burstBitErrorDistortion(alg, *burstBer, *burstBitBer, *burstLength))
+	}
+	if *unreliableBits != "" {
+		bits, err := parseBits(alg, *unreliableBits)
+		if err != nil {
+			log.Fatalf("Invalid unreliable bits: %s", err)
+		}
+		distortions = append(distortions, unreliableBitErrorDistortion(bits, *unreliableBer))
+	}
+
+	queries, err := generateDistortedQueries(corpus, *n, *length, *seed, distortions)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := writeLabelledQueries(alg, *out, queries); err != nil {
+		log.Fatalf("Failed writing queries: %s", err)
+	}
+	log.Printf("Wrote %d queries to: %s", len(queries), *out)
+}
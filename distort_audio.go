@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+// A distortion of audio, applied before fingerprint extraction to simulate
+// what a real channel does to audio. All randomness comes from the given
+// source, so distortions are reproducible given a seed.
+type audio_distortion func(rng *rand.Rand, audio pcm) pcm
+
+// Scales noise to give the target signal-to-noise ratio, in dB, when added to
+// the audio.
+func addNoise(audio pcm, noise []float64, snr float64) pcm {
+	noisePower := pcm{audio.sampleRate, noise}.power()
+	if noisePower == 0 {
+		return audio
+	}
+
+	scale := math.Sqrt(audio.power() / (noisePower * math.Pow(10, snr/10.0)))
+
+	samples := make([]float64, len(audio.samples))
+	for i, s := range audio.samples {
+		samples[i] = s + noise[i]*scale
+	}
+
+	return pcm{audio.sampleRate, samples}
+}
+
+// Adds white Gaussian noise at a signal-to-noise ratio in dB.
+func whiteNoiseDistortion(snr float64) audio_distortion {
+	return func(rng *rand.Rand, audio pcm) pcm {
+		noise := make([]float64, len(audio.samples))
+		for i := range noise {
+			noise[i] = rng.NormFloat64()
+		}
+
+		return addNoise(audio, noise, snr)
+	}
+}
+
+// Adds pink noise, with power falling 3 dB per octave, at a signal-to-noise
+// ratio in dB. Pink noise is made by filtering white noise with Paul Kellet's
+// economy filter.
+func pinkNoiseDistortion(snr float64) audio_distortion {
+	return func(rng *rand.Rand, audio pcm) pcm {
+		noise := make([]float64, len(audio.samples))
+		b0, b1, b2 := 0.0, 0.0, 0.0
+		for i := range noise {
+			white := rng.NormFloat64()
+			b0 = 0.99765*b0 + white*0.0990460
+			b1 = 0.96300*b1 + white*0.2965164
+			b2 = 0.57000*b2 + white*1.0526913
+			noise[i] = b0 + b1 + b2 + white*0.1848
+		}
+
+		return addNoise(audio, noise, snr)
+	}
+}
+
+// Removes frequencies above the cutoff in Hz, as lossy codecs such as MP3 do at
+// low bit rates.
+func lowPassDistortion(cutoff float64) audio_distortion {
+	return func(rng *rand.Rand, audio pcm) pcm {
+		kernel := lowPassKernel(cutoff/float64(audio.sampleRate), 101)
+		return pcm{audio.sampleRate, convolve(audio.samples, kernel)}
+	}
+}
+
+// Compresses the dynamic range of the audio, reducing the level above the
+// threshold in dB by the ratio. The level follows the signal envelope with
+// attack and release times in seconds.
+func compressionDistortion(threshold float64, ratio float64, attack float64, release float64) audio_distortion {
+	return func(rng *rand.Rand, audio pcm) pcm {
+		attackCoeff := math.Exp(-1.0 / (attack * float64(audio.sampleRate)))
+		releaseCoeff := math.Exp(-1.0 / (release * float64(audio.sampleRate)))
+
+		samples := make([]float64, len(audio.samples))
+		envelope := 0.0
+		for i, s := range audio.samples {
+			level := math.Abs(s)
+			if level > envelope {
+				envelope = attackCoeff*envelope + (1.0-attackCoeff)*level
+			} else {
+				envelope = releaseCoeff*envelope + (1.0-releaseCoeff)*level
+			}
+
+			gain := 1.0
+			if envelope > 0 {
+				levelDb := 20.0 * math.Log10(envelope)
+				if levelDb > threshold {
+					gain = math.Pow(10, (threshold-levelDb)*(1.0-1.0/ratio)/20.0)
+				}
+			}
+			samples[i] = s * gain
+		}
+
+		return pcm{audio.sampleRate, samples}
+	}
+}
+
+// Coefficients of a peaking equaliser biquad filter, from the Audio EQ Cookbook
+// by Robert Bristow-Johnson.
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+}
+
+func peakingBiquad(sampleRate int, freq float64, gain float64, q float64) biquad {
+	a := math.Pow(10, gain/40.0)
+	w0 := 2.0 * math.Pi * freq / float64(sampleRate)
+	alpha := math.Sin(w0) / (2.0 * q)
+	a0 := 1.0 + alpha/a
+
+	return biquad{
+		(1.0 + alpha*a) / a0,
+		-2.0 * math.Cos(w0) / a0,
+		(1.0 - alpha*a) / a0,
+		-2.0 * math.Cos(w0) / a0,
+		(1.0 - alpha/a) / a0,
+	}
+}
+
+func (f biquad) filter(samples []float64) []float64 {
+	filtered := make([]float64, len(samples))
+	x1, x2, y1, y2 := 0.0, 0.0, 0.0, 0.0
+	for i, x := range samples {
+		y := f.b0*x + f.b1*x1 + f.b2*x2 - f.a1*y1 - f.a2*y2
+		x2, x1 = x1, x
+		y2, y1 = y1, y
+		filtered[i] = y
+	}
+
+	return filtered
+}
+
+// Equalises the audio with a graphic equaliser of octave bands centred from
+// 31.25 Hz upwards, with a gain in dB for each band. Bands at or above the
+// Nyquist frequency are skipped.
+func equalizationDistortion(gains []float64) audio_distortion {
+	return func(rng *rand.Rand, audio pcm) pcm {
+		samples := audio.samples
+		for i, gain := range gains {
+			freq := 31.25 * math.Pow(2, float64(i))
+			if freq >= float64(audio.sampleRate)/2.0 || gain == 0 {
+				continue
+			}
+			samples = peakingBiquad(audio.sampleRate, freq, gain, math.Sqrt2).filter(samples)
+		}
+
+		return pcm{audio.sampleRate, samples}
+	}
+}
+
+// Resamples the audio to another sample rate and back again.
+func resampleDistortion(sampleRate int) audio_distortion {
+	return func(rng *rand.Rand, audio pcm) pcm {
+		return resample(resample(audio, sampleRate), audio.sampleRate)
+	}
+}
+
+// Changes the playback speed by a factor, changing both tempo and pitch, as
+// when radio stations speed up tracks.
+func speedDistortion(factor float64) audio_distortion {
+	return func(rng *rand.Rand, audio pcm) pcm {
+		return pcm{audio.sampleRate, interpolate(audio.samples, factor)}
+	}
+}
+
+// Changes the tempo by a factor while keeping the pitch, using overlap-add of
+// Hann windowed frames of about 40 milliseconds.
+func timeScale(samples []float64, sampleRate int, factor float64) []float64 {
+	size := sampleRate / 25
+	synthesisHop := size / 2
+	analysisHop := float64(synthesisHop) * factor
+	window := hannWindow(size)
+
+	frames := int(float64(len(samples)-size)/analysisHop) + 1
+	if frames < 1 {
+		return samples
+	}
+
+	scaled := make([]float64, (frames-1)*synthesisHop+size)
+	norm := make([]float64, len(scaled))
+	for k := 0; k < frames; k++ {
+		from := int(float64(k) * analysisHop)
+		to := k * synthesisHop
+		for i := 0; i < size && from+i < len(samples); i++ {
+			scaled[to+i] += samples[from+i] * window[i]
+			norm[to+i] += window[i]
+		}
+	}
+
+	for i := range scaled {
+		if norm[i] > 1e-3 {
+			scaled[i] /= norm[i]
+		}
+	}
+
+	return scaled
+}
+
+// Changes the tempo by a factor while keeping the pitch.
+func timeScaleDistortion(factor float64) audio_distortion {
+	return func(rng *rand.Rand, audio pcm) pcm {
+		return pcm{audio.sampleRate, timeScale(audio.samples, audio.sampleRate, factor)}
+	}
+}
+
+// Changes the pitch by a factor while keeping the tempo, by time scaling and
+// then changing the speed.
+func pitchDistortion(factor float64) audio_distortion {
+	return func(rng *rand.Rand, audio pcm) pcm {
+		stretched := timeScale(audio.samples, audio.sampleRate, 1.0/factor)
+		return pcm{audio.sampleRate, interpolate(stretched, factor)}
+	}
+}
+
+// Simulates a GSM phone call by limiting the audio to the 300-3400 Hz
+// telephone band at 8 kHz and quantising it with 8-bit mu-law.
+func gsmDistortion() audio_distortion {
+	return func(rng *rand.Rand, audio pcm) pcm {
+		narrow := resample(audio, 8000)
+		kernel := bandPassKernel(300.0/8000.0, 3400.0/8000.0, 101)
+		samples := convolve(narrow.samples, kernel)
+
+		const mu = 255.0
+		for i, s := range samples {
+			s = math.Max(-1.0, math.Min(1.0, s))
+			sign := 1.0
+			if s < 0 {
+				sign = -1.0
+			}
+
+			// compand, quantise to 8 bits and expand again
+			companded := sign * math.Log1p(mu*math.Abs(s)) / math.Log1p(mu)
+			quantised := math.Floor(companded*127.0+0.5) / 127.0
+			samples[i] = sign * (math.Pow(1.0+mu, math.Abs(quantised)) - 1.0) / mu
+		}
+
+		return resample(pcm{8000, samples}, audio.sampleRate)
+	}
+}
+
+// Adds an echo delayed by seconds and attenuated by the gain.
+func echoDistortion(delay float64, gain float64) audio_distortion {
+	return func(rng *rand.Rand, audio pcm) pcm {
+		d := int(delay * float64(audio.sampleRate))
+
+		samples := make([]float64, len(audio.samples))
+		for i, s := range audio.samples {
+			samples[i] = s
+			if i >= d {
+				samples[i] += gain * audio.samples[i-d]
+			}
+		}
+
+		return pcm{audio.sampleRate, samples}
+	}
+}
+
+// Named audio distortions with typical settings, similar to those of the
+// robustness experiments in the Philips paper.
+func namedAudioDistortions() map[string]audio_distortion {
+	return map[string]audio_distortion{
+		"none":          func(rng *rand.Rand, audio pcm) pcm { return audio },
+		"white_noise":   whiteNoiseDistortion(20),
+		"pink_noise":    pinkNoiseDistortion(20),
+		"low_pass":      lowPassDistortion(4000),
+		"compression":   compressionDistortion(-20, 4, 0.005, 0.1),
+		"equalization":  equalizationDistortion([]float64{-6, 6, -6, 6, -6, 6, -6, 6, -6, 6}),
+		"resample":      resampleDistortion(22050),
+		"speed_up":      speedDistortion(1.02),
+		"speed_down":    speedDistortion(0.98),
+		"time_scale_up": timeScaleDistortion(1.04),
+		"pitch_up":      pitchDistortion(1.02),
+		"gsm":           gsmDistortion(),
+		"echo":          echoDistortion(0.1, 0.5),
+	}
+}
+
+// Looks up named audio distortions from a comma separated list, or all of them
+// in name order for `all`.
+func parseAudioDistortions(names string) ([]string, []audio_distortion, error) {
+	named := namedAudioDistortions()
+
+	var list []string
+	if names == "all" {
+		for name := range named {
+			list = append(list, name)
+		}
+		sort.Strings(list)
+	} else {
+		list = strings.Split(names, ",")
+	}
+
+	distortions := make([]audio_distortion, len(list))
+	for i, name := range list {
+		d, found := named[name]
+		if !found {
+			return nil, nil, fmt.Errorf("Unknown audio distortion: %s", name)
+		}
+		distortions[i] = d
+	}
+
+	return list, distortions, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestNoiseDistortionsSignalToNoiseRatio(t *testing.T) {
+	audio := sineWave(8000, 440, 1.0)
+
+	for name, d := range map[string]audio_distortion{
+		"white": whiteNoiseDistortion(10),
+		"pink":  pinkNoiseDistortion(10),
+	} {
+		noisy := d(rand.New(rand.NewSource(1)), audio)
+
+		noise := make([]float64, len(audio.samples))
+		for i := range noise {
+			noise[i] = noisy.samples[i] - audio.samples[i]
+		}
+
+		snr := 10.0 * math.Log10(audio.power()/pcm{8000, noise}.power())
+		if math.Abs(snr-10.0) > 1e-6 {
+			t.Errorf("[%s] Expected SNR of 10 dB but was %f", name, snr)
+		}
+	}
+}
+
+func TestEchoDistortion(t *testing.T) {
+	audio := pcm{10, []float64{1, 0, 0, 0, 0}}
+
+	got := echoDistortion(0.2, 0.5)(nil, audio)
+	expected := []float64{1, 0, 0.5, 0, 0}
+	for i, e := range expected {
+		if e != got.samples[i] {
+			t.Errorf("[%d] Expected %f but got %f", i, e, got.samples[i])
+		}
+	}
+}
+
+func TestAudioDistortionsKeepFingerprintMatching(t *testing.T) {
+	audio := randomTones(1, 11025, 4.0)
+	reference := philips.extract("reference", audio)
+
+	for name, d := range namedAudioDistortions() {
+		distorted := d(rand.New(rand.NewSource(1)), audio)
+		query := philips.extract(name, distorted)
+
+		size := len(query.sfps)
+		if size > len(reference.sfps) {
+			size = len(reference.sfps)
+		}
+
+		// only the start stays aligned when the tempo changes
+		if size > 32 {
+			size = 32
+		}
+
+		queryFpb := fingerprint_block(query.sfps[:size])
+		ber, _ := queryFpb.bitErrorRateWith(philips, fingerprint_block(reference.sfps[:size]))
+		if ber > 0.35 {
+			t.Errorf("[%s] Expected BER below the threshold but was %f", name, ber)
+		}
+	}
+}
+
+func TestParseAudioDistortions(t *testing.T) {
+	names, distortions, err := parseAudioDistortions("gsm,echo")
+	if err != nil || len(names) != 2 || len(distortions) != 2 {
+		t.Errorf("Expected two distortions but got %v: %v", names, err)
+	}
+
+	if names, _, _ := parseAudioDistortions("all"); len(names) != len(namedAudioDistortions()) {
+		t.Errorf("Expected all distortions but got %v", names)
+	}
+
+	if _, _, err := parseAudioDistortions("gsm,bogus"); err == nil {
+		t.Errorf("Expected an error for an unknown distortion")
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func randomSubFingerprints(alg fingerprint_algorithm, seed int64, n int) []sub_fingerprint {
+	rng := rand.New(rand.NewSource(seed))
+	sfps := make([]sub_fingerprint, n)
+	for i := range sfps {
+		for j := 0; j < subFingerprintSizeBytes(alg); j++ {
+			sfps[i][j] = byte(rng.Intn(256))
+		}
+	}
+
+	return sfps
+}
+
+func measuredBitErrorRate(t *testing.T, left []sub_fingerprint, right []sub_fingerprint) float64 {
+	l := fingerprint_block(left)
+	ber, err := l.bitErrorRateWith(philips, fingerprint_block(right))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return float64(ber)
+}
+
+func TestBitErrorDistortions(t *testing.T) {
+	sfps := randomSubFingerprints(philips, 1, 10000)
+
+	fixtures := []struct {
+		name       string
+		distortion distortion
+		expected   float64
+	}{
+		{"uniform", uniformBitErrorDistortion(philips, 0.1), 0.1},
+		{"burst", burstBitErrorDistortion(philips, 0.1, 0.5, 8), 0.1},
+		{"unreliable", unreliableBitErrorDistortion([]int{0, 1, 2, 3}, 0.5), 4.0 / 32.0 * 0.5},
+	}
+
+	for _, fixture := range fixtures {
+		distorted, removed := fixture.distortion(rand.New(rand.NewSource(1)), sfps)
+		if removed != 0 || len(distorted) != len(sfps) {
+			t.Fatalf("[%s] Expected same alignment and length but removed %d and got length %d", fixture.name, removed, len(distorted))
+		}
+
+		if got := measuredBitErrorRate(t, sfps, distorted); math.Abs(fixture.expected-got) > 0.01 {
+			t.Errorf("[%s] Expected BER of about %f but was %f", fixture.name, fixture.expected, got)
+		}
+
+		// same seed, same distortion
+		again, _ := fixture.distortion(rand.New(rand.NewSource(1)), sfps)
+		for i := range distorted {
+			if distorted[i] != again[i] {
+				t.Fatalf("[%s][%d] Expected reproducible distortion", fixture.name, i)
+			}
+		}
+	}
+}
+
+func TestUnreliableBitErrorDistortionOnlyFlipsDesignatedBits(t *testing.T) {
+	sfps := make([]sub_fingerprint, 100)
+
+	distorted, _ := unreliableBitErrorDistortion([]int{7, 15}, 1.0)(rand.New(rand.NewSource(1)), sfps)
+	for i, sfp := range distorted {
+		if expected := (sub_fingerprint{1, 1, 0, 0}); expected != sfp {
+			t.Fatalf("[%d] Expected %v but got %v", i, expected, sfp)
+		}
+	}
+}
+
+func TestFrameShiftDistortion(t *testing.T) {
+	sfps := randomSubFingerprints(philips, 1, 10)
+
+	distorted, _ := frameShiftDistortion(philips, 1.0)(rand.New(rand.NewSource(1)), sfps)
+	for i := 0; i+1 < len(sfps); i++ {
+		if sfps[i+1] != distorted[i] {
+			t.Errorf("[%d] Expected a full frame shift to take the next sub-fingerprint", i)
+		}
+	}
+
+	distorted, _ = frameShiftDistortion(philips, 0.0)(rand.New(rand.NewSource(1)), sfps)
+	for i := range sfps {
+		if sfps[i] != distorted[i] {
+			t.Errorf("[%d] Expected no shift to leave the sub-fingerprint unchanged", i)
+		}
+	}
+}
+
+func TestTempoDistortion(t *testing.T) {
+	sfps := randomSubFingerprints(philips, 1, 1000)
+
+	fixtures := []struct {
+		factor   float64
+		expected int
+	}{
+		{1.0, 1000},
+		{1.04, 961},
+		{0.96, 1041},
+	}
+
+	for i, fixture := range fixtures {
+		distorted, removed := tempoDistortion(fixture.factor)(rand.New(rand.NewSource(1)), sfps)
+		if removed != 0 {
+			t.Errorf("[%d] Expected the start to stay aligned but removed %d", i, removed)
+		}
+
+		if math.Abs(float64(fixture.expected-len(distorted))) > 1 {
+			t.Errorf("[%d] Expected about %d sub-fingerprints but got %d", i, fixture.expected, len(distorted))
+		}
+
+		if sfps[0] != distorted[0] {
+			t.Errorf("[%d] Expected first sub-fingerprint to be unchanged", i)
+		}
+	}
+}
+
+func TestGenerateDistortedQueries(t *testing.T) {
+	corpus := []fingerprint{
+		fingerprint{"0001", randomSubFingerprints(philips, 1, 100), fingerprint_meta{}, 0},
+		fingerprint{"0002", randomSubFingerprints(philips, 2, 50), fingerprint_meta{}, 0},
+		fingerprint{"0003", randomSubFingerprints(philips, 3, 10), fingerprint_meta{}, 0}, // too short
+	}
+
+	queries, err := generateDistortedQueries(corpus, 20, 40, 1, []distortion{cropDistortion(10, 30)})
+	if err != nil {
+		t.Fatalf("Generating queries failed when it should not have: %s", err)
+	}
+
+	for i, query := range queries {
+		var reference fingerprint
+		for _, fp := range corpus {
+			if fp.id == query.id {
+				reference = fp
+			}
+		}
+
+		if reference.id == "" || reference.id == "0003" {
+			t.Fatalf("[%d] Unexpected reference fingerprint: %s", i, query.id)
+		}
+
+		if l := len(query.fp.sfps); l < 10 || l > 30 {
+			t.Errorf("[%d] Expected cropped query length within bounds but was %d", i, l)
+		}
+
+		for j, sfp := range query.fp.sfps {
+			if reference.sfps[query.offset+j] != sfp {
+				t.Fatalf("[%d][%d] Expected query to match the reference at offset %d", i, j, query.offset)
+			}
+		}
+	}
+
+	if _, err := generateDistortedQueries(corpus, 1, 101, 1, nil); err == nil {
+		t.Errorf("Expected an error when no fingerprint is long enough")
+	}
+}
+
+func TestWriteLabelledQueries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sherlock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// IDs of references with characters that must be quoted
+	queries := []labelled_query{
+		labelled_query{fingerprint{"q1", randomSubFingerprints(philips, 1, 10), fingerprint_meta{}, 0}, "a,b", 1},
+		labelled_query{fingerprint{"q2", randomSubFingerprints(philips, 2, 10), fingerprint_meta{}, 0}, "say \"hi\"\nagain", 2},
+		labelled_query{fingerprint{"q3", randomSubFingerprints(philips, 3, 10), fingerprint_meta{}, 0}, "", 0},
+	}
+
+	if err := writeLabelledQueries(philips, dir, queries); err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := readLabelledQueries(philips, filepath.Join(dir, "labels.csv"))
+	if err != nil {
+		t.Fatalf("Failed reading labelled queries: %s", err)
+	}
+
+	if len(read) != len(queries) {
+		t.Fatalf("Expected %d queries but was %d", len(queries), len(read))
+	}
+	for i, query := range queries {
+		if read[i].id != query.id || read[i].offset != query.offset || !reflect.DeepEqual(read[i].fp.sfps, query.fp.sfps) {
+			t.Errorf("[%d] Expected query of %q at %d but was of %q at %d", i, query.id, query.offset, read[i].id, read[i].offset)
+		}
+	}
+}
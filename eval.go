@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// A query fingerprint labelled with the ground truth of where it should match.
+// The offset is the position in the reference fingerprint of the start of the
+// query. An empty ID means that the query should not match anything.
+type labelled_query struct {
+	fp     fingerprint
+	id     string
+	offset int
+}
+
+// The outcome of searching with a single labelled query. A query whose search
+// failed has the error and no matches.
+type query_outcome struct {
+	query      labelled_query
+	matches    []match
+	candidates int // before BER filtering, summed over all windows
+	duration   time.Duration
+	err        error
+}
+
+// Summary of an evaluation over a labelled query set.
+//
+// Precision is the fraction of fingerprints matched by queries that were the
+// expected fingerprint. Recall is the fraction of queries with an expected
+// fingerprint that found it at any rank, while top-1 accuracy is the fraction
+// that ranked it first. Offset errors are between the expected offset and the
+// best ranked match of the expected fingerprint. Queries whose search failed
+// are counted as matching nothing.
+type evaluation struct {
+	Queries         int     `json:"queries"`
+	Positives       int     `json:"positives"`
+	Failed          int     `json:"failed"`
+	Precision       float64 `json:"precision"`
+	Recall          float64 `json:"recall"`
+	Top1Accuracy    float64 `json:"top1_accuracy"`
+	MeanOffsetError float64 `json:"mean_offset_error"`
+	MaxOffsetError  int     `json:"max_offset_error"`
+	MeanCandidates  float64 `json:"mean_candidates"`
+	MeanMatches     float64 `json:"mean_matches"`
+	LatencyP50      float64 `json:"latency_p50_ms"`
+	LatencyP90      float64 `json:"latency_p90_ms"`
+	LatencyP99      float64 `json:"latency_p99_ms"`
+	LatencyMax      float64 `json:"latency_max_ms"`
+}
+
+// Searches the index with each labelled query using the given parameters. A
+// query whose search fails doesn't stop the others, and is kept as an outcome
+// with the error.
+func searchLabelledQueries(queries []labelled_query, params search_params, idx index) ([]query_outcome, error) {
+	generator, err := params.candidateGenerator(idx)
+	if err != nil {
+		return nil, err
+	}
+
+	outcomes := make([]query_outcome, len(queries))
+	for i, query := range queries {
+		start := time.Now()
+		results, err := params.searchWindowsWith(query.fp, generator)
+		if err != nil {
+			err = fmt.Errorf("Search with query %s failed: %s", query.fp.id, err)
+			outcomes[i] = query_outcome{query, nil, 0, time.Since(start), err}
+			continue
+		}
+		matches := rankMatches(params.algorithm, query.fp, results)
+		duration := time.Since(start)
+
+		candidates := 0
+		for _, result := range results {
+			candidates += result.generated
+		}
+
+		outcomes[i] = query_outcome{query, matches, candidates, duration, nil}
+	}
+
+	return outcomes, nil
+}
+
+// Summarises the outcomes of searching with a labelled query set.
+func evaluateOutcomes(outcomes []query_outcome) evaluation {
+	e := evaluation{Queries: len(outcomes)}
+	if len(outcomes) == 0 {
+		return e
+	}
+
+	matchedIds, correctIds := 0, 0
+	found, top1, totalOffsetError := 0, 0, 0
+	totalCandidates, totalMatches := 0, 0
+	durations := make([]time.Duration, len(outcomes))
+
+	for i, outcome := range outcomes {
+		totalCandidates += outcome.candidates
+		totalMatches += len(outcome.matches)
+		durations[i] = outcome.duration
+		if outcome.err != nil {
+			e.Failed++
+		}
+
+		// distinct fingerprints matched by ID, keeping the best ranked match of
+		// each, so that a reference matched at several offsets counts once
+		best := make(map[string]match)
+		for _, m := range outcome.matches {
+			if _, seen := best[m.fp.id]; !seen {
+				best[m.fp.id] = m
+			}
+		}
+		matchedIds += len(best)
+
+		expected := outcome.query.id
+		if expected == "" {
+			continue
+		}
+		e.Positives++
+
+		m, matched := best[expected]
+		if !matched {
+			continue
+		}
+		correctIds++
+		found++
+
+		if outcome.matches[0].fp.id == expected {
+			top1++
+		}
+
+		offsetError := m.offset - outcome.query.offset
+		if offsetError < 0 {
+			offsetError = -offsetError
+		}
+		totalOffsetError += offsetError
+		if offsetError > e.MaxOffsetError {
+			e.MaxOffsetError = offsetError
+		}
+	}
+
+	e.Precision = ratio(correctIds, matchedIds)
+	e.Recall = ratio(found, e.Positives)
+	e.Top1Accuracy = ratio(top1, e.Positives)
+	e.MeanOffsetError = ratio(totalOffsetError, found)
+	e.MeanCandidates = ratio(totalCandidates, len(outcomes))
+	e.MeanMatches = ratio(totalMatches, len(outcomes))
+
+	sort.Sort(durations_ascending(durations))
+	e.LatencyP50 = milliseconds(percentile(durations, 0.50))
+	e.LatencyP90 = milliseconds(percentile(durations, 0.90))
+	e.LatencyP99 = milliseconds(percentile(durations, 0.99))
+	e.LatencyMax = milliseconds(durations[len(durations)-1])
+
+	return e
+}
+
+// Ratio of two counts, defined as zero when there is nothing to count.
+func ratio(n int, d int) float64 {
+	if d == 0 {
+		return 0.0
+	}
+	return float64(n) / float64(d)
+}
+
+type durations_ascending []time.Duration
+
+func (d durations_ascending) Len() int           { return len(d) }
+func (d durations_ascending) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d durations_ascending) Less(i, j int) bool { return d[i] < d[j] }
+
+// Nearest-rank percentile of sorted durations, where `p` is in [0, 1].
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+// Writes the evaluation as a human-readable table.
+func (e evaluation) writeText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "queries\t%d\n", e.Queries)
+	fmt.Fprintf(tw, "positives\t%d\n", e.Positives)
+	fmt.Fprintf(tw, "failed\t%d\n", e.Failed)
+	fmt.Fprintf(tw, "precision\t%.4f\n", e.Precision)
+	fmt.Fprintf(tw, "recall\t%.4f\n", e.Recall)
+	fmt.Fprintf(tw, "top-1 accuracy\t%.4f\n", e.Top1Accuracy)
+	fmt.Fprintf(tw, "offset error (mean/max)\t%.2f/%d\n", e.MeanOffsetError, e.MaxOffsetError)
+	fmt.Fprintf(tw, "candidates per query\t%.2f\n", e.MeanCandidates)
+	fmt.Fprintf(tw, "matches per query\t%.2f\n", e.MeanMatches)
+	fmt.Fprintf(tw, "latency p50/p90/p99/max (ms)\t%.3f/%.3f/%.3f/%.3f\n", e.LatencyP50, e.LatencyP90, e.LatencyP99, e.LatencyMax)
+
+	return tw.Flush()
+}
+
+// Reads a labelled query set from a CSV file with a header of `query,id,offset`.
+// Each row names a query fingerprint file, relative to the CSV file, along with
+// the ID of the expected reference fingerprint and the offset within it. An
+// empty ID means the query should not match anything. Query fingerprints must be
+// of the algorithm.
+func readLabelledQueries(alg fingerprint_algorithm, path string) ([]labelled_query, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rows) == 0 || len(rows[0]) != 3 || rows[0][0] != "query" {
+		return nil, fmt.Errorf("Labelled queries must have a header of query,id,offset: %s", path)
+	}
+
+	queries := make([]labelled_query, 0, len(rows)-1)
+	for i, row := range rows[1:] {
+		offset := 0
+		if row[2] != "" {
+			offset, err = strconv.Atoi(row[2])
+			if err != nil {
+				return nil, fmt.Errorf("Invalid offset on line %d: %s", i+2, err)
+			}
+		}
+
+		fp, err := readQueryFingerprintFile(alg, filepath.Join(filepath.Dir(path), row[0]))
+		if err != nil {
+			return nil, fmt.Errorf("Failed reading query on line %d: %s", i+2, err)
+		}
+
+		queries = append(queries, labelled_query{fp, row[1], offset})
+	}
+
+	return queries, nil
+}
+
+// Evaluates search over a labelled query set and prints precision, recall,
+// offset errors, candidates examined and latencies.
+func evalCommand(args []string) {
+	flags := flag.NewFlagSet("eval", flag.ExitOnError)
+	indexPath := flags.String("index", "", "path to the index to search")
+	queriesPath := flags.String("queries", "", "path to the CSV file of labelled queries")
+	output := flags.String("output", "text", "output format: text or json")
+	params := defaultSearchParams()
+	params.registerFlags(flags)
+	flags.Parse(args)
+
+	if *indexPath == "" || *queriesPath == "" {
+		log.Fatal("Both -index and -queries must be provided")
+	}
+
+	alg, _, idx, err := readIndexFile(*indexPath)
+	if err != nil {
+		log.Fatalf("Failed reading index: %s", err)
+	}
+	params, err = params.forAlgorithm(alg, flags)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	queries, err := readLabelledQueries(alg, *queriesPath)
+	if err != nil {
+		log.Fatalf("Failed reading labelled queries: %s", err)
+	}
+
+	outcomes, err := searchLabelledQueries(queries, params, idx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, outcome := range outcomes {
+		if outcome.err != nil {
+			log.Print(outcome.err)
+		}
+	}
+	e := evaluateOutcomes(outcomes)
+
+	switch *output {
+	case "text":
+		err = e.writeText(os.Stdout)
+	case "json":
+		err = json.NewEncoder(os.Stdout).Encode(e)
+	default:
+		err = fmt.Errorf("Unknown output format: %s", *output)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
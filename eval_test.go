@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestEvaluateOutcomes(t *testing.T) {
+	corpus := buildTestCorpus()
+
+	outcomes := []query_outcome{
+		// top-1 correct, off by one, and matched again at another offset
+		query_outcome{
+			labelled_query{fingerprint{}, "0001", 1},
+			[]match{match{&corpus[0], 2, 2, 0.0, 1.0}, match{&corpus[1], 2, 1, 0.0, 1.0}, match{&corpus[0], 5, 1, 0.1, 1.0}},
+			10,
+			1 * time.Millisecond,
+			nil,
+		},
+		// found, but not at the top
+		query_outcome{
+			labelled_query{fingerprint{}, "0003", 0},
+			[]match{match{&corpus[1], 0, 2, 0.0, 1.0}, match{&corpus[2], 0, 1, 0.1, 1.0}},
+			20,
+			2 * time.Millisecond,
+			nil,
+		},
+		// not found
+		query_outcome{
+			labelled_query{fingerprint{}, "0002", 0},
+			[]match{},
+			0,
+			3 * time.Millisecond,
+			nil,
+		},
+		// should not match, but did
+		query_outcome{
+			labelled_query{fingerprint{}, "", 0},
+			[]match{match{&corpus[2], 3, 1, 0.2, 1.0}},
+			2,
+			4 * time.Millisecond,
+			nil,
+		},
+		// failed, so not found
+		query_outcome{
+			labelled_query{fingerprint{}, "0001", 0},
+			nil,
+			0,
+			5 * time.Millisecond,
+			fmt.Errorf("Search failed"),
+		},
+	}
+
+	e := evaluateOutcomes(outcomes)
+
+	fixtures := []struct {
+		name     string
+		expected float64
+		got      float64
+	}{
+		{"queries", 5, float64(e.Queries)},
+		{"positives", 4, float64(e.Positives)},
+		{"failed", 1, float64(e.Failed)},
+		{"precision", 2.0 / 5.0, e.Precision},
+		{"recall", 2.0 / 4.0, e.Recall},
+		{"top-1 accuracy", 1.0 / 4.0, e.Top1Accuracy},
+		{"mean offset error", 0.5, e.MeanOffsetError},
+		{"max offset error", 1, float64(e.MaxOffsetError)},
+		{"mean candidates", 32.0 / 5.0, e.MeanCandidates},
+		{"mean matches", 6.0 / 5.0, e.MeanMatches},
+		{"latency p50", 3, e.LatencyP50},
+		{"latency p99", 5, e.LatencyP99},
+		{"latency max", 5, e.LatencyMax},
+	}
+
+	for _, fixture := range fixtures {
+		if fixture.expected != fixture.got {
+			t.Errorf("[%s] Expected %f but got %f", fixture.name, fixture.expected, fixture.got)
+		}
+	}
+}
+
+func TestSearchLabelledQueries(t *testing.T) {
+	corpus := buildTestCorpus()
+	idx := buildIndex(philips, corpus)
+
+	queries := []labelled_query{
+		labelled_query{fingerprint{"q1", corpus[2].sfps[1:], fingerprint_meta{}, 0}, "0003", 1},
+		labelled_query{fingerprint{"short", corpus[2].sfps[:1], fingerprint_meta{}, 0}, "0003", 0},
+	}
+
+	params := defaultSearchParams()
+	params.blockSize = 2
+	params.stepSize = 1
+	params.ber = 0.0
+
+	outcomes, err := searchLabelledQueries(queries, params, idx)
+	if err != nil {
+		t.Fatalf("Search failed when it should not have: %s", err)
+	}
+
+	// a query shorter than a block fails, and is a miss
+	e := evaluateOutcomes(outcomes)
+	if e.Recall != 0.5 || e.Top1Accuracy != 0.5 || e.MaxOffsetError != 0 || e.Failed != 1 || outcomes[1].err == nil {
+		t.Errorf("Expected the first query found and the second failed but got %+v", e)
+	}
+}
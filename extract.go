@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"github.com/golang/protobuf/proto"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Parameters of the Philips fingerprint extraction, as in the paper: frames of
+// about 0.37 seconds taken every 11.6 milliseconds, with energies in 33
+// logarithmically spaced bands between 300 Hz and 2000 Hz giving 32 bits. Wider
+// sub-fingerprints split the same range into more, narrower bands.
+const (
+	ExtractionSampleRate = 5512
+	ExtractionFrameSize  = 2048
+	ExtractionFrameHop   = 64
+	ExtractionMinFreq    = 300.0
+	ExtractionMaxFreq    = 2000.0
+)
+
+// Bins of the spectrum at the edges of each of the given number of extraction
+// bands.
+func extractionBandEdges(bands int) []int {
+	edges := make([]int, bands+1)
+	ratio := ExtractionMaxFreq / ExtractionMinFreq
+
+	for i := range edges {
+		freq := ExtractionMinFreq * math.Pow(ratio, float64(i)/float64(bands))
+		edges[i] = int(math.Floor(freq * ExtractionFrameSize / ExtractionSampleRate))
+	}
+
+	return edges
+}
+
+// Extracts a Philips fingerprint of sub-fingerprints of the given number of
+// bits from audio. Each bit of a sub-fingerprint is the sign of the energy
+// difference between neighbouring bands, differenced again with the previous
+// frame. The first frame has no previous frame, so sub-fingerprint `n` is of
+// frame `n+1`, which starts `(n+1) * ExtractionFrameHop` samples into the
+// audio once resampled.
+func extractFingerprint(id string, audio pcm, bits int) fingerprint {
+	samples := resample(audio, ExtractionSampleRate).samples
+	spectrogram := powerSpectrogram(samples, ExtractionFrameSize, ExtractionFrameHop, hannWindow(ExtractionFrameSize))
+	edges := extractionBandEdges(bits + 1)
+
+	energies := make([][]float64, len(spectrogram))
+	for n, power := range spectrogram {
+		energies[n] = make([]float64, bits+1)
+		for m := range energies[n] {
+			for bin := edges[m]; bin < edges[m+1]; bin++ {
+				energies[n][m] += power[bin]
+			}
+		}
+	}
+
+	fp := fingerprint{id: id, meta: defaultFingerprintMeta()}
+	for n := 1; n < len(energies); n++ {
+		var sfp sub_fingerprint
+		for m := 0; m < bits; m++ {
+			difference := energies[n][m] - energies[n][m+1] - (energies[n-1][m] - energies[n-1][m+1])
+			if difference > 0 {
+				sfp[m/BitsPerByte] |= 1 << uint(BitsPerByte-1-m%BitsPerByte)
+			}
+		}
+		fp.sfps = append(fp.sfps, sfp)
+	}
+
+	return fp
+}
+
+// The offset of the sub-fingerprint closest to a time in seconds.
+func offsetAtTime(seconds float64) int {
+	return int(math.Floor(seconds*ExtractionSampleRate/ExtractionFrameHop + 0.5))
+}
+
+// Lists the WAV files in a directory, in file name order.
+func listWAVFiles(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, file := range files {
+		if !file.IsDir() && strings.EqualFold(filepath.Ext(file.Name()), ".wav") {
+			paths = append(paths, filepath.Join(dir, file.Name()))
+		}
+	}
+
+	return paths, nil
+}
+
+// The ID of a fingerprint extracted from an audio file, being the file name
+// without the extension.
+func audioFileId(path string) string {
+	name := filepath.Base(path)
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// Extracts fingerprints from a directory of WAV files and writes them as a
+// length-delimited stream of index fingerprints, ready for the `build`
+// command. With the landmark algorithm, index landmark fingerprints are
+// written instead.
+func extractCommand(args []string) {
+	flags := flag.NewFlagSet("extract", flag.ExitOnError)
+	in := flags.String("in", "", "directory of 16-bit PCM WAV files")
+	out := flags.String("out", "", "path to write the stream of IndexFingerprints to")
+	algorithm := flags.String("algorithm", PhilipsAlgorithm, "fingerprint algorithm: "+fingerprintAlgorithmNames()+" or landmark")
+	flags.Parse(args)
+
+	if *in == "" || *out == "" {
+		log.Fatal("Both -in and -out must be provided")
+	}
+
+	var extract func(id string, audio pcm) (proto.Message, int)
+	unit := "sub-fingerprints"
+	if *algorithm == LandmarkAlgorithm {
+		unit = "landmarks"
+		extract = func(id string, audio pcm) (proto.Message, int) {
+			lfp := extractLandmarks(id, audio)
+			return newIndexLandmarkFingerprint(lfp), len(lfp.landmarks)
+		}
+	} else {
+		alg, err := newFingerprintAlgorithm(*algorithm)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		extract = func(id string, audio pcm) (proto.Message, int) {
+			fp := alg.extract(id, audio)
+			return newIndexFingerprint(alg, fp), len(fp.sfps)
+		}
+	}
+
+	paths, err := listWAVFiles(*in)
+	if err != nil {
+		log.Fatalf("Failed listing audio files: %s", err)
+	}
+
+	f, err := os.Create(*out)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w := bufio.NewWriter(f)
+
+	for i, path := range paths {
+		audio, err := readWAVFile(path)
+		if err != nil {
+			log.Fatalf("Failed reading %s: %s", path, err)
+		}
+
+		msg, size := extract(audioFileId(path), audio)
+		if err := writeDelimited(w, msg); err != nil {
+			log.Fatal(err)
+		}
+
+		log.Printf("Extracted %d %s from %s (%d/%d)", size, unit, path, i+1, len(paths))
+	}
+
+	if err := w.Flush(); err != nil {
+		log.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
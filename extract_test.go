@@ -0,0 +1,76 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// Audio with some structure over time, so that energy differences between
+// bands change from frame to frame.
+func randomTones(seed int64, sampleRate int, duration float64) pcm {
+	rng := rand.New(rand.NewSource(seed))
+	samples := make([]float64, int(float64(sampleRate)*duration))
+	noteLength := sampleRate / 8
+
+	var freqs []float64
+	for i := range samples {
+		if i%noteLength == 0 {
+			freqs = []float64{200 + rng.Float64()*1800, 200 + rng.Float64()*1800}
+		}
+
+		for _, freq := range freqs {
+			samples[i] += 0.3 * math.Sin(2.0*math.Pi*freq*float64(i)/float64(sampleRate))
+		}
+	}
+
+	return pcm{sampleRate, samples}
+}
+
+func TestExtractFingerprint(t *testing.T) {
+	for _, alg := range []fingerprint_algorithm{philips, philips64} {
+		testExtractFingerprint(t, alg)
+	}
+}
+
+func testExtractFingerprint(t *testing.T, alg fingerprint_algorithm) {
+	audio := randomTones(1, 11025, 10.0)
+	reference := alg.extract("0001", audio)
+
+	// frames of the resampled audio, less the first
+	expected := (10*ExtractionSampleRate-ExtractionFrameSize)/ExtractionFrameHop + 1 - 1
+	if math.Abs(float64(expected-len(reference.sfps))) > 1 {
+		t.Fatalf("[%s] Expected about %d sub-fingerprints but got %d", alg.name(), expected, len(reference.sfps))
+	}
+
+	// bits past the width of the algorithm are never set
+	for _, sfp := range reference.sfps {
+		for bit := alg.subFingerprintSizeBits(); bit < MaxSubFingerprintSizeBits; bit++ {
+			if bitAt(sfp, bit) {
+				t.Fatalf("[%s] Expected bit %d to be unset in %v", alg.name(), bit, sfp)
+			}
+		}
+	}
+
+	// a segment aligns with the reference at the offset of its start time
+	start := 4.0
+	query := alg.extract("query", audio.segment(start, 3.0))
+
+	referenceFpb, err := reference.extractFingerprintBlock(offsetAtTime(start), len(query.sfps))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queryFpb := fingerprint_block(query.sfps)
+	ber, _ := queryFpb.bitErrorRateWith(alg, referenceFpb)
+	if ber > 0.1 {
+		t.Errorf("[%s] Expected segment to match the reference with a low BER but was %f", alg.name(), ber)
+	}
+
+	// different audio does not
+	other := alg.extract("0002", randomTones(2, 11025, 3.0))
+	otherFpb := fingerprint_block(other.sfps[:len(query.sfps)])
+	if ber, _ := queryFpb.bitErrorRateWith(alg, otherFpb); ber < 0.35 {
+		t.Errorf("[%s] Expected different audio to have a high BER but was %f", alg.name(), ber)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import "math"
+
+// In-place, iterative radix-2 fast Fourier transform. The number of values
+// must be a power of two.
+func fft(x []complex128) {
+	n := len(x)
+
+	// bit-reversal permutation
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+
+	for size := 2; size <= n; size <<= 1 {
+		sin, cos := math.Sincos(-2.0 * math.Pi / float64(size))
+		step := complex(cos, sin)
+
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				even := x[start+k]
+				odd := w * x[start+k+size/2]
+				x[start+k] = even + odd
+				x[start+k+size/2] = even - odd
+				w *= step
+			}
+		}
+	}
+}
+
+// Coefficients of a Hann window of the given size.
+func hannWindow(size int) []float64 {
+	window := make([]float64, size)
+	for i := range window {
+		window[i] = 0.5 - 0.5*math.Cos(2.0*math.Pi*float64(i)/float64(size-1))
+	}
+
+	return window
+}
+
+// Power spectrum of each frame of the samples, taking frames of the given size
+// (a power of two) every `hop` samples and applying the window to each frame.
+// Only the first half of the spectrum, up to the Nyquist frequency, is kept.
+func powerSpectrogram(samples []float64, size int, hop int, window []float64) [][]float64 {
+	var spectrogram [][]float64
+	x := make([]complex128, size)
+
+	for start := 0; start+size <= len(samples); start += hop {
+		for i := range x {
+			x[i] = complex(samples[start+i]*window[i], 0)
+		}
+		fft(x)
+
+		power := make([]float64, size/2+1)
+		for i := range power {
+			re, im := real(x[i]), imag(x[i])
+			power[i] = re*re + im*im
+		}
+		spectrogram = append(spectrogram, power)
+	}
+
+	return spectrogram
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"math"
+	"math/cmplx"
+	"testing"
+)
+
+func TestFFT(t *testing.T) {
+	n := 64
+	x := make([]complex128, n)
+	for i := range x {
+		x[i] = complex(math.Cos(2.0*math.Pi*5.0*float64(i)/float64(n)), 0)
+	}
+
+	fft(x)
+
+	// a cosine at bin 5 puts half of its energy at bins 5 and n-5
+	for i, v := range x {
+		expected := 0.0
+		if i == 5 || i == n-5 {
+			expected = float64(n) / 2.0
+		}
+
+		if got := cmplx.Abs(v); math.Abs(expected-got) > 1e-9 {
+			t.Errorf("[%d] Expected magnitude %f but was %f", i, expected, got)
+		}
+	}
+}
+
+func TestPowerSpectrogram(t *testing.T) {
+	samples := make([]float64, 1024)
+	for i := range samples {
+		samples[i] = math.Sin(2.0 * math.Pi * 16.0 * float64(i) / 256.0)
+	}
+
+	spectrogram := powerSpectrogram(samples, 256, 128, hannWindow(256))
+	if expected, got := 7, len(spectrogram); expected != got {
+		t.Fatalf("Expected %d frames but got %d", expected, got)
+	}
+
+	for i, power := range spectrogram {
+		peak := 0
+		for bin := range power {
+			if power[bin] > power[peak] {
+				peak = bin
+			}
+		}
+
+		if peak != 16 {
+			t.Errorf("[%d] Expected peak at bin 16 but was at %d", i, peak)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+)
+
+const (
+	FieldParamPrefix       = "field."
+	IdPrefixParam          = "id_prefix"
+	FingerprintSetWordBits = 64
+)
+
+// A filter on the metadata of fingerprints, restricting a search to a subset
+// of the corpus such as a label, territory or batch of uploads. A fingerprint
+// passes when, for every key of the fields, it has the field with one of the
+// values, and when its ID starts with one of the ID prefixes, if there are
+// any. An empty filter passes every fingerprint.
+type fingerprint_filter struct {
+	fields     map[string][]string
+	idPrefixes []string
+}
+
+// Determines if the filter passes every fingerprint.
+func (f fingerprint_filter) empty() bool {
+	return len(f.fields) == 0 && len(f.idPrefixes) == 0
+}
+
+// Determines if the fingerprint passes the filter.
+func (f fingerprint_filter) matches(fp *fingerprint) bool {
+	for key, values := range f.fields {
+		value, found := fp.meta.fields[key]
+		if !found || !containsString(values, value) {
+			return false
+		}
+	}
+
+	if len(f.idPrefixes) == 0 {
+		return true
+	}
+	for _, prefix := range f.idPrefixes {
+		if strings.HasPrefix(fp.id, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsString(s []string, v string) bool {
+	for _, x := range s {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// A set of fingerprints as a bitset of their ordinals in the corpus, so that
+// checking a posting against a filter is a single bit test rather than a
+// lookup of its fields. A nil set contains every fingerprint.
+type fingerprint_set []uint64
+
+// Creates the set of fingerprints of the corpus passing the filter, or nil if
+// the filter is empty. The ordinals of the fingerprints must be their
+// positions in the corpus.
+func newFingerprintSet(corpus []*fingerprint, filter fingerprint_filter) fingerprint_set {
+	if filter.empty() {
+		return nil
+	}
+
+	set := make(fingerprint_set, (len(corpus)+FingerprintSetWordBits-1)/FingerprintSetWordBits)
+	for _, fp := range corpus {
+		if filter.matches(fp) {
+			set[fp.ordinal/FingerprintSetWordBits] |= 1 << uint(fp.ordinal%FingerprintSetWordBits)
+		}
+	}
+
+	return set
+}
+
+// Determines if the fingerprint is in the set.
+func (s fingerprint_set) contains(fp *fingerprint) bool {
+	if s == nil {
+		return true
+	}
+
+	i := fp.ordinal / FingerprintSetWordBits
+	return i < len(s) && s[i]&(1<<uint(fp.ordinal%FingerprintSetWordBits)) != 0
+}
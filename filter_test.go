@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestFingerprintSet(t *testing.T) {
+	corpus := make([]*fingerprint, 130)
+	for i := range corpus {
+		corpus[i] = &fingerprint{id: fmt.Sprintf("%04d", i), ordinal: i}
+		corpus[i].meta.fields = map[string]string{"label": fmt.Sprintf("L%d", i%3)}
+	}
+
+	fixtures := []struct {
+		filter   fingerprint_filter
+		expected int
+	}{
+		{fingerprint_filter{}, 130},
+		{fingerprint_filter{fields: map[string][]string{"label": {"L0"}}}, 44},
+		{fingerprint_filter{fields: map[string][]string{"label": {"L0", "L2"}}}, 87},
+		{fingerprint_filter{fields: map[string][]string{"label": {"L0"}, "territory": {"GB"}}}, 0},
+		{fingerprint_filter{idPrefixes: []string{"000", "0120"}}, 11},
+		{fingerprint_filter{fields: map[string][]string{"label": {"L1"}}, idPrefixes: []string{"000"}}, 3},
+	}
+
+	for i, fixture := range fixtures {
+		set := newFingerprintSet(corpus, fixture.filter)
+		if fixture.filter.empty() != (set == nil) {
+			t.Errorf("[%d] Expected a nil set only of an empty filter", i)
+		}
+
+		n := 0
+		for _, fp := range corpus {
+			if set.contains(fp) != fixture.filter.matches(fp) {
+				t.Errorf("[%d] Expected the set to contain %s only if it matches the filter", i, fp.id)
+			}
+			if set.contains(fp) {
+				n++
+			}
+		}
+
+		if fixture.expected != n {
+			t.Errorf("[%d] Expected %d fingerprints in the set but was %d", i, fixture.expected, n)
+		}
+	}
+
+	// fingerprints added after the set was made are not in it
+	set := newFingerprintSet(corpus, fixtures[1].filter)
+	if set.contains(&fingerprint{id: "0130", ordinal: 130}) {
+		t.Error("Expected a fingerprint beyond the set not to be in it")
+	}
+}
+
+func TestSearchBySubFingerprintInSet(t *testing.T) {
+	corpus := []fingerprint{
+		{"0001", []sub_fingerprint{{1, 2, 3, 4}, {5, 6, 7, 8}}, fingerprint_meta{}, 0},
+		{"0002", []sub_fingerprint{{5, 6, 7, 8}}, fingerprint_meta{}, 1},
+	}
+	idx := buildIndex(philips, corpus)
+	set := newFingerprintSet([]*fingerprint{&corpus[0], &corpus[1]}, fingerprint_filter{idPrefixes: []string{"0002"}})
+
+	if candidates := searchBySubFingerprint(sub_fingerprint{5, 6, 7, 8}, 0, idx, nil); len(candidates) != 2 {
+		t.Errorf("Expected 2 candidates without a set but was %d", len(candidates))
+	}
+
+	candidates := searchBySubFingerprint(sub_fingerprint{5, 6, 7, 8}, 0, idx, set)
+	if len(candidates) != 1 || candidates[0].fp != &corpus[1] {
+		t.Errorf("Expected only a candidate of 0002 but was %v", candidates)
+	}
+}
@@ -7,19 +7,56 @@ import (
 )
 
 const (
-	SubFingerprintSizeBytes = 4                                     // 32-bits
-	SubFingerprintSizeBits  = SubFingerprintSizeBytes * BitsPerByte // 32-bits
-	FingerprintBlockSize    = 256                                   // except during testing, so this is a hint
+	MaxSubFingerprintSizeBytes = 8                                        // 64-bits
+	MaxSubFingerprintSizeBits  = MaxSubFingerprintSizeBytes * BitsPerByte // 64-bits
+	FingerprintBlockSize       = 256                                      // except during testing, so this is a hint
 )
 
-type sub_fingerprint [SubFingerprintSizeBytes]byte
+// Large enough for the sub-fingerprints of any fingerprint algorithm, with the
+// bits past the width of the algorithm left as zero.
+type sub_fingerprint [MaxSubFingerprintSizeBytes]byte
 
 // size is determined at runtime (flexible to testing)
 type fingerprint_block []sub_fingerprint
 
 type fingerprint struct {
-	id   string
-	sfps []sub_fingerprint
+	id      string
+	sfps    []sub_fingerprint
+	meta    fingerprint_meta
+	ordinal int // position in the corpus of a served index, for sets of fingerprints
+}
+
+// Metadata of a fingerprint, with the duration between the start of
+// consecutive sub-fingerprints, the frame hop, in seconds and the sample rate
+// of the audio they were extracted from. When not known, these are zero and
+// taken to be those of the Philips defaults used by `extract`. Fields are
+// arbitrary metadata, such as title, artist and ISRC, returned with search
+// results so that they don't need looking up elsewhere, and are nil when there
+// are none.
+type fingerprint_meta struct {
+	frameHop   float64
+	sampleRate int
+	fields     map[string]string
+}
+
+// The metadata of fingerprints extracted with the Philips defaults, with a
+// frame hop of about 11.6 milliseconds.
+func defaultFingerprintMeta() fingerprint_meta {
+	return fingerprint_meta{float64(ExtractionFrameHop) / ExtractionSampleRate, ExtractionSampleRate, nil}
+}
+
+// The frame hop in seconds, or that of the Philips defaults when not known.
+func (m fingerprint_meta) frameHopSeconds() float64 {
+	if m.frameHop > 0 {
+		return m.frameHop
+	}
+	return defaultFingerprintMeta().frameHop
+}
+
+// The time in seconds of a position in sub-fingerprints, which may be negative
+// for alignments before the start of a fingerprint.
+func (m fingerprint_meta) seconds(position int) float64 {
+	return float64(position) * m.frameHopSeconds()
 }
 
 // Determines the bit-wise Hamming distance from the sub-fingerprint to any
@@ -39,7 +76,7 @@ func (left *sub_fingerprint) hammingDistanceTo(right sub_fingerprint) int {
 
 // Creates a copy of the sub-fingerprint and flips a single bit.
 func (sfp *sub_fingerprint) flipBit(i int) sub_fingerprint {
-	if i < 0 || i >= SubFingerprintSizeBits {
+	if i < 0 || i >= MaxSubFingerprintSizeBits {
 		log.Fatalf("Can not flip a bit in a position that does not exist: %d")
 	}
 
@@ -59,13 +96,14 @@ func (sfp *sub_fingerprint) flipBit(i int) sub_fingerprint {
 	return flipped
 }
 
-// For every bit of the sub-fingerprint, create a copy of the original and flip
-// a single bit. This produces a slice of sub-fingerprints that are all Hamming
-// distance of one (1) from the original sub-fingerprint.
-func (sfp *sub_fingerprint) flipAllBits() []sub_fingerprint {
-	flipped := make([]sub_fingerprint, SubFingerprintSizeBits)
+// For every bit of the sub-fingerprint within the width of the algorithm, create
+// a copy of the original and flip a single bit. This produces a slice of
+// sub-fingerprints that are all Hamming distance of one (1) from the original
+// sub-fingerprint.
+func (sfp *sub_fingerprint) flipAllBits(alg fingerprint_algorithm) []sub_fingerprint {
+	flipped := make([]sub_fingerprint, alg.subFingerprintSizeBits())
 
-	for i := 0; i < SubFingerprintSizeBits; i++ {
+	for i := range flipped {
 		flipped[i] = sfp.flipBit(i)
 	}
 
@@ -76,7 +114,7 @@ func (sfp *sub_fingerprint) flipAllBits() []sub_fingerprint {
 // equal to or less than a Hamming distance of `n`. Note that this is sequential
 // and the algorithm is O(bits^n) so this can be slow for larger values of `n`.
 // This algorithm could be optimised when necessary.
-func (sfp *sub_fingerprint) flipAllBitsUntil(n int) ([]sub_fingerprint, error) {
+func (sfp *sub_fingerprint) flipAllBitsUntil(alg fingerprint_algorithm, n int) ([]sub_fingerprint, error) {
 	if n < 1 {
 		err := fmt.Errorf("Target Hamming distance must be greater than or equal to 1: %d", n)
 		return make([]sub_fingerprint, 0), err
@@ -85,7 +123,7 @@ func (sfp *sub_fingerprint) flipAllBitsUntil(n int) ([]sub_fingerprint, error) {
 	set := make(
 		map[sub_fingerprint]bool,
 		int(math.Pow(
-			float64(SubFingerprintSizeBits),
+			float64(alg.subFingerprintSizeBits()),
 			float64(n),
 		)),
 	)
@@ -93,7 +131,7 @@ func (sfp *sub_fingerprint) flipAllBitsUntil(n int) ([]sub_fingerprint, error) {
 
 	for i := 1; i <= n; i++ {
 		for os, _ := range set {
-			for _, fs := range os.flipAllBits() {
+			for _, fs := range os.flipAllBits(alg) {
 				set[fs] = true
 			}
 		}
@@ -111,8 +149,8 @@ func (sfp *sub_fingerprint) flipAllBitsUntil(n int) ([]sub_fingerprint, error) {
 }
 
 // Calculates the bit error rate from the fingerprint block to any other
-// fingerprint block.
-func (left *fingerprint_block) bitErrorRateWith(right fingerprint_block) (float32, error) {
+// fingerprint block, using the distance and width of the algorithm.
+func (left *fingerprint_block) bitErrorRateWith(alg fingerprint_algorithm, right fingerprint_block) (float32, error) {
 	if len(*left) != len(right) {
 		err := fmt.Errorf(
 			"Fingerprint block to compare with was of size %d, but %d was expected",
@@ -124,10 +162,10 @@ func (left *fingerprint_block) bitErrorRateWith(right fingerprint_block) (float3
 
 	totalHammingDistance := 0
 	for i, leftSfp := range *left {
-		totalHammingDistance += leftSfp.hammingDistanceTo(right[i])
+		totalHammingDistance += alg.distance(leftSfp, right[i])
 	}
 
-	numBits := len(*left) * SubFingerprintSizeBits
+	numBits := len(*left) * alg.subFingerprintSizeBits()
 
 	return float32(totalHammingDistance) / float32(numBits), nil
 }
@@ -169,3 +207,43 @@ func (fp *fingerprint) extractFingerprintBlock(start int, size int) (fingerprint
 
 	return fpb, nil
 }
+
+// Extract the part of a fingerprint block that overlaps with the fingerprint,
+// given the starting position and the size of the block. Unlike
+// `extractFingerprintBlock`, the block may start before the beginning of the
+// fingerprint (a negative start) or run past the end of it, as happens when a
+// query straddles the start or end of a reference. The overlapping region of
+// the fingerprint is returned along with the position within the block at
+// which the overlap begins. If there is no overlap at all, an error is
+// returned instead.
+func (fp *fingerprint) extractOverlappingFingerprintBlock(start int, size int) (fingerprint_block, int, error) {
+	if size < 1 {
+		err := fmt.Errorf("Size must be greater than or equal to one: %d", size)
+		return nil, 0, err
+	}
+
+	end := start + size // end index is exclusive
+
+	if start >= len(fp.sfps) || end <= 0 {
+		err := fmt.Errorf(
+			"Block from start %d of size %d does not overlap the fingerprint of size %d",
+			start,
+			size,
+			len(fp.sfps),
+		)
+		return nil, 0, err
+	}
+
+	// clip the block to the bounds of the fingerprint
+	blockOffset := 0
+	if start < 0 {
+		blockOffset = -start
+		start = 0
+	}
+
+	if end > len(fp.sfps) {
+		end = len(fp.sfps)
+	}
+
+	return fp.sfps[start:end], blockOffset, nil
+}
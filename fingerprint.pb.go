@@ -0,0 +1,198 @@
+// The messages of fingerprint.proto, maintained by hand rather than generated,
+// in the form of the proto2 API of github.com/golang/protobuf. Any change to
+// fingerprint.proto must be made here too.
+
+package main
+
+import proto "github.com/golang/protobuf/proto"
+import math "math"
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = math.Inf
+
+type IndexFingerprint struct {
+	Id               *string                   `protobuf:"bytes,1,req,name=id" json:"id,omitempty"`
+	Size             *uint32                   `protobuf:"varint,2,req,name=size" json:"size,omitempty"`
+	Stream           []byte                    `protobuf:"bytes,3,req,name=stream" json:"stream,omitempty"`
+	FrameHop         *float64                  `protobuf:"fixed64,4,opt,name=frameHop" json:"frameHop,omitempty"`
+	SampleRate       *uint32                   `protobuf:"varint,5,opt,name=sampleRate" json:"sampleRate,omitempty"`
+	Fields           []*IndexFingerprint_Field `protobuf:"bytes,6,rep,name=fields" json:"fields,omitempty"`
+	XXX_unrecognized []byte                    `json:"-"`
+}
+
+func (m *IndexFingerprint) Reset()         { *m = IndexFingerprint{} }
+func (m *IndexFingerprint) String() string { return proto.CompactTextString(m) }
+func (*IndexFingerprint) ProtoMessage()    {}
+
+func (m *IndexFingerprint) GetId() string {
+	if m != nil && m.Id != nil {
+		return *m.Id
+	}
+	return ""
+}
+
+func (m *IndexFingerprint) GetSize() uint32 {
+	if m != nil && m.Size != nil {
+		return *m.Size
+	}
+	return 0
+}
+
+func (m *IndexFingerprint) GetStream() []byte {
+	if m != nil {
+		return m.Stream
+	}
+	return nil
+}
+
+func (m *IndexFingerprint) GetFrameHop() float64 {
+	if m != nil && m.FrameHop != nil {
+		return *m.FrameHop
+	}
+	return 0
+}
+
+func (m *IndexFingerprint) GetSampleRate() uint32 {
+	if m != nil && m.SampleRate != nil {
+		return *m.SampleRate
+	}
+	return 0
+}
+
+func (m *IndexFingerprint) GetFields() []*IndexFingerprint_Field {
+	if m != nil {
+		return m.Fields
+	}
+	return nil
+}
+
+type IndexFingerprint_Field struct {
+	Key              *string `protobuf:"bytes,1,req,name=key" json:"key,omitempty"`
+	Value            *string `protobuf:"bytes,2,req,name=value" json:"value,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *IndexFingerprint_Field) Reset()         { *m = IndexFingerprint_Field{} }
+func (m *IndexFingerprint_Field) String() string { return proto.CompactTextString(m) }
+func (*IndexFingerprint_Field) ProtoMessage()    {}
+
+func (m *IndexFingerprint_Field) GetKey() string {
+	if m != nil && m.Key != nil {
+		return *m.Key
+	}
+	return ""
+}
+
+func (m *IndexFingerprint_Field) GetValue() string {
+	if m != nil && m.Value != nil {
+		return *m.Value
+	}
+	return ""
+}
+
+type QueryFingerprint struct {
+	SubFingerprints  []*QueryFingerprint_QuerySubFingerprint `protobuf:"bytes,1,rep,name=subFingerprints" json:"subFingerprints,omitempty"`
+	Id               *string                                 `protobuf:"bytes,2,opt,name=id" json:"id,omitempty"`
+	XXX_unrecognized []byte                                  `json:"-"`
+}
+
+func (m *QueryFingerprint) Reset()         { *m = QueryFingerprint{} }
+func (m *QueryFingerprint) String() string { return proto.CompactTextString(m) }
+func (*QueryFingerprint) ProtoMessage()    {}
+
+func (m *QueryFingerprint) GetSubFingerprints() []*QueryFingerprint_QuerySubFingerprint {
+	if m != nil {
+		return m.SubFingerprints
+	}
+	return nil
+}
+
+func (m *QueryFingerprint) GetId() string {
+	if m != nil && m.Id != nil {
+		return *m.Id
+	}
+	return ""
+}
+
+type QueryFingerprint_QuerySubFingerprint struct {
+	Value               []byte   `protobuf:"bytes,1,req,name=value" json:"value,omitempty"`
+	MostSignificantBits []uint32 `protobuf:"varint,2,rep,packed,name=mostSignificantBits" json:"mostSignificantBits,omitempty"`
+	XXX_unrecognized    []byte   `json:"-"`
+}
+
+func (m *QueryFingerprint_QuerySubFingerprint) Reset() {
+	*m = QueryFingerprint_QuerySubFingerprint{}
+}
+func (m *QueryFingerprint_QuerySubFingerprint) String() string { return proto.CompactTextString(m) }
+func (*QueryFingerprint_QuerySubFingerprint) ProtoMessage()    {}
+
+func (m *QueryFingerprint_QuerySubFingerprint) GetValue() []byte {
+	if m != nil {
+		return m.Value
+	}
+	return nil
+}
+
+func (m *QueryFingerprint_QuerySubFingerprint) GetMostSignificantBits() []uint32 {
+	if m != nil {
+		return m.MostSignificantBits
+	}
+	return nil
+}
+
+type IndexLandmarkFingerprint struct {
+	Id               *string  `protobuf:"bytes,1,req,name=id" json:"id,omitempty"`
+	Hashes           []uint32 `protobuf:"fixed32,2,rep,packed,name=hashes" json:"hashes,omitempty"`
+	Times            []uint32 `protobuf:"varint,3,rep,packed,name=times" json:"times,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
+}
+
+func (m *IndexLandmarkFingerprint) Reset()         { *m = IndexLandmarkFingerprint{} }
+func (m *IndexLandmarkFingerprint) String() string { return proto.CompactTextString(m) }
+func (*IndexLandmarkFingerprint) ProtoMessage()    {}
+
+func (m *IndexLandmarkFingerprint) GetId() string {
+	if m != nil && m.Id != nil {
+		return *m.Id
+	}
+	return ""
+}
+
+func (m *IndexLandmarkFingerprint) GetHashes() []uint32 {
+	if m != nil {
+		return m.Hashes
+	}
+	return nil
+}
+
+func (m *IndexLandmarkFingerprint) GetTimes() []uint32 {
+	if m != nil {
+		return m.Times
+	}
+	return nil
+}
+
+type QueryLandmarkFingerprint struct {
+	Hashes           []uint32 `protobuf:"fixed32,1,rep,packed,name=hashes" json:"hashes,omitempty"`
+	Times            []uint32 `protobuf:"varint,2,rep,packed,name=times" json:"times,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
+}
+
+func (m *QueryLandmarkFingerprint) Reset()         { *m = QueryLandmarkFingerprint{} }
+func (m *QueryLandmarkFingerprint) String() string { return proto.CompactTextString(m) }
+func (*QueryLandmarkFingerprint) ProtoMessage()    {}
+
+func (m *QueryLandmarkFingerprint) GetHashes() []uint32 {
+	if m != nil {
+		return m.Hashes
+	}
+	return nil
+}
+
+func (m *QueryLandmarkFingerprint) GetTimes() []uint32 {
+	if m != nil {
+		return m.Times
+	}
+	return nil
+}
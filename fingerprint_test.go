@@ -54,7 +54,7 @@ func TestSubFingerprintFlipAllBits(t *testing.T) {
 		{2*8 + 5, sub_fingerprint{0, 0, 4, 0}}, // index 22; byte 2, index 5; 00000000 (0) -> 00000100 (4)
 	}
 
-	flipped := fixture.flipAllBits()
+	flipped := fixture.flipAllBits(philips)
 	for i, e := range expectations {
 		got := flipped[e.index]
 		if e.sfp != got {
@@ -63,6 +63,24 @@ func TestSubFingerprintFlipAllBits(t *testing.T) {
 	}
 }
 
+func TestSubFingerprintFlipAllBits64(t *testing.T) {
+	fixture := sub_fingerprint{}
+	flipped := fixture.flipAllBits(philips64)
+
+	if len(flipped) != 64 {
+		t.Fatalf("Expected 64 sub-fingerprints but got %d", len(flipped))
+	}
+
+	if expected := (sub_fingerprint{0, 0, 0, 0, 0, 0, 0, 1}); flipped[63] != expected {
+		t.Errorf("Expected %v but got %v", expected, flipped[63])
+	}
+
+	left := fingerprint_block{sub_fingerprint{}}
+	if ber, _ := left.bitErrorRateWith(philips64, fingerprint_block{flipped[63]}); ber != 1.0/64.0 {
+		t.Errorf("Expected BER of %f but got %f", 1.0/64.0, ber)
+	}
+}
+
 func TestFingerprintBlockBitErrorRateWith(t *testing.T) {
 
 	left := fingerprint_block{
@@ -97,7 +115,7 @@ func TestFingerprintBlockBitErrorRateWith(t *testing.T) {
 	}
 
 	for i, fixture := range fixtures {
-		got, err := left.bitErrorRateWith(fixture.right)
+		got, err := left.bitErrorRateWith(philips, fixture.right)
 		if err != nil {
 			t.Fatalf("[%d] BER failed when it should not have: %s", i, err)
 		}
@@ -118,6 +136,8 @@ func TestExtractFingerprintBlock(t *testing.T) {
 			sub_fingerprint{0, 0, 9, 0},
 			sub_fingerprint{1, 1, 0, 0},
 		},
+		fingerprint_meta{},
+		0,
 	}
 
 	fixtures := []struct {
@@ -162,3 +182,91 @@ func TestExtractFingerprintBlock(t *testing.T) {
 		}
 	}
 }
+
+func TestExtractOverlappingFingerprintBlock(t *testing.T) {
+
+	fp := fingerprint{
+		"0001",
+		[]sub_fingerprint{
+			sub_fingerprint{0, 0, 0, 0},
+			sub_fingerprint{0, 0, 1, 0},
+			sub_fingerprint{0, 0, 9, 0},
+			sub_fingerprint{1, 1, 0, 0},
+		},
+		fingerprint_meta{},
+		0,
+	}
+
+	fixtures := []struct {
+		start               int
+		size                int
+		expectedBlockOffset int
+		expected            fingerprint_block
+	}{
+		{
+			1,
+			2,
+			0,
+			fingerprint_block{
+				sub_fingerprint{0, 0, 1, 0},
+				sub_fingerprint{0, 0, 9, 0},
+			},
+		},
+		{
+			-2,
+			3,
+			2,
+			fingerprint_block{
+				sub_fingerprint{0, 0, 0, 0},
+			},
+		},
+		{
+			2,
+			4,
+			0,
+			fingerprint_block{
+				sub_fingerprint{0, 0, 9, 0},
+				sub_fingerprint{1, 1, 0, 0},
+			},
+		},
+		{
+			-1,
+			6,
+			1,
+			fingerprint_block{
+				sub_fingerprint{0, 0, 0, 0},
+				sub_fingerprint{0, 0, 1, 0},
+				sub_fingerprint{0, 0, 9, 0},
+				sub_fingerprint{1, 1, 0, 0},
+			},
+		},
+	}
+
+	for i, fixture := range fixtures {
+		got, blockOffset, err := fp.extractOverlappingFingerprintBlock(fixture.start, fixture.size)
+		if err != nil {
+			t.Fatalf("[%d] Extracting overlapping fingerprint block failed when it should not have: %s", i, err)
+		}
+
+		if fixture.expectedBlockOffset != blockOffset {
+			t.Errorf("[%d] Expected block offset %d but was %d", i, fixture.expectedBlockOffset, blockOffset)
+		}
+
+		if len(fixture.expected) != len(got) {
+			t.Fatalf("[%d] Expected fingerprint of size %d but was of size %d", i, len(fixture.expected), len(got))
+		}
+
+		for j, expected := range fixture.expected {
+			if expected != got[j] {
+				t.Errorf("[%d][%d] Expected sub-fingerprint %v but was %v", i, j, expected, got[j])
+			}
+		}
+	}
+
+	// blocks entirely outside of the fingerprint do not overlap
+	for i, start := range []int{-3, 4} {
+		if _, _, err := fp.extractOverlappingFingerprintBlock(start, 3); err == nil {
+			t.Errorf("[%d] Expected an error for a block that does not overlap from start %d", i, start)
+		}
+	}
+}
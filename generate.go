@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+)
+
+// Parameters of a synthetic corpus. Consecutive sub-fingerprints are
+// correlated, as in real fingerprints where frames overlap heavily, with each
+// bit keeping the value of the previous sub-fingerprint with the given
+// probability. Fractions of each fingerprint are silent or repeat earlier
+// segments of the same fingerprint, and a fraction of fingerprints share a
+// segment with an earlier fingerprint, as covers and samples do.
+// Sub-fingerprints are of the width of the algorithm.
+type corpus_params struct {
+	algorithm       fingerprint_algorithm
+	size            int
+	minLength       int
+	maxLength       int
+	correlation     float64
+	silenceFraction float64
+	repeatFraction  float64
+	sharedFraction  float64
+	segmentLength   int
+	sharedBer       float64
+	seed            int64
+}
+
+func defaultCorpusParams() corpus_params {
+	return corpus_params{
+		algorithm:       philips,
+		size:            1000,
+		minLength:       1500,  // about 17 seconds
+		maxLength:       30000, // about 6 minutes
+		correlation:     0.9,
+		silenceFraction: 0.02,
+		repeatFraction:  0.1,
+		sharedFraction:  0.05,
+		segmentLength:   FingerprintBlockSize,
+		sharedBer:       0.1,
+		seed:            1,
+	}
+}
+
+// Generates a deterministic synthetic corpus, the same for the same
+// parameters.
+func generateCorpus(p corpus_params) ([]fingerprint, error) {
+	if p.size < 0 || p.minLength < 1 || p.maxLength < p.minLength {
+		err := fmt.Errorf("Invalid corpus size %d or lengths from %d to %d", p.size, p.minLength, p.maxLength)
+		return nil, err
+	}
+
+	if p.segmentLength < 1 || p.segmentLength > p.minLength {
+		err := fmt.Errorf("Segment length must be between one and the minimum length %d: %d", p.minLength, p.segmentLength)
+		return nil, err
+	}
+
+	rng := rand.New(rand.NewSource(p.seed))
+	corpus := make([]fingerprint, p.size)
+
+	for i := range corpus {
+		length := p.minLength + rng.Intn(p.maxLength-p.minLength+1)
+		sfps := correlatedSubFingerprints(rng, p.algorithm.subFingerprintSizeBits(), length, p.correlation)
+		segments := float64(length) / float64(p.segmentLength)
+
+		// silence has no energy differences, so no bits set
+		for k := 0; k < int(p.silenceFraction*segments+0.5); k++ {
+			start := rng.Intn(length - p.segmentLength + 1)
+			for j := start; j < start+p.segmentLength; j++ {
+				sfps[j] = sub_fingerprint{}
+			}
+		}
+
+		// repeats of an earlier segment, such as a chorus
+		for k := 0; k < int(p.repeatFraction*segments+0.5); k++ {
+			from := rng.Intn(length - p.segmentLength + 1)
+			to := rng.Intn(length - p.segmentLength + 1)
+			copy(sfps[to:to+p.segmentLength], sfps[from:from+p.segmentLength])
+		}
+
+		// a segment shared with an earlier fingerprint, with some bit errors
+		if i > 0 && rng.Float64() < p.sharedFraction {
+			other := corpus[rng.Intn(i)].sfps
+			from := rng.Intn(len(other) - p.segmentLength + 1)
+			to := rng.Intn(length - p.segmentLength + 1)
+
+			shared, _ := uniformBitErrorDistortion(p.algorithm, p.sharedBer)(rng, other[from:from+p.segmentLength])
+			copy(sfps[to:to+p.segmentLength], shared)
+		}
+
+		corpus[i] = fingerprint{fmt.Sprintf("%08d", i), sfps, fingerprint_meta{}, 0}
+	}
+
+	return corpus, nil
+}
+
+// Generates sub-fingerprints of the given number of bits where each bit keeps
+// the value of the same bit of the previous sub-fingerprint with the given
+// probability, otherwise being random.
+func correlatedSubFingerprints(rng *rand.Rand, bits int, length int, correlation float64) []sub_fingerprint {
+	sfps := make([]sub_fingerprint, length)
+	for i := range sfps {
+		for bit := 0; bit < bits; bit++ {
+			set := rng.Intn(2) == 1
+			if i > 0 && rng.Float64() < correlation {
+				set = bitAt(sfps[i-1], bit)
+			}
+
+			if set {
+				sfps[i][bit/BitsPerByte] |= 1 << uint(BitsPerByte-1-bit%BitsPerByte)
+			}
+		}
+	}
+
+	return sfps
+}
+
+// Generates a synthetic corpus and writes it as a length-delimited stream of
+// index fingerprints, ready for the `build` command or for ingestion.
+func generateCommand(args []string) {
+	p := defaultCorpusParams()
+
+	flags := flag.NewFlagSet("generate", flag.ExitOnError)
+	out := flags.String("out", "", "path to write the stream of IndexFingerprints to")
+	algorithm := flags.String("algorithm", PhilipsAlgorithm, "fingerprint algorithm giving the width of sub-fingerprints: "+fingerprintAlgorithmNames())
+	flags.IntVar(&p.size, "n", p.size, "number of fingerprints")
+	flags.IntVar(&p.minLength, "length.min", p.minLength, "minimum number of sub-fingerprints in a fingerprint")
+	flags.IntVar(&p.maxLength, "length.max", p.maxLength, "maximum number of sub-fingerprints in a fingerprint")
+	flags.Float64Var(&p.correlation, "correlation", p.correlation, "probability of a bit keeping the value of the previous sub-fingerprint")
+	flags.Float64Var(&p.silenceFraction, "silence", p.silenceFraction, "fraction of each fingerprint that is silent")
+	flags.Float64Var(&p.repeatFraction, "repeat", p.repeatFraction, "fraction of each fingerprint repeating an earlier segment")
+	flags.Float64Var(&p.sharedFraction, "shared", p.sharedFraction, "fraction of fingerprints sharing a segment with another")
+	flags.IntVar(&p.segmentLength, "segment.length", p.segmentLength, "number of sub-fingerprints in silent, repeated and shared segments")
+	flags.Float64Var(&p.sharedBer, "shared.ber", p.sharedBer, "bit error rate of shared segments")
+	flags.Int64Var(&p.seed, "seed", p.seed, "seed of the random number generator")
+	flags.Parse(args)
+
+	if *out == "" {
+		log.Fatal("-out must be provided")
+	}
+
+	alg, err := newFingerprintAlgorithm(*algorithm)
+	if err != nil {
+		log.Fatal(err)
+	}
+	p.algorithm = alg
+
+	corpus, err := generateCorpus(p)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	f, err := os.Create(*out)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w := bufio.NewWriter(f)
+
+	for _, fp := range corpus {
+		if err := writeDelimited(w, newIndexFingerprint(alg, fp)); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		log.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Wrote %d fingerprints to: %s", len(corpus), *out)
+}
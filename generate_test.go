@@ -0,0 +1,97 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func testCorpusParams() corpus_params {
+	p := defaultCorpusParams()
+	p.size = 20
+	p.minLength = 200
+	p.maxLength = 400
+	p.segmentLength = 32
+	p.sharedFraction = 0.5
+	p.sharedBer = 0.0
+
+	return p
+}
+
+func TestGenerateCorpusIsDeterministic(t *testing.T) {
+	p := testCorpusParams()
+
+	first, err := generateCorpus(p)
+	if err != nil {
+		t.Fatalf("Generating corpus failed when it should not have: %s", err)
+	}
+	second, _ := generateCorpus(p)
+
+	if expected, got := p.size, len(first); expected != got {
+		t.Fatalf("Expected %d fingerprints but got %d", expected, got)
+	}
+
+	for i, fp := range first {
+		if l := len(fp.sfps); l < p.minLength || l > p.maxLength {
+			t.Errorf("[%d] Expected length between %d and %d but was %d", i, p.minLength, p.maxLength, l)
+		}
+
+		if fp.id != second[i].id || len(fp.sfps) != len(second[i].sfps) {
+			t.Fatalf("[%d] Expected the same fingerprint from the same seed", i)
+		}
+
+		for j := range fp.sfps {
+			if fp.sfps[j] != second[i].sfps[j] {
+				t.Fatalf("[%d][%d] Expected the same sub-fingerprint from the same seed", i, j)
+			}
+		}
+	}
+}
+
+func TestCorrelatedSubFingerprints(t *testing.T) {
+	sfps := correlatedSubFingerprints(rand.New(rand.NewSource(1)), 32, 10000, 0.8)
+
+	// bits differ when not kept and the random bit differs, half the time
+	different := 0
+	for i := 1; i < len(sfps); i++ {
+		different += sfps[i].hammingDistanceTo(sfps[i-1])
+	}
+
+	rate := float64(different) / float64((len(sfps)-1)*philips.subFingerprintSizeBits())
+	if rate < 0.09 || rate > 0.11 {
+		t.Errorf("Expected about 10%% of bits to change between sub-fingerprints but was %f", rate)
+	}
+}
+
+func TestGenerateCorpusSharesSegments(t *testing.T) {
+	p := testCorpusParams()
+	p.silenceFraction = 0.0
+
+	corpus, _ := generateCorpus(p)
+	idx := buildIndex(philips, corpus)
+
+	// some fingerprints share a whole segment with another
+	shared := 0
+	for i := range corpus {
+		queryFp := fingerprint{"query", corpus[i].sfps, fingerprint_meta{}, 0}
+		candidates, err := searchByFingerprint(philips, queryFp, p.segmentLength, p.segmentLength, nil, 0.0, 1.0, false, idx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, c := range candidates {
+			if c.fp.id != corpus[i].id {
+				shared++
+				break
+			}
+		}
+	}
+
+	if shared == 0 {
+		t.Errorf("Expected some fingerprints to share segments with others")
+	}
+
+	p.segmentLength = p.minLength + 1
+	if _, err := generateCorpus(p); err == nil {
+		t.Errorf("Expected an error for segments longer than the minimum length")
+	}
+}
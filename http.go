@@ -1,5 +1,28 @@
 package main
 
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"github.com/gorilla/pat"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	DefaultBulkIndexBatchSize = 1000
+)
+
 func handlerFuncWith(stages ...func(w *http.ResponseWriter, r *http.Request) error) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		for _, f := range stages {
@@ -12,6 +35,879 @@ func handlerFuncWith(stages ...func(w *http.ResponseWriter, r *http.Request) err
 
 func statsHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		responseWriter.Write([]byte(`OK`))
+		w.Write([]byte(`OK`))
+	}
+}
+
+// Routes the HTTP API of the default index and of the named indexes of the
+// registry. Routes match by prefix, so more specific routes come first, and
+// each handles only the whole path of its route. Landmark indexes only support
+// adding, getting and searching single fingerprints.
+func newRouter(s *index_server, reg *index_registry) *pat.Router {
+	r := pat.New()
+	get := func(route string, handler http.HandlerFunc) {
+		r.Get(route, wholePathHandler(route, handler))
+	}
+	post := func(route string, handler http.HandlerFunc) {
+		r.Post(route, wholePathHandler(route, handler))
+	}
+
+	fingerprint := algorithmHandler(fingerprintHandler, landmarkFingerprintHandler)
+	bulkIndex := algorithmHandler(bulkIndexHandler, nil)
+	index := algorithmHandler(indexHandler, landmarkIndexHandler)
+	batchSearch := algorithmHandler(batchSearchHandler, nil)
+	search := algorithmHandler(searchHandler, landmarkSearchHandler)
+	monitor := algorithmHandler(monitorHandler, nil)
+
+	// named indexes
+	get("/indexes/{name}/index/{id}", namedIndexHandler(reg, fingerprint))
+	post("/indexes/{name}/index/bulk", namedIndexHandler(reg, bulkIndex))
+	post("/indexes/{name}/index", namedIndexHandler(reg, index))
+	post("/indexes/{name}/search/batch", namedIndexHandler(reg, batchSearch))
+	post("/indexes/{name}/search", namedIndexHandler(reg, search))
+	post("/indexes/{name}/monitor", namedIndexHandler(reg, monitor))
+	get("/indexes/{name}/-/stats", namedIndexHandler(reg, indexStatsHandler))
+	post("/indexes/{name}", createIndexHandler(reg))
+	r.Delete("/indexes/{name}", wholePathHandler("/indexes/{name}", deleteIndexHandler(reg)))
+	get("/indexes", listIndexesHandler(reg))
+
+	// default index
+	get("/index/{id}", fingerprint(s))
+	post("/index/bulk", bulkIndex(s))
+	post("/index", index(s))
+	post("/search/batch", batchSearch(s))
+	post("/search", search(s))
+	post("/monitor", monitor(s))
+	get("/-/stats", statsHandler())
+
+	return r
+}
+
+// Handles only requests of the whole path of the route, with its variables,
+// responding that any longer path is not found. Routes otherwise match by
+// prefix, so that, for example, deleting a fingerprint of an index would
+// delete the index.
+func wholePathHandler(route string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := route
+		for key, values := range r.URL.Query() {
+			if strings.HasPrefix(key, ":") {
+				path = strings.Replace(path, "{"+key[1:]+"}", values[0], 1)
+			}
+		}
+
+		if r.URL.Path != path {
+			http.NotFound(w, r)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// Handles a request to an index with the handler of its kind of fingerprints,
+// being the landmark handler for a landmark index, or responds that the
+// request is not supported when there is no handler of its kind.
+func algorithmHandler(
+	handler func(s *index_server) http.HandlerFunc,
+	landmarkHandler func(s *index_server) http.HandlerFunc) func(s *index_server) http.HandlerFunc {
+
+	return func(s *index_server) http.HandlerFunc {
+		switch {
+		case s.landmarks == nil:
+			return handler(s)
+		case landmarkHandler != nil:
+			return landmarkHandler(s)
+		}
+
+		return func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, fmt.Sprintf("Not supported by indexes of the %s algorithm", LandmarkAlgorithm), http.StatusBadRequest)
+		}
+	}
+}
+
+// Statistics of an index, with its search defaults by the names of the
+// parameters. Landmark indexes count distinct hashes rather than
+// sub-fingerprints.
+type index_stats_report struct {
+	Name            string            `json:"name,omitempty"`
+	Algorithm       string            `json:"algorithm"`
+	Fingerprints    int               `json:"fingerprints"`
+	SubFingerprints int               `json:"sub_fingerprints"`
+	Hashes          int               `json:"hashes,omitempty"`
+	Defaults        map[string]string `json:"defaults"`
+}
+
+func newIndexStatsReport(s *index_server) index_stats_report {
+	fingerprints, keys := s.size()
+	if s.landmarks != nil {
+		return index_stats_report{s.name, LandmarkAlgorithm, fingerprints, 0, keys, s.landmarks.flagValues()}
+	}
+	return index_stats_report{s.name, s.alg.name(), fingerprints, keys, 0, s.params.flagValues()}
+}
+
+// Responds with the statistics of an index.
+func indexStatsHandler(s *index_server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, newIndexStatsReport(s))
+	}
+}
+
+// Handles a request to a named index of the registry with the handler of that
+// index, or responds that there is no such index.
+func namedIndexHandler(reg *index_registry, handler func(s *index_server) http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get(":name")
+		s, found := reg.get(name)
+		if !found {
+			http.Error(w, fmt.Sprintf("Index not found: %s", name), http.StatusNotFound)
+			return
+		}
+
+		handler(s)(w, r)
+	}
+}
+
+// Creates an empty named index, with the `algorithm` and any search parameters
+// given in the URL query as its defaults, responding with its statistics. An
+// index of the same name already existing is a conflict.
+func createIndexHandler(reg *index_registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get(":name")
+		config := index_config{PhilipsAlgorithm, make(map[string]string)}
+		for key, values := range r.URL.Query() {
+			switch {
+			case strings.HasPrefix(key, ":"): // variables of the route
+			case key == "algorithm":
+				config.Algorithm = values[len(values)-1]
+			default:
+				config.Defaults[key] = values[len(values)-1]
+			}
+		}
+
+		s, created, err := reg.create(name, config)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !created {
+			http.Error(w, fmt.Sprintf("Index already exists: %s", name), http.StatusConflict)
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, newIndexStatsReport(s))
+	}
+}
+
+// Deletes a named index, along with everything persisted of it.
+func deleteIndexHandler(reg *index_registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get(":name")
+		deleted, err := reg.delete(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !deleted {
+			http.Error(w, fmt.Sprintf("Index not found: %s", name), http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Responds with the statistics of every named index, in name order.
+func listIndexesHandler(reg *index_registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		reports := make([]index_stats_report, 0)
+		for _, name := range reg.names() {
+			if s, found := reg.get(name); found {
+				reports = append(reports, newIndexStatsReport(s))
+			}
+		}
+
+		writeJSON(w, http.StatusOK, reports)
+	}
+}
+
+// Details of an indexed fingerprint, as returned when it is added and by
+// `GET /index/{id}`.
+type fingerprint_report struct {
+	Id         string            `json:"id"`
+	Length     int               `json:"length"`
+	Duration   float64           `json:"duration_seconds"`
+	FrameHop   float64           `json:"frame_hop_seconds"`
+	SampleRate int               `json:"sample_rate,omitempty"`
+	Fields     map[string]string `json:"fields,omitempty"`
+}
+
+func newFingerprintReport(fp *fingerprint) fingerprint_report {
+	return fingerprint_report{
+		fp.id,
+		len(fp.sfps),
+		fp.meta.seconds(len(fp.sfps)),
+		fp.meta.frameHopSeconds(),
+		fp.meta.sampleRate,
+		fp.meta.fields,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed writing response: %s", err)
+	}
+}
+
+// Adds a fingerprint to the index, from a POST body of a single
+// `IndexFingerprint` with any metadata fields, responding with its details.
+// IDs must be unique, so adding a fingerprint of an ID already indexed is a
+// conflict.
+func indexHandler(s *index_server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		buf, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ifp := &IndexFingerprint{}
+		if err := proto.Unmarshal(buf, ifp); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid IndexFingerprint: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		fp, err := newFingerprintFromIndexFingerprint(s.alg, ifp)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		added, err := s.add(fp)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !added {
+			http.Error(w, fmt.Sprintf("Fingerprint is already indexed: %s", fp.id), http.StatusConflict)
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, newFingerprintReport(&fp))
+	}
+}
+
+// Details of an indexed landmark fingerprint, as returned when it is added to
+// a landmark index and by `GET /index/{id}`.
+type landmark_fingerprint_report struct {
+	Id        string `json:"id"`
+	Landmarks int    `json:"landmarks"`
+}
+
+// Adds a landmark fingerprint to a landmark index, from a POST body of a
+// single `IndexLandmarkFingerprint`, as `indexHandler` does.
+func landmarkIndexHandler(s *index_server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		buf, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ilfp := &IndexLandmarkFingerprint{}
+		if err := proto.Unmarshal(buf, ilfp); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid IndexLandmarkFingerprint: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		lfp, err := newLandmarkFingerprintFromIndexLandmarkFingerprint(ilfp)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		added, err := s.addLandmarks(lfp)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !added {
+			http.Error(w, fmt.Sprintf("Fingerprint is already indexed: %s", lfp.id), http.StatusConflict)
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, landmark_fingerprint_report{lfp.id, len(lfp.landmarks)})
 	}
 }
+
+// The outcome of a single fingerprint of `/index/bulk`, as a line of the
+// response, with the position of the fingerprint in the request and why it
+// was not added, if it wasn't.
+type bulk_index_result struct {
+	Position int    `json:"position"`
+	Id       string `json:"id,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+type bulk_index_results_by_position []bulk_index_result
+
+func (s bulk_index_results_by_position) Len() int           { return len(s) }
+func (s bulk_index_results_by_position) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s bulk_index_results_by_position) Less(i, j int) bool { return s[i].Position < s[j].Position }
+
+// The summary of `/index/bulk`, as the last line of the response, with why
+// the request stopped being read, if it did before the end.
+type bulk_index_summary struct {
+	Added  int    `json:"added"`
+	Failed int    `json:"failed"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Adds many fingerprints to the index from a single request, a
+// length-delimited stream of `IndexFingerprint` messages, gzip compressed if
+// the request has a `Content-Encoding` of `gzip`. Fingerprints are added in
+// batches of `batch.size` as they are read, so the request is never held in
+// memory as a whole, and the outcome of each is written once its batch is
+// added, one JSON object per line in the order of the request. A fingerprint
+// that can't be added, such as one of an ID already indexed, is reported on
+// its line without failing the others. The last line is the summary, and the
+// request stops being read if the stream itself can't be read.
+func bulkIndexHandler(s *index_server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		batchSize := DefaultBulkIndexBatchSize
+		flags := flag.NewFlagSet("request", flag.ContinueOnError)
+		flags.IntVar(&batchSize, "batch.size", batchSize, "")
+		for name, vs := range r.URL.Query() {
+			if strings.HasPrefix(name, ":") { // variables of the route
+				continue
+			}
+			if flags.Lookup(name) == nil {
+				http.Error(w, fmt.Sprintf("Unknown parameter: %s", name), http.StatusBadRequest)
+				return
+			}
+			if err := flags.Set(name, vs[len(vs)-1]); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid parameter %s: %s", name, err), http.StatusBadRequest)
+				return
+			}
+		}
+
+		if batchSize < 1 {
+			http.Error(w, fmt.Sprintf("Batch size must be greater than or equal to one: %d", batchSize), http.StatusBadRequest)
+			return
+		}
+
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid gzip body: %s", err), http.StatusBadRequest)
+				return
+			}
+			defer gz.Close()
+			body = gz
+		}
+
+		enableFullDuplex(w)
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+
+		encoder := json.NewEncoder(w)
+		flusher, _ := w.(http.Flusher)
+		var summary bulk_index_summary
+
+		// fingerprints that failed before being batched are reported along
+		// with the batch, in the order of the request
+		var results []bulk_index_result
+		var batch []fingerprint
+		var positions []int
+		flush := func() error {
+			if len(batch) > 0 {
+				for i, err := range s.addBatch(batch) {
+					result := bulk_index_result{Position: positions[i], Id: batch[i].id}
+					if err != nil {
+						result.Error = err.Error()
+					}
+					results = append(results, result)
+				}
+			}
+			batch, positions = nil, nil
+
+			sort.Sort(bulk_index_results_by_position(results))
+			for _, result := range results {
+				if result.Error == "" {
+					summary.Added++
+				} else {
+					summary.Failed++
+				}
+				if err := encoder.Encode(result); err != nil {
+					return err
+				}
+			}
+			results = nil
+
+			if flusher != nil {
+				flusher.Flush()
+			}
+			return nil
+		}
+
+		reader := bufio.NewReader(body)
+		for position := 0; ; position++ {
+			buf, err := readDelimitedBytes(reader)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				summary.Error = fmt.Sprintf("Failed reading fingerprint %d: %s", position, err)
+				break
+			}
+
+			ifp := &IndexFingerprint{}
+			if err := proto.Unmarshal(buf, ifp); err != nil {
+				results = append(results, bulk_index_result{position, "", fmt.Sprintf("Invalid IndexFingerprint: %s", err)})
+			} else if fp, err := newFingerprintFromIndexFingerprint(s.alg, ifp); err != nil {
+				results = append(results, bulk_index_result{position, ifp.GetId(), err.Error()})
+			} else {
+				batch = append(batch, fp)
+				positions = append(positions, position)
+			}
+
+			if len(batch)+len(results) >= batchSize {
+				if err := flush(); err != nil {
+					log.Printf("Failed writing bulk index result: %s", err)
+					return
+				}
+			}
+		}
+
+		if err := flush(); err != nil {
+			log.Printf("Failed writing bulk index result: %s", err)
+			return
+		}
+
+		encoder.Encode(struct {
+			Summary bulk_index_summary `json:"summary"`
+		}{summary})
+	}
+}
+
+// Responds with the details of an indexed fingerprint: its metadata, length
+// and duration.
+func fingerprintHandler(s *index_server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Query().Get(":id")
+		fp, found := s.get(id)
+		if !found {
+			http.Error(w, fmt.Sprintf("Fingerprint not found: %s", id), http.StatusNotFound)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, newFingerprintReport(fp))
+	}
+}
+
+// Responds with the details of an indexed landmark fingerprint of a landmark
+// index.
+func landmarkFingerprintHandler(s *index_server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Query().Get(":id")
+		lfp, found := s.getLandmarks(id)
+		if !found {
+			http.Error(w, fmt.Sprintf("Fingerprint not found: %s", id), http.StatusNotFound)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, landmark_fingerprint_report{lfp.id, len(lfp.landmarks)})
+	}
+}
+
+// Searches the index with a POST body of a single `QueryFingerprint`,
+// responding with the same report as the `query` command, where matches and
+// segments carry the metadata fields of their reference. Search parameters,
+// `limit` and `timeline.max_drift` can be given in the URL query, along with
+// a filter restricting the search to a subset of the index.
+func searchHandler(s *index_server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var limit, maxDrift int
+		params, filter, err := searchParamsFromQuery(s.params, r.URL.Query(), func(flags *flag.FlagSet) {
+			registerReportFlags(flags, &limit, &maxDrift)
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		buf, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		qfp := &QueryFingerprint{}
+		if err := proto.Unmarshal(buf, qfp); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid QueryFingerprint: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		id := qfp.GetId()
+		if id == "" {
+			id = "query"
+		}
+
+		queryFp, err := newFingerprintFromQueryFingerprint(s.alg, id, qfp)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		s.mutex.RLock()
+		generator, err := s.generator(params, filter)
+		s.mutex.RUnlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		report, err := s.query(params, generator, queryFp, limit, maxDrift)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, report)
+	}
+}
+
+// Registers the parameters of the report of a search, as in the URL query.
+func registerReportFlags(flags *flag.FlagSet, limit *int, maxDrift *int) {
+	flags.IntVar(limit, "limit", 10, "")
+	flags.IntVar(maxDrift, "timeline.max_drift", DefaultTimelineMaxDrift, "")
+}
+
+// Registers the search parameters of a landmark index, defaulting to the
+// values they point to, as in the URL query and the config of the index.
+func registerLandmarkFlags(flags *flag.FlagSet, minCount *int) {
+	flags.IntVar(minCount, "min_count", *minCount, "")
+}
+
+// Searches a landmark index with a POST body of a single
+// `QueryLandmarkFingerprint`, responding with the same report as the `query`
+// command of a landmark index. The `limit` and `min_count` can be given in
+// the URL query, and any other parameter is an error.
+func landmarkSearchHandler(s *index_server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := 10
+		minCount := s.landmarks.minCount
+		flags := flag.NewFlagSet("request", flag.ContinueOnError)
+		flags.IntVar(&limit, "limit", limit, "")
+		registerLandmarkFlags(flags, &minCount)
+		for name, vs := range r.URL.Query() {
+			if strings.HasPrefix(name, ":") { // variables of the route
+				continue
+			}
+			if flags.Lookup(name) == nil {
+				http.Error(w, fmt.Sprintf("Unknown parameter: %s", name), http.StatusBadRequest)
+				return
+			}
+			if err := flags.Set(name, vs[len(vs)-1]); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid parameter %s: %s", name, err), http.StatusBadRequest)
+				return
+			}
+		}
+
+		buf, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		qlfp := &QueryLandmarkFingerprint{}
+		if err := proto.Unmarshal(buf, qlfp); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid QueryLandmarkFingerprint: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		query, err := newLandmarkFingerprintFromQueryLandmarkFingerprint("query", qlfp)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		report, err := s.queryLandmarks(query, minCount, limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, report)
+	}
+}
+
+// The result of a single query of `/search/batch`, as a line of the response,
+// with the report of the query or why it failed. The position is of the query
+// in the request, and the ID is that of the query, if it was given one.
+type batch_search_result struct {
+	Position int           `json:"position"`
+	Id       string        `json:"id,omitempty"`
+	Report   *query_report `json:"report,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// Searches the index with many queries in a single request, a length-delimited
+// stream of `QueryFingerprint` messages, each with an ID of its own. Queries
+// are searched in parallel, up to `parallelism` at a time, as they are read,
+// and the result of each is written as it completes, one JSON object per line
+// and so not in the order of the request. A query that fails is reported on
+// its line without failing the others. If the stream itself can not be read,
+// the last line is an error with a position of -1. Parameters are the same as
+// for `/search`, and apply to every query.
+func batchSearchHandler(s *index_server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var limit, maxDrift int
+		parallelism := runtime.NumCPU()
+		params, filter, err := searchParamsFromQuery(s.params, r.URL.Query(), func(flags *flag.FlagSet) {
+			registerReportFlags(flags, &limit, &maxDrift)
+			flags.IntVar(&parallelism, "parallelism", parallelism, "")
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if parallelism < 1 || parallelism > runtime.NumCPU() {
+			http.Error(w, fmt.Sprintf("Parallelism must be between one and %d: %d", runtime.NumCPU(), parallelism), http.StatusBadRequest)
+			return
+		}
+
+		s.mutex.RLock()
+		generator, err := s.generator(params, filter)
+		s.mutex.RUnlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		type batch_query struct {
+			position int
+			qfp      *QueryFingerprint
+		}
+
+		queries := make(chan batch_query)
+		results := make(chan batch_search_result)
+		var workers sync.WaitGroup
+		for i := 0; i < parallelism; i++ {
+			workers.Add(1)
+			go func() {
+				defer workers.Done()
+				for q := range queries {
+					result := batch_search_result{Position: q.position, Id: q.qfp.GetId()}
+					queryFp, err := newFingerprintFromQueryFingerprint(s.alg, result.Id, q.qfp)
+					if err == nil {
+						var report query_report
+						report, err = s.query(params, generator, queryFp, limit, maxDrift)
+						result.Report = &report
+					}
+					if err != nil {
+						result.Report, result.Error = nil, err.Error()
+					}
+					results <- result
+				}
+			}()
+		}
+
+		// read queries as the results of earlier ones are written
+		var readErr error
+		go func() {
+			body := bufio.NewReader(r.Body)
+			for position := 0; ; position++ {
+				qfp := &QueryFingerprint{}
+				if err := readDelimited(body, qfp); err != nil {
+					if err != io.EOF {
+						readErr = fmt.Errorf("Failed reading query %d: %s", position, err)
+					}
+					break
+				}
+				queries <- batch_query{position, qfp}
+			}
+			close(queries)
+			workers.Wait()
+			close(results)
+		}()
+
+		enableFullDuplex(w)
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+
+		encoder := json.NewEncoder(w)
+		flusher, _ := w.(http.Flusher)
+		failed := false
+		for result := range results {
+			if failed {
+				continue
+			}
+			if err := encoder.Encode(result); err != nil {
+				log.Printf("Failed writing batch search result: %s", err)
+				failed = true
+				continue
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+
+		if readErr != nil && !failed {
+			encoder.Encode(batch_search_result{Position: -1, Error: readErr.Error()})
+		}
+	}
+}
+
+// Allows the request body to be read after the response has started, as
+// streamed responses do, rather than it being discarded when the response
+// headers are written. Responses that don't support it are left as they are.
+func enableFullDuplex(w http.ResponseWriter) {
+	http.NewResponseController(w).EnableFullDuplex()
+}
+
+// Monitors a continuous stream sent as a chunked HTTP POST body, a
+// length-delimited stream of query fingerprints each holding the next
+// sub-fingerprints of the stream. Events are written as they happen, one JSON
+// object per line, and when the body ends any references still matching
+// stop. Search parameters, `stop_after` and a filter can be given in the URL
+// query, as for `/search`. The stream is searched with the index as it is when
+// each chunk arrives, so that references added while monitoring are found.
+func monitorHandler(s *index_server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stopAfter := DefaultMonitorStopAfter
+		params, filter, err := searchParamsFromQuery(s.params, r.URL.Query(), func(flags *flag.FlagSet) {
+			flags.IntVar(&stopAfter, "stop_after", stopAfter, "")
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		s.mutex.RLock()
+		generator, err := s.generator(params, filter)
+		indexed := len(s.fingerprints)
+		s.mutex.RUnlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		monitor, err := newStreamMonitorWith(params, generator, stopAfter)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		enableFullDuplex(w)
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+
+		encoder := json.NewEncoder(w)
+		write := func(events []monitor_event) error {
+			for _, event := range events {
+				if err := encoder.Encode(event); err != nil {
+					return err
+				}
+			}
+			if flusher, ok := w.(http.Flusher); ok {
+				flusher.Flush()
+			}
+			return nil
+		}
+
+		body := bufio.NewReader(r.Body)
+		for {
+			qfp := &QueryFingerprint{}
+			if err := readDelimited(body, qfp); err == io.EOF {
+				break
+			} else if err != nil {
+				log.Printf("Failed reading monitored stream: %s", err)
+				return
+			}
+
+			chunk, err := newFingerprintFromQueryFingerprint(s.alg, "stream", qfp)
+			if err != nil {
+				log.Printf("Failed reading monitored stream: %s", err)
+				return
+			}
+
+			// fingerprints are only ever added, so the generator is created
+			// again once there are more, including them in the filter
+			s.mutex.RLock()
+			if len(s.fingerprints) != indexed {
+				monitor.generator, err = s.generator(params, filter)
+				indexed = len(s.fingerprints)
+			}
+			var events []monitor_event
+			if err == nil {
+				events, err = monitor.push(chunk.sfps)
+			}
+			s.mutex.RUnlock()
+			if err == nil {
+				err = write(events)
+			}
+			if err != nil {
+				log.Printf("Failed monitoring stream: %s", err)
+				return
+			}
+		}
+
+		if err := write(monitor.close()); err != nil {
+			log.Printf("Failed monitoring stream: %s", err)
+		}
+	}
+}
+
+// Parses search parameters from a URL query, named the same as the command
+// line flags and defaulting to the given parameters, along with a filter on
+// fingerprints. The filter is of fields given as `field.<key>=<value>`, where
+// a key given more than once is any of its values, and of ID prefixes given as
+// `id_prefix=<prefix>`, any of which may match. Other parameters of a request
+// can be registered with `register`, and any unknown parameter is an error.
+func searchParamsFromQuery(
+	defaults search_params,
+	values url.Values,
+	register func(flags *flag.FlagSet)) (search_params, fingerprint_filter, error) {
+
+	params := defaults
+	flags := flag.NewFlagSet("request", flag.ContinueOnError)
+	params.registerFlags(flags)
+	if register != nil {
+		register(flags)
+	}
+
+	filter := fingerprint_filter{fields: make(map[string][]string)}
+	for name, vs := range values {
+		// variables of the route
+		if strings.HasPrefix(name, ":") {
+			continue
+		}
+
+		if strings.HasPrefix(name, FieldParamPrefix) {
+			key := strings.TrimPrefix(name, FieldParamPrefix)
+			filter.fields[key] = append(filter.fields[key], vs...)
+			continue
+		}
+
+		if name == IdPrefixParam {
+			filter.idPrefixes = append(filter.idPrefixes, vs...)
+			continue
+		}
+
+		if flags.Lookup(name) == nil {
+			return params, filter, fmt.Errorf("Unknown parameter: %s", name)
+		}
+		for _, v := range vs {
+			if err := flags.Set(name, v); err != nil {
+				return params, filter, fmt.Errorf("Invalid parameter %s: %s", name, err)
+			}
+		}
+	}
+
+	return params, filter, nil
+}
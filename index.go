@@ -1,5 +1,7 @@
 package main
 
+import "fmt"
+
 type posting struct {
 	fp     *fingerprint
 	offset int
@@ -7,28 +9,183 @@ type posting struct {
 
 type posting_list []posting
 
-type index map[sub_fingerprint]posting_list
+// The sub-fingerprints of algorithms of up to 32 bits, being the bytes of a
+// `sub_fingerprint` within the width of the algorithm.
+type sub_fingerprint32 [4]byte
+
+func (sfp sub_fingerprint) narrow() sub_fingerprint32 {
+	var n sub_fingerprint32
+	copy(n[:], sfp[:])
+	return n
+}
+
+func (n sub_fingerprint32) widen() sub_fingerprint {
+	var sfp sub_fingerprint
+	copy(sfp[:], n[:])
+	return sfp
+}
+
+// An inverted index from sub-fingerprints to their postings. The keys are of
+// the width of the algorithm the index is built for, so that an index of 32-bit
+// sub-fingerprints takes no more memory than one of a 32-bit key, with only
+// one of the maps used. An index may also have the LSH tables of blocks of its
+// fingerprints, which are updated along with it.
+type index struct {
+	width  int
+	narrow map[sub_fingerprint32]posting_list
+	wide   map[sub_fingerprint]posting_list
+	lsh    *lsh_index
+}
+
+// Creates an empty index of the sub-fingerprints of the algorithm.
+func newIndex(alg fingerprint_algorithm) index {
+	idx := index{width: alg.subFingerprintSizeBits()}
+	if idx.isNarrow() {
+		idx.narrow = make(map[sub_fingerprint32]posting_list)
+	} else {
+		idx.wide = make(map[sub_fingerprint]posting_list)
+	}
+
+	return idx
+}
+
+func (idx index) isNarrow() bool {
+	return idx.width <= len(sub_fingerprint32{})*BitsPerByte
+}
+
+// The number of distinct sub-fingerprints in the index.
+func (idx index) size() int {
+	if idx.isNarrow() {
+		return len(idx.narrow)
+	}
+	return len(idx.wide)
+}
+
+// Finds the posting list of a sub-fingerprint.
+func (idx index) postings(sfp sub_fingerprint) (posting_list, bool) {
+	if idx.isNarrow() {
+		pl, found := idx.narrow[sfp.narrow()]
+		return pl, found
+	}
+
+	pl, found := idx.wide[sfp]
+	return pl, found
+}
+
+// Appends postings to the posting list of a sub-fingerprint.
+func (idx index) append(sfp sub_fingerprint, postings ...posting) {
+	if idx.isNarrow() {
+		key := sfp.narrow()
+		idx.narrow[key] = append(idx.narrow[key], postings...)
+	} else {
+		idx.wide[sfp] = append(idx.wide[sfp], postings...)
+	}
+}
+
+// Calls the function with each sub-fingerprint of the index and its posting
+// list, in no particular order.
+func (idx index) forEach(f func(sfp sub_fingerprint, pl posting_list)) {
+	for key, pl := range idx.narrow {
+		f(key.widen(), pl)
+	}
+	for sfp, pl := range idx.wide {
+		f(sfp, pl)
+	}
+}
 
 // Builds an index from a fingerprint corpus. Conserves memory by simply
 // building against pointers to fingerprints in the corpus directly.
-func buildIndex(corpus []fingerprint) index {
-	idx := make(index)
+func buildIndex(alg fingerprint_algorithm, corpus []fingerprint) index {
+	idx := newIndex(alg)
+
+	for i := range corpus {
+		// need to dereference the actual fp, can't just use `&fp`
+		addToIndex(idx, &corpus[i])
+	}
+
+	return idx
+}
+
+// Adds the postings of a single fingerprint to an index, and to its LSH
+// tables if it has them, pointing to the fingerprint given.
+func addToIndex(idx index, fp *fingerprint) {
+	for offset, sfp := range fp.sfps {
+		// add posting to posting list for given sub-fingerprint
+		idx.append(sfp, posting{fp, offset})
+	}
+
+	if idx.lsh != nil {
+		idx.lsh.add(fp)
+	}
+}
+
+// Merges the postings of one index into another of the same algorithm. Posting
+// lists of the index being merged are appended to any existing posting lists.
+func mergeIndex(into index, from index) {
+	from.forEach(func(sfp sub_fingerprint, pl posting_list) {
+		into.append(sfp, pl...)
+	})
+}
+
+// Builds an index from a fingerprint corpus by splitting the corpus into
+// batches and building a partial index for each batch in parallel. Partial
+// indexes are merged in corpus order, so the result is the same as with
+// `buildIndex`. The progress function, if provided, is called with the total
+// number of fingerprints indexed after each batch is merged.
+func buildIndexInBatches(
+	alg fingerprint_algorithm,
+	corpus []fingerprint,
+	batchSize int,
+	parallelism int,
+	progress func(indexed int)) (index, error) {
+
+	if batchSize < 1 {
+		err := fmt.Errorf("Batch size must be greater than or equal to one: %d", batchSize)
+		return index{}, err
+	}
 
-	for i, fp := range corpus {
-		for offset, sfp := range fp.sfps {
+	if parallelism < 1 {
+		err := fmt.Errorf("Parallelism must be greater than or equal to one: %d", parallelism)
+		return index{}, err
+	}
+
+	numBatches := (len(corpus) + batchSize - 1) / batchSize
+	batches := make(chan int, numBatches)
+	done := make([]chan index, numBatches)
+	for i := range done {
+		done[i] = make(chan index, 1)
+		batches <- i
+	}
+	close(batches)
 
-			// need to dereference the actual fp, can't just use `&fp`
-			posting := posting{&corpus[i], offset}
+	for w := 0; w < parallelism; w++ {
+		go func() {
+			for i := range batches {
+				end := (i + 1) * batchSize
+				if end > len(corpus) {
+					end = len(corpus)
+				}
 
-			// add posting to posting list for given sub-fingerprint
-			pl, exists := idx[sfp]
-			if exists {
-				idx[sfp] = append(pl, posting) // existing posting list
-			} else {
-				idx[sfp] = posting_list{posting} // new posting list
+				// slice of the corpus, so postings still point into the corpus
+				done[i] <- buildIndex(alg, corpus[i*batchSize:end])
 			}
+		}()
+	}
+
+	idx := newIndex(alg)
+	indexed := 0
+	for i := range done {
+		mergeIndex(idx, <-done[i])
+
+		indexed += batchSize
+		if indexed > len(corpus) {
+			indexed = len(corpus)
+		}
+
+		if progress != nil {
+			progress(indexed)
 		}
 	}
 
-	return idx
+	return idx, nil
 }
@@ -12,6 +12,8 @@ func TestBuildIndex(t *testing.T) {
 				sub_fingerprint{0, 0, 9, 0},
 				sub_fingerprint{1, 8, 0, 0},
 			},
+			fingerprint_meta{},
+			0,
 		},
 		fingerprint{
 			"0002",
@@ -21,6 +23,8 @@ func TestBuildIndex(t *testing.T) {
 				sub_fingerprint{0, 0, 9, 0},
 				sub_fingerprint{1, 8, 0, 0},
 			},
+			fingerprint_meta{},
+			0,
 		},
 		fingerprint{
 			"0003",
@@ -30,18 +34,20 @@ func TestBuildIndex(t *testing.T) {
 				sub_fingerprint{0, 7, 9, 0},
 				sub_fingerprint{1, 8, 0, 1},
 			},
+			fingerprint_meta{},
+			0,
 		},
 	}
 
-	idx := buildIndex(corpus)
+	idx := buildIndex(philips, corpus)
 
 	// size of the index == total number of unique sub-fingerprints in the corpus
-	if expected, got := 8, len(idx); expected != got {
+	if expected, got := 8, idx.size(); expected != got {
 		t.Errorf("Expected %d but got %d", expected, got)
 	}
 
 	// should have posting list with sound one and two
-	pl := idx[sub_fingerprint{0, 0, 1, 0}]
+	pl, _ := idx.postings(sub_fingerprint{0, 0, 1, 0})
 	if expected, got := 2, len(pl); expected != got {
 		t.Errorf("Expected %d but got %d", expected, got)
 	}
@@ -73,3 +79,39 @@ func TestBuildIndex(t *testing.T) {
 		}
 	}
 }
+
+func TestBuildIndexInBatches(t *testing.T) {
+	corpus := buildTestCorpus()
+	expectedIdx := buildIndex(philips, corpus)
+
+	for _, batchSize := range []int{1, 2, 3, 10} {
+		var progress []int
+		idx, err := buildIndexInBatches(philips, corpus, batchSize, 2, func(indexed int) {
+			progress = append(progress, indexed)
+		})
+		if err != nil {
+			t.Fatalf("[%d] Building index failed when it should not have: %s", batchSize, err)
+		}
+
+		if expected, got := expectedIdx.size(), idx.size(); expected != got {
+			t.Errorf("[%d] Expected index of size %d but was %d", batchSize, expected, got)
+		}
+
+		expectedIdx.forEach(func(sfp sub_fingerprint, expectedPl posting_list) {
+			pl, _ := idx.postings(sfp)
+			if len(expectedPl) != len(pl) {
+				t.Fatalf("[%d] Expected posting list of size %d but was %d", batchSize, len(expectedPl), len(pl))
+			}
+
+			for i, expectedP := range expectedPl {
+				if expectedP != pl[i] {
+					t.Errorf("[%d][%d] Expected posting %v but was %v", batchSize, i, expectedP, pl[i])
+				}
+			}
+		})
+
+		if expected, got := len(corpus), progress[len(progress)-1]; expected != got {
+			t.Errorf("[%d] Expected final progress of %d but was %d", batchSize, expected, got)
+		}
+	}
+}
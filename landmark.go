@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Parameters of landmark fingerprint extraction, after Wang [1]. Peaks are
+// picked from the spectrogram of frames of 128 milliseconds taken every 32
+// milliseconds, and each anchor peak is paired with the first peaks in a
+// target zone following it. Each pair is hashed from the frequency bins of
+// both peaks and the number of frames between them, using 9, 9 and 14 bits.
+//
+// [1] A. Wang, “An Industrial-Strength Audio Search Algorithm,” in _Proc.
+// International Symposium on Music Information Retrieval (ISMIR)_, 2003.
+const (
+	LandmarkSampleRate      = 8000
+	LandmarkFrameSize       = 1024
+	LandmarkFrameHop        = 256
+	LandmarkPeakFreqRadius  = 10 // bins either side a peak must be greater than
+	LandmarkPeakTimeRadius  = 3  // frames either side a peak must be greater than
+	LandmarkPeaksPerSecond  = 30
+	LandmarkFanOut          = 5
+	LandmarkMaxTimeDelta    = 63 // frames, about 2 seconds
+	LandmarkMaxFreqDelta    = 127
+	LandmarkFreqBits        = 9
+	LandmarkTimeDeltaBits   = 14
+	DefaultLandmarkMinCount = 5
+)
+
+// A hash of a pair of peaks, as the frequency bin of the anchor peak, the
+// frequency bin of the target peak and the number of frames between them.
+type landmark_hash uint32
+
+func newLandmarkHash(f1 int, f2 int, dt int) landmark_hash {
+	return landmark_hash(f1<<(LandmarkFreqBits+LandmarkTimeDeltaBits) | f2<<LandmarkTimeDeltaBits | dt)
+}
+
+// A hash and the frame of its anchor peak.
+type landmark struct {
+	hash landmark_hash
+	time int
+}
+
+type landmark_fingerprint struct {
+	id        string
+	landmarks []landmark
+}
+
+type spectral_peak struct {
+	time  int
+	bin   int
+	power float64
+}
+
+// Picks peaks from a spectrogram, being the points greater than all others in
+// a neighbourhood of frequency bins and frames. Only the strongest peaks of
+// each second are kept, which keeps the density of peaks even over loud and
+// quiet audio. Peaks are returned in time order and then bin order.
+func pickSpectralPeaks(spectrogram [][]float64, framesPerSecond int) []spectral_peak {
+	var peaks []spectral_peak
+	for start := 0; start < len(spectrogram); start += framesPerSecond {
+		var second []spectral_peak
+		for t := start; t < start+framesPerSecond && t < len(spectrogram); t++ {
+			for bin, power := range spectrogram[t] {
+				if power > 0 && isSpectralPeak(spectrogram, t, bin) {
+					second = append(second, spectral_peak{t, bin, power})
+				}
+			}
+		}
+
+		sort.Sort(spectral_peaks_by_power(second))
+		if len(second) > LandmarkPeaksPerSecond {
+			second = second[:LandmarkPeaksPerSecond]
+		}
+		sort.Sort(spectral_peaks_by_time(second))
+
+		peaks = append(peaks, second...)
+	}
+
+	return peaks
+}
+
+func isSpectralPeak(spectrogram [][]float64, t int, bin int) bool {
+	power := spectrogram[t][bin]
+	for dt := -LandmarkPeakTimeRadius; dt <= LandmarkPeakTimeRadius; dt++ {
+		if t+dt < 0 || t+dt >= len(spectrogram) {
+			continue
+		}
+
+		frame := spectrogram[t+dt]
+		for db := -LandmarkPeakFreqRadius; db <= LandmarkPeakFreqRadius; db++ {
+			if (dt == 0 && db == 0) || bin+db < 0 || bin+db >= len(frame) {
+				continue
+			}
+
+			// ties go to the earliest and lowest point
+			other := frame[bin+db]
+			if other > power || (other == power && (dt < 0 || (dt == 0 && db < 0))) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+type spectral_peaks_by_power []spectral_peak
+
+func (s spectral_peaks_by_power) Len() int           { return len(s) }
+func (s spectral_peaks_by_power) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s spectral_peaks_by_power) Less(i, j int) bool { return s[i].power > s[j].power }
+
+type spectral_peaks_by_time []spectral_peak
+
+func (s spectral_peaks_by_time) Len() int      { return len(s) }
+func (s spectral_peaks_by_time) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s spectral_peaks_by_time) Less(i, j int) bool {
+	if s[i].time != s[j].time {
+		return s[i].time < s[j].time
+	}
+	return s[i].bin < s[j].bin
+}
+
+// Pairs each anchor peak with up to `LandmarkFanOut` of the peaks following it
+// in its target zone, hashing each pair. Peaks must be in time order.
+func pairSpectralPeaks(peaks []spectral_peak) []landmark {
+	var landmarks []landmark
+	for i, anchor := range peaks {
+		paired := 0
+		for _, target := range peaks[i+1:] {
+			dt := target.time - anchor.time
+			if dt > LandmarkMaxTimeDelta || paired >= LandmarkFanOut {
+				break
+			}
+
+			df := target.bin - anchor.bin
+			if dt < 1 || df < -LandmarkMaxFreqDelta || df > LandmarkMaxFreqDelta {
+				continue
+			}
+
+			landmarks = append(landmarks, landmark{newLandmarkHash(anchor.bin, target.bin, dt), anchor.time})
+			paired++
+		}
+	}
+
+	return landmarks
+}
+
+// Extracts a landmark fingerprint from audio. The bin at the Nyquist frequency
+// is dropped so that bins fit in the bits of a hash.
+func extractLandmarks(id string, audio pcm) landmark_fingerprint {
+	samples := resample(audio, LandmarkSampleRate).samples
+	spectrogram := powerSpectrogram(samples, LandmarkFrameSize, LandmarkFrameHop, hannWindow(LandmarkFrameSize))
+	for t := range spectrogram {
+		spectrogram[t] = spectrogram[t][:LandmarkFrameSize/2]
+	}
+
+	framesPerSecond := int(math.Floor(float64(LandmarkSampleRate)/LandmarkFrameHop + 0.5))
+	peaks := pickSpectralPeaks(spectrogram, framesPerSecond)
+
+	return landmark_fingerprint{id, pairSpectralPeaks(peaks)}
+}
+
+// The frame of a landmark closest to a time in seconds.
+func landmarkTimeAtTime(seconds float64) int {
+	return int(math.Floor(seconds*LandmarkSampleRate/LandmarkFrameHop + 0.5))
+}
+
+// The time in seconds of a landmark frame.
+func landmarkSeconds(frame int) float64 {
+	return float64(frame) * LandmarkFrameHop / LandmarkSampleRate
+}
+
+type landmark_posting struct {
+	fp   *landmark_fingerprint
+	time int
+}
+
+type landmark_index map[landmark_hash][]landmark_posting
+
+// Builds an index of landmark hashes from a corpus of landmark fingerprints,
+// pointing into the corpus directly as `buildIndex` does.
+func buildLandmarkIndex(corpus []landmark_fingerprint) landmark_index {
+	idx := make(landmark_index)
+	for i := range corpus {
+		addToLandmarkIndex(idx, &corpus[i])
+	}
+
+	return idx
+}
+
+// Adds the hashes of a landmark fingerprint to the index.
+func addToLandmarkIndex(idx landmark_index, fp *landmark_fingerprint) {
+	for _, l := range fp.landmarks {
+		idx[l.hash] = append(idx[l.hash], landmark_posting{fp, l.time})
+	}
+}
+
+// A fingerprint matching a query, with the offset of the start of the query in
+// the fingerprint, in frames, and the number of hashes agreeing on the offset.
+type landmark_match struct {
+	fp     *landmark_fingerprint
+	offset int
+	count  int
+}
+
+type landmark_matches_by_rank []landmark_match
+
+func (s landmark_matches_by_rank) Len() int      { return len(s) }
+func (s landmark_matches_by_rank) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s landmark_matches_by_rank) Less(i, j int) bool {
+	if s[i].count != s[j].count {
+		return s[i].count > s[j].count
+	}
+	if s[i].fp.id != s[j].fp.id {
+		return s[i].fp.id < s[j].fp.id
+	}
+	return s[i].offset < s[j].offset
+}
+
+// Searches the index with the hashes of a query landmark fingerprint. Every
+// hash found votes for the offset between the query and a fingerprint, and
+// the fingerprint matches at the offset with the most votes, as the peak of a
+// histogram of offsets, if it has at least `minCount` votes. Matches are
+// ranked by the number of votes.
+func searchByLandmarks(query landmark_fingerprint, minCount int, idx landmark_index) ([]landmark_match, error) {
+	if minCount < 1 {
+		err := fmt.Errorf("Minimum count must be greater than or equal to one: %d", minCount)
+		return make([]landmark_match, 0), err
+	}
+
+	type histogram_bin struct {
+		fp     *landmark_fingerprint
+		offset int
+	}
+
+	histogram := make(map[histogram_bin]int)
+	for _, l := range query.landmarks {
+		for _, posting := range idx[l.hash] {
+			histogram[histogram_bin{posting.fp, posting.time - l.time}]++
+		}
+	}
+
+	best := make(map[*landmark_fingerprint]landmark_match)
+	for bin, count := range histogram {
+		m, found := best[bin.fp]
+		if !found || count > m.count || (count == m.count && bin.offset < m.offset) {
+			best[bin.fp] = landmark_match{bin.fp, bin.offset, count}
+		}
+	}
+
+	matches := make([]landmark_match, 0, len(best))
+	for _, m := range best {
+		if m.count >= minCount {
+			matches = append(matches, m)
+		}
+	}
+	sort.Sort(landmark_matches_by_rank(matches))
+
+	return matches, nil
+}
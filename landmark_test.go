@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"github.com/golang/protobuf/proto"
+	"math/rand"
+	"testing"
+)
+
+func TestNewLandmarkHash(t *testing.T) {
+	fixtures := []struct {
+		f1, f2, dt int
+		expected   landmark_hash
+	}{
+		{0, 0, 0, 0},
+		{0, 0, 1, 1},
+		{0, 1, 0, 1 << 14},
+		{1, 0, 0, 1 << 23},
+		{511, 511, 1<<14 - 1, 0xffffffff},
+	}
+
+	for i, fixture := range fixtures {
+		if got := newLandmarkHash(fixture.f1, fixture.f2, fixture.dt); fixture.expected != got {
+			t.Errorf("[%d] Expected hash %x but got %x", i, fixture.expected, got)
+		}
+	}
+}
+
+func TestPickSpectralPeaks(t *testing.T) {
+	spectrogram := [][]float64{
+		{0, 1, 0, 0, 0},
+		{0, 2, 0, 0, 3},
+		{0, 0, 0, 0, 0},
+	}
+
+	// within the neighbourhood, only the greatest point is a peak
+	peaks := pickSpectralPeaks(spectrogram, 10)
+	if len(peaks) != 1 || peaks[0] != (spectral_peak{1, 4, 3}) {
+		t.Errorf("Expected a single peak at frame 1, bin 4 but got %v", peaks)
+	}
+}
+
+// A noisy segment of audio matches the reference it was taken from at the
+// offset of its start time, and not other audio.
+func TestSearchByLandmarks(t *testing.T) {
+	corpus := []landmark_fingerprint{
+		extractLandmarks("0001", randomTones(1, 11025, 20.0)),
+		extractLandmarks("0002", randomTones(2, 11025, 20.0)),
+		extractLandmarks("0003", randomTones(3, 11025, 20.0)),
+	}
+	idx := buildLandmarkIndex(corpus)
+
+	start := 7.0
+	segment := randomTones(2, 11025, 20.0).segment(start, 5.0)
+	noisy := whiteNoiseDistortion(0)(rand.New(rand.NewSource(1)), segment)
+	query := extractLandmarks("query", noisy)
+
+	matches, err := searchByLandmarks(query, DefaultLandmarkMinCount, idx)
+	if err != nil {
+		t.Fatalf("Search failed when it should not have: %s", err)
+	}
+
+	if len(matches) == 0 {
+		t.Fatalf("Expected a match in %d landmarks of the query", len(query.landmarks))
+	}
+
+	if expected, got := landmarkTimeAtTime(start), matches[0].offset; matches[0].fp.id != "0002" || got < expected-1 || got > expected+1 {
+		t.Errorf("Expected best match 0002@%d but was %s@%d", expected, matches[0].fp.id, got)
+	}
+
+	for _, m := range matches[1:] {
+		if m.count >= matches[0].count/2 {
+			t.Errorf("Expected other matches to have far fewer hashes but %s had %d of %d", m.fp.id, m.count, matches[0].count)
+		}
+	}
+
+	if _, err := searchByLandmarks(query, 0, idx); err == nil {
+		t.Error("Expected an error for a minimum count of zero")
+	}
+}
+
+func TestIndexLandmarkFingerprintRoundTrip(t *testing.T) {
+	lfp := landmark_fingerprint{"0001", []landmark{{1, 2}, {newLandmarkHash(3, 4, 5), 6}}}
+
+	buf, err := proto.Marshal(newIndexLandmarkFingerprint(lfp))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ilfp := new(IndexLandmarkFingerprint)
+	if err := proto.Unmarshal(buf, ilfp); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := newLandmarkFingerprintFromIndexLandmarkFingerprint(ilfp)
+	if err != nil {
+		t.Fatalf("Conversion failed when it should not have: %s", err)
+	}
+
+	if lfp.id != got.id || len(lfp.landmarks) != len(got.landmarks) {
+		t.Fatalf("Expected %s with %d landmarks but was %s with %d", lfp.id, len(lfp.landmarks), got.id, len(got.landmarks))
+	}
+
+	for i, expected := range lfp.landmarks {
+		if expected != got.landmarks[i] {
+			t.Errorf("[%d] Expected landmark %v but was %v", i, expected, got.landmarks[i])
+		}
+	}
+
+	if _, err := newLandmarkFingerprintFromQueryLandmarkFingerprint("query", &QueryLandmarkFingerprint{Hashes: []uint32{1}}); err == nil {
+		t.Error("Expected an error for a hash without a time")
+	}
+}
+
+func TestWriteAndReadLandmarkIndex(t *testing.T) {
+	corpus := []landmark_fingerprint{
+		{"0001", []landmark{{1, 2}, {3, 4}}},
+		{"0002", []landmark{{1, 5}}},
+	}
+
+	var buf bytes.Buffer
+	if err := writeLandmarkIndex(&buf, corpus); err != nil {
+		t.Fatalf("Writing landmark index failed when it should not have: %s", err)
+	}
+	persisted := buf.Bytes()
+
+	gotCorpus, gotIdx, err := readLandmarkIndex(bytes.NewReader(persisted))
+	if err != nil {
+		t.Fatalf("Reading landmark index failed when it should not have: %s", err)
+	}
+
+	if len(gotCorpus) != len(corpus) || len(gotIdx[1]) != 2 || gotIdx[1][1].fp != &gotCorpus[1] {
+		t.Errorf("Expected landmark index to be built from the read corpus but got %v", gotIdx)
+	}
+
+	// indexes of one algorithm can't be read as the other
+	if _, _, _, err := readIndex(bytes.NewReader(persisted)); err == nil {
+		t.Error("Expected an error reading a landmark index as a Philips index")
+	}
+
+	buf.Reset()
+	if err := writeIndex(&buf, philips, buildTestCorpus(), buildIndex(philips, buildTestCorpus()[:0])); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := readLandmarkIndex(&buf); err == nil {
+		t.Error("Expected an error reading a Philips index as a landmark index")
+	}
+}
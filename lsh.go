@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+const (
+	DefaultLSHTables = 32
+	DefaultLSHBits   = 16
+)
+
+// Locality-sensitive hashing over whole fingerprint blocks, by bit sampling.
+// Each table hashes a block by sampling the same bits from it, so two blocks
+// collide in a table with a probability of `(1 - BER)^bits`. Unlike searching
+// by sub-fingerprint, this finds blocks in which every sub-fingerprint has a
+// few bit errors, provided there are enough tables. Every block of the given
+// size in the corpus is indexed, starting at every offset. The tables of an
+// index are kept with it, so that they are built once rather than for every
+// search, and are updated as fingerprints are added to it.
+type lsh_index struct {
+	blockSize int
+	tables    []lsh_table
+	postings  posting_list
+}
+
+// A hash table of blocks, with the bits sampled from a block to make the hash
+// and, for each hash, the positions in the postings of the blocks.
+type lsh_table struct {
+	bits    []lsh_bit
+	buckets map[uint64][]int32
+}
+
+// The position of a sampled bit in a fingerprint block.
+type lsh_bit struct {
+	offset int // sub-fingerprint in the block
+	bit    int // bit in the sub-fingerprint
+}
+
+// Samples the bits of each table at random without replacement from blocks of
+// sub-fingerprints of the given width, so that the tables are the same for the
+// same seed.
+func sampleLSHBits(width int, blockSize int, numTables int, numBits int, seed int64) [][]lsh_bit {
+	rng := rand.New(rand.NewSource(seed))
+	bits := make([][]lsh_bit, numTables)
+	for i := range bits {
+		bits[i] = make([]lsh_bit, numBits)
+		for j, pos := range rng.Perm(blockSize * width)[:numBits] {
+			bits[i][j] = lsh_bit{pos / width, pos % width}
+		}
+	}
+
+	return bits
+}
+
+// Hashes the fingerprint block by concatenating the sampled bits.
+func (t *lsh_table) hash(fpb fingerprint_block) uint64 {
+	var h uint64
+	for _, b := range t.bits {
+		h <<= 1
+		if bitAt(fpb[b.offset], b.bit) {
+			h |= 1
+		}
+	}
+
+	return h
+}
+
+// Builds an LSH index of the fingerprints in the index, with the given number
+// of tables each sampling the given number of bits from blocks of the given
+// size. Only the bits within the width of the algorithm are sampled.
+// Fingerprints shorter than a block are not indexed.
+func buildLSHIndex(
+	alg fingerprint_algorithm,
+	idx index,
+	blockSize int,
+	numTables int,
+	numBits int) (*lsh_index, error) {
+
+	if blockSize < 1 {
+		err := fmt.Errorf("Block size must be greater than or equal to one: %d", blockSize)
+		return nil, err
+	}
+
+	if numTables < 1 {
+		err := fmt.Errorf("Number of LSH tables must be greater than or equal to one: %d", numTables)
+		return nil, err
+	}
+
+	width := alg.subFingerprintSizeBits()
+	if numBits < 1 || numBits > 64 || numBits > blockSize*width {
+		err := fmt.Errorf("Number of LSH bits must be between one and 64, and within a block: %d", numBits)
+		return nil, err
+	}
+
+	lsh := &lsh_index{
+		blockSize: blockSize,
+		tables:    make([]lsh_table, numTables),
+	}
+
+	for i, bits := range sampleLSHBits(width, blockSize, numTables, numBits, 1) {
+		lsh.tables[i] = lsh_table{bits, make(map[uint64][]int32)}
+	}
+
+	for _, fp := range indexedFingerprints(idx) {
+		lsh.add(fp)
+	}
+
+	return lsh, nil
+}
+
+// Adds every block of a fingerprint to the tables, pointing to the fingerprint
+// given.
+func (lsh *lsh_index) add(fp *fingerprint) {
+	for offset := 0; offset+lsh.blockSize <= len(fp.sfps); offset++ {
+		fpb := fingerprint_block(fp.sfps[offset : offset+lsh.blockSize])
+		position := int32(len(lsh.postings))
+		lsh.postings = append(lsh.postings, posting{fp, offset})
+
+		for i := range lsh.tables {
+			t := &lsh.tables[i]
+			h := t.hash(fpb)
+			t.buckets[h] = append(t.buckets[h], position)
+		}
+	}
+}
+
+// Determines if these are the tables of the given block size, number of tables
+// and number of bits, being false when there are no tables.
+func (lsh *lsh_index) matches(blockSize int, numTables int, numBits int) bool {
+	return lsh != nil &&
+		lsh.blockSize == blockSize &&
+		len(lsh.tables) == numTables &&
+		len(lsh.tables[0].bits) == numBits
+}
+
+// Finds the distinct fingerprints pointed to by the postings of the index.
+func indexedFingerprints(idx index) []*fingerprint {
+	seen := make(map[*fingerprint]bool)
+	var fps []*fingerprint
+	idx.forEach(func(sfp sub_fingerprint, pl posting_list) {
+		for _, posting := range pl {
+			if !seen[posting.fp] {
+				seen[posting.fp] = true
+				fps = append(fps, posting.fp)
+			}
+		}
+	})
+
+	return fps
+}
+
+// Finds candidate blocks that collide with the query fingerprint block in any
+// of the tables. The query block must be of the size of the indexed blocks.
+// Only fingerprints in the set are candidates.
+func (lsh *lsh_index) search(queryFpb fingerprint_block, set fingerprint_set) ([]candidate, error) {
+	if len(queryFpb) != lsh.blockSize {
+		err := fmt.Errorf(
+			"Query fingerprint block of size %d can not be searched in LSH tables of block size %d",
+			len(queryFpb),
+			lsh.blockSize,
+		)
+		return make([]candidate, 0), err
+	}
+
+	candidates := make(map[candidate]bool)
+	for i := range lsh.tables {
+		t := &lsh.tables[i]
+		for _, position := range t.buckets[t.hash(queryFpb)] {
+			p := lsh.postings[position]
+			if set.contains(p.fp) {
+				candidates[candidate{p.fp, p.offset}] = true
+			}
+		}
+	}
+
+	return candidateSetToSlice(candidates), nil
+}
+
+// Creates a candidate generator that finds candidates in the LSH index, along
+// with exact matches of the sub-fingerprints in the index. Query blocks of a
+// different size to the LSH blocks, such as trailing blocks, and blocks
+// partially overlapping the start or end of a fingerprint are only found by
+// exact matches. The LSH tables of the index are used when they are of the
+// given parameters, and otherwise are built once, when creating the generator.
+func lshCandidateGenerator(
+	alg fingerprint_algorithm,
+	idx index,
+	blockSize int,
+	numTables int,
+	numBits int) (candidate_generator, error) {
+
+	generators, err := lshCandidateGenerators(alg, idx, blockSize, numTables, numBits)
+	if err != nil {
+		return nil, err
+	}
+
+	return generators(nil), nil
+}
+
+// Same as `lshCandidateGenerator` but creating generators restricted to a set
+// of fingerprints, all sharing the same LSH index.
+func lshCandidateGenerators(
+	alg fingerprint_algorithm,
+	idx index,
+	blockSize int,
+	numTables int,
+	numBits int) (candidate_generators, error) {
+
+	generators, _, err := updatableLSHCandidateGenerators(alg, idx, blockSize, numTables, numBits)
+	return generators, err
+}
+
+// Same as `lshCandidateGenerators`, along with a function adding a fingerprint
+// to LSH tables built for the generators, to be called as the fingerprint is
+// added to the index. The function is nil when the generators use the tables
+// of the index, which are updated along with it.
+func updatableLSHCandidateGenerators(
+	alg fingerprint_algorithm,
+	idx index,
+	blockSize int,
+	numTables int,
+	numBits int) (candidate_generators, func(fp *fingerprint), error) {
+
+	lsh := idx.lsh
+	var add func(fp *fingerprint)
+	if !lsh.matches(blockSize, numTables, numBits) {
+		var err error
+		lsh, err = buildLSHIndex(alg, idx, blockSize, numTables, numBits)
+		if err != nil {
+			return nil, nil, err
+		}
+		add = lsh.add
+	}
+
+	generators := func(set fingerprint_set) candidate_generator {
+		return func(queryFpb fingerprint_block) ([]candidate, error) {
+			exact, err := searchByFingerprintBlock(queryFpb, nil, idx, set)
+			if err != nil || len(queryFpb) != lsh.blockSize {
+				return exact, err
+			}
+
+			approx, err := lsh.search(queryFpb, set)
+			if err != nil {
+				return make([]candidate, 0), err
+			}
+
+			candidates := make(map[candidate]bool, len(exact)+len(approx))
+			addCandidatesToSet(exact, candidates)
+			addCandidatesToSet(approx, candidates)
+
+			return candidateSetToSlice(candidates), nil
+		}
+	}
+
+	return generators, add, nil
+}
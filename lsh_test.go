@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// A block in which every sub-fingerprint has bit errors can not be found by
+// exact matches of sub-fingerprints, but can be found by LSH.
+func TestLSHCandidateGenerator(t *testing.T) {
+	corpus := []fingerprint{
+		{"0001", randomSubFingerprints(philips, 1, 100), fingerprint_meta{}, 0},
+		{"0002", randomSubFingerprints(philips, 2, 100), fingerprint_meta{}, 0},
+		{"0003", randomSubFingerprints(philips, 3, 100), fingerprint_meta{}, 0},
+	}
+	idx := buildIndex(philips, corpus)
+
+	blockSize, offset := 16, 42
+	queryFpb := make(fingerprint_block, blockSize)
+	for i, sfp := range corpus[1].sfps[offset : offset+blockSize] {
+		queryFpb[i] = sfp.flipBit(i % philips.subFingerprintSizeBits())
+		queryFpb[i] = queryFpb[i].flipBit((i + 11) % philips.subFingerprintSizeBits())
+	}
+
+	exact, err := subFingerprintCandidateGenerator(nil, idx, nil)(queryFpb)
+	if err != nil {
+		t.Fatalf("Generating candidates failed when it should not have: %s", err)
+	}
+
+	if len(exact) != 0 {
+		t.Fatalf("Expected no exact candidates but got %d", len(exact))
+	}
+
+	generator, err := lshCandidateGenerator(philips, idx, blockSize, DefaultLSHTables, DefaultLSHBits)
+	if err != nil {
+		t.Fatalf("Creating LSH candidate generator failed when it should not have: %s", err)
+	}
+
+	candidates, err := generator(queryFpb)
+	if err != nil {
+		t.Fatalf("Generating candidates failed when it should not have: %s", err)
+	}
+
+	found := false
+	for _, c := range candidates {
+		if c.fp.id == "0002" && c.offset == offset {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Errorf("Expected candidate 0002@%d in %d candidates", offset, len(candidates))
+	}
+
+	// shorter blocks fall back to exact matches only
+	if _, err := generator(queryFpb[:blockSize/2]); err != nil {
+		t.Errorf("Generating candidates for a short block failed when it should not have: %s", err)
+	}
+}
+
+func TestBuildLSHIndex(t *testing.T) {
+	corpus := []fingerprint{
+		{"0001", randomSubFingerprints(philips, 1, 10), fingerprint_meta{}, 0},
+		{"0002", randomSubFingerprints(philips, 2, 3), fingerprint_meta{}, 0},
+	}
+	idx := buildIndex(philips, corpus)
+
+	lsh, err := buildLSHIndex(philips, idx, 4, 2, 8)
+	if err != nil {
+		t.Fatalf("Building LSH index failed when it should not have: %s", err)
+	}
+
+	// blocks starting at every offset, skipping the fingerprint shorter than a block
+	if expected, got := 7, len(lsh.postings); expected != got {
+		t.Errorf("Expected %d indexed blocks but got %d", expected, got)
+	}
+
+	for i, bad := range [][3]int{{0, 2, 8}, {4, 0, 8}, {4, 2, 0}, {4, 2, 65}, {1, 2, 33}} {
+		if _, err := buildLSHIndex(philips, idx, bad[0], bad[1], bad[2]); err == nil {
+			t.Errorf("[%d] Expected an error building LSH index with %v", i, bad)
+		}
+	}
+}
+
+func TestIndexLSHTables(t *testing.T) {
+	corpus := []fingerprint{
+		{"0001", randomSubFingerprints(philips, 1, 10), fingerprint_meta{}, 0},
+		{"0002", randomSubFingerprints(philips, 2, 3), fingerprint_meta{}, 0},
+		{"0003", randomSubFingerprints(philips, 3, 8), fingerprint_meta{}, 0},
+	}
+
+	params := defaultSearchParams()
+	params.approxSearchStrategy, params.blockSize, params.lshTables, params.lshBits = "lsh", 4, 2, 8
+	idx, err := params.withLSHTables(buildIndex(philips, corpus[:1]))
+	if err != nil {
+		t.Fatalf("Adding LSH tables failed when it should not have: %s", err)
+	}
+
+	// the tables are kept up to date as fingerprints are added
+	addToIndex(idx, &corpus[1])
+	addToIndex(idx, &corpus[2])
+	expected, err := buildLSHIndex(philips, buildIndex(philips, corpus), 4, 2, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectLSHIndex(t, expected, idx.lsh)
+
+	// tables of the same parameters are not built again
+	if again, _ := params.withLSHTables(idx); again.lsh != idx.lsh {
+		t.Errorf("Expected the LSH tables of the index to be kept")
+	}
+
+	params.lshBits = 16
+	if other, _ := params.withLSHTables(idx); other.lsh == idx.lsh || !other.lsh.matches(4, 2, 16) {
+		t.Errorf("Expected LSH tables of other parameters to be built")
+	}
+}
+
+// Checks that the tables have the same bits and blocks in each bucket, by ID
+// and offset.
+func expectLSHIndex(t *testing.T, expected *lsh_index, got *lsh_index) {
+	if !got.matches(expected.blockSize, len(expected.tables), len(expected.tables[0].bits)) {
+		t.Fatalf("Expected LSH tables of block size %d but was %v", expected.blockSize, got)
+	}
+
+	blocks := func(lsh *lsh_index, positions []int32) map[string]bool {
+		set := make(map[string]bool)
+		for _, position := range positions {
+			p := lsh.postings[position]
+			set[fmt.Sprintf("%s@%d", p.fp.id, p.offset)] = true
+		}
+		return set
+	}
+
+	for i, table := range expected.tables {
+		if !reflect.DeepEqual(table.bits, got.tables[i].bits) || len(table.buckets) != len(got.tables[i].buckets) {
+			t.Fatalf("[%d] Expected table of bits %v and %d buckets", i, table.bits, len(table.buckets))
+		}
+		for h, positions := range table.buckets {
+			if e, g := blocks(expected, positions), blocks(got, got.tables[i].buckets[h]); !reflect.DeepEqual(e, g) {
+				t.Errorf("[%d][%d] Expected blocks %v but were %v", i, h, e, g)
+			}
+		}
+	}
+}
@@ -2,28 +2,150 @@ package main
 
 import (
 	"flag"
-	"github.com/gorilla/pat"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strings"
 )
 
 // A simple, stand-alone, fingerprint index. This is meant as a small-scale
 // evaluation tool for testing various search and indexing parameters and
 // algorithms of the Philips fingerprinter [1].
 //
+// The first argument selects a command, defaulting to `serve` which starts the
+// HTTP server. Other commands work offline, for example `build` which builds
+// and persists an index from a directory of fingerprint files, `query` which
+// searches a persisted index, `eval` which evaluates search over a labelled
+// query set, `sweep` which does so for many search parameters and `distort`
+// which generates a labelled query set from the index. With audio, `extract`
+// fingerprints WAV files and `robustness` evaluates search over distorted
+// audio. Finally, `roc` reports on the distribution of BER to help choose a
+// threshold, `generate` creates a synthetic corpus and `dedup` finds
+// duplicates across the corpus of an index. The `extract`, `build` and `query`
+// commands can instead use landmark fingerprints [2].
+//
 // [1] J. Haitsma and A. Kalker, “A Highly Robust Audio Fingerprinting System,”
 // in _Proc. International Symposium on Music Information Retrieval (ISMIR)_,
 // 2002.
 //
+// [2] A. Wang, “An Industrial-Strength Audio Search Algorithm,” in _Proc.
+// International Symposium on Music Information Retrieval (ISMIR)_, 2003.
 func main() {
-	serverAddr := flag.String("server.addr", ":8080", "HTTP server listen address")
-	flag.Parse()
+	command := "serve"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "serve":
+		serveCommand(args)
+	case "build":
+		buildCommand(args)
+	case "query":
+		queryCommand(args)
+	case "eval":
+		evalCommand(args)
+	case "sweep":
+		sweepCommand(args)
+	case "distort":
+		distortCommand(args)
+	case "extract":
+		extractCommand(args)
+	case "robustness":
+		robustnessCommand(args)
+	case "roc":
+		rocCommand(args)
+	case "generate":
+		generateCommand(args)
+	case "dedup":
+		dedupCommand(args)
+	default:
+		log.Fatalf("Unknown command: %s", command)
+	}
+}
+
+// Starts the HTTP server of an index, loaded from disk if one is given and
+// otherwise empty, which fingerprints can be added to and searched, along with
+// any number of named indexes. With the landmark algorithm, the index is of
+// landmark fingerprints, and any index given must have been built with it.
+func serveCommand(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	serverAddr := flags.String("server.addr", ":8080", "HTTP server listen address")
+	indexPath := flags.String("index", "", "path to an index to load")
+	algorithm := flags.String("algorithm", PhilipsAlgorithm, "fingerprint algorithm of an empty index, or of a landmark index: "+fingerprintAlgorithmNames()+" or landmark")
+	indexesDir := flags.String("indexes.dir", "", "directory to persist named indexes to and read them from, otherwise they are kept in memory")
+	params := defaultSearchParams()
+	params.registerFlags(flags)
+	flags.Parse(args)
 
-	// routes
-	r := pat.New()
-	r.Get("/-/stats", statsHandler())
+	var s *index_server
+	var err error
+	if *algorithm == LandmarkAlgorithm {
+		s, err = newLandmarkIndexServerOfFile(*indexPath)
+	} else {
+		s, params, err = newIndexServerOfFile(*algorithm, *indexPath, params, flags)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	reg, err := openIndexRegistry(*indexesDir, params)
+	if err != nil {
+		log.Fatalf("Failed reading named indexes: %s", err)
+	}
+	defer reg.close()
+
+	r := newRouter(s, reg)
 
 	// serve
 	log.Printf("Listening on: %s", *serverAddr)
 	log.Fatal(http.ListenAndServe(*serverAddr, r))
 }
+
+// Creates the server of the index at the path, if there is one, and otherwise
+// of an empty index of the algorithm, along with the search parameters for
+// the algorithm of the index.
+func newIndexServerOfFile(
+	algorithm string,
+	path string,
+	params search_params,
+	flags *flag.FlagSet) (*index_server, search_params, error) {
+
+	alg, err := newFingerprintAlgorithm(algorithm)
+	if err != nil {
+		return nil, params, err
+	}
+
+	var corpus []fingerprint
+	idx := newIndex(alg)
+	if path != "" {
+		alg, corpus, idx, err = readIndexFile(path)
+		if err != nil {
+			return nil, params, fmt.Errorf("Failed reading index: %s", err)
+		}
+	}
+	params, err = params.forAlgorithm(alg, flags)
+	if err != nil {
+		return nil, params, err
+	}
+
+	s, err := newIndexServer(alg, params, corpus, idx)
+	return s, params, err
+}
+
+// Creates the server of the landmark index at the path, if there is one, and
+// otherwise of an empty landmark index.
+func newLandmarkIndexServerOfFile(path string) (*index_server, error) {
+	var corpus []landmark_fingerprint
+	if path != "" {
+		var err error
+		corpus, _, err = readLandmarkIndexFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Failed reading index: %s", err)
+		}
+	}
+
+	return newLandmarkIndexServer(corpus, DefaultLandmarkMinCount)
+}
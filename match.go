@@ -0,0 +1,100 @@
+package main
+
+import "sort"
+
+// A match of a whole query fingerprint against a reference fingerprint. The
+// offset is the position in the reference at which the start of the query is
+// aligned, and can be negative when the query starts before the reference.
+// The number of windows is how many windows of the query found the same
+// alignment, while the BER is over the whole query where it overlaps the
+// reference. The speed is the factor the query was stretched by to match,
+// being the detected speed of the query relative to the reference.
+type match struct {
+	fp      *fingerprint
+	offset  int
+	windows int
+	ber     float32
+	speed   float64
+}
+
+type matches_by_rank []match
+
+func (m matches_by_rank) Len() int      { return len(m) }
+func (m matches_by_rank) Swap(i, j int) { m[i], m[j] = m[j], m[i] }
+func (m matches_by_rank) Less(i, j int) bool {
+	if m[i].windows != m[j].windows {
+		return m[i].windows > m[j].windows
+	}
+	if m[i].ber != m[j].ber {
+		return m[i].ber < m[j].ber
+	}
+	if m[i].fp.id != m[j].fp.id {
+		return m[i].fp.id < m[j].fp.id
+	}
+	if m[i].offset != m[j].offset {
+		return m[i].offset < m[j].offset
+	}
+	return m[i].speed < m[j].speed
+}
+
+// Ranks the candidates found in each window of a query fingerprint as matches
+// of the whole query. Candidates are aligned to the start of the query, so the
+// same alignment found by different windows is a single match. Matches are
+// ranked by the number of windows they were found in, then by BER. When
+// windows were searched at different speed factors, alignments are of the
+// query stretched by each factor, and a reference only keeps the matches at
+// the speed of its best match.
+func rankMatches(alg fingerprint_algorithm, queryFp fingerprint, results []window_result) []match {
+	type alignment struct {
+		c     candidate
+		speed float64
+	}
+
+	windows := make(map[alignment]int)
+	for _, result := range results {
+		for _, c := range result.candidates {
+			aligned := candidate{c.fp, c.offset - result.window.offset}
+			windows[alignment{aligned, result.speed}]++
+		}
+	}
+
+	stretched := make(map[float64]fingerprint)
+	matches := make([]match, 0, len(windows))
+	for a, n := range windows {
+		stretchedFp, found := stretched[a.speed]
+		if !found {
+			stretchedFp = stretchFingerprint(queryFp, a.speed)
+			stretched[a.speed] = stretchedFp
+		}
+
+		referenceFpb, queryStart, err := a.c.extractOverlappingFingerprintBlock(len(stretchedFp.sfps))
+		if err != nil {
+			continue
+		}
+
+		queryFpb := fingerprint_block(stretchedFp.sfps[queryStart : queryStart+len(referenceFpb)])
+		ber, err := queryFpb.bitErrorRateWith(alg, referenceFpb)
+		if err != nil {
+			continue
+		}
+
+		matches = append(matches, match{a.c.fp, a.c.offset, n, ber, a.speed})
+	}
+
+	sort.Sort(matches_by_rank(matches))
+
+	// keep only the matches of each reference at the speed of its best match
+	speeds := make(map[*fingerprint]float64)
+	kept := matches[:0]
+	for _, m := range matches {
+		speed, found := speeds[m.fp]
+		if !found {
+			speeds[m.fp] = m.speed
+		} else if speed != m.speed {
+			continue
+		}
+		kept = append(kept, m)
+	}
+
+	return kept
+}
@@ -0,0 +1,58 @@
+package main
+
+import "testing"
+
+func TestRankMatches(t *testing.T) {
+	corpus := buildTestCorpus()
+
+	queryFp := fingerprint{
+		"query",
+		[]sub_fingerprint{
+			sub_fingerprint{1, 0, 0, 0},
+			sub_fingerprint{0, 0, 2, 0},
+			sub_fingerprint{0, 7, 9, 0},
+			sub_fingerprint{1, 8, 0, 0}, // one bit different from "0003"
+		},
+		fingerprint_meta{},
+		0,
+	}
+
+	// windows of size two, with candidates relative to the window start
+	results := []window_result{
+		window_result{
+			window:     query_window{0, 2},
+			candidates: []candidate{candidate{&corpus[2], 0}, candidate{&corpus[0], 2}},
+			speed:      1.0,
+		},
+		window_result{
+			window:     query_window{2, 2},
+			candidates: []candidate{candidate{&corpus[2], 2}},
+			speed:      1.0,
+		},
+	}
+
+	matches := rankMatches(philips, queryFp, results)
+	if expected, got := 2, len(matches); expected != got {
+		t.Fatalf("Expected %d matches but got %d", expected, got)
+	}
+
+	expectations := []struct {
+		id      string
+		offset  int
+		windows int
+		ber     float32
+	}{
+		{"0003", 0, 2, 1.0 / 128.0},
+		{"0001", 2, 1, 6.0 / 64.0},
+	}
+
+	for i, e := range expectations {
+		m := matches[i]
+		if e.id != m.fp.id || e.offset != m.offset || e.windows != m.windows || e.ber != m.ber {
+			t.Errorf(
+				"[%d] Expected match %s@%d in %d windows with BER %f but was %s@%d in %d windows with BER %f",
+				i, e.id, e.offset, e.windows, e.ber, m.fp.id, m.offset, m.windows, m.ber,
+			)
+		}
+	}
+}
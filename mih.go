@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+const (
+	DefaultMultiIndexSubstrings = 0 // chosen from the size of the index
+)
+
+// A multi-index over the distinct sub-fingerprints of an index, for finding
+// those within a Hamming distance of a query sub-fingerprint without flipping
+// every combination of bits [1]. Each sub-fingerprint is split into `m`
+// disjoint substrings of consecutive bits, and each substring is indexed in
+// its own table. By the pigeonhole principle, a sub-fingerprint within a
+// Hamming distance of `r` has at least one substring within a distance of
+// `r/m` (rounded down), so only the much smaller substrings need their bits
+// flipped.
+//
+// [1] M. Norouzi, A. Punjani and D. J. Fleet, “Fast Search in Hamming Space
+// with Multi-Index Hashing,” in _Proc. IEEE Conference on Computer Vision and
+// Pattern Recognition (CVPR)_, 2012.
+type multi_index struct {
+	substrings []substring_bits
+	bits       int
+	tables     []map[uint64][]sub_fingerprint
+}
+
+// The position of a substring, as the number of bits to shift right and the
+// number of bits in the substring.
+type substring_bits struct {
+	shift  uint
+	length int
+}
+
+func (s substring_bits) of(v uint64) uint64 {
+	return (v >> s.shift) & (1<<uint(s.length) - 1)
+}
+
+// The bits of a sub-fingerprint of the given width as an integer, with the
+// first bit the most significant.
+func subFingerprintToUint64(sfp sub_fingerprint, bits int) uint64 {
+	return binary.BigEndian.Uint64(sfp[:]) >> uint(MaxSubFingerprintSizeBits-bits)
+}
+
+// Splits the bits of a sub-fingerprint of the given width into `m` substrings
+// of as equal length as possible, with any extra bits going to the first
+// substrings.
+func splitSubstrings(bits int, m int) []substring_bits {
+	substrings := make([]substring_bits, m)
+	shift := bits
+	for i := range substrings {
+		length := bits / m
+		if i < bits%m {
+			length++
+		}
+
+		shift -= length
+		substrings[i] = substring_bits{uint(shift), length}
+	}
+
+	return substrings
+}
+
+// Chooses the number of substrings for a multi-index over the given number of
+// distinct sub-fingerprints of the given width. Substrings of about log2(keys)
+// bits are recommended [1], so that each substring lookup finds about one
+// sub-fingerprint.
+func chooseMultiIndexSubstrings(bits int, keys int) int {
+	if keys < 2 {
+		return 1
+	}
+
+	m := int(math.Floor(float64(bits)/math.Log2(float64(keys)) + 0.5))
+	if m < 1 {
+		m = 1
+	} else if m > bits {
+		m = bits
+	}
+
+	return m
+}
+
+// Builds a multi-index over the distinct sub-fingerprints of the index, of the
+// width of the algorithm, using the given number of substrings, or choosing it
+// from the size of the index when zero (0).
+func buildMultiIndex(alg fingerprint_algorithm, idx index, m int) (*multi_index, error) {
+	bits := alg.subFingerprintSizeBits()
+	if m == 0 {
+		m = chooseMultiIndexSubstrings(bits, idx.size())
+	}
+
+	if m < 1 || m > bits {
+		err := fmt.Errorf("Number of substrings must be between one and %d: %d", bits, m)
+		return nil, err
+	}
+
+	mi := &multi_index{
+		splitSubstrings(bits, m),
+		bits,
+		make([]map[uint64][]sub_fingerprint, m),
+	}
+
+	for i := range mi.tables {
+		mi.tables[i] = make(map[uint64][]sub_fingerprint)
+	}
+
+	idx.forEach(func(sfp sub_fingerprint, pl posting_list) {
+		v := subFingerprintToUint64(sfp, bits)
+		for i, s := range mi.substrings {
+			key := s.of(v)
+			mi.tables[i][key] = append(mi.tables[i][key], sfp)
+		}
+	})
+
+	return mi, nil
+}
+
+// Adds a sub-fingerprint to the multi-index, unless it is already indexed, as
+// it is added to the index. The number of substrings stays that of when the
+// multi-index was built.
+func (mi *multi_index) add(sfp sub_fingerprint) {
+	v := subFingerprintToUint64(sfp, mi.bits)
+	for _, indexed := range mi.tables[0][mi.substrings[0].of(v)] {
+		if indexed == sfp {
+			return
+		}
+	}
+
+	for i, s := range mi.substrings {
+		key := s.of(v)
+		mi.tables[i][key] = append(mi.tables[i][key], sfp)
+	}
+}
+
+// Generates all values of a substring of the given length that are equal to
+// or less than a Hamming distance of `n` from the value, including the value
+// itself.
+func flipSubstringBitsUntil(v uint64, length int, n int) []uint64 {
+	flipped := []uint64{v}
+
+	// flip one more bit at a time, only at positions after the last one flipped
+	// so that each combination of positions is generated once
+	type partial struct {
+		v    uint64
+		next int
+	}
+	frontier := []partial{{v, 0}}
+	for d := 1; d <= n; d++ {
+		var nextFrontier []partial
+		for _, p := range frontier {
+			for i := p.next; i < length; i++ {
+				fv := p.v ^ (1 << uint(i))
+				flipped = append(flipped, fv)
+				nextFrontier = append(nextFrontier, partial{fv, i + 1})
+			}
+		}
+		frontier = nextFrontier
+	}
+
+	return flipped
+}
+
+// Finds all of the indexed sub-fingerprints that are equal to or less than a
+// Hamming distance of `r` from the sub-fingerprint. Candidates from the
+// substring lookups are verified with the full Hamming distance.
+func (mi *multi_index) searchWithin(sfp sub_fingerprint, r int) []sub_fingerprint {
+	substringRadius := r / len(mi.substrings)
+	v := subFingerprintToUint64(sfp, mi.bits)
+
+	seen := make(map[sub_fingerprint]bool)
+	var found []sub_fingerprint
+	for i, s := range mi.substrings {
+		for _, key := range flipSubstringBitsUntil(s.of(v), s.length, substringRadius) {
+			for _, candidate := range mi.tables[i][key] {
+				if seen[candidate] {
+					continue
+				}
+				seen[candidate] = true
+
+				if bits.OnesCount64(v^subFingerprintToUint64(candidate, mi.bits)) <= r {
+					found = append(found, candidate)
+				}
+			}
+		}
+	}
+
+	return found
+}
+
+// Creates an approximate search strategy that finds the sub-fingerprints of
+// the index within a Hamming distance of `n` using a multi-index of `m`
+// substrings, or a number chosen from the size of the index when zero (0).
+// Unlike bit flipping, only sub-fingerprints that are in the index are
+// returned. The multi-index is built once, when creating the strategy.
+func multiIndexApproximateSearchStrategy(
+	alg fingerprint_algorithm,
+	idx index,
+	m int,
+	n int) (approximate_search_strategy, error) {
+
+	strategy, _, err := updatableMultiIndexApproximateSearchStrategy(alg, idx, m, n)
+	return strategy, err
+}
+
+// Same as `multiIndexApproximateSearchStrategy`, along with a function adding
+// the sub-fingerprints of a fingerprint to the multi-index, to be called as the
+// fingerprint is added to the index.
+func updatableMultiIndexApproximateSearchStrategy(
+	alg fingerprint_algorithm,
+	idx index,
+	m int,
+	n int) (approximate_search_strategy, func(fp *fingerprint), error) {
+
+	if n < 1 {
+		err := fmt.Errorf("Maximum Hamming distance must be greater than or equal to one: %d", n)
+		return nil, nil, err
+	}
+
+	mi, err := buildMultiIndex(alg, idx, m)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	strategy := func(sfp sub_fingerprint) ([]sub_fingerprint, error) {
+		return mi.searchWithin(sfp, n), nil
+	}
+	add := func(fp *fingerprint) {
+		for _, sfp := range fp.sfps {
+			mi.add(sfp)
+		}
+	}
+
+	return strategy, add, nil
+}
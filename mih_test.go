@@ -0,0 +1,133 @@
+package main
+
+import "testing"
+
+func TestSplitSubstrings(t *testing.T) {
+	fixtures := []struct {
+		m        int
+		expected []substring_bits
+	}{
+		{1, []substring_bits{{0, 32}}},
+		{4, []substring_bits{{24, 8}, {16, 8}, {8, 8}, {0, 8}}},
+		{3, []substring_bits{{21, 11}, {10, 11}, {0, 10}}},
+	}
+
+	for i, fixture := range fixtures {
+		got := splitSubstrings(32, fixture.m)
+		if len(fixture.expected) != len(got) {
+			t.Fatalf("[%d] Expected %d substrings but got %d", i, len(fixture.expected), len(got))
+		}
+
+		for j, expected := range fixture.expected {
+			if expected != got[j] {
+				t.Errorf("[%d][%d] Expected substring %+v but got %+v", i, j, expected, got[j])
+			}
+		}
+	}
+}
+
+func TestChooseMultiIndexSubstrings(t *testing.T) {
+	fixtures := []struct {
+		keys     int
+		expected int
+	}{
+		{0, 1},
+		{1, 1},
+		{2, 32},
+		{1 << 8, 4},
+		{1 << 16, 2},
+		{1 << 20, 2},
+		{1 << 30, 1},
+	}
+
+	for i, fixture := range fixtures {
+		if got := chooseMultiIndexSubstrings(32, fixture.keys); fixture.expected != got {
+			t.Errorf("[%d] Expected %d substrings for %d keys but got %d", i, fixture.expected, fixture.keys, got)
+		}
+	}
+}
+
+func TestFlipSubstringBitsUntil(t *testing.T) {
+	fixtures := []struct {
+		length   int
+		n        int
+		expected int
+	}{
+		{8, 0, 1},
+		{8, 1, 1 + 8},
+		{8, 2, 1 + 8 + 28},
+		{11, 3, 1 + 11 + 55 + 165},
+	}
+
+	for i, fixture := range fixtures {
+		got := flipSubstringBitsUntil(0x5a, fixture.length, fixture.n)
+		seen := make(map[uint64]bool)
+		for _, v := range got {
+			seen[v] = true
+		}
+
+		if len(got) != fixture.expected || len(seen) != fixture.expected {
+			t.Errorf("[%d] Expected %d distinct values but got %d of %d", i, fixture.expected, len(seen), len(got))
+		}
+	}
+}
+
+// Multi-index hashing must find exactly the indexed sub-fingerprints that a
+// brute force search over the index finds.
+func TestMultiIndexSearchWithin(t *testing.T) {
+	for _, alg := range []fingerprint_algorithm{philips, philips64} {
+		testMultiIndexSearchWithin(t, alg)
+	}
+}
+
+func testMultiIndexSearchWithin(t *testing.T, alg fingerprint_algorithm) {
+	sfps := randomSubFingerprints(alg, 1, 2000)
+
+	// add some close neighbours of the queries so there is something to find
+	queries := sfps[:20]
+	for _, q := range queries {
+		for _, bits := range [][]int{{3}, {5, 17}, {0, 12, 31}, {1, 9, 20, alg.subFingerprintSizeBits() - 1}} {
+			neighbour := q
+			for _, bit := range bits {
+				neighbour = neighbour.flipBit(bit)
+			}
+			sfps = append(sfps, neighbour)
+		}
+	}
+	idx := buildIndex(alg, []fingerprint{{"0001", sfps, fingerprint_meta{}, 0}})
+
+	for _, m := range []int{0, 1, 2, 3, 4} {
+		mi, err := buildMultiIndex(alg, idx, m)
+		if err != nil {
+			t.Fatalf("Building multi-index failed when it should not have: %s", err)
+		}
+
+		for r := 0; r <= 4; r++ {
+			for i, q := range queries {
+				expected := make(map[sub_fingerprint]bool)
+				idx.forEach(func(sfp sub_fingerprint, pl posting_list) {
+					if q.hammingDistanceTo(sfp) <= r {
+						expected[sfp] = true
+					}
+				})
+
+				got := mi.searchWithin(q, r)
+				if len(expected) != len(got) {
+					t.Errorf("[%s m=%d r=%d][%d] Expected %d sub-fingerprints but got %d", alg.name(), m, r, i, len(expected), len(got))
+				}
+
+				for _, sfp := range got {
+					if !expected[sfp] {
+						t.Errorf("[%s m=%d r=%d][%d] Unexpected sub-fingerprint %v", alg.name(), m, r, i, sfp)
+					}
+				}
+			}
+		}
+	}
+
+	for _, m := range []int{-1, alg.subFingerprintSizeBits() + 1} {
+		if _, err := buildMultiIndex(alg, idx, m); err == nil {
+			t.Errorf("Expected an error building a multi-index with %d substrings", m)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+const (
+	DefaultMonitorStopAfter = 2 // windows
+)
+
+// An event of a stream monitor, when a reference starts or stops matching the
+// stream. The position is of the stream, in sub-fingerprints since the start
+// of the stream, and the offset is the position in the reference aligned with
+// it. A start is at the start of the first window that matched, and a stop at
+// the end of the last window that matched.
+type monitor_event struct {
+	Type            string  `json:"type"`
+	Id              string  `json:"id"`
+	Position        int     `json:"position"`
+	PositionSeconds float64 `json:"position_seconds"`
+	Offset          int     `json:"offset"`
+	OffsetSeconds   float64 `json:"offset_seconds"`
+	BER             float32 `json:"ber"`
+}
+
+// Creates an event of a reference at a position in the stream, which is taken
+// to have the frame hop of the Philips defaults when converted to seconds.
+func newMonitorEvent(eventType string, fp *fingerprint, position int, offset int, ber float32) monitor_event {
+	return monitor_event{
+		eventType,
+		fp.id,
+		position,
+		fingerprint_meta{}.seconds(position),
+		offset,
+		fp.meta.seconds(offset),
+		ber,
+	}
+}
+
+// A reference matching the stream, with its alignment as the offset in the
+// reference of the start of the stream, which drifts when the stream and
+// reference differ in speed.
+type monitored_track struct {
+	fp        *fingerprint
+	alignment int
+	ber       float32
+	end       int // position of the end of the last window that matched
+	misses    int // consecutive windows that did not match
+}
+
+// Monitors a continuous stream of sub-fingerprints for what is playing over
+// time. The stream is fed incrementally, and every step of new
+// sub-fingerprints the most recent block is searched as a rolling window. A
+// reference starts playing when a window first matches it, and stops when it
+// has not matched for a number of windows in a row. Speed factors are not
+// used, so the stream is searched frame for frame.
+type stream_monitor struct {
+	params    search_params
+	generator candidate_generator
+	stopAfter int
+	window    []sub_fingerprint // the most recent block of the stream
+	position  int               // of the next sub-fingerprint
+	sinceStep int               // sub-fingerprints since the last search
+	tracks    map[*fingerprint]*monitored_track
+}
+
+// Creates a stream monitor searching the index with the given parameters,
+// which stops tracking a reference after it has not matched the given number
+// of windows in a row.
+func newStreamMonitor(params search_params, idx index, stopAfter int) (*stream_monitor, error) {
+	generator, err := params.candidateGenerator(idx)
+	if err != nil {
+		return nil, err
+	}
+
+	return newStreamMonitorWith(params, generator, stopAfter)
+}
+
+// Same as `newStreamMonitor` but with a candidate generator already created
+// from the parameters.
+func newStreamMonitorWith(params search_params, generator candidate_generator, stopAfter int) (*stream_monitor, error) {
+	if params.blockSize < 1 || params.stepSize < 1 {
+		err := fmt.Errorf("Block size and step size must be greater than or equal to one: %d, %d", params.blockSize, params.stepSize)
+		return nil, err
+	}
+
+	if stopAfter < 1 {
+		return nil, fmt.Errorf("Number of windows to stop after must be greater than or equal to one: %d", stopAfter)
+	}
+
+	return &stream_monitor{
+		params:    params,
+		generator: generator,
+		stopAfter: stopAfter,
+		window:    make([]sub_fingerprint, 0, params.blockSize),
+		tracks:    make(map[*fingerprint]*monitored_track),
+	}, nil
+}
+
+// Feeds sub-fingerprints of the stream to the monitor, returning any events
+// from the windows searched, in order.
+func (m *stream_monitor) push(sfps []sub_fingerprint) ([]monitor_event, error) {
+	var events []monitor_event
+	for _, sfp := range sfps {
+		if len(m.window) == m.params.blockSize {
+			copy(m.window, m.window[1:])
+			m.window = m.window[:len(m.window)-1]
+		}
+		m.window = append(m.window, sfp)
+		m.position++
+		m.sinceStep++
+
+		// search the first full block, then every step after it
+		if len(m.window) < m.params.blockSize {
+			continue
+		}
+		if m.position > m.params.blockSize && m.sinceStep < m.params.stepSize {
+			continue
+		}
+		m.sinceStep = 0
+
+		windowEvents, err := m.searchWindow()
+		if err != nil {
+			return events, err
+		}
+		events = append(events, windowEvents...)
+	}
+
+	return events, nil
+}
+
+// Searches the current window, updating the tracks and returning the events of
+// references starting and stopping, with stops first.
+func (m *stream_monitor) searchWindow() ([]monitor_event, error) {
+	queryFpb := fingerprint_block(m.window)
+	start := m.position - len(m.window)
+
+	candidates, err := m.generator(queryFpb)
+	if err != nil {
+		return nil, err
+	}
+
+	// the best alignment of each reference in this window
+	best := make(map[*fingerprint]monitored_track)
+	for _, c := range filterCandidatesByBER(m.params.algorithm, queryFpb, candidates, float32(m.params.ber), float32(m.params.minOverlap)) {
+		found := monitored_track{fp: c.fp, alignment: c.offset - start, ber: candidateBitErrorRate(m.params.algorithm, queryFpb, c)}
+		if b, seen := best[c.fp]; !seen || m.betterAlignment(found, b) {
+			best[c.fp] = found
+		}
+	}
+
+	var stops, starts []monitor_event
+	for fp, track := range m.tracks {
+		if _, found := best[fp]; found {
+			continue
+		}
+
+		track.misses++
+		if track.misses >= m.stopAfter {
+			stops = append(stops, track.event("stop"))
+			delete(m.tracks, fp)
+		}
+	}
+
+	for fp, found := range best {
+		track, tracked := m.tracks[fp]
+		if !tracked {
+			track = &monitored_track{fp: fp}
+			m.tracks[fp] = track
+		}
+
+		track.alignment, track.ber, track.misses = found.alignment, found.ber, 0
+		track.end = m.position
+
+		if !tracked {
+			starts = append(starts, newMonitorEvent("start", fp, start, start+found.alignment, found.ber))
+		}
+	}
+
+	sort.Sort(monitor_events_by_id(stops))
+	sort.Sort(monitor_events_by_id(starts))
+
+	return append(stops, starts...), nil
+}
+
+// Determines if an alignment of a reference is better than another. For a
+// reference already being tracked, the alignment closest to that of the track
+// is better, so that a track doesn't jump between repeated segments, and
+// otherwise the one with the lowest BER.
+func (m *stream_monitor) betterAlignment(a monitored_track, b monitored_track) bool {
+	if track, tracked := m.tracks[a.fp]; tracked {
+		da, db := abs(a.alignment-track.alignment), abs(b.alignment-track.alignment)
+		if da != db {
+			return da < db
+		}
+	}
+
+	if a.ber != b.ber {
+		return a.ber < b.ber
+	}
+	return a.alignment < b.alignment
+}
+
+// The references currently matching the stream, in ID order, as events of
+// where each last matched.
+func (m *stream_monitor) playing() []monitor_event {
+	var events []monitor_event
+	for _, track := range m.tracks {
+		events = append(events, track.event("playing"))
+	}
+	sort.Sort(monitor_events_by_id(events))
+
+	return events
+}
+
+// Ends the stream, stopping every reference still matching.
+func (m *stream_monitor) close() []monitor_event {
+	var events []monitor_event
+	for fp, track := range m.tracks {
+		events = append(events, track.event("stop"))
+		delete(m.tracks, fp)
+	}
+	sort.Sort(monitor_events_by_id(events))
+
+	return events
+}
+
+// An event at the end of the last window the track matched.
+func (track *monitored_track) event(eventType string) monitor_event {
+	return newMonitorEvent(eventType, track.fp, track.end, track.end+track.alignment, track.ber)
+}
+
+type monitor_events_by_id []monitor_event
+
+func (s monitor_events_by_id) Len() int           { return len(s) }
+func (s monitor_events_by_id) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s monitor_events_by_id) Less(i, j int) bool { return s[i].Id < s[j].Id }
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
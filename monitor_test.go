@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// A stream of noise with two references playing in it, along with the stream
+// position and reference offset at which each starts and stops playing.
+func buildTestStream(t *testing.T) ([]fingerprint, []sub_fingerprint, []monitor_event) {
+	p := defaultCorpusParams()
+	p.size, p.minLength, p.maxLength, p.segmentLength = 20, 2000, 3000, 256
+	p.silenceFraction, p.repeatFraction, p.sharedFraction = 0, 0, 0
+	corpus, err := generateCorpus(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stream []sub_fingerprint
+	stream = append(stream, randomSubFingerprints(philips, 1, 1000)...)
+	stream = append(stream, corpus[3].sfps[200:1200]...)
+	stream = append(stream, randomSubFingerprints(philips, 2, 1000)...)
+	stream = append(stream, corpus[11].sfps[0:800]...)
+	stream = append(stream, randomSubFingerprints(philips, 3, 600)...)
+
+	playing := []monitor_event{
+		{Type: "start", Id: corpus[3].id, Position: 1000, Offset: 200},
+		{Type: "stop", Id: corpus[3].id, Position: 2000, Offset: 1200},
+		{Type: "start", Id: corpus[11].id, Position: 3000, Offset: 0},
+		{Type: "stop", Id: corpus[11].id, Position: 3800, Offset: 800},
+	}
+
+	return corpus, stream, playing
+}
+
+func testMonitorParams() search_params {
+	params := defaultSearchParams()
+	params.blockSize, params.stepSize = 128, 64
+	return params
+}
+
+// Pushes the stream in uneven chunks, collecting every event.
+func monitorTestStream(t *testing.T, monitor *stream_monitor, stream []sub_fingerprint) []monitor_event {
+	var events []monitor_event
+	sizes := []int{1, 7, 100, 333}
+	for i, start := 0, 0; start < len(stream); i++ {
+		end := start + sizes[i%len(sizes)]
+		if end > len(stream) {
+			end = len(stream)
+		}
+
+		chunkEvents, err := monitor.push(stream[start:end])
+		if err != nil {
+			t.Fatalf("Push failed when it should not have: %s", err)
+		}
+		events = append(events, chunkEvents...)
+		start = end
+	}
+
+	return append(events, monitor.close()...)
+}
+
+// Events are expected within a step and block of where a reference starts or
+// stops playing, since windows partly overlapping it can match too, but always
+// at the offset aligned with the stream.
+func checkMonitorEvents(t *testing.T, expected []monitor_event, got []monitor_event, blockSize int) {
+	if len(expected) != len(got) {
+		t.Fatalf("Expected %d events but got %d: %v", len(expected), len(got), got)
+	}
+
+	for i, e := range expected {
+		g := got[i]
+		if e.Type != g.Type || e.Id != g.Id {
+			t.Errorf("[%d] Expected a %s of %s but was a %s of %s", i, e.Type, e.Id, g.Type, g.Id)
+		}
+
+		if g.Position < e.Position-blockSize || g.Position > e.Position+blockSize {
+			t.Errorf("[%d] Expected a position near %d but was %d", i, e.Position, g.Position)
+		}
+
+		if e.Offset-e.Position != g.Offset-g.Position {
+			t.Errorf("[%d] Expected offset %d at position %d but was %d", i, e.Offset, e.Position, g.Offset-g.Position+e.Position)
+		}
+
+		meta := defaultFingerprintMeta()
+		if meta.seconds(g.Position) != g.PositionSeconds || meta.seconds(g.Offset) != g.OffsetSeconds {
+			t.Errorf("[%d] Expected times %fs and %fs but were %fs and %fs", i, meta.seconds(g.Position), meta.seconds(g.Offset), g.PositionSeconds, g.OffsetSeconds)
+		}
+	}
+}
+
+func TestStreamMonitor(t *testing.T) {
+	corpus, stream, expected := buildTestStream(t)
+	idx := buildIndex(philips, corpus)
+	params := testMonitorParams()
+
+	monitor, err := newStreamMonitor(params, idx, DefaultMonitorStopAfter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMonitorEvents(t, expected, monitorTestStream(t, monitor, stream), params.blockSize)
+
+	// the same events whether pushed in chunks or all at once
+	monitor, _ = newStreamMonitor(params, idx, DefaultMonitorStopAfter)
+	events, _ := monitor.push(stream)
+	checkMonitorEvents(t, expected, append(events, monitor.close()...), params.blockSize)
+
+	// part way through the first reference, it is playing at its aligned offset
+	monitor, _ = newStreamMonitor(params, idx, DefaultMonitorStopAfter)
+	monitor.push(stream[:1500])
+	playing := monitor.playing()
+	if len(playing) != 1 || playing[0].Id != corpus[3].id || playing[0].Offset-playing[0].Position != -800 {
+		t.Errorf("Expected %s playing aligned with the stream but was %v", corpus[3].id, playing)
+	}
+
+	for i, fixture := range []struct {
+		blockSize int
+		stopAfter int
+	}{{0, 1}, {128, 0}} {
+		params.blockSize = fixture.blockSize
+		if _, err := newStreamMonitor(params, idx, fixture.stopAfter); err == nil {
+			t.Errorf("[%d] Expected an error creating a stream monitor", i)
+		}
+	}
+}
+
+func TestMonitorHandler(t *testing.T) {
+	corpus, stream, expected := buildTestStream(t)
+	s, err := newIndexServer(philips, defaultSearchParams(), corpus, buildIndex(philips, corpus))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var body bytes.Buffer
+	for start := 0; start < len(stream); start += 250 {
+		end := start + 250
+		if end > len(stream) {
+			end = len(stream)
+		}
+		writeDelimited(&body, newQueryFingerprint(philips, fingerprint{"chunk", stream[start:end], fingerprint_meta{}, 0}))
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/monitor?block_size=128&step_size=64&stop_after=2", &body)
+	monitorHandler(s)(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d but was %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	var events []monitor_event
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var event monitor_event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("Failed decoding event: %s", err)
+		}
+		events = append(events, event)
+	}
+	checkMonitorEvents(t, expected, events, 128)
+
+	fixtures := []struct {
+		query  string
+		status int
+	}{
+		{"stop_after=0", http.StatusBadRequest},
+		{"block_size=large", http.StatusBadRequest},
+		{"unknown=1", http.StatusBadRequest},
+	}
+
+	for i, fixture := range fixtures {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/monitor?"+fixture.query, &bytes.Buffer{})
+		monitorHandler(s)(w, r)
+
+		if fixture.status != w.Code {
+			t.Errorf("[%d] Expected status %d but was %d", i, fixture.status, w.Code)
+		}
+	}
+}
+
+func TestMonitorHandlerWithFingerprintsAdded(t *testing.T) {
+	corpus, stream, expected := buildTestStream(t)
+	added := corpus[11]
+	corpus = append(corpus[:11], corpus[12:]...)
+	s, err := newIndexServer(philips, defaultSearchParams(), corpus, buildIndex(philips, corpus))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(monitorHandler(s))
+	defer server.Close()
+
+	// the response starts once the first chunk is searched, before the
+	// reference is added, and a filter only passes fingerprints added since
+	body, chunks := io.Pipe()
+	responses := make(chan *http.Response)
+	go func() {
+		response, err := http.Post(server.URL+"/monitor?block_size=128&step_size=64&stop_after=2&id_prefix=0", "application/octet-stream", body)
+		if err != nil {
+			t.Error(err)
+			body.Close()
+		}
+		responses <- response
+	}()
+
+	writeDelimited(chunks, newQueryFingerprint(philips, fingerprint{"chunk", stream[:250], fingerprint_meta{}, 0}))
+	response := <-responses
+	if response == nil {
+		t.FailNow()
+	}
+	defer response.Body.Close()
+
+	if ok, err := s.add(added); !ok || err != nil {
+		t.Fatalf("Failed adding fingerprint: %v", err)
+	}
+
+	for start := 250; start < len(stream); start += 250 {
+		end := start + 250
+		if end > len(stream) {
+			end = len(stream)
+		}
+		writeDelimited(chunks, newQueryFingerprint(philips, fingerprint{"chunk", stream[start:end], fingerprint_meta{}, 0}))
+	}
+	chunks.Close()
+
+	var events []monitor_event
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		var event monitor_event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("Failed decoding event: %s", err)
+		}
+		events = append(events, event)
+	}
+	checkMonitorEvents(t, expected, events, 128)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+const (
+	DefaultBitErrorRate       = 0.35 // threshold suggested in the Philips paper
+	DefaultMaxHammingDistance = 2
+)
+
+// The parameters of a search, shared between the HTTP API and the commands so
+// that the same knobs are available everywhere.
+type search_params struct {
+	algorithm            fingerprint_algorithm
+	blockSize            int
+	stepSize             int
+	approxSearchStrategy string
+	maxHammingDistance   int
+	mihSubstrings        int
+	lshTables            int
+	lshBits              int
+	ber                  float64
+	minOverlap           float64
+	trailingBlock        bool
+	speedFactors         string
+}
+
+// The default search parameters of the Philips algorithm. The algorithm is
+// replaced with that of the index being searched, see `forAlgorithm`.
+func defaultSearchParams() search_params {
+	return philips.defaultSearchParams()
+}
+
+// Changes the parameters to those of another algorithm, keeping any that were
+// set explicitly with flags rather than left at the defaults of the previous
+// algorithm. The flags must have been registered with `registerFlags`.
+func (p search_params) forAlgorithm(alg fingerprint_algorithm, flags *flag.FlagSet) (search_params, error) {
+	if p.algorithm != nil && p.algorithm.name() == alg.name() {
+		return p, nil
+	}
+
+	q := alg.defaultSearchParams()
+	if flags == nil {
+		return q, nil
+	}
+
+	// re-apply the flags that were set to the defaults of the new algorithm
+	var err error
+	reapply := flag.NewFlagSet(flags.Name(), flag.ContinueOnError)
+	q.registerFlags(reapply)
+	flags.Visit(func(f *flag.Flag) {
+		if reapply.Lookup(f.Name) == nil || err != nil {
+			return
+		}
+		if e := reapply.Set(f.Name, f.Value.String()); e != nil {
+			err = fmt.Errorf("Invalid parameter %s for the %s algorithm: %s", f.Name, alg.name(), e)
+		}
+	})
+
+	return q, err
+}
+
+// Registers command line flags for each of the search parameters, using the
+// current values as defaults. Flags are named the same as in the HTTP API.
+func (p *search_params) registerFlags(flags *flag.FlagSet) {
+	flags.IntVar(&p.blockSize, "block_size", p.blockSize, "number of sub-fingerprints in a query fingerprint block")
+	flags.IntVar(&p.stepSize, "step_size", p.stepSize, "number of sub-fingerprints to step between query fingerprint blocks")
+	flags.StringVar(&p.approxSearchStrategy, "approx_search_strategy", p.approxSearchStrategy, "approximate search strategy: none, flip, mih or lsh")
+	flags.IntVar(&p.maxHammingDistance, "max_hamming_distance", p.maxHammingDistance, "maximum Hamming distance of a sub-fingerprint when bit flipping or multi-index hashing")
+	flags.IntVar(&p.mihSubstrings, "mih_substrings", p.mihSubstrings, "number of substrings a sub-fingerprint is split into when multi-index hashing")
+	flags.IntVar(&p.lshTables, "lsh_tables", p.lshTables, "number of LSH tables of fingerprint blocks")
+	flags.IntVar(&p.lshBits, "lsh_bits", p.lshBits, "number of bits sampled from a fingerprint block for each LSH table")
+	flags.Float64Var(&p.ber, "ber", p.ber, "upper bound threshold of the bit error rate between fingerprint blocks")
+	flags.Float64Var(&p.minOverlap, "min_overlap", p.minOverlap, "minimum fraction of a query block that must overlap a reference")
+	flags.BoolVar(&p.trailingBlock, "trailing_block", p.trailingBlock, "search the end of the query with a shorter trailing block")
+	flags.StringVar(&p.speedFactors, "speed_factors", p.speedFactors, "comma separated speed factors to stretch the query by before searching")
+}
+
+// The values of the search parameters as strings, by the names of their flags.
+func (p search_params) flagValues() map[string]string {
+	flags := flag.NewFlagSet("params", flag.ContinueOnError)
+	p.registerFlags(flags)
+
+	values := make(map[string]string)
+	flags.VisitAll(func(f *flag.Flag) {
+		values[f.Name] = f.Value.String()
+	})
+
+	return values
+}
+
+// Adds the LSH tables of these parameters to the index when searching with
+// LSH, unless the index already has them, so that a served index builds them
+// once and keeps them up to date as fingerprints are added.
+func (p search_params) withLSHTables(idx index) (index, error) {
+	if p.approxSearchStrategy != "lsh" || idx.lsh.matches(p.blockSize, p.lshTables, p.lshBits) {
+		return idx, nil
+	}
+
+	lsh, err := buildLSHIndex(p.algorithm, idx, p.blockSize, p.lshTables, p.lshBits)
+	if err != nil {
+		return idx, err
+	}
+	idx.lsh = lsh
+
+	return idx, nil
+}
+
+// Creates the candidate generator of these parameters for the index, from
+// the approximate search strategy. This may be expensive, for example building
+// a multi-index or LSH tables, so create it once when searching with many
+// queries.
+func (p search_params) candidateGenerator(idx index) (candidate_generator, error) {
+	generators, err := p.candidateGenerators(idx)
+	if err != nil {
+		return nil, err
+	}
+
+	return generators(nil), nil
+}
+
+// Same as `candidateGenerator` but creating generators restricted to a set of
+// fingerprints, so that a filtered search shares what is expensive to create.
+func (p search_params) candidateGenerators(idx index) (candidate_generators, error) {
+	generators, _, err := p.updatableCandidateGenerators(idx)
+	return generators, err
+}
+
+// Same as `candidateGenerators`, along with a function adding a fingerprint to
+// what the generators keep of the index of their own, such as a multi-index or
+// LSH tables, to be called as the fingerprint is added to the index. The
+// function is nil when the generators only use the index itself.
+func (p search_params) updatableCandidateGenerators(idx index) (candidate_generators, func(fp *fingerprint), error) {
+	if p.approxSearchStrategy == "lsh" {
+		return updatableLSHCandidateGenerators(p.algorithm, idx, p.blockSize, p.lshTables, p.lshBits)
+	}
+
+	var strategy approximate_search_strategy
+	var add func(fp *fingerprint)
+	var err error
+	if p.approxSearchStrategy == "mih" {
+		strategy, add, err = updatableMultiIndexApproximateSearchStrategy(p.algorithm, idx, p.mihSubstrings, p.maxHammingDistance)
+	} else {
+		strategy, err = newApproximateSearchStrategy(p.algorithm, p.approxSearchStrategy, p.maxHammingDistance, p.mihSubstrings, idx)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	generators := func(set fingerprint_set) candidate_generator {
+		return subFingerprintCandidateGenerator(strategy, idx, set)
+	}
+
+	return generators, add, nil
+}
+
+// Searches the index with the query fingerprint using these parameters,
+// keeping the results of each window of the query separate.
+func (p search_params) searchWindows(queryFp fingerprint, idx index) ([]window_result, error) {
+	generator, err := p.candidateGenerator(idx)
+	if err != nil {
+		return make([]window_result, 0), err
+	}
+
+	return p.searchWindowsWith(queryFp, generator)
+}
+
+// Same as `searchWindows` but with a candidate generator already created from
+// these parameters. The query is searched at each of the speed factors.
+func (p search_params) searchWindowsWith(queryFp fingerprint, generator candidate_generator) ([]window_result, error) {
+	factors, err := parseSpeedFactors(p.speedFactors)
+	if err != nil {
+		return make([]window_result, 0), err
+	}
+
+	return searchSpeedFactors(queryFp, factors, p.blockSize, func(stretched fingerprint) ([]window_result, error) {
+		return searchByFingerprintWindowsWith(
+			p.algorithm,
+			stretched,
+			p.blockSize,
+			p.stepSize,
+			generator,
+			float32(p.ber),
+			float32(p.minOverlap),
+			p.trailingBlock,
+		)
+	})
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+)
+
+// The fingerprint algorithms an index can be built with. Indexes persisted
+// before there was a choice of algorithm have no algorithm, being Philips.
+const (
+	PhilipsAlgorithm   = "philips"
+	Philips64Algorithm = "philips64"
+	LandmarkAlgorithm  = "landmark"
+)
+
+// The persisted form of an index and the corpus it was built from. Postings
+// refer to fingerprints by their position in the corpus rather than by pointer
+// so that the index can be written out and read back in again. The
+// sub-fingerprints of algorithms of up to 32 bits are written as 32 bits, as
+// they were before there were wider algorithms, so that those indexes can
+// still be read, and those of wider algorithms in fields of their own. LSH
+// tables are only written when the index has them.
+type persisted_index struct {
+	Algorithm    string
+	Fingerprints []persisted_fingerprint
+	Postings     map[sub_fingerprint32][]persisted_posting
+	WidePostings map[sub_fingerprint][]persisted_posting
+	LSH          *persisted_lsh_index
+}
+
+type persisted_fingerprint struct {
+	Id         string
+	Sfps       []sub_fingerprint32
+	WideSfps   []sub_fingerprint
+	FrameHop   float64
+	SampleRate int
+	Fields     map[string]string
+}
+
+type persisted_posting struct {
+	Fingerprint int
+	Offset      int
+}
+
+type persisted_lsh_index struct {
+	BlockSize int
+	Tables    []persisted_lsh_table
+	Postings  []persisted_posting
+}
+
+type persisted_lsh_table struct {
+	Offsets []int
+	Bits    []int
+	Buckets map[uint64][]int32
+}
+
+// Writes an index and the corpus it was built from, along with the algorithm
+// the fingerprints were extracted with. Every posting in the index must point
+// to a fingerprint in the corpus.
+func writeIndex(w io.Writer, alg fingerprint_algorithm, corpus []fingerprint, idx index) error {
+	narrow := idx.isNarrow()
+	positions := make(map[*fingerprint]int, len(corpus))
+	p := persisted_index{
+		Algorithm:    alg.name(),
+		Fingerprints: make([]persisted_fingerprint, len(corpus)),
+	}
+	if narrow {
+		p.Postings = make(map[sub_fingerprint32][]persisted_posting, idx.size())
+	} else {
+		p.WidePostings = make(map[sub_fingerprint][]persisted_posting, idx.size())
+	}
+
+	for i := range corpus {
+		positions[&corpus[i]] = i
+		p.Fingerprints[i] = persisted_fingerprint{
+			Id:         corpus[i].id,
+			FrameHop:   corpus[i].meta.frameHop,
+			SampleRate: corpus[i].meta.sampleRate,
+			Fields:     corpus[i].meta.fields,
+		}
+		if narrow {
+			p.Fingerprints[i].Sfps = make([]sub_fingerprint32, len(corpus[i].sfps))
+			for j, sfp := range corpus[i].sfps {
+				p.Fingerprints[i].Sfps[j] = sfp.narrow()
+			}
+		} else {
+			p.Fingerprints[i].WideSfps = corpus[i].sfps
+		}
+	}
+
+	var err error
+	idx.forEach(func(sfp sub_fingerprint, pl posting_list) {
+		ppl, plErr := persistPostings(pl, positions)
+		if plErr != nil {
+			err = plErr
+		} else if narrow {
+			p.Postings[sfp.narrow()] = ppl
+		} else {
+			p.WidePostings[sfp] = ppl
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if idx.lsh != nil {
+		p.LSH = &persisted_lsh_index{
+			BlockSize: idx.lsh.blockSize,
+			Tables:    make([]persisted_lsh_table, len(idx.lsh.tables)),
+		}
+		for i, t := range idx.lsh.tables {
+			pt := persisted_lsh_table{make([]int, len(t.bits)), make([]int, len(t.bits)), t.buckets}
+			for j, b := range t.bits {
+				pt.Offsets[j], pt.Bits[j] = b.offset, b.bit
+			}
+			p.LSH.Tables[i] = pt
+		}
+		if p.LSH.Postings, err = persistPostings(idx.lsh.postings, positions); err != nil {
+			return err
+		}
+	}
+
+	return gob.NewEncoder(w).Encode(p)
+}
+
+// Converts postings to refer to fingerprints by their position in the corpus.
+func persistPostings(pl posting_list, positions map[*fingerprint]int) ([]persisted_posting, error) {
+	ppl := make([]persisted_posting, len(pl))
+	for i, posting := range pl {
+		position, found := positions[posting.fp]
+		if !found {
+			return nil, fmt.Errorf("Posting for fingerprint %s does not point into the corpus", posting.fp.id)
+		}
+		ppl[i] = persisted_posting{position, posting.offset}
+	}
+
+	return ppl, nil
+}
+
+// Converts persisted postings to point into the corpus.
+func readPostings(ppl []persisted_posting, corpus []fingerprint) (posting_list, error) {
+	pl := make(posting_list, len(ppl))
+	for i, pp := range ppl {
+		if pp.Fingerprint < 0 || pp.Fingerprint >= len(corpus) {
+			return nil, fmt.Errorf("Posting refers to fingerprint %d but the corpus is of size %d", pp.Fingerprint, len(corpus))
+		}
+		pl[i] = posting{&corpus[pp.Fingerprint], pp.Offset}
+	}
+
+	return pl, nil
+}
+
+// Reads an index, the corpus it was built from and its algorithm, as written by
+// `writeIndex`, including those written before there was a choice of algorithm.
+func readIndex(r io.Reader) (fingerprint_algorithm, []fingerprint, index, error) {
+	var p persisted_index
+	if err := gob.NewDecoder(r).Decode(&p); err != nil {
+		return nil, nil, index{}, fmt.Errorf("Failed decoding index: %s", err)
+	}
+
+	if p.Algorithm == LandmarkAlgorithm {
+		return nil, nil, index{}, fmt.Errorf("Index was built with the %s algorithm, which only the query and serve commands can read, given -algorithm=%s", p.Algorithm, p.Algorithm)
+	}
+
+	alg, err := newFingerprintAlgorithm(p.Algorithm)
+	if err != nil {
+		return nil, nil, index{}, err
+	}
+
+	corpus := make([]fingerprint, len(p.Fingerprints))
+	for i, pfp := range p.Fingerprints {
+		sfps := pfp.WideSfps
+		if len(pfp.Sfps) > 0 {
+			sfps = make([]sub_fingerprint, len(pfp.Sfps))
+			for j, n := range pfp.Sfps {
+				sfps[j] = n.widen()
+			}
+		}
+		corpus[i] = fingerprint{pfp.Id, sfps, fingerprint_meta{pfp.FrameHop, pfp.SampleRate, pfp.Fields}, 0}
+	}
+
+	idx := newIndex(alg)
+	add := func(sfp sub_fingerprint, ppl []persisted_posting) error {
+		pl, err := readPostings(ppl, corpus)
+		if err != nil {
+			return err
+		}
+		idx.append(sfp, pl...)
+		return nil
+	}
+
+	for n, ppl := range p.Postings {
+		if err := add(n.widen(), ppl); err != nil {
+			return nil, nil, index{}, err
+		}
+	}
+	for sfp, ppl := range p.WidePostings {
+		if err := add(sfp, ppl); err != nil {
+			return nil, nil, index{}, err
+		}
+	}
+
+	if p.LSH != nil {
+		idx.lsh, err = readLSHIndex(p.LSH, corpus)
+		if err != nil {
+			return nil, nil, index{}, err
+		}
+	}
+
+	return alg, corpus, idx, nil
+}
+
+// Reads the LSH tables of an index, with postings pointing into the corpus.
+func readLSHIndex(p *persisted_lsh_index, corpus []fingerprint) (*lsh_index, error) {
+	if len(p.Tables) == 0 {
+		return nil, fmt.Errorf("LSH index has no tables")
+	}
+
+	lsh := &lsh_index{
+		blockSize: p.BlockSize,
+		tables:    make([]lsh_table, len(p.Tables)),
+	}
+
+	var err error
+	if lsh.postings, err = readPostings(p.Postings, corpus); err != nil {
+		return nil, err
+	}
+
+	for i, pt := range p.Tables {
+		if len(pt.Offsets) != len(pt.Bits) {
+			return nil, fmt.Errorf("LSH table %d has %d offsets but %d bits", i, len(pt.Offsets), len(pt.Bits))
+		}
+
+		t := lsh_table{make([]lsh_bit, len(pt.Bits)), pt.Buckets}
+		for j, offset := range pt.Offsets {
+			if offset < 0 || offset >= p.BlockSize {
+				return nil, fmt.Errorf("LSH table %d samples offset %d of blocks of size %d", i, offset, p.BlockSize)
+			}
+			t.bits[j] = lsh_bit{offset, pt.Bits[j]}
+		}
+		for _, positions := range pt.Buckets {
+			for _, position := range positions {
+				if position < 0 || int(position) >= len(lsh.postings) {
+					return nil, fmt.Errorf("LSH table %d refers to block %d but there are %d", i, position, len(lsh.postings))
+				}
+			}
+		}
+		if t.buckets == nil {
+			t.buckets = make(map[uint64][]int32)
+		}
+		lsh.tables[i] = t
+	}
+
+	return lsh, nil
+}
+
+// Reads an index, its corpus and its algorithm from a file.
+func readIndexFile(path string) (fingerprint_algorithm, []fingerprint, index, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, index{}, err
+	}
+	defer f.Close()
+
+	return readIndex(bufio.NewReader(f))
+}
+
+// Writes an index, its corpus and its algorithm to a file, replacing any
+// existing file.
+func writeIndexFile(path string, alg fingerprint_algorithm, corpus []fingerprint, idx index) error {
+	return writeFile(path, func(w io.Writer) error {
+		return writeIndex(w, alg, corpus, idx)
+	})
+}
+
+// The persisted form of a landmark index, which is only the corpus it was
+// built from since the index is quick to build again when read. The algorithm
+// is shared with `persisted_index` so that reading the wrong kind of index
+// fails clearly.
+type persisted_landmark_index struct {
+	Algorithm            string
+	LandmarkFingerprints []persisted_landmark_fingerprint
+}
+
+type persisted_landmark_fingerprint struct {
+	Id     string
+	Hashes []landmark_hash
+	Times  []int
+}
+
+// Writes the corpus of a landmark index.
+func writeLandmarkIndex(w io.Writer, corpus []landmark_fingerprint) error {
+	p := persisted_landmark_index{
+		Algorithm:            LandmarkAlgorithm,
+		LandmarkFingerprints: make([]persisted_landmark_fingerprint, len(corpus)),
+	}
+
+	for i, lfp := range corpus {
+		plfp := persisted_landmark_fingerprint{
+			lfp.id,
+			make([]landmark_hash, len(lfp.landmarks)),
+			make([]int, len(lfp.landmarks)),
+		}
+		for j, l := range lfp.landmarks {
+			plfp.Hashes[j], plfp.Times[j] = l.hash, l.time
+		}
+		p.LandmarkFingerprints[i] = plfp
+	}
+
+	return gob.NewEncoder(w).Encode(p)
+}
+
+// Reads the corpus of a landmark index and builds the index again, as written
+// by `writeLandmarkIndex`.
+func readLandmarkIndex(r io.Reader) ([]landmark_fingerprint, landmark_index, error) {
+	var p persisted_landmark_index
+	if err := gob.NewDecoder(r).Decode(&p); err != nil {
+		return nil, nil, err
+	}
+
+	if p.Algorithm != LandmarkAlgorithm {
+		algorithm := p.Algorithm
+		if algorithm == "" {
+			algorithm = PhilipsAlgorithm
+		}
+		return nil, nil, fmt.Errorf("Index was built with the %s algorithm, not %s", algorithm, LandmarkAlgorithm)
+	}
+
+	corpus := make([]landmark_fingerprint, len(p.LandmarkFingerprints))
+	for i, plfp := range p.LandmarkFingerprints {
+		if len(plfp.Hashes) != len(plfp.Times) {
+			err := fmt.Errorf("Landmark fingerprint %s has %d hashes but %d times", plfp.Id, len(plfp.Hashes), len(plfp.Times))
+			return nil, nil, err
+		}
+
+		corpus[i] = landmark_fingerprint{plfp.Id, make([]landmark, len(plfp.Hashes))}
+		for j, hash := range plfp.Hashes {
+			corpus[i].landmarks[j] = landmark{hash, plfp.Times[j]}
+		}
+	}
+
+	return corpus, buildLandmarkIndex(corpus), nil
+}
+
+// Reads a landmark index and its corpus from a file.
+func readLandmarkIndexFile(path string) ([]landmark_fingerprint, landmark_index, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	return readLandmarkIndex(bufio.NewReader(f))
+}
+
+// Writes the corpus of a landmark index to a file, replacing any existing file.
+func writeLandmarkIndexFile(path string, corpus []landmark_fingerprint) error {
+	return writeFile(path, func(w io.Writer) error {
+		return writeLandmarkIndex(w, corpus)
+	})
+}
+
+// Writes a file with a buffered writer, replacing any existing file.
+func writeFile(path string, write func(w io.Writer) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	if err := write(w); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"reflect"
+	"testing"
+)
+
+func TestWriteAndReadIndex(t *testing.T) {
+	for _, alg := range []fingerprint_algorithm{philips, philips64} {
+		corpus := buildTestCorpus()
+		corpus[1].meta = fingerprint_meta{0.01, 44100, map[string]string{"artist": "Artist"}}
+		idx := buildIndex(alg, corpus)
+		lsh, err := buildLSHIndex(alg, idx, 2, 3, 8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		idx.lsh = lsh
+
+		var buf bytes.Buffer
+		if err := writeIndex(&buf, alg, corpus, idx); err != nil {
+			t.Fatalf("[%s] Writing index failed when it should not have: %s", alg.name(), err)
+		}
+
+		gotAlg, gotCorpus, gotIdx, err := readIndex(&buf)
+		if err != nil {
+			t.Fatalf("[%s] Reading index failed when it should not have: %s", alg.name(), err)
+		}
+
+		if gotAlg.name() != alg.name() {
+			t.Errorf("[%s] Expected index of the %s algorithm but was %s", alg.name(), alg.name(), gotAlg.name())
+		}
+
+		if expected, got := len(corpus), len(gotCorpus); expected != got {
+			t.Fatalf("[%s] Expected corpus of size %d but was %d", alg.name(), expected, got)
+		}
+
+		for i, fp := range corpus {
+			if !reflect.DeepEqual(fp.meta, gotCorpus[i].meta) || !reflect.DeepEqual(fp.sfps, gotCorpus[i].sfps) {
+				t.Errorf("[%s][%d] Expected fingerprint %v but was %v", alg.name(), i, fp, gotCorpus[i])
+			}
+		}
+
+		expectIndex(t, alg.name(), idx, gotIdx)
+		expectLSHIndex(t, idx.lsh, gotIdx.lsh)
+
+		// postings must point into the read corpus
+		pl, _ := gotIdx.postings(sub_fingerprint{0, 7, 9, 0})
+		for _, p := range pl {
+			if p.fp != &gotCorpus[2] {
+				t.Errorf("[%s] Expected posting to point to fingerprint in the corpus", alg.name())
+			}
+		}
+	}
+}
+
+// Indexes written before there was a choice of algorithm have 32-bit
+// sub-fingerprints, and no algorithm when written before the choice of
+// fingerprint algorithm was recorded.
+func TestReadIndexOfPhilipsSubFingerprints(t *testing.T) {
+	type old_fingerprint struct {
+		Id   string
+		Sfps [][4]byte
+	}
+	old := struct {
+		Fingerprints []old_fingerprint
+		Postings     map[[4]byte][]persisted_posting
+	}{
+		[]old_fingerprint{{"0001", [][4]byte{{1, 2, 3, 4}, {5, 6, 7, 8}, {1, 2, 3, 4}}}},
+		map[[4]byte][]persisted_posting{
+			{1, 2, 3, 4}: {{0, 0}, {0, 2}},
+			{5, 6, 7, 8}: {{0, 1}},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(old); err != nil {
+		t.Fatal(err)
+	}
+
+	alg, corpus, idx, err := readIndex(&buf)
+	if err != nil {
+		t.Fatalf("Reading index failed when it should not have: %s", err)
+	}
+
+	if alg.name() != philips.name() {
+		t.Errorf("Expected index of the %s algorithm but was %s", philips.name(), alg.name())
+	}
+
+	expected := []fingerprint{{"0001", []sub_fingerprint{{1, 2, 3, 4}, {5, 6, 7, 8}, {1, 2, 3, 4}}, fingerprint_meta{}, 0}}
+	if !reflect.DeepEqual(expected, corpus) {
+		t.Fatalf("Expected corpus %v but was %v", expected, corpus)
+	}
+
+	expectIndex(t, alg.name(), buildIndex(philips, expected), idx)
+}
+
+// Checks that two indexes have the same postings, by ID and offset.
+func expectIndex(t *testing.T, name string, expected index, got index) {
+	if expected.size() != got.size() {
+		t.Fatalf("[%s] Expected index of size %d but was %d", name, expected.size(), got.size())
+	}
+
+	expected.forEach(func(sfp sub_fingerprint, pl posting_list) {
+		gotPl, _ := got.postings(sfp)
+		if len(pl) != len(gotPl) {
+			t.Fatalf("[%s] Expected posting list of size %d for %v but was %d", name, len(pl), sfp, len(gotPl))
+		}
+
+		for i, p := range pl {
+			if p.fp.id != gotPl[i].fp.id || p.offset != gotPl[i].offset {
+				t.Errorf("[%s][%v][%d] Expected posting %s@%d but was %s@%d", name, sfp, i, p.fp.id, p.offset, gotPl[i].fp.id, gotPl[i].offset)
+			}
+		}
+	})
+}
+
+func TestWriteIndexWithPostingOutsideCorpus(t *testing.T) {
+	corpus := buildTestCorpus()
+	idx := buildIndex(philips, buildTestCorpus())
+
+	var buf bytes.Buffer
+	if err := writeIndex(&buf, philips, corpus, idx); err == nil {
+		t.Errorf("Expected an error for postings not pointing into the corpus")
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// Report of a single query, as printed by the `query` command. Positions in
+// the query and in references are reported both in sub-fingerprints and in
+// seconds, from the frame hop of the fingerprint.
+type query_report struct {
+	Query    string           `json:"query"`
+	Size     int              `json:"size"`
+	Duration float64          `json:"duration_ms"`
+	Windows  []window_report  `json:"windows"`
+	Matches  []match_report   `json:"matches"`
+	Segments []segment_report `json:"segments"`
+}
+
+type window_report struct {
+	Speed             float64 `json:"speed"`
+	Offset            int     `json:"offset"`
+	OffsetSeconds     float64 `json:"offset_seconds"`
+	Size              int     `json:"size"`
+	Candidates        int     `json:"candidates"`
+	Matches           int     `json:"matches"`
+	Duration          float64 `json:"duration_ms"`
+	Best              string  `json:"best,omitempty"`
+	BestOffset        int     `json:"best_offset"`
+	BestOffsetSeconds float64 `json:"best_offset_seconds"`
+	BestBER           float32 `json:"best_ber"`
+}
+
+type match_report struct {
+	Id            string            `json:"id"`
+	Offset        int               `json:"offset"`
+	OffsetSeconds float64           `json:"offset_seconds"`
+	Windows       int               `json:"windows"`
+	BER           float32           `json:"ber"`
+	Speed         float64           `json:"speed"`
+	Fields        map[string]string `json:"fields,omitempty"`
+}
+
+// A segment of the timeline, with positions in the query and reference, so
+// that a long query of several references can be turned into a cue sheet.
+type segment_report struct {
+	Id                    string            `json:"id"`
+	QueryStart            int               `json:"query_start"`
+	QueryStartSeconds     float64           `json:"query_start_seconds"`
+	QueryEnd              int               `json:"query_end"`
+	QueryEndSeconds       float64           `json:"query_end_seconds"`
+	ReferenceStart        int               `json:"reference_start"`
+	ReferenceStartSeconds float64           `json:"reference_start_seconds"`
+	ReferenceEnd          int               `json:"reference_end"`
+	ReferenceEndSeconds   float64           `json:"reference_end_seconds"`
+	Windows               int               `json:"windows"`
+	BER                   float32           `json:"ber"`
+	Speed                 float64           `json:"speed"`
+	Fields                map[string]string `json:"fields,omitempty"`
+}
+
+// Reports a segment of a query, with the metadata of the query giving the
+// times of positions in it.
+func newSegmentReport(queryMeta fingerprint_meta, s segment) segment_report {
+	return segment_report{
+		s.fp.id,
+		s.queryStart,
+		queryMeta.seconds(s.queryStart),
+		s.queryEnd,
+		queryMeta.seconds(s.queryEnd),
+		s.referenceStart,
+		s.fp.meta.seconds(s.referenceStart),
+		s.referenceEnd,
+		s.fp.meta.seconds(s.referenceEnd),
+		s.windows,
+		s.ber,
+		s.speed,
+		s.fp.meta.fields,
+	}
+}
+
+func newQueryReport(
+	queryFp fingerprint,
+	results []window_result,
+	windowMatches []window_match,
+	matches []match,
+	segments []segment,
+	duration time.Duration) query_report {
+
+	report := query_report{
+		Query:    queryFp.id,
+		Size:     len(queryFp.sfps),
+		Duration: milliseconds(duration),
+		Windows:  make([]window_report, len(results)),
+		Matches:  make([]match_report, len(matches)),
+		Segments: make([]segment_report, len(segments)),
+	}
+
+	// windows are of the query stretched by their speed
+	for i, result := range results {
+		report.Windows[i] = window_report{
+			Speed:         result.speed,
+			Offset:        result.window.offset,
+			OffsetSeconds: queryFp.meta.seconds(result.window.offset) / result.speed,
+			Size:          result.window.size,
+			Candidates:    result.generated,
+			Matches:       len(result.candidates),
+			Duration:      milliseconds(result.duration),
+		}
+
+		if best := windowMatches[i]; best.fp != nil {
+			report.Windows[i].Best = best.fp.id
+			report.Windows[i].BestOffset = best.offset
+			report.Windows[i].BestOffsetSeconds = best.fp.meta.seconds(best.offset)
+			report.Windows[i].BestBER = best.ber
+		}
+	}
+
+	for i, m := range matches {
+		report.Matches[i] = match_report{m.fp.id, m.offset, m.fp.meta.seconds(m.offset), m.windows, m.ber, m.speed, m.fp.meta.fields}
+	}
+
+	for i, s := range segments {
+		report.Segments[i] = newSegmentReport(queryFp.meta, s)
+	}
+
+	return report
+}
+
+// Formats a position in sub-fingerprints along with its time in seconds.
+func framesAndSeconds(frames int, seconds float64) string {
+	return fmt.Sprintf("%d (%.2fs)", frames, seconds)
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Writes the report as human-readable tables of the ranked matches, of the
+// timeline of segments and of the search of each window.
+func (report query_report) writeText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "Query %s of %d sub-fingerprints searched in %.3fms\n\n", report.Query, report.Size, report.Duration)
+
+	fmt.Fprintln(tw, "RANK\tID\tOFFSET\tWINDOWS\tBER\tSPEED")
+	for i, m := range report.Matches {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%d\t%.4f\t%g\n", i+1, m.Id, framesAndSeconds(m.Offset, m.OffsetSeconds), m.Windows, m.BER, m.Speed)
+	}
+
+	fmt.Fprintln(tw, "\nSEGMENT\tID\tQUERY START\tQUERY END\tREF START\tREF END\tWINDOWS\tBER\tSPEED")
+	for i, s := range report.Segments {
+		fmt.Fprintf(
+			tw,
+			"%d\t%s\t%s\t%s\t%s\t%s\t%d\t%.4f\t%g\n",
+			i+1,
+			s.Id,
+			framesAndSeconds(s.QueryStart, s.QueryStartSeconds),
+			framesAndSeconds(s.QueryEnd, s.QueryEndSeconds),
+			framesAndSeconds(s.ReferenceStart, s.ReferenceStartSeconds),
+			framesAndSeconds(s.ReferenceEnd, s.ReferenceEndSeconds),
+			s.Windows,
+			s.BER,
+			s.Speed,
+		)
+	}
+
+	fmt.Fprintln(tw, "\nWINDOW\tSPEED\tOFFSET\tSIZE\tCANDIDATES\tMATCHES\tTIME (ms)\tBEST\tBEST OFFSET\tBEST BER")
+	for i, window := range report.Windows {
+		best, bestOffset, bestBER := "-", "-", "-"
+		if window.Best != "" {
+			best, bestOffset, bestBER = window.Best, framesAndSeconds(window.BestOffset, window.BestOffsetSeconds), fmt.Sprintf("%.4f", window.BestBER)
+		}
+		fmt.Fprintf(tw, "%d\t%g\t%s\t%d\t%d\t%d\t%.3f\t%s\t%s\t%s\n", i, window.Speed, framesAndSeconds(window.Offset, window.OffsetSeconds), window.Size, window.Candidates, window.Matches, window.Duration, best, bestOffset, bestBER)
+	}
+
+	return tw.Flush()
+}
+
+// Searches a persisted index offline with a single query fingerprint and prints
+// the ranked matches, the timeline of segments matching each reference and
+// statistics about each window of the search.
+func queryCommand(args []string) {
+	flags := flag.NewFlagSet("query", flag.ExitOnError)
+	indexPath := flags.String("index", "", "path to the index to search")
+	fpPath := flags.String("fp", "", "path to the query fingerprint")
+	fpFormat := flags.String("fp.format", "query", "format of the query fingerprint file: query (QueryFingerprint) or index (IndexFingerprint)")
+	output := flags.String("output", "text", "output format: text or json")
+	limit := flags.Int("limit", 10, "maximum number of matches to print, or zero for all")
+	algorithm := flags.String("algorithm", "", "fingerprint algorithm of the index, checked against the index unless landmark: "+fingerprintAlgorithmNames()+" or landmark")
+	maxDrift := flags.Int("timeline.max_drift", DefaultTimelineMaxDrift, "maximum drift in alignment, in sub-fingerprints, between windows merged into a segment of the timeline")
+	minCount := flags.Int("min_count", DefaultLandmarkMinCount, "minimum number of landmark hashes agreeing on the offset of a match")
+	params := defaultSearchParams()
+	params.registerFlags(flags)
+	flags.Parse(args)
+
+	if *indexPath == "" || *fpPath == "" {
+		log.Fatal("Both -index and -fp must be provided")
+	}
+
+	if *algorithm == LandmarkAlgorithm {
+		queryLandmarkIndex(*indexPath, *fpPath, *fpFormat, *output, *limit, *minCount)
+		return
+	}
+
+	alg, _, idx, err := readIndexFile(*indexPath)
+	if err != nil {
+		log.Fatalf("Failed reading index: %s", err)
+	}
+
+	if *algorithm != "" && *algorithm != alg.name() {
+		log.Fatalf("Index was built with the %s algorithm, not %s", alg.name(), *algorithm)
+	}
+	params, err = params.forAlgorithm(alg, flags)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var queryFp fingerprint
+	switch *fpFormat {
+	case "query":
+		queryFp, err = readQueryFingerprintFile(alg, *fpPath)
+	case "index":
+		var fps []fingerprint
+		fps, err = readIndexFingerprintFile(alg, *fpPath)
+		if err == nil && len(fps) != 1 {
+			err = fmt.Errorf("Expected a single fingerprint but found %d", len(fps))
+		}
+		if err == nil {
+			queryFp = fps[0]
+		}
+	default:
+		err = fmt.Errorf("Unknown fingerprint format: %s", *fpFormat)
+	}
+	if err != nil {
+		log.Fatalf("Failed reading query fingerprint: %s", err)
+	}
+
+	start := time.Now()
+	results, err := params.searchWindows(queryFp, idx)
+	if err != nil {
+		log.Fatalf("Search failed: %s", err)
+	}
+	matches := rankMatches(alg, queryFp, results)
+	windowMatches := bestWindowMatches(alg, queryFp, results)
+	segments := mergeWindowMatches(alg, queryFp, windowMatches, *maxDrift)
+	duration := time.Since(start)
+
+	if *limit > 0 && len(matches) > *limit {
+		matches = matches[:*limit]
+	}
+
+	report := newQueryReport(queryFp, results, windowMatches, matches, segments, duration)
+
+	switch *output {
+	case "text":
+		err = report.writeText(os.Stdout)
+	case "json":
+		err = json.NewEncoder(os.Stdout).Encode(report)
+	default:
+		err = fmt.Errorf("Unknown output format: %s", *output)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Report of a single query of a landmark index, as printed by the `query`
+// command and responded by `/search` of a landmark index. Offsets are in
+// landmark frames and in seconds.
+type landmark_query_report struct {
+	Query     string                  `json:"query"`
+	Landmarks int                     `json:"landmarks"`
+	Duration  float64                 `json:"duration_ms"`
+	Matches   []landmark_match_report `json:"matches"`
+}
+
+type landmark_match_report struct {
+	Id            string  `json:"id"`
+	Offset        int     `json:"offset"`
+	OffsetSeconds float64 `json:"offset_seconds"`
+	Count         int     `json:"count"`
+}
+
+func newLandmarkQueryReport(query landmark_fingerprint, matches []landmark_match, duration time.Duration) landmark_query_report {
+	report := landmark_query_report{
+		Query:     query.id,
+		Landmarks: len(query.landmarks),
+		Duration:  milliseconds(duration),
+		Matches:   make([]landmark_match_report, len(matches)),
+	}
+	for i, m := range matches {
+		report.Matches[i] = landmark_match_report{m.fp.id, m.offset, landmarkSeconds(m.offset), m.count}
+	}
+
+	return report
+}
+
+func (report landmark_query_report) writeText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "Query %s of %d landmarks searched in %.3fms\n\n", report.Query, report.Landmarks, report.Duration)
+
+	fmt.Fprintln(tw, "RANK\tID\tOFFSET\tCOUNT")
+	for i, m := range report.Matches {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%d\n", i+1, m.Id, framesAndSeconds(m.Offset, m.OffsetSeconds), m.Count)
+	}
+
+	return tw.Flush()
+}
+
+// Searches a persisted landmark index offline with a single query landmark
+// fingerprint and prints the ranked matches.
+func queryLandmarkIndex(indexPath string, fpPath string, fpFormat string, output string, limit int, minCount int) {
+	_, idx, err := readLandmarkIndexFile(indexPath)
+	if err != nil {
+		log.Fatalf("Failed reading index: %s", err)
+	}
+
+	var query landmark_fingerprint
+	switch fpFormat {
+	case "query":
+		query, err = readQueryLandmarkFingerprintFile(fpPath)
+	case "index":
+		var lfps []landmark_fingerprint
+		lfps, err = readIndexLandmarkFingerprintFile(fpPath)
+		if err == nil && len(lfps) != 1 {
+			err = fmt.Errorf("Expected a single fingerprint but found %d", len(lfps))
+		}
+		if err == nil {
+			query = lfps[0]
+		}
+	default:
+		err = fmt.Errorf("Unknown fingerprint format: %s", fpFormat)
+	}
+	if err != nil {
+		log.Fatalf("Failed reading query fingerprint: %s", err)
+	}
+
+	start := time.Now()
+	matches, err := searchByLandmarks(query, minCount, idx)
+	if err != nil {
+		log.Fatalf("Search failed: %s", err)
+	}
+	duration := time.Since(start)
+
+	if limit > 0 && len(matches) > limit {
+		matches = matches[:limit]
+	}
+
+	report := newLandmarkQueryReport(query, matches, duration)
+
+	switch output {
+	case "text":
+		err = report.writeText(os.Stdout)
+	case "json":
+		err = json.NewEncoder(os.Stdout).Encode(report)
+	default:
+		err = fmt.Errorf("Unknown output format: %s", output)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
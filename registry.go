@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+const (
+	IndexConfigFile       = "index.json"
+	IndexFingerprintsFile = "fingerprints"
+)
+
+// Names of indexes are used as directory names, so are restricted to those
+// that are safe as one.
+var indexNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]*$`)
+
+// The named indexes served from one process, for example one catalogue of each
+// customer, each independent of the others with its own algorithm and search
+// defaults. When there is a directory, each index persists to a directory of
+// its own within it, holding its config and a log of the fingerprints added,
+// and is read back from it when the registry is opened again. Indexes of the
+// landmark algorithm log landmark fingerprints instead.
+type index_registry struct {
+	mutex    sync.RWMutex
+	dir      string
+	defaults search_params
+	servers  map[string]*index_server
+	logs     map[string]*os.File
+}
+
+// The config of a named index, as persisted in its directory. The defaults are
+// only the search parameters given when the index was created, by name, so
+// that the rest follow the defaults of the registry. The only search parameter
+// of a landmark index is `min_count`.
+type index_config struct {
+	Algorithm string            `json:"algorithm"`
+	Defaults  map[string]string `json:"defaults,omitempty"`
+}
+
+// Opens a registry of named indexes, reading every index in the directory, if
+// there is one. The default search parameters are those of indexes not given
+// their own.
+func openIndexRegistry(dir string, defaults search_params) (*index_registry, error) {
+	reg := &index_registry{
+		dir:      dir,
+		defaults: defaults,
+		servers:  make(map[string]*index_server),
+		logs:     make(map[string]*os.File),
+	}
+
+	if dir == "" {
+		return reg, nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		if !file.IsDir() || !indexNamePattern.MatchString(file.Name()) {
+			continue
+		}
+
+		if err := reg.load(file.Name()); err != nil {
+			reg.close()
+			return nil, fmt.Errorf("Failed reading index %s: %s", file.Name(), err)
+		}
+		fingerprints, _ := reg.servers[file.Name()].size()
+		log.Printf("Read index %s of %d fingerprints", file.Name(), fingerprints)
+	}
+
+	return reg, nil
+}
+
+// Reads a named index from its directory, dropping any fingerprint at the end
+// of the log that was cut short, for example by the process being killed.
+func (reg *index_registry) load(name string) error {
+	config, err := readIndexConfig(filepath.Join(reg.dir, name, IndexConfigFile))
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(reg.dir, name, IndexFingerprintsFile)
+	s, size, err := reg.newServer(config, path)
+	if err != nil {
+		return err
+	}
+
+	return reg.serve(name, s, path, size)
+}
+
+// Creates an empty named index with the algorithm and search defaults of the
+// config, unless there already is an index of the name, which is reported as
+// false along with that index.
+func (reg *index_registry) create(name string, config index_config) (*index_server, bool, error) {
+	if !indexNamePattern.MatchString(name) {
+		return nil, false, fmt.Errorf("Invalid index name: %s", name)
+	}
+
+	s, _, err := reg.newServer(config, "")
+	if err != nil {
+		return nil, false, err
+	}
+
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	if existing, found := reg.servers[name]; found {
+		return existing, false, nil
+	}
+
+	path := ""
+	if reg.dir != "" {
+		dir := filepath.Join(reg.dir, name)
+		if err := os.Mkdir(dir, 0755); err != nil {
+			return nil, false, err
+		}
+
+		err := writeFile(filepath.Join(dir, IndexConfigFile), func(w io.Writer) error {
+			return json.NewEncoder(w).Encode(config)
+		})
+		if err != nil {
+			os.RemoveAll(dir)
+			return nil, false, err
+		}
+		path = filepath.Join(dir, IndexFingerprintsFile)
+	}
+
+	if err := reg.serveLocked(name, s, path, 0); err != nil {
+		if reg.dir != "" {
+			os.RemoveAll(filepath.Join(reg.dir, name))
+		}
+		return nil, false, err
+	}
+
+	return s, true, nil
+}
+
+// Creates the server of an index of the config, of the fingerprints of the log
+// at the path, if there is one, along with the size of the complete
+// fingerprints read from it.
+func (reg *index_registry) newServer(config index_config, path string) (*index_server, int64, error) {
+	if config.Algorithm == LandmarkAlgorithm {
+		minCount, err := landmarkConfigMinCount(config)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		corpus, size, err := readLandmarkFingerprintLog(path)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		s, err := newLandmarkIndexServer(corpus, minCount)
+		return s, size, err
+	}
+
+	alg, params, err := reg.configParams(config)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	corpus, size, err := readFingerprintLog(alg, path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	s, err := newIndexServer(alg, params, corpus, buildIndex(alg, corpus))
+	return s, size, err
+}
+
+// Serves a named index, appending fingerprints added to the log at the path,
+// if there is one, from the given size.
+func (reg *index_registry) serve(name string, s *index_server, path string, size int64) error {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	return reg.serveLocked(name, s, path, size)
+}
+
+func (reg *index_registry) serveLocked(name string, s *index_server, path string, size int64) error {
+	s.name = name
+
+	if path != "" {
+		f, err := openFingerprintLog(path, size)
+		if err != nil {
+			return err
+		}
+		s.log = f
+		reg.logs[name] = f
+	}
+
+	reg.servers[name] = s
+	return nil
+}
+
+// Gets a named index.
+func (reg *index_registry) get(name string) (*index_server, bool) {
+	reg.mutex.RLock()
+	defer reg.mutex.RUnlock()
+
+	s, found := reg.servers[name]
+	return s, found
+}
+
+// The names of the indexes, in order.
+func (reg *index_registry) names() []string {
+	reg.mutex.RLock()
+	defer reg.mutex.RUnlock()
+
+	names := make([]string, 0, len(reg.servers))
+	for name := range reg.servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Deletes a named index along with its directory, reporting false if there is
+// no such index. Searches already running finish with the index as it was.
+func (reg *index_registry) delete(name string) (bool, error) {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	s, found := reg.servers[name]
+	if !found {
+		return false, nil
+	}
+	delete(reg.servers, name)
+
+	// wait for any fingerprint being added before closing its log
+	s.mutex.Lock()
+	s.log = nil
+	s.mutex.Unlock()
+
+	if f, found := reg.logs[name]; found {
+		f.Close()
+		delete(reg.logs, name)
+	}
+
+	if reg.dir != "" {
+		return true, os.RemoveAll(filepath.Join(reg.dir, name))
+	}
+	return true, nil
+}
+
+// Closes the logs of every index.
+func (reg *index_registry) close() {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	for name, f := range reg.logs {
+		f.Close()
+		delete(reg.logs, name)
+	}
+}
+
+// The algorithm and search parameters of an index config, being the defaults
+// of the registry for the algorithm with those of the config applied.
+func (reg *index_registry) configParams(config index_config) (fingerprint_algorithm, search_params, error) {
+	alg, err := newFingerprintAlgorithm(config.Algorithm)
+	if err != nil {
+		return nil, search_params{}, err
+	}
+
+	params := reg.defaults
+	flags := flag.NewFlagSet("index", flag.ContinueOnError)
+	params.registerFlags(flags)
+	for name, value := range config.Defaults {
+		if flags.Lookup(name) == nil {
+			return nil, params, fmt.Errorf("Unknown parameter: %s", name)
+		}
+		if err := flags.Set(name, value); err != nil {
+			return nil, params, fmt.Errorf("Invalid parameter %s: %s", name, err)
+		}
+	}
+
+	params, err = params.forAlgorithm(alg, flags)
+	return alg, params, err
+}
+
+// The minimum count of matches of the config of a landmark index, defaulting
+// to `DefaultLandmarkMinCount`.
+func landmarkConfigMinCount(config index_config) (int, error) {
+	minCount := DefaultLandmarkMinCount
+	flags := flag.NewFlagSet("index", flag.ContinueOnError)
+	registerLandmarkFlags(flags, &minCount)
+	for name, value := range config.Defaults {
+		if flags.Lookup(name) == nil {
+			return 0, fmt.Errorf("Unknown parameter: %s", name)
+		}
+		if err := flags.Set(name, value); err != nil {
+			return 0, fmt.Errorf("Invalid parameter %s: %s", name, err)
+		}
+	}
+
+	if minCount < 1 {
+		return 0, fmt.Errorf("Minimum count must be greater than or equal to one: %d", minCount)
+	}
+
+	return minCount, nil
+}
+
+func readIndexConfig(path string) (index_config, error) {
+	var config index_config
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+
+	err = json.Unmarshal(buf, &config)
+	return config, err
+}
+
+// Reads the fingerprints of a log, if there is one, along with the size of the
+// complete fingerprints read, as `readLog` does.
+func readFingerprintLog(alg fingerprint_algorithm, path string) ([]fingerprint, int64, error) {
+	var corpus []fingerprint
+	size, err := readLog(
+		path,
+		func() proto.Message { return new(IndexFingerprint) },
+		func(msg proto.Message) error {
+			fp, err := newFingerprintFromIndexFingerprint(alg, msg.(*IndexFingerprint))
+			if err != nil {
+				return err
+			}
+			corpus = append(corpus, fp)
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return corpus, size, nil
+}
+
+// Reads the landmark fingerprints of the log of a landmark index, if there is
+// one, along with the size of the complete fingerprints read, as `readLog`
+// does.
+func readLandmarkFingerprintLog(path string) ([]landmark_fingerprint, int64, error) {
+	var corpus []landmark_fingerprint
+	size, err := readLog(
+		path,
+		func() proto.Message { return new(IndexLandmarkFingerprint) },
+		func(msg proto.Message) error {
+			lfp, err := newLandmarkFingerprintFromIndexLandmarkFingerprint(msg.(*IndexLandmarkFingerprint))
+			if err != nil {
+				return err
+			}
+			corpus = append(corpus, lfp)
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return corpus, size, nil
+}
+
+// Reads the messages of a log, if there is one, passing each to `read`, along
+// with the size of the complete messages read, as the bytes read rather than
+// the size they would be written with, since they may have been written by
+// another encoder. A last message cut short is not read.
+func readLog(path string, newMessage func() proto.Message, read func(msg proto.Message) error) (int64, error) {
+	if path == "" {
+		return 0, nil
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var size int64
+	counted := &counting_reader{r: f}
+	r := bufio.NewReader(counted)
+	for {
+		msg := newMessage()
+		err := readDelimited(r, msg)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("Invalid fingerprint at byte %d: %s", size, err)
+		}
+
+		if err := read(msg); err != nil {
+			return 0, err
+		}
+		size = counted.n - int64(r.Buffered())
+	}
+
+	return size, nil
+}
+
+// A reader counting the bytes read from it.
+type counting_reader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *counting_reader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Opens a log to append fingerprints to, dropping any last fingerprint that
+// was cut short.
+func openFingerprintLog(path string, size int64) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
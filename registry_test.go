@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIndexRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sherlock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := defaultCorpusParams()
+	p.size, p.minLength, p.maxLength = 6, 1000, 2000
+	p.silenceFraction, p.repeatFraction, p.sharedFraction = 0, 0, 0
+	corpus, err := generateCorpus(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg, err := openIndexRegistry(dir, defaultSearchParams())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := newIndexServer(philips, defaultSearchParams(), nil, newIndex(philips))
+	r := newRouter(s, reg)
+
+	request := func(method string, target string, body []byte) int {
+		w := serveTestRequest(r, method, target, body)
+		return w.Code
+	}
+
+	fixtures := []struct {
+		method string
+		target string
+		status int
+	}{
+		{"POST", "/indexes/a?block_size=128", http.StatusCreated},
+		{"POST", "/indexes/b", http.StatusCreated},
+		{"POST", "/indexes/a", http.StatusConflict},
+		{"POST", "/indexes/.hidden", http.StatusBadRequest},
+		{"POST", "/indexes/c?algorithm=unknown", http.StatusBadRequest},
+		{"POST", "/indexes/c?algorithm=landmark&block_size=128", http.StatusBadRequest},
+		{"POST", "/indexes/c?block_size=large", http.StatusBadRequest},
+		{"GET", "/indexes/c/-/stats", http.StatusNotFound},
+		{"DELETE", "/indexes/c", http.StatusNotFound},
+		// only the whole path creates, deletes or lists indexes
+		{"POST", "/indexes/c/nonsense", http.StatusNotFound},
+		{"GET", "/indexes/c/-/stats", http.StatusNotFound},
+		{"DELETE", "/indexes/a/index/x", http.StatusNotFound},
+		{"DELETE", "/indexes/a/", http.StatusNotFound},
+		{"GET", "/indexes/a/-/stats", http.StatusOK},
+		{"GET", "/indexesXYZ", http.StatusNotFound},
+	}
+	for i, fixture := range fixtures {
+		if status := request(fixture.method, fixture.target, nil); fixture.status != status {
+			t.Errorf("[%d] Expected status %d of %s %s but was %d", i, fixture.status, fixture.method, fixture.target, status)
+		}
+	}
+
+	// each index has fingerprints of its own
+	for i, fp := range corpus {
+		name := "a"
+		if i >= 3 {
+			name = "b"
+		}
+		body, _ := proto.Marshal(newIndexFingerprint(philips, fp))
+		if status := request("POST", "/indexes/"+name+"/index", body); status != http.StatusCreated {
+			t.Fatalf("[%d] Expected status %d but was %d", i, http.StatusCreated, status)
+		}
+	}
+
+	query, _ := proto.Marshal(newQueryFingerprint(philips, fingerprint{"query", corpus[1].sfps[100:600], fingerprint_meta{}, 0}))
+	for i, fixture := range []struct {
+		name     string
+		expected int
+	}{{"a", 1}, {"b", 0}} {
+		w := serveTestRequest(r, "POST", "/indexes/"+fixture.name+"/search", query)
+		var report query_report
+		json.Unmarshal(w.Body.Bytes(), &report)
+
+		found := make(map[string]bool)
+		for _, m := range report.Matches {
+			found[m.Id] = true
+		}
+		if w.Code != http.StatusOK || len(found) != fixture.expected || (fixture.expected > 0 && !found[corpus[1].id]) {
+			t.Errorf("[%d] Expected %d matching references in %s but was %d: %v", i, fixture.expected, fixture.name, w.Code, found)
+		}
+	}
+
+	if status := request("GET", "/indexes/b/index/"+corpus[1].id, nil); status != http.StatusNotFound {
+		t.Errorf("Expected status %d of a fingerprint of another index but was %d", http.StatusNotFound, status)
+	}
+	if status := request("GET", "/index/"+corpus[1].id, nil); status != http.StatusNotFound {
+		t.Errorf("Expected status %d of a fingerprint in the default index but was %d", http.StatusNotFound, status)
+	}
+
+	// the last fingerprint added was cut short, as if the process was killed
+	path := filepath.Join(dir, "b", IndexFingerprintsFile)
+	info, _ := os.Stat(path)
+	os.Truncate(path, info.Size()-10)
+
+	// indexes are read back with their defaults, other than those deleted
+	if status := request("DELETE", "/indexes/a", nil); status != http.StatusNoContent {
+		t.Errorf("Expected status %d deleting an index but was %d", http.StatusNoContent, status)
+	}
+	reg.close()
+
+	reg, err = openIndexRegistry(dir, defaultSearchParams())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reg.close()
+	r = newRouter(s, reg)
+
+	w := serveTestRequest(r, "GET", "/indexes", nil)
+	var stats []index_stats_report
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("Failed decoding stats: %s", err)
+	}
+	if len(stats) != 1 || stats[0].Name != "b" || stats[0].Fingerprints != 2 || stats[0].Algorithm != PhilipsAlgorithm {
+		t.Errorf("Expected only index b of 2 fingerprints but was %v", stats)
+	}
+
+	// fingerprints can still be added after the one cut short
+	body, _ := proto.Marshal(newIndexFingerprint(philips, corpus[5]))
+	if status := request("POST", "/indexes/b/index", body); status != http.StatusCreated {
+		t.Errorf("Expected status %d adding again but was %d", http.StatusCreated, status)
+	}
+	reg.close()
+	if fps, _, err := readFingerprintLog(philips, path); err != nil || len(fps) != 3 {
+		t.Errorf("Expected 3 fingerprints in the log but was %d: %v", len(fps), err)
+	}
+
+	// defaults of an index are its own
+	reg, _ = openIndexRegistry(dir, defaultSearchParams())
+	defer reg.close()
+	reg.create("c", index_config{Philips64Algorithm, map[string]string{"block_size": "128"}})
+	c, _ := reg.get("c")
+	if c.params.blockSize != 128 || c.params.algorithm.name() != Philips64Algorithm || c.alg.name() != Philips64Algorithm {
+		t.Errorf("Expected defaults of the index but were %v", c.params)
+	}
+}
+
+func TestBulkIndexHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sherlock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := defaultCorpusParams()
+	p.size, p.minLength, p.maxLength, p.segmentLength = 8, 100, 200, 64
+	corpus, err := generateCorpus(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg, err := openIndexRegistry(dir, defaultSearchParams())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reg.close()
+	s, _ := newIndexServer(philips, defaultSearchParams(), nil, newIndex(philips))
+	r := newRouter(s, reg)
+	serveTestRequest(r, "POST", "/indexes/bulk", nil)
+
+	one, _ := proto.Marshal(newIndexFingerprint(philips, corpus[0]))
+	if w := serveTestRequest(r, "POST", "/indexes/bulk/index", one); w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d but was %d", http.StatusCreated, w.Code)
+	}
+
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	for _, fp := range corpus {
+		writeDelimited(gz, newIndexFingerprint(philips, fp))
+	}
+	writeDelimited(gz, newIndexFingerprint(philips, corpus[4]))
+	writeDelimited(gz, &IndexFingerprint{Id: proto.String("invalid"), Size: proto.Uint32(2), Stream: []byte{1, 2, 3}})
+	gz.Write([]byte{3, 0xff, 0xff, 0xff}) // not a message
+	writeDelimited(gz, newIndexFingerprint(philips, fingerprint{"last", corpus[1].sfps, fingerprint_meta{}, 0}))
+	gz.Write([]byte{100, 1}) // cut short
+	gz.Close()
+
+	request := httptest.NewRequest("POST", "/indexes/bulk/index/bulk?batch.size=3", &body)
+	request.Header.Set("Content-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, request)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d but was %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	lines := bytes.Split(bytes.TrimSpace(w.Body.Bytes()), []byte("\n"))
+	var results []bulk_index_result
+	for _, line := range lines[:len(lines)-1] {
+		var result bulk_index_result
+		if err := json.Unmarshal(line, &result); err != nil {
+			t.Fatalf("Failed decoding result: %s", err)
+		}
+		results = append(results, result)
+	}
+
+	failed := map[int]bool{0: true, 8: true, 9: true, 10: true}
+	if len(results) != 12 {
+		t.Fatalf("Expected 12 results but was %d: %s", len(results), w.Body.String())
+	}
+	for i, result := range results {
+		if result.Position != i || (result.Error != "") != failed[i] {
+			t.Errorf("[%d] Expected position %d failed %t but was %v", i, i, failed[i], result)
+		}
+	}
+
+	var summary struct {
+		Summary bulk_index_summary `json:"summary"`
+	}
+	json.Unmarshal(lines[len(lines)-1], &summary)
+	if summary.Summary.Added != 8 || summary.Summary.Failed != 4 || summary.Summary.Error == "" {
+		t.Errorf("Expected 8 added, 4 failed and a read error but was %v", summary.Summary)
+	}
+
+	bulk, _ := reg.get("bulk")
+	if n, _ := bulk.size(); n != 9 {
+		t.Errorf("Expected 9 fingerprints indexed but was %d", n)
+	}
+
+	// every fingerprint added is in the log
+	reg.close()
+	if fps, _, err := readFingerprintLog(philips, filepath.Join(dir, "bulk", IndexFingerprintsFile)); err != nil || len(fps) != 9 {
+		t.Errorf("Expected 9 fingerprints in the log but was %d: %v", len(fps), err)
+	}
+
+	if w := serveTestRequest(r, "POST", "/index/bulk?batch.size=0", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d but was %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+// A log that fails to write all but half of each write while failing.
+type failing_log struct {
+	*os.File
+	failing bool
+}
+
+func (l *failing_log) Write(p []byte) (int, error) {
+	if l.failing {
+		n, _ := l.File.Write(p[:len(p)/2])
+		return n, fmt.Errorf("No space left on device")
+	}
+	return l.File.Write(p)
+}
+
+func TestIndexServerLogFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sherlock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := defaultCorpusParams()
+	p.size, p.minLength, p.maxLength, p.segmentLength = 5, 100, 200, 64
+	corpus, err := generateCorpus(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, IndexFingerprintsFile)
+	f, err := openFingerprintLog(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := &failing_log{f, false}
+
+	s, _ := newIndexServer(philips, defaultSearchParams(), nil, newIndex(philips))
+	s.log = log
+
+	// a failed write leaves nothing of the fingerprint in the log
+	if added, err := s.add(corpus[0]); !added || err != nil {
+		t.Fatalf("Expected fingerprint added but was %v", err)
+	}
+	log.failing = true
+	if added, err := s.add(corpus[1]); added || err == nil {
+		t.Errorf("Expected fingerprint not added when the log fails")
+	}
+	if errs := s.addBatch(corpus[1:]); errs[0] == nil {
+		t.Errorf("Expected batch not added when the log fails")
+	}
+
+	// later fingerprints follow the last written in full, even when shorter
+	// than what was written of the failed batch
+	log.failing = false
+	if added, err := s.add(corpus[1]); !added || err != nil {
+		t.Fatalf("Expected fingerprint added but was %v", err)
+	}
+	f.Close()
+
+	fps, size, err := readFingerprintLog(philips, path)
+	info, _ := os.Stat(path)
+	if err != nil || len(fps) != 2 || size != info.Size() {
+		t.Fatalf("Expected 2 fingerprints in the whole log but was %d in %d of %d bytes: %v", len(fps), size, info.Size(), err)
+	}
+	for i, fp := range fps {
+		if fp.id != corpus[i].id {
+			t.Errorf("[%d] Expected fingerprint %s in the log but was %s", i, corpus[i].id, fp.id)
+		}
+	}
+	if n, _ := s.size(); n != 2 {
+		t.Errorf("Expected 2 fingerprints indexed but was %d", n)
+	}
+}
+
+// Entries written by another encoder, such as with a longer varint of their
+// size, are kept when a last entry cut short is dropped.
+func TestReadFingerprintLogOfAnotherEncoder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sherlock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var log bytes.Buffer
+	corpus := buildTestCorpus()
+	for _, fp := range corpus[:2] {
+		buf, _ := proto.Marshal(newIndexFingerprint(philips, fp))
+		log.Write([]byte{byte(len(buf)) | 0x80, 0}) // size as a two byte varint
+		log.Write(buf)
+	}
+	complete := int64(log.Len())
+	writeDelimited(&log, newIndexFingerprint(philips, corpus[2]))
+	log.Truncate(log.Len() - 3)
+
+	path := filepath.Join(dir, IndexFingerprintsFile)
+	if err := ioutil.WriteFile(path, log.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fps, size, err := readFingerprintLog(philips, path)
+	if err != nil || len(fps) != 2 || size != complete {
+		t.Fatalf("Expected 2 fingerprints of %d bytes but was %d of %d bytes: %v", complete, len(fps), size, err)
+	}
+
+	f, err := openFingerprintLog(path, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeDelimited(f, newIndexFingerprint(philips, corpus[2]))
+	f.Close()
+
+	if fps, _, err := readFingerprintLog(philips, path); err != nil || len(fps) != 3 || fps[2].id != corpus[2].id {
+		t.Errorf("Expected 3 fingerprints in the log but was %d: %v", len(fps), err)
+	}
+}
+
+func TestLandmarkIndexRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sherlock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// fingerprints of distinct hashes, one each frame
+	corpus := make([]landmark_fingerprint, 3)
+	for i := range corpus {
+		corpus[i].id = fmt.Sprintf("%04d", i+1)
+		for time := 0; time < 20; time++ {
+			corpus[i].landmarks = append(corpus[i].landmarks, landmark{landmark_hash(100*i + time), time})
+		}
+	}
+
+	reg, err := openIndexRegistry(dir, defaultSearchParams())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := newLandmarkIndexServer(nil, DefaultLandmarkMinCount)
+	r := newRouter(s, reg)
+
+	index, _ := proto.Marshal(newIndexLandmarkFingerprint(corpus[0]))
+	// a query of ten frames from frame 5 of the second
+	queryLfp := landmark_fingerprint{id: "query"}
+	for _, l := range corpus[1].landmarks[5:15] {
+		queryLfp.landmarks = append(queryLfp.landmarks, landmark{l.hash, l.time - 5})
+	}
+	query, _ := proto.Marshal(newQueryLandmarkFingerprint(queryLfp))
+	fixtures := []struct {
+		method string
+		target string
+		body   []byte
+		status int
+	}{
+		{"POST", "/indexes/l?algorithm=landmark&min_count=0", nil, http.StatusBadRequest},
+		{"POST", "/indexes/l?algorithm=landmark&min_count=8", nil, http.StatusCreated},
+		{"POST", "/indexes/l/index", index, http.StatusCreated},
+		{"POST", "/indexes/l/index", index, http.StatusConflict},
+		{"POST", "/indexes/l/index", []byte("nonsense"), http.StatusBadRequest},
+		{"GET", "/indexes/l/index/" + corpus[0].id, nil, http.StatusOK},
+		{"GET", "/indexes/l/index/" + corpus[1].id, nil, http.StatusNotFound},
+		{"POST", "/indexes/l/search?min_count=0", query, http.StatusBadRequest},
+		{"POST", "/indexes/l/search?block_size=128", query, http.StatusBadRequest},
+		{"POST", "/indexes/l/index/bulk", nil, http.StatusBadRequest},
+		{"POST", "/indexes/l/search/batch", nil, http.StatusBadRequest},
+		{"POST", "/indexes/l/monitor", nil, http.StatusBadRequest},
+		// the default index
+		{"POST", "/index", index, http.StatusCreated},
+		{"GET", "/index/" + corpus[0].id, nil, http.StatusOK},
+		{"POST", "/monitor", nil, http.StatusBadRequest},
+	}
+	for i, fixture := range fixtures {
+		if w := serveTestRequest(r, fixture.method, fixture.target, fixture.body); fixture.status != w.Code {
+			t.Errorf("[%d] Expected status %d of %s %s but was %d: %s", i, fixture.status, fixture.method, fixture.target, w.Code, w.Body)
+		}
+	}
+
+	for _, lfp := range corpus[1:] {
+		body, _ := proto.Marshal(newIndexLandmarkFingerprint(lfp))
+		if w := serveTestRequest(r, "POST", "/indexes/l/index", body); w.Code != http.StatusCreated {
+			t.Fatalf("Expected status %d adding %s but was %d", http.StatusCreated, lfp.id, w.Code)
+		}
+	}
+	reg.close()
+
+	// the index is read back with its defaults, which requests can override
+	reg, err = openIndexRegistry(dir, defaultSearchParams())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reg.close()
+	r = newRouter(s, reg)
+
+	for i, fixture := range []struct {
+		target   string
+		expected int
+	}{
+		{"/indexes/l/search", 1},
+		{"/indexes/l/search?min_count=11", 0},
+		{"/search", 0},
+	} {
+		w := serveTestRequest(r, "POST", fixture.target, query)
+		var report landmark_query_report
+		json.Unmarshal(w.Body.Bytes(), &report)
+
+		if w.Code != http.StatusOK || len(report.Matches) != fixture.expected {
+			t.Errorf("[%d] Expected %d matches of %s but was %d: %s", i, fixture.expected, fixture.target, w.Code, w.Body)
+			continue
+		}
+		if fixture.expected > 0 && (report.Matches[0].Id != corpus[1].id || report.Matches[0].Offset != 5 || report.Matches[0].Count != 10) {
+			t.Errorf("[%d] Expected a match of %s at 5 of 10 hashes but was %v", i, corpus[1].id, report.Matches[0])
+		}
+	}
+
+	var stats index_stats_report
+	w := serveTestRequest(r, "GET", "/indexes/l/-/stats", nil)
+	json.Unmarshal(w.Body.Bytes(), &stats)
+	if stats.Algorithm != LandmarkAlgorithm || stats.Fingerprints != 3 || stats.Hashes != 60 || stats.Defaults["min_count"] != "8" {
+		t.Errorf("Expected stats of 3 landmark fingerprints of 60 hashes and a minimum count of 8 but was %v", stats)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"text/tabwriter"
+)
+
+// Audio of a reference fingerprint in the index.
+type reference_audio struct {
+	id    string
+	audio pcm
+}
+
+// A segment of reference audio, by position in seconds.
+type audio_segment struct {
+	reference *reference_audio
+	start     float64
+	duration  float64
+}
+
+// Picks random segments of the given duration from the reference audio. The
+// same seed always picks the same segments, so that every distortion is
+// evaluated on the same segments.
+func pickAudioSegments(references []reference_audio, n int, duration float64, seed int64) ([]audio_segment, error) {
+	var eligible []*reference_audio
+	for i := range references {
+		if references[i].audio.duration() >= duration {
+			eligible = append(eligible, &references[i])
+		}
+	}
+
+	if len(eligible) == 0 {
+		return nil, fmt.Errorf("No reference audio is at least the segment duration: %fs", duration)
+	}
+
+	rng := rand.New(rand.NewSource(seed))
+	segments := make([]audio_segment, n)
+	for i := range segments {
+		reference := eligible[rng.Intn(len(eligible))]
+		start := rng.Float64() * (reference.audio.duration() - duration)
+		segments[i] = audio_segment{reference, start, duration}
+	}
+
+	return segments, nil
+}
+
+// Generates labelled queries by distorting each segment of audio and
+// extracting a fingerprint with the algorithm from the result.
+func generateAudioQueries(
+	alg fingerprint_algorithm,
+	segments []audio_segment,
+	seed int64,
+	distortion audio_distortion) []labelled_query {
+
+	queries := make([]labelled_query, len(segments))
+	for i, segment := range segments {
+		rng := rand.New(rand.NewSource(seed + int64(i)))
+		audio := distortion(rng, segment.reference.audio.segment(segment.start, segment.duration))
+
+		queries[i] = labelled_query{
+			alg.extract(fmt.Sprintf("%06d", i), audio),
+			segment.reference.id,
+			offsetAtTime(segment.start),
+		}
+	}
+
+	return queries
+}
+
+// Evaluation of search over queries with a single type of audio distortion.
+type robustness_result struct {
+	Distortion string `json:"distortion"`
+	evaluation
+}
+
+func writeRobustnessText(w io.Writer, results []robustness_result) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "DISTORTION\tRECALL\tTOP-1\tPRECISION\tOFFSET ERROR\tCANDIDATES\tP50 (ms)")
+	for _, r := range results {
+		fmt.Fprintf(
+			tw,
+			"%s\t%.4f\t%.4f\t%.4f\t%.2f\t%.2f\t%.3f\n",
+			r.Distortion,
+			r.Recall,
+			r.Top1Accuracy,
+			r.Precision,
+			r.MeanOffsetError,
+			r.MeanCandidates,
+			r.LatencyP50,
+		)
+	}
+
+	return tw.Flush()
+}
+
+// Evaluates the robustness of search to distortions of audio. Segments are
+// taken from the reference audio of the index, each distortion is applied to
+// them before extracting query fingerprints, and the recall for each type of
+// distortion is reported.
+func robustnessCommand(args []string) {
+	flags := flag.NewFlagSet("robustness", flag.ExitOnError)
+	indexPath := flags.String("index", "", "path to the index to search")
+	audioDir := flags.String("audio", "", "directory of the reference WAV files, named by fingerprint ID")
+	names := flags.String("distortions", "all", "comma separated audio distortions to evaluate, or all")
+	n := flags.Int("n", 100, "number of segments to take from the reference audio")
+	duration := flags.Float64("duration", 5.0, "duration in seconds of each segment")
+	seed := flags.Int64("seed", 1, "seed of the random number generator")
+	output := flags.String("output", "text", "output format: text or json")
+	params := defaultSearchParams()
+	params.registerFlags(flags)
+	flags.Parse(args)
+
+	if *indexPath == "" || *audioDir == "" {
+		log.Fatal("Both -index and -audio must be provided")
+	}
+
+	distortionNames, distortions, err := parseAudioDistortions(*names)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	alg, _, idx, err := readIndexFile(*indexPath)
+	if err != nil {
+		log.Fatalf("Failed reading index: %s", err)
+	}
+	params, err = params.forAlgorithm(alg, flags)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	paths, err := listWAVFiles(*audioDir)
+	if err != nil {
+		log.Fatalf("Failed listing audio files: %s", err)
+	}
+
+	references := make([]reference_audio, len(paths))
+	for i, path := range paths {
+		audio, err := readWAVFile(path)
+		if err != nil {
+			log.Fatalf("Failed reading %s: %s", path, err)
+		}
+		references[i] = reference_audio{audioFileId(path), audio}
+	}
+
+	segments, err := pickAudioSegments(references, *n, *duration, *seed)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	results := make([]robustness_result, len(distortions))
+	for i, distortion := range distortions {
+		queries := generateAudioQueries(alg, segments, *seed, distortion)
+
+		outcomes, err := searchLabelledQueries(queries, params, idx)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		results[i] = robustness_result{distortionNames[i], evaluateOutcomes(outcomes)}
+		log.Printf("Evaluated distortion %s (%d/%d)", distortionNames[i], i+1, len(distortions))
+	}
+
+	switch *output {
+	case "text":
+		err = writeRobustnessText(os.Stdout, results)
+	case "json":
+		err = json.NewEncoder(os.Stdout).Encode(results)
+	default:
+		err = fmt.Errorf("Unknown output format: %s", *output)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// Bit error rates between pairs of fingerprint blocks. Matching pairs are a
+// block of a query and the block of its reference at the ground truth offset,
+// while non-matching pairs are a block of a query and a random block of any
+// other fingerprint.
+type ber_samples struct {
+	matching    []float64
+	nonMatching []float64
+}
+
+// Samples the BER of matching and non-matching block pairs, taking a number of
+// random blocks from each labelled query. Blocks of matching pairs must lie
+// fully within the reference.
+func sampleBlockBERs(
+	alg fingerprint_algorithm,
+	corpus []fingerprint,
+	queries []labelled_query,
+	blockSize int,
+	blocksPerQuery int,
+	seed int64) (ber_samples, error) {
+
+	var samples ber_samples
+
+	byId := make(map[string]*fingerprint, len(corpus))
+	var eligible []*fingerprint
+	for i := range corpus {
+		byId[corpus[i].id] = &corpus[i]
+		if len(corpus[i].sfps) >= blockSize {
+			eligible = append(eligible, &corpus[i])
+		}
+	}
+
+	if len(eligible) == 0 {
+		return samples, fmt.Errorf("No fingerprints in the corpus are at least the block size: %d", blockSize)
+	}
+
+	rng := rand.New(rand.NewSource(seed))
+	for _, query := range queries {
+		if len(query.fp.sfps) < blockSize {
+			continue
+		}
+
+		for k := 0; k < blocksPerQuery; k++ {
+			start := rng.Intn(len(query.fp.sfps) - blockSize + 1)
+			queryFpb := fingerprint_block(query.fp.sfps[start : start+blockSize])
+
+			if reference, found := byId[query.id]; found {
+				if referenceFpb, err := reference.extractFingerprintBlock(query.offset+start, blockSize); err == nil {
+					ber, _ := queryFpb.bitErrorRateWith(alg, referenceFpb)
+					samples.matching = append(samples.matching, float64(ber))
+				}
+			}
+
+			other := eligible[rng.Intn(len(eligible))]
+			if other.id == query.id {
+				continue
+			}
+
+			otherStart := rng.Intn(len(other.sfps) - blockSize + 1)
+			ber, _ := queryFpb.bitErrorRateWith(alg, other.sfps[otherStart:otherStart+blockSize])
+			samples.nonMatching = append(samples.nonMatching, float64(ber))
+		}
+	}
+
+	if len(samples.matching) == 0 || len(samples.nonMatching) == 0 {
+		err := fmt.Errorf(
+			"Not enough block pairs sampled, with %d matching and %d non-matching",
+			len(samples.matching),
+			len(samples.nonMatching),
+		)
+		return samples, err
+	}
+
+	return samples, nil
+}
+
+// The theoretical rate of false positives for a BER threshold, from the normal
+// approximation of the Philips paper. The BER of non-matching blocks of `n`
+// bits is approximately normal with a mean of 0.5, but with a standard
+// deviation three times that of independent bits due to correlation between
+// sub-fingerprints. Blocks have as many bits as the width of the algorithm
+// times the block size.
+func theoreticalFalsePositiveRate(alg fingerprint_algorithm, threshold float64, blockSize int) float64 {
+	n := float64(blockSize * alg.subFingerprintSizeBits())
+	return 0.5 * math.Erfc((1.0-2.0*threshold)/(3.0*math.Sqrt2)*math.Sqrt(n))
+}
+
+// Mean and standard deviation of a normal distribution fitted to the samples.
+func fitNormal(samples []float64) (float64, float64) {
+	if len(samples) == 0 {
+		return 0.0, 0.0
+	}
+
+	mean := 0.0
+	for _, s := range samples {
+		mean += s
+	}
+	mean /= float64(len(samples))
+
+	variance := 0.0
+	for _, s := range samples {
+		variance += (s - mean) * (s - mean)
+	}
+	variance /= float64(len(samples))
+
+	return mean, math.Sqrt(variance)
+}
+
+// Density histogram of samples in equal width bins over [0, 1].
+func histogram(samples []float64, bins int) []float64 {
+	density := make([]float64, bins)
+	for _, s := range samples {
+		bin := int(s * float64(bins))
+		if bin >= bins {
+			bin = bins - 1
+		} else if bin < 0 {
+			bin = 0
+		}
+		density[bin]++
+	}
+
+	for i := range density {
+		density[i] *= float64(bins) / float64(len(samples))
+	}
+
+	return density
+}
+
+// A point of the ROC curve for a BER threshold, with the true and false
+// positive rates observed and the theoretical false positive rate.
+type roc_point struct {
+	Threshold                float64
+	TruePositiveRate         float64
+	FalsePositiveRate        float64
+	TheoreticalFalsePositive float64
+}
+
+// Fraction of the sorted samples that are at most the threshold.
+func fractionAtMost(sorted []float64, threshold float64) float64 {
+	n := sort.Search(len(sorted), func(i int) bool { return sorted[i] > threshold })
+	return float64(n) / float64(len(sorted))
+}
+
+// Calculates the ROC curve over thresholds from zero up to and including the
+// maximum, in the given steps.
+func rocCurve(alg fingerprint_algorithm, samples ber_samples, blockSize int, maxThreshold float64, step float64) []roc_point {
+	matching := append([]float64(nil), samples.matching...)
+	nonMatching := append([]float64(nil), samples.nonMatching...)
+	sort.Float64s(matching)
+	sort.Float64s(nonMatching)
+
+	var curve []roc_point
+	for i := 0; float64(i)*step <= maxThreshold+1e-9; i++ {
+		threshold := float64(i) * step
+		curve = append(curve, roc_point{
+			threshold,
+			fractionAtMost(matching, threshold),
+			fractionAtMost(nonMatching, threshold),
+			theoreticalFalsePositiveRate(alg, threshold, blockSize),
+		})
+	}
+
+	return curve
+}
+
+// A threshold recommended for a reason, such as meeting a target false
+// positive rate.
+type threshold_recommendation struct {
+	Reason string
+	roc_point
+}
+
+// Recommends thresholds from the ROC curve: the highest with no observed false
+// positives, the one maximising Youden's J statistic (TPR - FPR), and the
+// highest meeting each target theoretical false positive rate.
+func recommendThresholds(curve []roc_point, targets []float64) []threshold_recommendation {
+	var recommendations []threshold_recommendation
+
+	zeroFp := -1
+	youden := 0
+	for i, p := range curve {
+		if p.FalsePositiveRate == 0 {
+			zeroFp = i
+		}
+
+		best := curve[youden]
+		if p.TruePositiveRate-p.FalsePositiveRate > best.TruePositiveRate-best.FalsePositiveRate {
+			youden = i
+		}
+	}
+
+	if zeroFp >= 0 {
+		recommendations = append(recommendations, threshold_recommendation{"no observed false positives", curve[zeroFp]})
+	}
+	recommendations = append(recommendations, threshold_recommendation{"maximum Youden's J", curve[youden]})
+
+	for _, target := range targets {
+		highest := -1
+		for i, p := range curve {
+			if p.TheoreticalFalsePositive <= target {
+				highest = i
+			}
+		}
+
+		if highest >= 0 {
+			reason := fmt.Sprintf("theoretical false positive rate at most %g", target)
+			recommendations = append(recommendations, threshold_recommendation{reason, curve[highest]})
+		}
+	}
+
+	return recommendations
+}
+
+func writeROCCSV(w io.Writer, curve []roc_point) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"threshold", "true_positive_rate", "false_positive_rate", "theoretical_false_positive_rate"})
+
+	f := func(v float64) string { return strconv.FormatFloat(v, 'g', -1, 64) }
+	for _, p := range curve {
+		cw.Write([]string{f(p.Threshold), f(p.TruePositiveRate), f(p.FalsePositiveRate), f(p.TheoreticalFalsePositive)})
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// Everything shown on the HTML report, with plots already laid out as SVG
+// coordinates.
+type roc_report struct {
+	BlockSize         int
+	Matching          int
+	NonMatching       int
+	MatchingMean      float64
+	MatchingStdDev    float64
+	NonMatchingMean   float64
+	NonMatchingStdDev float64
+	MatchingBars      []svg_rect
+	NonMatchingBars   []svg_rect
+	MatchingFit       string
+	NonMatchingFit    string
+	ROC               string
+	TheoreticalFP     string
+	Recommendations   []threshold_recommendation
+	PlotWidth         int
+	PlotHeight        int
+}
+
+type svg_rect struct {
+	X, Y, Width, Height float64
+}
+
+const (
+	rocPlotWidth  = 640
+	rocPlotHeight = 320
+	rocBins       = 100
+)
+
+// Points of a polyline in plot coordinates, scaling x from [0, 1] and y from
+// [0, maxY] with y pointing upwards.
+func svgPoints(xs []float64, ys []float64, maxY float64) string {
+	points := ""
+	for i := range xs {
+		x := xs[i] * rocPlotWidth
+		y := rocPlotHeight - math.Min(ys[i]/maxY, 1.0)*rocPlotHeight
+		points += fmt.Sprintf("%.2f,%.2f ", x, y)
+	}
+
+	return points
+}
+
+func newROCReport(samples ber_samples, blockSize int, curve []roc_point, recommendations []threshold_recommendation) roc_report {
+	r := roc_report{
+		BlockSize:       blockSize,
+		Matching:        len(samples.matching),
+		NonMatching:     len(samples.nonMatching),
+		Recommendations: recommendations,
+		PlotWidth:       rocPlotWidth,
+		PlotHeight:      rocPlotHeight,
+	}
+
+	r.MatchingMean, r.MatchingStdDev = fitNormal(samples.matching)
+	r.NonMatchingMean, r.NonMatchingStdDev = fitNormal(samples.nonMatching)
+
+	matching := histogram(samples.matching, rocBins)
+	nonMatching := histogram(samples.nonMatching, rocBins)
+
+	maxDensity := 0.0
+	for i := range matching {
+		maxDensity = math.Max(maxDensity, math.Max(matching[i], nonMatching[i]))
+	}
+
+	bars := func(density []float64) []svg_rect {
+		rects := make([]svg_rect, len(density))
+		width := float64(rocPlotWidth) / float64(len(density))
+		for i, d := range density {
+			height := d / maxDensity * rocPlotHeight
+			rects[i] = svg_rect{float64(i) * width, rocPlotHeight - height, width, height}
+		}
+		return rects
+	}
+	r.MatchingBars = bars(matching)
+	r.NonMatchingBars = bars(nonMatching)
+
+	fit := func(mean float64, stdDev float64) string {
+		xs := make([]float64, rocPlotWidth)
+		ys := make([]float64, rocPlotWidth)
+		for i := range xs {
+			xs[i] = float64(i) / rocPlotWidth
+			if stdDev > 0 {
+				z := (xs[i] - mean) / stdDev
+				ys[i] = math.Exp(-z*z/2.0) / (stdDev * math.Sqrt(2.0*math.Pi))
+			}
+		}
+		return svgPoints(xs, ys, maxDensity)
+	}
+	r.MatchingFit = fit(r.MatchingMean, r.MatchingStdDev)
+	r.NonMatchingFit = fit(r.NonMatchingMean, r.NonMatchingStdDev)
+
+	fprs := make([]float64, len(curve))
+	tprs := make([]float64, len(curve))
+	thresholds := make([]float64, len(curve))
+	logFps := make([]float64, len(curve))
+	for i, p := range curve {
+		fprs[i] = p.FalsePositiveRate
+		tprs[i] = p.TruePositiveRate
+		thresholds[i] = p.Threshold / curve[len(curve)-1].Threshold
+
+		// plotted on a log scale down to 1e-40
+		logFps[i] = math.Max(0, 40.0+math.Log10(math.Max(p.TheoreticalFalsePositive, 1e-40)))
+	}
+	r.ROC = svgPoints(fprs, tprs, 1.0)
+	r.TheoreticalFP = svgPoints(thresholds, logFps, 40.0)
+
+	return r
+}
+
+var rocReportTemplate = template.Must(template.New("roc").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>BER distribution and ROC</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+svg { border: 1px solid #ccc; margin-bottom: 1em; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: right; }
+.matching { fill: #2a9d8f; fill-opacity: 0.5; }
+.non-matching { fill: #e76f51; fill-opacity: 0.5; }
+.line { fill: none; stroke-width: 2; }
+</style>
+</head>
+<body>
+<h1>BER distribution and ROC</h1>
+<p>Blocks of {{.BlockSize}} sub-fingerprints, {{.Matching}} matching and {{.NonMatching}} non-matching pairs.</p>
+
+<h2>BER histograms</h2>
+<p>
+Matching: mean {{printf "%.4f" .MatchingMean}}, standard deviation {{printf "%.4f" .MatchingStdDev}}.
+Non-matching: mean {{printf "%.4f" .NonMatchingMean}}, standard deviation {{printf "%.4f" .NonMatchingStdDev}}.
+Lines are fitted normal distributions. BER from 0 to 1 left to right.
+</p>
+<svg width="{{.PlotWidth}}" height="{{.PlotHeight}}">
+{{range .MatchingBars}}<rect class="matching" x="{{.X}}" y="{{.Y}}" width="{{.Width}}" height="{{.Height}}"/>{{end}}
+{{range .NonMatchingBars}}<rect class="non-matching" x="{{.X}}" y="{{.Y}}" width="{{.Width}}" height="{{.Height}}"/>{{end}}
+<polyline class="line" stroke="#2a9d8f" points="{{.MatchingFit}}"/>
+<polyline class="line" stroke="#e76f51" points="{{.NonMatchingFit}}"/>
+</svg>
+
+<h2>ROC</h2>
+<p>Observed true positive rate (up) against false positive rate (right), both from 0 to 1.</p>
+<svg width="{{.PlotWidth}}" height="{{.PlotHeight}}">
+<polyline class="line" stroke="#264653" points="{{.ROC}}"/>
+</svg>
+
+<h2>Theoretical false positive rate</h2>
+<p>From 1e-40 (bottom) to 1 (top) on a log scale, against the BER threshold.</p>
+<svg width="{{.PlotWidth}}" height="{{.PlotHeight}}">
+<polyline class="line" stroke="#264653" points="{{.TheoreticalFP}}"/>
+</svg>
+
+<h2>Recommended thresholds</h2>
+<table>
+<tr><th>Reason</th><th>Threshold</th><th>TPR</th><th>FPR</th><th>Theoretical FPR</th></tr>
+{{range .Recommendations}}<tr><td>{{.Reason}}</td><td>{{printf "%.3f" .Threshold}}</td><td>{{printf "%.4f" .TruePositiveRate}}</td><td>{{printf "%.4f" .FalsePositiveRate}}</td><td>{{printf "%.3g" .TheoreticalFalsePositive}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// Reports on the distribution of BER between matching and non-matching block
+// pairs, to help choose the BER threshold. Writes the ROC curve as CSV and a
+// self-contained HTML page with histograms, the ROC curve and recommended
+// thresholds.
+func rocCommand(args []string) {
+	flags := flag.NewFlagSet("roc", flag.ExitOnError)
+	indexPath := flags.String("index", "", "path to the index")
+	queriesPath := flags.String("queries", "", "path to the CSV file of labelled queries")
+	blockSize := flags.Int("block_size", FingerprintBlockSize, "number of sub-fingerprints in a block")
+	blocksPerQuery := flags.Int("blocks", 10, "number of blocks sampled from each query")
+	seed := flags.Int64("seed", 1, "seed of the random number generator")
+	csvPath := flags.String("csv", "roc.csv", "path to write the ROC curve to as CSV")
+	htmlPath := flags.String("html", "roc.html", "path to write the HTML report to")
+	flags.Parse(args)
+
+	if *indexPath == "" || *queriesPath == "" {
+		log.Fatal("Both -index and -queries must be provided")
+	}
+
+	alg, corpus, _, err := readIndexFile(*indexPath)
+	if err != nil {
+		log.Fatalf("Failed reading index: %s", err)
+	}
+
+	queries, err := readLabelledQueries(alg, *queriesPath)
+	if err != nil {
+		log.Fatalf("Failed reading labelled queries: %s", err)
+	}
+
+	samples, err := sampleBlockBERs(alg, corpus, queries, *blockSize, *blocksPerQuery, *seed)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	curve := rocCurve(alg, samples, *blockSize, 0.6, 0.005)
+	recommendations := recommendThresholds(curve, []float64{1e-6, 1e-12, 1e-20})
+
+	for _, r := range recommendations {
+		log.Printf("Threshold %.3f for %s: TPR %.4f, FPR %.4f, theoretical FPR %.3g",
+			r.Threshold, r.Reason, r.TruePositiveRate, r.FalsePositiveRate, r.TheoreticalFalsePositive)
+	}
+
+	csvFile, err := os.Create(*csvPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := writeROCCSV(csvFile, curve); err != nil {
+		log.Fatal(err)
+	}
+	csvFile.Close()
+
+	htmlFile, err := os.Create(*htmlPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := rocReportTemplate.Execute(htmlFile, newROCReport(samples, *blockSize, curve, recommendations)); err != nil {
+		log.Fatal(err)
+	}
+	htmlFile.Close()
+}
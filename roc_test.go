@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestTheoreticalFalsePositiveRate(t *testing.T) {
+	// the paper quotes 3.6e-20 for blocks of 256 at a threshold of 0.35, while
+	// its formula gives 7.1e-20
+	got := theoreticalFalsePositiveRate(philips, 0.35, 256)
+	if got < 1e-20 || got > 1e-19 {
+		t.Errorf("Expected a rate in the order of 1e-20 but got %g", got)
+	}
+
+	if got := theoreticalFalsePositiveRate(philips, 0.5, 256); got != 0.5 {
+		t.Errorf("Expected 0.5 at a threshold of 0.5 but got %g", got)
+	}
+}
+
+func TestFitNormalAndHistogram(t *testing.T) {
+	samples := []float64{0.1, 0.2, 0.3, 0.4}
+
+	mean, stdDev := fitNormal(samples)
+	if math.Abs(mean-0.25) > 1e-9 || math.Abs(stdDev-math.Sqrt(0.0125)) > 1e-9 {
+		t.Errorf("Expected mean 0.25 and standard deviation %f but got %f and %f", math.Sqrt(0.0125), mean, stdDev)
+	}
+
+	density := histogram(samples, 10)
+	area := 0.0
+	for _, d := range density {
+		area += d / 10.0
+	}
+	if math.Abs(area-1.0) > 1e-9 {
+		t.Errorf("Expected histogram density to integrate to one but was %f", area)
+	}
+}
+
+func TestROCCurveAndRecommendations(t *testing.T) {
+	samples := ber_samples{
+		matching:    []float64{0.05, 0.1, 0.2, 0.3},
+		nonMatching: []float64{0.25, 0.45, 0.5, 0.55},
+	}
+
+	curve := rocCurve(philips, samples, 256, 0.6, 0.05)
+	if expected, got := 13, len(curve); expected != got {
+		t.Fatalf("Expected %d points but got %d", expected, got)
+	}
+
+	fixtures := []struct {
+		index int
+		tpr   float64
+		fpr   float64
+	}{
+		{0, 0.0, 0.0},
+		{2, 0.5, 0.0},
+		{4, 0.75, 0.0},
+		{6, 1.0, 0.25},
+		{12, 1.0, 1.0},
+	}
+
+	for _, fixture := range fixtures {
+		p := curve[fixture.index]
+		if fixture.tpr != p.TruePositiveRate || fixture.fpr != p.FalsePositiveRate {
+			t.Errorf("[%d] Expected TPR %f and FPR %f but got %f and %f", fixture.index, fixture.tpr, fixture.fpr, p.TruePositiveRate, p.FalsePositiveRate)
+		}
+	}
+
+	recommendations := recommendThresholds(curve, []float64{1e-20})
+	if expected, got := 3, len(recommendations); expected != got {
+		t.Fatalf("Expected %d recommendations but got %d", expected, got)
+	}
+
+	if expected, got := 0.2, recommendations[0].Threshold; math.Abs(expected-got) > 1e-9 {
+		t.Errorf("Expected highest threshold without false positives of %f but got %f", expected, got)
+	}
+
+	if expected, got := 0.3, recommendations[2].Threshold; math.Abs(expected-got) > 1e-9 {
+		t.Errorf("Expected threshold for the theoretical rate of %f but got %f", expected, got)
+	}
+
+	var buf bytes.Buffer
+	if err := rocReportTemplate.Execute(&buf, newROCReport(samples, 256, curve, recommendations)); err != nil {
+		t.Errorf("Rendering the HTML report failed when it should not have: %s", err)
+	}
+}
+
+func TestSampleBlockBERs(t *testing.T) {
+	corpus := []fingerprint{
+		fingerprint{"0001", randomSubFingerprints(philips, 1, 100), fingerprint_meta{}, 0},
+		fingerprint{"0002", randomSubFingerprints(philips, 2, 100), fingerprint_meta{}, 0},
+	}
+
+	queries := []labelled_query{
+		labelled_query{fingerprint{"q1", corpus[0].sfps[10:50], fingerprint_meta{}, 0}, "0001", 10},
+	}
+
+	samples, err := sampleBlockBERs(philips, corpus, queries, 8, 20, 1)
+	if err != nil {
+		t.Fatalf("Sampling failed when it should not have: %s", err)
+	}
+
+	if expected, got := 20, len(samples.matching); expected != got {
+		t.Errorf("Expected %d matching samples but got %d", expected, got)
+	}
+
+	for i, ber := range samples.matching {
+		if ber != 0.0 {
+			t.Errorf("[%d] Expected undistorted matching BER of zero but was %f", i, ber)
+		}
+	}
+
+	mean, _ := fitNormal(samples.nonMatching)
+	if len(samples.nonMatching) == 0 || math.Abs(mean-0.5) > 0.05 {
+		t.Errorf("Expected non-matching BER around 0.5 but was %f over %d samples", mean, len(samples.nonMatching))
+	}
+	// a query longer than every fingerprint of the corpus
+	long := []labelled_query{
+		labelled_query{fingerprint{"q2", randomSubFingerprints(philips, 3, 200), fingerprint_meta{}, 0}, "", 0},
+	}
+	if _, err := sampleBlockBERs(philips, corpus, long, 150, 20, 1); err == nil {
+		t.Errorf("Expected an error when no fingerprint is as long as a block")
+	}
+}
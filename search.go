@@ -1,10 +1,16 @@
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"math"
+	"time"
+)
 
 // Candidate fingerprint block within a fingerprint. The offset here is the
 // start of the block. The end of the block is determined by the offset plus the
-// size of the blocks being used.
+// size of the blocks being used. The offset can be negative, or the block can
+// run off the end of the fingerprint, when the query only partially overlaps
+// the start or end of the fingerprint.
 type candidate struct {
 	fp     *fingerprint
 	offset int
@@ -14,6 +20,10 @@ func (c *candidate) extractFingerprintBlock(size int) (fingerprint_block, error)
 	return c.fp.extractFingerprintBlock(c.offset, size)
 }
 
+func (c *candidate) extractOverlappingFingerprintBlock(size int) (fingerprint_block, int, error) {
+	return c.fp.extractOverlappingFingerprintBlock(c.offset, size)
+}
+
 func addCandidatesToSet(s []candidate, m map[candidate]bool) {
 	for _, c := range s {
 		m[c] = true
@@ -31,16 +41,36 @@ func candidateSetToSlice(m map[candidate]bool) []candidate {
 	return s
 }
 
+// Filters candidates by the bit error rate between the query fingerprint block
+// and the candidate fingerprint block. Only the region where the candidate
+// block overlaps the fingerprint is compared, so candidates at the very start
+// or end of a fingerprint can still match. The overlap must cover at least
+// the given minimum fraction of the query block, otherwise the candidate is
+// dropped. A minimum overlap of one (1) requires the full block to overlap.
 func filterCandidatesByBER(
+	alg fingerprint_algorithm,
 	queryFpb fingerprint_block,
 	candidates []candidate,
-	ber float32) []candidate {
+	ber float32,
+	minOverlap float32) []candidate {
+
+	minOverlapSize := int(math.Ceil(float64(minOverlap) * float64(len(queryFpb))))
+	if minOverlapSize < 1 {
+		minOverlapSize = 1
+	}
 
 	var filtered []candidate
 	for _, candidate := range candidates {
-		// FIXME: errors swallowed
-		candidateFpb, _ := candidate.extractFingerprintBlock(len(queryFpb))
-		actualBer, _ := queryFpb.bitErrorRateWith(candidateFpb)
+		candidateFpb, queryStart, err := candidate.extractOverlappingFingerprintBlock(len(queryFpb))
+		if err != nil || len(candidateFpb) < minOverlapSize {
+			continue
+		}
+
+		overlappingQueryFpb := queryFpb[queryStart : queryStart+len(candidateFpb)]
+		actualBer, err := overlappingQueryFpb.bitErrorRateWith(alg, candidateFpb)
+		if err != nil {
+			continue
+		}
 
 		if actualBer <= ber {
 			filtered = append(filtered, candidate)
@@ -50,6 +80,23 @@ func filterCandidatesByBER(
 	return filtered
 }
 
+// The BER of the overlap of a query fingerprint block with a candidate, which
+// must have already passed filtering, otherwise it is one (1).
+func candidateBitErrorRate(alg fingerprint_algorithm, queryFpb fingerprint_block, c candidate) float32 {
+	candidateFpb, queryStart, err := c.extractOverlappingFingerprintBlock(len(queryFpb))
+	if err != nil {
+		return 1.0
+	}
+
+	overlappingQueryFpb := queryFpb[queryStart : queryStart+len(candidateFpb)]
+	ber, err := overlappingQueryFpb.bitErrorRateWith(alg, candidateFpb)
+	if err != nil {
+		return 1.0
+	}
+
+	return ber
+}
+
 type approximate_search_strategy func(sfp sub_fingerprint) ([]sub_fingerprint, error)
 
 func noopApproximateSearchStrategy() approximate_search_strategy {
@@ -58,33 +105,67 @@ func noopApproximateSearchStrategy() approximate_search_strategy {
 	}
 }
 
-func flipAllApproximateSearchStrategy(n int) approximate_search_strategy {
+func flipAllApproximateSearchStrategy(alg fingerprint_algorithm, n int) approximate_search_strategy {
 	return func(sfp sub_fingerprint) ([]sub_fingerprint, error) {
-		return sfp.flipAllBitsUntil(n)
+		return sfp.flipAllBitsUntil(alg, n)
 	}
 }
 
+// Creates an approximate search strategy by name, as used in the search
+// parameters. The maximum Hamming distance is only used by the bit flipping
+// and multi-index hashing strategies, and the number of substrings and the
+// index only by multi-index hashing.
+func newApproximateSearchStrategy(
+	alg fingerprint_algorithm,
+	name string,
+	maxHammingDistance int,
+	substrings int,
+	idx index) (approximate_search_strategy, error) {
+
+	switch name {
+	case "none":
+		return noopApproximateSearchStrategy(), nil
+	case "flip":
+		if maxHammingDistance < 1 {
+			err := fmt.Errorf("Maximum Hamming distance must be greater than or equal to one: %d", maxHammingDistance)
+			return nil, err
+		}
+		return flipAllApproximateSearchStrategy(alg, maxHammingDistance), nil
+	case "mih":
+		return multiIndexApproximateSearchStrategy(alg, idx, substrings, maxHammingDistance)
+	}
+
+	return nil, fmt.Errorf("Unknown approximate search strategy: %s", name)
+}
+
 // Given a sub-fingerprint and the offset of that sub-fingerprint in the query
 // fingerprint block, find an exact match of the sub-fingerprint in the index.
 // The candidate fingerprint block is created such that the position in the
 // fingerprint block of both the query and candidate sub-fingerprint are the
 // same. Only this offset is saved since the block can be regenerated from this.
+// Postings of fingerprints not in the set are skipped, so that they never
+// become candidates.
 func searchBySubFingerprint(
 	querySfp sub_fingerprint,
 	queryOffset int,
-	idx index) []candidate {
+	idx index,
+	set fingerprint_set) []candidate {
 
-	postings, found := idx[querySfp]
+	postings, found := idx.postings(querySfp)
 	if !found {
 		return make([]candidate, 0)
 	}
 
-	candidates := make([]candidate, len(postings))
-	for i, posting := range postings {
-		candidates[i] = candidate{
+	candidates := make([]candidate, 0, len(postings))
+	for _, posting := range postings {
+		if !set.contains(posting.fp) {
+			continue
+		}
+
+		candidates = append(candidates, candidate{
 			posting.fp,
 			posting.offset - queryOffset,
-		}
+		})
 	}
 
 	return candidates
@@ -95,11 +176,13 @@ func searchBySubFingerprint(
 // BER. This will always do an exact match search on the sub-fingerprints in the
 // query fingerprint block, however you can optionally pass a strategy for
 // approximate sub-fingerprint searching. This is usually a bit-flipping
-// algorithm.
+// algorithm. Only fingerprints in the set are candidates, and a nil set
+// searches every fingerprint.
 func searchByFingerprintBlock(
 	queryFpb fingerprint_block,
 	approxSearchStrategy approximate_search_strategy,
-	idx index) ([]candidate, error) {
+	idx index,
+	set fingerprint_set) ([]candidate, error) {
 
 	candidates := make(map[candidate]bool)
 
@@ -111,6 +194,7 @@ func searchByFingerprintBlock(
 			querySfp,
 			queryOffset,
 			idx,
+			set,
 		)
 
 		addCandidatesToSet(newCandidates, candidates)
@@ -129,6 +213,7 @@ func searchByFingerprintBlock(
 					approxQuerySfp,
 					queryOffset,
 					idx,
+					set,
 				)
 
 				addCandidatesToSet(newCandidates, candidates)
@@ -139,49 +224,215 @@ func searchByFingerprintBlock(
 	return candidateSetToSlice(candidates), nil
 }
 
+// Generates candidates for a query fingerprint block, before any filtering on
+// BER. The offsets of candidates are relative to the start of the block.
+type candidate_generator func(queryFpb fingerprint_block) ([]candidate, error)
+
+// Creates candidate generators restricted to a set of fingerprints, sharing
+// whatever is expensive to create, such as a multi-index or LSH tables,
+// between every set.
+type candidate_generators func(set fingerprint_set) candidate_generator
+
+// Creates a candidate generator that searches the index for the
+// sub-fingerprints of the query fingerprint block, as `searchByFingerprintBlock`
+// does, with an optional approximate search strategy and restricted to the set
+// of fingerprints.
+func subFingerprintCandidateGenerator(
+	approxSearchStrategy approximate_search_strategy,
+	idx index,
+	set fingerprint_set) candidate_generator {
+
+	return func(queryFpb fingerprint_block) ([]candidate, error) {
+		return searchByFingerprintBlock(queryFpb, approxSearchStrategy, idx, set)
+	}
+}
+
+// A window of the query fingerprint to search, as the start position and the
+// size of the query fingerprint block.
+type query_window struct {
+	offset int
+	size   int
+}
+
+// Schedules the sliding windows over a query fingerprint of the given length.
+// Full blocks are taken at every step while they fit within the query. When
+// the last full block does not reach the end of the query, the remaining
+// sub-fingerprints are covered either by one more full block aligned to the
+// end of the query or, if requested, by a trailing short block starting at the
+// next step. When the next step is past the end of the query, the trailing
+// block instead starts after the last full block, at most a block from the
+// end. A step size greater than the block size still leaves gaps between
+// blocks, as intended, but the end of the query is always searched.
+func scheduleQueryWindows(length int, blockSize int, stepSize int, trailingBlock bool) []query_window {
+	var windows []query_window
+	if length < blockSize {
+		return windows
+	}
+
+	offset := 0
+	for ; offset+blockSize <= length; offset += stepSize {
+		windows = append(windows, query_window{offset, blockSize})
+	}
+
+	lastEnd := windows[len(windows)-1].offset + blockSize
+	if lastEnd == length {
+		return windows
+	}
+
+	if trailingBlock {
+		if offset >= length {
+			offset = lastEnd
+			if offset < length-blockSize {
+				offset = length - blockSize
+			}
+		}
+		windows = append(windows, query_window{offset, length - offset})
+	} else {
+		windows = append(windows, query_window{length - blockSize, blockSize})
+	}
+
+	return windows
+}
+
+// The result of searching a single window of the query fingerprint. The
+// candidates are those remaining after BER filtering, while `generated` is the
+// number of candidates found before filtering. When the query was stretched by
+// a speed factor before searching, the window is of the stretched query.
+type window_result struct {
+	window     query_window
+	candidates []candidate
+	generated  int
+	duration   time.Duration
+	speed      float64
+}
+
 // Given a query fingerprint, find candidates based on a sliding window query
 // fingerprint block. The step size of the sliding window and the block size
 // must be specified. Note that it is possible to provide a step size that is
 // greater than or equal to the block size. This results in sub-fingerprints
-// being searched no more than once from the query fingerprint.
+// being searched no more than once from the query fingerprint. The end of the
+// query is always searched, with a full block aligned to the end or, when
+// `trailingBlock` is set, with a shorter block. The minimum overlap is the
+// fraction of a query block that must overlap a reference fingerprint for a
+// candidate to be considered, allowing matches on queries that straddle the
+// start or end of a reference.
 func searchByFingerprint(
+	alg fingerprint_algorithm,
 	queryFp fingerprint,
 	blockSize int,
 	stepSize int,
 	approxSearchStrategy approximate_search_strategy,
 	ber float32,
+	minOverlap float32,
+	trailingBlock bool,
 	idx index) ([]candidate, error) {
 
+	results, err := searchByFingerprintWindows(
+		alg,
+		queryFp,
+		blockSize,
+		stepSize,
+		approxSearchStrategy,
+		ber,
+		minOverlap,
+		trailingBlock,
+		idx,
+	)
+	if err != nil {
+		return make([]candidate, 0), err
+	}
+
+	candidates := make(map[candidate]bool)
+	for _, result := range results {
+		addCandidatesToSet(result.candidates, candidates)
+	}
+
+	return candidateSetToSlice(candidates), nil
+}
+
+// Same as `searchByFingerprint` but keeps the candidates found in each window
+// of the query fingerprint separate, along with some statistics about the
+// search of each window.
+func searchByFingerprintWindows(
+	alg fingerprint_algorithm,
+	queryFp fingerprint,
+	blockSize int,
+	stepSize int,
+	approxSearchStrategy approximate_search_strategy,
+	ber float32,
+	minOverlap float32,
+	trailingBlock bool,
+	idx index) ([]window_result, error) {
+
+	return searchByFingerprintWindowsWith(
+		alg,
+		queryFp,
+		blockSize,
+		stepSize,
+		subFingerprintCandidateGenerator(approxSearchStrategy, idx, nil),
+		ber,
+		minOverlap,
+		trailingBlock,
+	)
+}
+
+// Same as `searchByFingerprintWindows` but generates the candidates of each
+// window with the given candidate generator.
+func searchByFingerprintWindowsWith(
+	alg fingerprint_algorithm,
+	queryFp fingerprint,
+	blockSize int,
+	stepSize int,
+	generator candidate_generator,
+	ber float32,
+	minOverlap float32,
+	trailingBlock bool) ([]window_result, error) {
+
 	if blockSize < 1 {
 		err := fmt.Errorf("Block size must be greater than or equal to one: %d", blockSize)
-		return make([]candidate, 0), err
+		return make([]window_result, 0), err
 	}
 
 	if stepSize < 1 {
 		err := fmt.Errorf("Step size must be greater than or equal to one: %d", stepSize)
-		return make([]candidate, 0), err
+		return make([]window_result, 0), err
+	}
+
+	if minOverlap <= 0 || minOverlap > 1 {
+		err := fmt.Errorf("Minimum overlap must be greater than zero and at most one: %f", minOverlap)
+		return make([]window_result, 0), err
 	}
 
 	if l := len(queryFp.sfps); l < blockSize {
 		err := fmt.Errorf("Query fingerprint must be greater than or equal to a block (%d): %d", blockSize, l)
-		return make([]candidate, 0), err
+		return make([]window_result, 0), err
 	}
 
-	candidates := make(map[candidate]bool)
+	windows := scheduleQueryWindows(len(queryFp.sfps), blockSize, stepSize, trailingBlock)
+	results := make([]window_result, len(windows))
 
 	// walk through the fingerprint, taking steps as specified
-	for offset := 0; offset+blockSize < len(queryFp.sfps); offset += stepSize {
-		queryFpb, err := queryFp.extractFingerprintBlock(offset, blockSize)
+	for i, window := range windows {
+		start := time.Now()
+
+		queryFpb, err := queryFp.extractFingerprintBlock(window.offset, window.size)
 		if err != nil {
-			return make([]candidate, 0), err
+			return make([]window_result, 0), err
 		}
 
-		newCandidates, err := searchByFingerprintBlock(queryFpb, approxSearchStrategy, idx)
+		newCandidates, err := generator(queryFpb)
 		if err != nil {
-			return make([]candidate, 0), err
+			return make([]window_result, 0), err
+		}
+
+		results[i] = window_result{
+			window,
+			filterCandidatesByBER(alg, queryFpb, newCandidates, ber, minOverlap),
+			len(newCandidates),
+			time.Since(start),
+			1.0,
 		}
-		addCandidatesToSet(filterCandidatesByBER(queryFpb, newCandidates, ber), candidates)
 	}
 
-	return candidateSetToSlice(candidates), nil
+	return results, nil
 }
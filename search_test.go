@@ -1,5 +1,7 @@
 package main
 
+import "testing"
+
 func buildTestCorpus() []fingerprint {
 	return []fingerprint{
 		fingerprint{
@@ -10,6 +12,8 @@ func buildTestCorpus() []fingerprint {
 				sub_fingerprint{0, 0, 9, 0},
 				sub_fingerprint{1, 8, 0, 0},
 			},
+			fingerprint_meta{},
+			0,
 		},
 		fingerprint{
 			"0002",
@@ -19,6 +23,8 @@ func buildTestCorpus() []fingerprint {
 				sub_fingerprint{0, 0, 9, 0},
 				sub_fingerprint{1, 8, 0, 0},
 			},
+			fingerprint_meta{},
+			0,
 		},
 		fingerprint{
 			"0003",
@@ -28,6 +34,151 @@ func buildTestCorpus() []fingerprint {
 				sub_fingerprint{0, 7, 9, 0},
 				sub_fingerprint{1, 8, 0, 1},
 			},
+			fingerprint_meta{},
+			0,
+		},
+	}
+}
+
+func TestFilterCandidatesByBERWithPartialOverlap(t *testing.T) {
+	corpus := buildTestCorpus()
+
+	// query that catches the end of "0001" and runs past it
+	queryFpb := fingerprint_block{
+		sub_fingerprint{0, 0, 9, 0},
+		sub_fingerprint{1, 8, 0, 0},
+		sub_fingerprint{255, 255, 255, 255},
+		sub_fingerprint{255, 255, 255, 255},
+	}
+
+	candidates := []candidate{
+		candidate{&corpus[0], 2},  // overlaps by half the block, exactly
+		candidate{&corpus[0], -3}, // overlaps by a single sub-fingerprint
+		candidate{&corpus[0], 4},  // does not overlap at all
+	}
+
+	fixtures := []struct {
+		minOverlap float32
+		expected   int
+	}{
+		{1.0, 0},
+		{0.5, 1},
+		{0.25, 1}, // overlapping single sub-fingerprint at -3 has a high BER
+	}
+
+	for i, fixture := range fixtures {
+		got := filterCandidatesByBER(philips, queryFpb, candidates, 0.1, fixture.minOverlap)
+		if fixture.expected != len(got) {
+			t.Fatalf("[%d] Expected %d candidates but got %d", i, fixture.expected, len(got))
+		}
+
+		for _, c := range got {
+			if c.offset != 2 {
+				t.Errorf("[%d] Expected candidate at offset 2 but was %d", i, c.offset)
+			}
+		}
+	}
+}
+
+func TestSearchByFingerprintAtEndOfReference(t *testing.T) {
+	corpus := buildTestCorpus()
+	idx := buildIndex(philips, corpus)
+
+	// last two sub-fingerprints of "0003" followed by unknown audio
+	queryFp := fingerprint{
+		"query",
+		[]sub_fingerprint{
+			sub_fingerprint{0, 7, 9, 0},
+			sub_fingerprint{1, 8, 0, 1},
+			sub_fingerprint{3, 3, 3, 3},
+			sub_fingerprint{4, 4, 4, 4},
+			sub_fingerprint{5, 5, 5, 5},
 		},
+		fingerprint_meta{},
+		0,
+	}
+
+	candidates, err := searchByFingerprint(philips, queryFp, 4, 1, nil, 0.0, 0.5, false, idx)
+	if err != nil {
+		t.Fatalf("Search failed when it should not have: %s", err)
+	}
+
+	if expected, got := 1, len(candidates); expected != got {
+		t.Fatalf("Expected %d candidates but got %d", expected, got)
+	}
+
+	if expected, got := "0003", candidates[0].fp.id; expected != got {
+		t.Errorf("Expected candidate fingerprint %s but was %s", expected, got)
+	}
+
+	if expected, got := 2, candidates[0].offset; expected != got {
+		t.Errorf("Expected candidate offset %d but was %d", expected, got)
+	}
+}
+
+func TestScheduleQueryWindows(t *testing.T) {
+	fixtures := []struct {
+		length        int
+		blockSize     int
+		stepSize      int
+		trailingBlock bool
+		expected      []query_window
+	}{
+		// equal to the block size
+		{4, 4, 1, false, []query_window{{0, 4}}},
+		{4, 4, 1, true, []query_window{{0, 4}}},
+		// one more than the block size
+		{5, 4, 1, false, []query_window{{0, 4}, {1, 4}}},
+		{5, 4, 4, false, []query_window{{0, 4}, {1, 4}}},
+		{5, 4, 4, true, []query_window{{0, 4}, {4, 1}}},
+		// multiples of the block size
+		{8, 4, 4, false, []query_window{{0, 4}, {4, 4}}},
+		{12, 4, 4, true, []query_window{{0, 4}, {4, 4}, {8, 4}}},
+		{12, 4, 2, false, []query_window{{0, 4}, {2, 4}, {4, 4}, {6, 4}, {8, 4}}},
+		// steps not landing on the end
+		{9, 4, 2, false, []query_window{{0, 4}, {2, 4}, {4, 4}, {5, 4}}},
+		{9, 4, 2, true, []query_window{{0, 4}, {2, 4}, {4, 4}, {6, 3}}},
+		// steps greater than the block size
+		{10, 2, 4, false, []query_window{{0, 2}, {4, 2}, {8, 2}}},
+		{11, 2, 4, false, []query_window{{0, 2}, {4, 2}, {8, 2}, {9, 2}}},
+		{13, 2, 4, true, []query_window{{0, 2}, {4, 2}, {8, 2}, {12, 1}}},
+		{11, 2, 4, true, []query_window{{0, 2}, {4, 2}, {8, 2}, {10, 1}}},
+		{12, 2, 5, true, []query_window{{0, 2}, {5, 2}, {10, 2}}},
+		{14, 2, 5, true, []query_window{{0, 2}, {5, 2}, {10, 2}, {12, 2}}},
+		// shorter than a block
+		{3, 4, 1, false, nil},
+	}
+
+	for i, fixture := range fixtures {
+		got := scheduleQueryWindows(fixture.length, fixture.blockSize, fixture.stepSize, fixture.trailingBlock)
+		if len(fixture.expected) != len(got) {
+			t.Fatalf("[%d] Expected windows %v but got %v", i, fixture.expected, got)
+		}
+
+		for j, expected := range fixture.expected {
+			if expected != got[j] {
+				t.Errorf("[%d][%d] Expected window %v but got %v", i, j, expected, got[j])
+			}
+		}
+	}
+}
+
+func TestSearchByFingerprintOfExactlyOneBlock(t *testing.T) {
+	corpus := buildTestCorpus()
+	idx := buildIndex(philips, corpus)
+
+	queryFp := fingerprint{"query", corpus[2].sfps, fingerprint_meta{}, 0}
+
+	candidates, err := searchByFingerprint(philips, queryFp, len(queryFp.sfps), 1, nil, 0.0, 1.0, false, idx)
+	if err != nil {
+		t.Fatalf("Search failed when it should not have: %s", err)
+	}
+
+	if expected, got := 1, len(candidates); expected != got {
+		t.Fatalf("Expected %d candidates but got %d", expected, got)
+	}
+
+	if expected, got := "0003", candidates[0].fp.id; expected != got {
+		t.Errorf("Expected candidate fingerprint %s but was %s", expected, got)
 	}
 }
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	MaxCachedCandidateGenerators = 4
+)
+
+// An index served over HTTP, which fingerprints can be added to while it is
+// being searched. The corpus is kept in the order fingerprints were added, as
+// their ordinals, and by ID, which must be unique. The candidate generators of
+// the most recently used search parameters are kept, and updated as
+// fingerprints are added, since some are expensive to create, but only a few
+// so that requests of many different parameters don't each keep one. Named
+// indexes have a log that every fingerprint added is written to before it is
+// indexed, so that it can be read back. An index of the landmark algorithm has
+// landmark fingerprints instead, and no algorithm of sub-fingerprints.
+type index_server struct {
+	mutex        sync.RWMutex
+	name         string
+	alg          fingerprint_algorithm
+	params       search_params
+	fingerprints []*fingerprint
+	corpus       map[string]*fingerprint
+	idx          index
+	generators   map[search_params]cached_generators
+	genOrder     []search_params // least recently used first
+	genMutex     sync.Mutex
+	landmarks    *landmark_corpus
+	log          fingerprint_log
+	logErr       error
+}
+
+// The landmark fingerprints of an index of the landmark algorithm, by ID, and
+// the index of their hashes, with the minimum count of matches of requests.
+type landmark_corpus struct {
+	fingerprints map[string]*landmark_fingerprint
+	idx          landmark_index
+	minCount     int
+}
+
+// The candidate generators of search parameters, with the function adding a
+// fingerprint to what they keep of the index of their own, if anything.
+type cached_generators struct {
+	generators candidate_generators
+	add        func(fp *fingerprint)
+}
+
+// A log of fingerprints, as an append-only file.
+type fingerprint_log interface {
+	io.WriteSeeker
+	Truncate(size int64) error
+}
+
+// Creates a server of an index built from the corpus, with the default search
+// parameters of requests. When those search with LSH, the tables are added to
+// the index if it doesn't already have them.
+func newIndexServer(alg fingerprint_algorithm, params search_params, corpus []fingerprint, idx index) (*index_server, error) {
+	idx, err := params.withLSHTables(idx)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &index_server{
+		alg:          alg,
+		params:       params,
+		fingerprints: make([]*fingerprint, len(corpus)),
+		corpus:       make(map[string]*fingerprint, len(corpus)),
+		idx:          idx,
+		generators:   make(map[search_params]cached_generators),
+	}
+
+	for i := range corpus {
+		if _, found := s.corpus[corpus[i].id]; found {
+			return nil, fmt.Errorf("Fingerprint ID is not unique: %s", corpus[i].id)
+		}
+		corpus[i].ordinal = i
+		s.fingerprints[i] = &corpus[i]
+		s.corpus[corpus[i].id] = &corpus[i]
+	}
+
+	return s, nil
+}
+
+// Creates a server of a landmark index built from the corpus, with the default
+// minimum count of matches of requests.
+func newLandmarkIndexServer(corpus []landmark_fingerprint, minCount int) (*index_server, error) {
+	s := &index_server{
+		landmarks: &landmark_corpus{
+			fingerprints: make(map[string]*landmark_fingerprint, len(corpus)),
+			idx:          make(landmark_index),
+			minCount:     minCount,
+		},
+	}
+
+	for i := range corpus {
+		if _, found := s.landmarks.fingerprints[corpus[i].id]; found {
+			return nil, fmt.Errorf("Fingerprint ID is not unique: %s", corpus[i].id)
+		}
+		s.landmarks.fingerprints[corpus[i].id] = &corpus[i]
+		addToLandmarkIndex(s.landmarks.idx, &corpus[i])
+	}
+
+	return s, nil
+}
+
+// The search parameters of requests to a landmark index by name, as those of
+// `search_params.flagValues`.
+func (c *landmark_corpus) flagValues() map[string]string {
+	minCount := c.minCount
+	flags := flag.NewFlagSet("params", flag.ContinueOnError)
+	registerLandmarkFlags(flags, &minCount)
+
+	values := make(map[string]string)
+	flags.VisitAll(func(f *flag.Flag) {
+		values[f.Name] = f.Value.String()
+	})
+
+	return values
+}
+
+// Adds a fingerprint to the index, unless one of the same ID was already
+// added, which is reported as false. An error writing the fingerprint to the
+// log leaves it out of the index.
+func (s *index_server) add(fp fingerprint) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, found := s.corpus[fp.id]; found {
+		return false, nil
+	}
+
+	if s.log != nil {
+		var entry bytes.Buffer
+		writeDelimited(&entry, newIndexFingerprint(s.alg, fp))
+		if err := s.writeLog(entry.Bytes()); err != nil {
+			return false, fmt.Errorf("Failed writing fingerprint %s to log: %s", fp.id, err)
+		}
+	}
+
+	s.insert(&fp)
+
+	return true, nil
+}
+
+// Adds a batch of fingerprints to the index at once, with the error of each
+// fingerprint that was not added. A fingerprint of an ID already added,
+// including earlier in the batch, is not added. The batch is written to the
+// log in a single write, and an error writing it leaves the whole batch out of
+// the index.
+func (s *index_server) addBatch(fps []fingerprint) []error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	errs := make([]error, len(fps))
+	batch := make(map[string]bool, len(fps))
+	var entries bytes.Buffer
+	for i := range fps {
+		if _, found := s.corpus[fps[i].id]; found || batch[fps[i].id] {
+			errs[i] = fmt.Errorf("Fingerprint is already indexed: %s", fps[i].id)
+			continue
+		}
+		batch[fps[i].id] = true
+
+		if s.log != nil {
+			writeDelimited(&entries, newIndexFingerprint(s.alg, fps[i]))
+		}
+	}
+
+	if s.log != nil {
+		if err := s.writeLog(entries.Bytes()); err != nil {
+			for i := range errs {
+				if errs[i] == nil {
+					errs[i] = fmt.Errorf("Failed writing fingerprint %s to log: %s", fps[i].id, err)
+				}
+			}
+			return errs
+		}
+	}
+
+	for i := range fps {
+		if errs[i] == nil {
+			s.insert(&fps[i])
+		}
+	}
+
+	return errs
+}
+
+// Adds a landmark fingerprint to a landmark index, as `add` does.
+func (s *index_server) addLandmarks(lfp landmark_fingerprint) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, found := s.landmarks.fingerprints[lfp.id]; found {
+		return false, nil
+	}
+
+	if s.log != nil {
+		var entry bytes.Buffer
+		writeDelimited(&entry, newIndexLandmarkFingerprint(lfp))
+		if err := s.writeLog(entry.Bytes()); err != nil {
+			return false, fmt.Errorf("Failed writing fingerprint %s to log: %s", lfp.id, err)
+		}
+	}
+
+	s.landmarks.fingerprints[lfp.id] = &lfp
+	addToLandmarkIndex(s.landmarks.idx, &lfp)
+
+	return true, nil
+}
+
+// Appends entries to the log in a single write. A write that fails may have
+// written part of the entries, so the log is truncated back to where it was,
+// leaving no partial entry for later entries to follow. If that fails too,
+// nothing more is written to the log. The caller must hold the write lock on
+// the index.
+func (s *index_server) writeLog(entries []byte) error {
+	if s.logErr != nil {
+		return s.logErr
+	}
+
+	size, err := s.log.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.log.Write(entries); err != nil {
+		if terr := s.log.Truncate(size); terr != nil {
+			s.logErr = fmt.Errorf("Log is unusable after failing to truncate it: %s", terr)
+		} else if _, serr := s.log.Seek(size, io.SeekStart); serr != nil {
+			s.logErr = fmt.Errorf("Log is unusable after failing to truncate it: %s", serr)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Inserts a fingerprint into the corpus and the index, and into what the
+// kept candidate generators keep of the index, so that they never need
+// creating again as the index grows. The caller must hold the write lock on
+// the index.
+func (s *index_server) insert(fp *fingerprint) {
+	fp.ordinal = len(s.fingerprints)
+	s.fingerprints = append(s.fingerprints, fp)
+	s.corpus[fp.id] = fp
+	addToIndex(s.idx, fp)
+
+	s.genMutex.Lock()
+	for _, cached := range s.generators {
+		if cached.add != nil {
+			cached.add(fp)
+		}
+	}
+	s.genMutex.Unlock()
+}
+
+// Gets an indexed fingerprint by ID.
+func (s *index_server) get(id string) (*fingerprint, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	fp, found := s.corpus[id]
+	return fp, found
+}
+
+// Gets an indexed landmark fingerprint of a landmark index by ID.
+func (s *index_server) getLandmarks(id string) (*landmark_fingerprint, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	lfp, found := s.landmarks.fingerprints[id]
+	return lfp, found
+}
+
+// The number of fingerprints and of distinct sub-fingerprints indexed, or of
+// distinct hashes of a landmark index.
+func (s *index_server) size() (int, int) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if s.landmarks != nil {
+		return len(s.landmarks.fingerprints), len(s.landmarks.idx)
+	}
+	return len(s.corpus), s.idx.size()
+}
+
+// The candidate generator of the search parameters, restricted to the
+// fingerprints passing the filter. What is expensive to create for the
+// parameters is kept for later searches, if they are among the most recently
+// used, and updated as fingerprints are added, while the set of fingerprints
+// is made for each filter. The caller must hold at least a read lock on the
+// index.
+func (s *index_server) generator(params search_params, filter fingerprint_filter) (candidate_generator, error) {
+	s.genMutex.Lock()
+	cached, found := s.generators[params]
+	if !found {
+		var err error
+		cached.generators, cached.add, err = params.updatableCandidateGenerators(s.idx)
+		if err != nil {
+			s.genMutex.Unlock()
+			return nil, err
+		}
+		s.generators[params] = cached
+	}
+
+	// move the parameters to the end as the most recently used, dropping the
+	// least recently used beyond the maximum
+	for i, p := range s.genOrder {
+		if p == params {
+			s.genOrder = append(s.genOrder[:i], s.genOrder[i+1:]...)
+			break
+		}
+	}
+	s.genOrder = append(s.genOrder, params)
+	if len(s.genOrder) > MaxCachedCandidateGenerators {
+		delete(s.generators, s.genOrder[0])
+		s.genOrder = s.genOrder[1:]
+	}
+	s.genMutex.Unlock()
+
+	return cached.generators(newFingerprintSet(s.fingerprints, filter)), nil
+}
+
+// Searches the index with the query fingerprint as the `query` command does,
+// with a candidate generator of `generator`, reporting at most the limit of
+// matches unless it is zero.
+func (s *index_server) query(
+	params search_params,
+	generator candidate_generator,
+	queryFp fingerprint,
+	limit int,
+	maxDrift int) (query_report, error) {
+
+	start := time.Now()
+	s.mutex.RLock()
+	results, err := params.searchWindowsWith(queryFp, generator)
+	s.mutex.RUnlock()
+	if err != nil {
+		return query_report{}, err
+	}
+
+	matches := rankMatches(s.alg, queryFp, results)
+	windowMatches := bestWindowMatches(s.alg, queryFp, results)
+	segments := mergeWindowMatches(s.alg, queryFp, windowMatches, maxDrift)
+	duration := time.Since(start)
+
+	if limit > 0 && len(matches) > limit {
+		matches = matches[:limit]
+	}
+
+	return newQueryReport(queryFp, results, windowMatches, matches, segments, duration), nil
+}
+
+// Searches a landmark index with the query landmark fingerprint as the `query`
+// command does, reporting at most the limit of matches unless it is zero.
+func (s *index_server) queryLandmarks(query landmark_fingerprint, minCount int, limit int) (landmark_query_report, error) {
+	start := time.Now()
+	s.mutex.RLock()
+	matches, err := searchByLandmarks(query, minCount, s.landmarks.idx)
+	s.mutex.RUnlock()
+	if err != nil {
+		return landmark_query_report{}, err
+	}
+	duration := time.Since(start)
+
+	if limit > 0 && len(matches) > limit {
+		matches = matches[:limit]
+	}
+
+	return newLandmarkQueryReport(query, matches, duration), nil
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/golang/protobuf/proto"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func serveTestRequest(r http.Handler, method string, target string, body []byte) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(method, target, bytes.NewReader(body)))
+	return w
+}
+
+func TestIndexServerHandlers(t *testing.T) {
+	p := defaultCorpusParams()
+	p.size, p.minLength, p.maxLength = 10, 1000, 2000
+	p.silenceFraction, p.repeatFraction, p.sharedFraction = 0, 0, 0
+	corpus, err := generateCorpus(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a copy of a reference with different fields
+	corpus = append(corpus, fingerprint{"copy", corpus[2].sfps, fingerprint_meta{}, 0})
+	for i := range corpus {
+		genre := "rock"
+		if i%2 == 1 || corpus[i].id == "copy" {
+			genre = "jazz"
+		}
+		corpus[i].meta = defaultFingerprintMeta()
+		corpus[i].meta.fields = map[string]string{"genre": genre}
+	}
+
+	s, err := newIndexServer(philips, defaultSearchParams(), nil, newIndex(philips))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg, _ := openIndexRegistry("", defaultSearchParams())
+	r := newRouter(s, reg)
+
+	for i, fp := range corpus {
+		body, _ := proto.Marshal(newIndexFingerprint(philips, fp))
+		if w := serveTestRequest(r, "POST", "/index", body); w.Code != http.StatusCreated {
+			t.Fatalf("[%d] Expected status %d but was %d: %s", i, http.StatusCreated, w.Code, w.Body.String())
+		}
+	}
+
+	body, _ := proto.Marshal(newIndexFingerprint(philips, corpus[0]))
+	if w := serveTestRequest(r, "POST", "/index", body); w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d adding a duplicate ID but was %d", http.StatusConflict, w.Code)
+	}
+
+	if n, _ := s.size(); n != len(corpus) {
+		t.Errorf("Expected %d fingerprints indexed but was %d", len(corpus), n)
+	}
+
+	// lookup
+	w := serveTestRequest(r, "GET", "/index/copy", nil)
+	var report fingerprint_report
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Failed decoding fingerprint report: %s", err)
+	}
+	expected := newFingerprintReport(&corpus[len(corpus)-1])
+	if w.Code != http.StatusOK || !reflect.DeepEqual(expected, report) {
+		t.Errorf("Expected %v but was %d: %v", expected, w.Code, report)
+	}
+
+	if w := serveTestRequest(r, "GET", "/index/missing", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d but was %d", http.StatusNotFound, w.Code)
+	}
+
+	// search, with and without fields to filter on
+	query, _ := proto.Marshal(newQueryFingerprint(philips, fingerprint{"query", corpus[2].sfps[100:600], fingerprint_meta{}, 0}))
+	fixtures := []struct {
+		query    string
+		expected []string
+	}{
+		{"", []string{corpus[2].id, "copy"}},
+		{"?field.genre=rock", []string{corpus[2].id}},
+		{"?field.genre=jazz", []string{"copy"}},
+		{"?field.genre=blues", []string{}},
+		{"?field.genre=rock&field.label=none", []string{}},
+		{"?field.genre=rock&field.genre=jazz", []string{corpus[2].id, "copy"}},
+		{"?id_prefix=cop", []string{"copy"}},
+		{"?id_prefix=0000", []string{corpus[2].id}},
+		{"?id_prefix=0000&id_prefix=cop", []string{corpus[2].id, "copy"}},
+		{"?id_prefix=0000&field.genre=jazz", []string{}},
+		{"?id_prefix=0000&approx_search_strategy=lsh&lsh_bits=24", []string{corpus[2].id}},
+	}
+
+	for i, fixture := range fixtures {
+		w := serveTestRequest(r, "POST", "/search"+fixture.query, query)
+		if w.Code != http.StatusOK {
+			t.Fatalf("[%d] Expected status %d but was %d: %s", i, http.StatusOK, w.Code, w.Body.String())
+		}
+
+		var report query_report
+		if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+			t.Fatalf("[%d] Failed decoding query report: %s", i, err)
+		}
+
+		// a reference matches at the offset of each window
+		found := make(map[string]bool)
+		for _, m := range report.Matches {
+			found[m.Id] = true
+			if !reflect.DeepEqual(s.corpus[m.Id].meta.fields, m.Fields) {
+				t.Errorf("[%d] Expected fields %v of %s but were %v", i, s.corpus[m.Id].meta.fields, m.Id, m.Fields)
+			}
+		}
+		ids := []string{}
+		for id := range found {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		if !reflect.DeepEqual(fixture.expected, ids) {
+			t.Errorf("[%d] Expected matches %v but were %v", i, fixture.expected, ids)
+		}
+	}
+
+	if w := serveTestRequest(r, "POST", "/search?unknown=1", query); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d but was %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestBatchSearchHandler(t *testing.T) {
+	p := defaultCorpusParams()
+	p.size, p.minLength, p.maxLength = 10, 1000, 2000
+	p.silenceFraction, p.repeatFraction, p.sharedFraction = 0, 0, 0
+	corpus, err := generateCorpus(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := newIndexServer(philips, defaultSearchParams(), corpus, buildIndex(philips, corpus))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg, _ := openIndexRegistry("", defaultSearchParams())
+	server := httptest.NewServer(newRouter(s, reg))
+	defer server.Close()
+
+	// the first result is read before the rest of the queries are sent
+	body, queries := io.Pipe()
+	responses := make(chan *http.Response)
+	go func() {
+		response, err := http.Post(server.URL+"/search/batch?parallelism=1", "application/octet-stream", body)
+		if err != nil {
+			t.Error(err)
+			body.Close()
+		}
+		responses <- response
+	}()
+
+	writeDelimited(queries, newQueryFingerprint(philips, fingerprint{"q0", corpus[3].sfps[100:600], fingerprint_meta{}, 0}))
+	response := <-responses
+	if response == nil {
+		t.FailNow()
+	}
+	defer response.Body.Close()
+
+	lines := bufio.NewScanner(response.Body)
+	var results []batch_search_result
+	read := func() {
+		if !lines.Scan() {
+			t.Fatalf("Expected a result after %d: %v", len(results), lines.Err())
+		}
+		var result batch_search_result
+		if err := json.Unmarshal(lines.Bytes(), &result); err != nil {
+			t.Fatalf("Failed decoding result: %s", err)
+		}
+		results = append(results, result)
+	}
+	read()
+
+	writeDelimited(queries, newQueryFingerprint(philips, fingerprint{"", corpus[7].sfps[0:500], fingerprint_meta{}, 0}))
+	writeDelimited(queries, &QueryFingerprint{
+		Id:              proto.String("invalid"),
+		SubFingerprints: []*QueryFingerprint_QuerySubFingerprint{{Value: []byte{1, 2}}},
+	})
+	queries.Write([]byte{100, 1, 2}) // cut short
+	queries.Close()
+	for len(results) < 4 {
+		read()
+	}
+
+	expected := []struct {
+		id    string
+		match string
+		err   bool
+	}{
+		{"q0", corpus[3].id, false},
+		{"", corpus[7].id, false},
+		{"invalid", "", true},
+		{"", "", true},
+	}
+
+	for i, e := range expected {
+		position := i
+		if i == 3 {
+			position = -1
+		}
+		result := results[i]
+		if result.Position != position || result.Id != e.id || (result.Error != "") != e.err {
+			t.Errorf("[%d] Expected position %d of %s with error %t but was %v", i, position, e.id, e.err, result)
+		}
+		if e.match != "" && (result.Report == nil || len(result.Report.Matches) == 0 || result.Report.Matches[0].Id != e.match) {
+			t.Errorf("[%d] Expected a match of %s but was %v", i, e.match, result.Report)
+		}
+	}
+}
+
+func TestIndexServerGeneratorCache(t *testing.T) {
+	corpus := buildTestCorpus()
+	s, err := newIndexServer(philips, defaultSearchParams(), corpus, buildIndex(philips, corpus))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only the most recently used parameters are kept
+	params := s.params
+	params.approxSearchStrategy, params.blockSize = "lsh", 2
+	for bits := 1; bits <= 2*MaxCachedCandidateGenerators; bits++ {
+		params.lshBits = bits
+		if _, err := s.generator(params, fingerprint_filter{}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.generator(s.params, fingerprint_filter{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(s.generators) != MaxCachedCandidateGenerators || len(s.genOrder) != MaxCachedCandidateGenerators {
+		t.Errorf("Expected %d generators kept but was %d", MaxCachedCandidateGenerators, len(s.generators))
+	}
+	if _, found := s.generators[s.params]; !found {
+		t.Errorf("Expected the generator of the parameters used throughout to be kept")
+	}
+	if _, found := s.generators[params]; !found {
+		t.Errorf("Expected the generator of the parameters used last to be kept")
+	}
+}
+
+// Kept candidate generators find fingerprints added after they were created.
+func TestIndexServerGeneratorUpdate(t *testing.T) {
+	corpus := buildTestCorpus()
+	s, err := newIndexServer(philips, defaultSearchParams(), corpus[:2], buildIndex(philips, corpus[:2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params := s.params
+	params.approxSearchStrategy, params.maxHammingDistance, params.mihSubstrings = "mih", 1, 2
+	if _, err := s.generator(params, fingerprint_filter{}); err != nil {
+		t.Fatal(err)
+	}
+
+	added := fingerprint{
+		id:   "0004",
+		sfps: []sub_fingerprint{sub_fingerprint{7, 7, 7, 7}, sub_fingerprint{5, 5, 5, 5}},
+	}
+	if ok, err := s.add(added); !ok || err != nil {
+		t.Fatalf("Expected fingerprint to be added but was %v: %v", ok, err)
+	}
+	if _, found := s.generators[params]; !found {
+		t.Fatalf("Expected the generator to be kept as the fingerprint was added")
+	}
+
+	generator, err := s.generator(params, fingerprint_filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	candidates, err := generator(fingerprint_block{sub_fingerprint{7, 7, 7, 6}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 1 || candidates[0].fp.id != added.id {
+		t.Errorf("Expected the added fingerprint as the only candidate but was %v", candidates)
+	}
+}
+
+// Routes match by prefix, so only the whole path of a route is handled.
+func TestRouterWholePaths(t *testing.T) {
+	corpus := buildTestCorpus()
+	s, err := newIndexServer(philips, defaultSearchParams(), nil, newIndex(philips))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg, _ := openIndexRegistry("", defaultSearchParams())
+	if _, _, err := reg.create("a", index_config{PhilipsAlgorithm, nil}); err != nil {
+		t.Fatal(err)
+	}
+	r := newRouter(s, reg)
+
+	body, _ := proto.Marshal(newIndexFingerprint(philips, corpus[0]))
+	fixtures := []struct {
+		method string
+		target string
+	}{
+		{"POST", "/indexes"},
+		{"POST", "/indexfoo"},
+		{"POST", "/index/anything"},
+		{"POST", "/index/bulkfoo"},
+		{"POST", "/index/bulk/anything"},
+		{"POST", "/searchfoo"},
+		{"POST", "/search/anything"},
+		{"POST", "/search/batch/anything"},
+		{"POST", "/monitor/anything"},
+		{"GET", "/index/0001/anything"},
+		{"GET", "/-/statsfoo"},
+		{"POST", "/indexes/a/indexfoo"},
+		{"POST", "/indexes/a/index/anything"},
+		{"POST", "/indexes/a/search/anything"},
+		{"GET", "/indexes/a/index/0001/anything"},
+	}
+	for i, fixture := range fixtures {
+		if w := serveTestRequest(r, fixture.method, fixture.target, body); w.Code != http.StatusNotFound {
+			t.Errorf("[%d] Expected status %d of %s %s but was %d", i, http.StatusNotFound, fixture.method, fixture.target, w.Code)
+		}
+	}
+
+	named, _ := reg.get("a")
+	if n, _ := s.size(); n != 0 {
+		t.Errorf("Expected no fingerprints added to the default index but was %d", n)
+	}
+	if n, _ := named.size(); n != 0 {
+		t.Errorf("Expected no fingerprints added to index a but was %d", n)
+	}
+
+	if w := serveTestRequest(r, "POST", "/index", body); w.Code != http.StatusCreated {
+		t.Errorf("Expected status %d but was %d", http.StatusCreated, w.Code)
+	}
+	if w := serveTestRequest(r, "GET", "/index/"+corpus[0].id, nil); w.Code != http.StatusOK {
+		t.Errorf("Expected status %d but was %d", http.StatusOK, w.Code)
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"runtime"
+	"strconv"
+)
+
+// Specification of a parameter sweep. Each list gives the values to try for a
+// search parameter, and parameters without values keep their defaults. A grid
+// sweep tries every combination of values while a random sweep tries a number
+// of samples, picking a value of each parameter at random.
+type sweep_spec struct {
+	Mode                 string    `json:"mode"`
+	Samples              int       `json:"samples"`
+	Seed                 int64     `json:"seed"`
+	BlockSize            []int     `json:"block_size"`
+	StepSize             []int     `json:"step_size"`
+	ApproxSearchStrategy []string  `json:"approx_search_strategy"`
+	MaxHammingDistance   []int     `json:"max_hamming_distance"`
+	MihSubstrings        []int     `json:"mih_substrings"`
+	LshTables            []int     `json:"lsh_tables"`
+	LshBits              []int     `json:"lsh_bits"`
+	BER                  []float64 `json:"ber"`
+	MinOverlap           []float64 `json:"min_overlap"`
+	TrailingBlock        []bool    `json:"trailing_block"`
+	SpeedFactors         []string  `json:"speed_factors"`
+}
+
+// A single search parameter of a sweep, with the number of values to try and
+// a function setting the i-th value.
+type sweep_dimension struct {
+	size int
+	set  func(p *search_params, i int)
+}
+
+func (spec sweep_spec) dimensions() []sweep_dimension {
+	return []sweep_dimension{
+		{len(spec.BlockSize), func(p *search_params, i int) { p.blockSize = spec.BlockSize[i] }},
+		{len(spec.StepSize), func(p *search_params, i int) { p.stepSize = spec.StepSize[i] }},
+		{len(spec.ApproxSearchStrategy), func(p *search_params, i int) { p.approxSearchStrategy = spec.ApproxSearchStrategy[i] }},
+		{len(spec.MaxHammingDistance), func(p *search_params, i int) { p.maxHammingDistance = spec.MaxHammingDistance[i] }},
+		{len(spec.MihSubstrings), func(p *search_params, i int) { p.mihSubstrings = spec.MihSubstrings[i] }},
+		{len(spec.LshTables), func(p *search_params, i int) { p.lshTables = spec.LshTables[i] }},
+		{len(spec.LshBits), func(p *search_params, i int) { p.lshBits = spec.LshBits[i] }},
+		{len(spec.BER), func(p *search_params, i int) { p.ber = spec.BER[i] }},
+		{len(spec.MinOverlap), func(p *search_params, i int) { p.minOverlap = spec.MinOverlap[i] }},
+		{len(spec.TrailingBlock), func(p *search_params, i int) { p.trailingBlock = spec.TrailingBlock[i] }},
+		{len(spec.SpeedFactors), func(p *search_params, i int) { p.speedFactors = spec.SpeedFactors[i] }},
+	}
+}
+
+// Generates the search parameters of each configuration to try, starting from
+// the base parameters. Configurations that only differ in parameters unused by
+// the approximate search strategy are only tried once.
+func (spec sweep_spec) configurations(base search_params) ([]search_params, error) {
+	var configs []search_params
+	seen := make(map[search_params]bool)
+	add := func(p search_params) {
+		if p.approxSearchStrategy == "none" || p.approxSearchStrategy == "lsh" {
+			p.maxHammingDistance = 0 // unused
+		}
+		if p.approxSearchStrategy != "mih" {
+			p.mihSubstrings = 0 // unused
+		}
+		if p.approxSearchStrategy != "lsh" {
+			p.lshTables, p.lshBits = 0, 0 // unused
+		}
+
+		if !seen[p] {
+			seen[p] = true
+			configs = append(configs, p)
+		}
+	}
+
+	switch spec.Mode {
+	case "", "grid":
+		grid := []search_params{base}
+		for _, dim := range spec.dimensions() {
+			if dim.size == 0 {
+				continue
+			}
+
+			expanded := make([]search_params, 0, len(grid)*dim.size)
+			for _, p := range grid {
+				for i := 0; i < dim.size; i++ {
+					dim.set(&p, i)
+					expanded = append(expanded, p)
+				}
+			}
+			grid = expanded
+		}
+
+		for _, p := range grid {
+			add(p)
+		}
+
+	case "random":
+		if spec.Samples < 1 {
+			return nil, fmt.Errorf("Random sweeps need one or more samples: %d", spec.Samples)
+		}
+
+		rng := rand.New(rand.NewSource(spec.Seed))
+		for i := 0; i < spec.Samples; i++ {
+			p := base
+			for _, dim := range spec.dimensions() {
+				if dim.size > 0 {
+					dim.set(&p, rng.Intn(dim.size))
+				}
+			}
+			add(p)
+		}
+
+	default:
+		return nil, fmt.Errorf("Unknown sweep mode: %s", spec.Mode)
+	}
+
+	return configs, nil
+}
+
+// The evaluation of a single configuration of a sweep, along with whether it
+// is on the Pareto frontier of recall against the mean number of candidates
+// examined per query and of recall against the median latency.
+type sweep_result struct {
+	Config               int     `json:"config"`
+	BlockSize            int     `json:"block_size"`
+	StepSize             int     `json:"step_size"`
+	ApproxSearchStrategy string  `json:"approx_search_strategy"`
+	MaxHammingDistance   int     `json:"max_hamming_distance"`
+	MihSubstrings        int     `json:"mih_substrings"`
+	LshTables            int     `json:"lsh_tables"`
+	LshBits              int     `json:"lsh_bits"`
+	BER                  float64 `json:"ber"`
+	MinOverlap           float64 `json:"min_overlap"`
+	TrailingBlock        bool    `json:"trailing_block"`
+	SpeedFactors         string  `json:"speed_factors"`
+	evaluation
+	ParetoCandidates bool `json:"pareto_candidates"`
+	ParetoLatency    bool `json:"pareto_latency"`
+}
+
+func newSweepResult(config int, p search_params, e evaluation) sweep_result {
+	return sweep_result{
+		Config:               config,
+		BlockSize:            p.blockSize,
+		StepSize:             p.stepSize,
+		ApproxSearchStrategy: p.approxSearchStrategy,
+		MaxHammingDistance:   p.maxHammingDistance,
+		MihSubstrings:        p.mihSubstrings,
+		LshTables:            p.lshTables,
+		LshBits:              p.lshBits,
+		BER:                  p.ber,
+		MinOverlap:           p.minOverlap,
+		TrailingBlock:        p.trailingBlock,
+		SpeedFactors:         p.speedFactors,
+		evaluation:           e,
+	}
+}
+
+// Evaluates each configuration over the labelled query set, running the given
+// number of configurations in parallel. Note that latencies are measured while
+// other configurations are running, so are only comparable within a sweep.
+func runSweep(
+	configs []search_params,
+	queries []labelled_query,
+	idx index,
+	parallelism int,
+	progress func(done int)) ([]sweep_result, error) {
+
+	if parallelism < 1 {
+		return nil, fmt.Errorf("Parallelism must be greater than or equal to one: %d", parallelism)
+	}
+
+	type sweep_outcome struct {
+		config int
+		e      evaluation
+		err    error
+	}
+
+	jobs := make(chan int, len(configs))
+	for i := range configs {
+		jobs <- i
+	}
+	close(jobs)
+
+	outcomes := make(chan sweep_outcome)
+	for w := 0; w < parallelism; w++ {
+		go func() {
+			for i := range jobs {
+				queryOutcomes, err := searchLabelledQueries(queries, configs[i], idx)
+				outcomes <- sweep_outcome{i, evaluateOutcomes(queryOutcomes), err}
+			}
+		}()
+	}
+
+	results := make([]sweep_result, len(configs))
+	var firstErr error
+	for done := 1; done <= len(configs); done++ {
+		outcome := <-outcomes
+		if outcome.err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("Configuration %d failed: %s", outcome.config, outcome.err)
+		}
+		results[outcome.config] = newSweepResult(outcome.config, configs[outcome.config], outcome.e)
+
+		if progress != nil {
+			progress(done)
+		}
+	}
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	markParetoFrontiers(results)
+	return results, nil
+}
+
+// Marks the results on the Pareto frontiers of recall, which is to be
+// maximised, against candidates examined and latency, which are to be
+// minimised.
+func markParetoFrontiers(results []sweep_result) {
+	candidates := make([]float64, len(results))
+	latency := make([]float64, len(results))
+	recall := make([]float64, len(results))
+	for i, r := range results {
+		candidates[i] = r.MeanCandidates
+		latency[i] = r.LatencyP50
+		recall[i] = r.Recall
+	}
+
+	for i := range results {
+		results[i].ParetoCandidates = onParetoFrontier(i, recall, candidates)
+		results[i].ParetoLatency = onParetoFrontier(i, recall, latency)
+	}
+}
+
+// Determines if the i-th point is not dominated by any other point, where the
+// benefit is to be maximised and the cost minimised.
+func onParetoFrontier(i int, benefit []float64, cost []float64) bool {
+	for j := range benefit {
+		if j == i {
+			continue
+		}
+
+		if benefit[j] >= benefit[i] && cost[j] <= cost[i] &&
+			(benefit[j] > benefit[i] || cost[j] < cost[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func writeSweepResultsCSV(w io.Writer, results []sweep_result) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{
+		"config", "block_size", "step_size", "approx_search_strategy",
+		"max_hamming_distance", "mih_substrings", "lsh_tables", "lsh_bits",
+		"ber", "min_overlap", "trailing_block", "speed_factors",
+		"queries", "precision", "recall", "top1_accuracy", "mean_offset_error",
+		"mean_candidates", "latency_p50_ms", "latency_p90_ms", "latency_p99_ms",
+		"pareto_candidates", "pareto_latency",
+	})
+
+	f := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+	for _, r := range results {
+		cw.Write([]string{
+			strconv.Itoa(r.Config),
+			strconv.Itoa(r.BlockSize),
+			strconv.Itoa(r.StepSize),
+			r.ApproxSearchStrategy,
+			strconv.Itoa(r.MaxHammingDistance),
+			strconv.Itoa(r.MihSubstrings),
+			strconv.Itoa(r.LshTables),
+			strconv.Itoa(r.LshBits),
+			f(r.BER),
+			f(r.MinOverlap),
+			strconv.FormatBool(r.TrailingBlock),
+			r.SpeedFactors,
+			strconv.Itoa(r.Queries),
+			f(r.Precision),
+			f(r.Recall),
+			f(r.Top1Accuracy),
+			f(r.MeanOffsetError),
+			f(r.MeanCandidates),
+			f(r.LatencyP50),
+			f(r.LatencyP90),
+			f(r.LatencyP99),
+			strconv.FormatBool(r.ParetoCandidates),
+			strconv.FormatBool(r.ParetoLatency),
+		})
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// Results of a sweep as written in JSON, with the configurations on each
+// Pareto frontier listed separately.
+type sweep_report struct {
+	Results          []sweep_result `json:"results"`
+	ParetoCandidates []int          `json:"pareto_candidates"`
+	ParetoLatency    []int          `json:"pareto_latency"`
+}
+
+func newSweepReport(results []sweep_result) sweep_report {
+	report := sweep_report{results, []int{}, []int{}}
+	for _, r := range results {
+		if r.ParetoCandidates {
+			report.ParetoCandidates = append(report.ParetoCandidates, r.Config)
+		}
+		if r.ParetoLatency {
+			report.ParetoLatency = append(report.ParetoLatency, r.Config)
+		}
+	}
+
+	return report
+}
+
+func readSweepSpec(path string) (sweep_spec, error) {
+	var spec sweep_spec
+
+	f, err := os.Open(path)
+	if err != nil {
+		return spec, err
+	}
+	defer f.Close()
+
+	err = json.NewDecoder(f).Decode(&spec)
+	return spec, err
+}
+
+// Sweeps search parameters over a labelled query set, evaluating each
+// configuration and writing a table of results.
+func sweepCommand(args []string) {
+	flags := flag.NewFlagSet("sweep", flag.ExitOnError)
+	indexPath := flags.String("index", "", "path to the index to search")
+	queriesPath := flags.String("queries", "", "path to the CSV file of labelled queries")
+	specPath := flags.String("spec", "", "path to the JSON sweep specification")
+	output := flags.String("output", "csv", "output format: csv or json")
+	parallelism := flags.Int("parallelism", runtime.NumCPU(), "number of configurations evaluated in parallel")
+	params := defaultSearchParams()
+	params.registerFlags(flags)
+	flags.Parse(args)
+
+	if *indexPath == "" || *queriesPath == "" || *specPath == "" {
+		log.Fatal("All of -index, -queries and -spec must be provided")
+	}
+
+	spec, err := readSweepSpec(*specPath)
+	if err != nil {
+		log.Fatalf("Failed reading sweep specification: %s", err)
+	}
+
+	alg, _, idx, err := readIndexFile(*indexPath)
+	if err != nil {
+		log.Fatalf("Failed reading index: %s", err)
+	}
+
+	params, err = params.forAlgorithm(alg, flags)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	configs, err := spec.configurations(params)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	queries, err := readLabelledQueries(alg, *queriesPath)
+	if err != nil {
+		log.Fatalf("Failed reading labelled queries: %s", err)
+	}
+
+	results, err := runSweep(configs, queries, idx, *parallelism, func(done int) {
+		log.Printf("Evaluated %d/%d configurations", done, len(configs))
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch *output {
+	case "csv":
+		err = writeSweepResultsCSV(os.Stdout, results)
+	case "json":
+		err = json.NewEncoder(os.Stdout).Encode(newSweepReport(results))
+	default:
+		err = fmt.Errorf("Unknown output format: %s", *output)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import "testing"
+
+func TestSweepSpecGridConfigurations(t *testing.T) {
+	spec := sweep_spec{
+		BlockSize:            []int{2, 4},
+		ApproxSearchStrategy: []string{"none", "flip"},
+		MaxHammingDistance:   []int{1, 2},
+		BER:                  []float64{0.1, 0.2, 0.3},
+	}
+
+	configs, err := spec.configurations(defaultSearchParams())
+	if err != nil {
+		t.Fatalf("Generating configurations failed when it should not have: %s", err)
+	}
+
+	// 2 block sizes * (1 none + 2 flip) * 3 BERs
+	if expected, got := 18, len(configs); expected != got {
+		t.Fatalf("Expected %d configurations but got %d", expected, got)
+	}
+
+	for i, p := range configs {
+		if p.stepSize != FingerprintBlockSize {
+			t.Errorf("[%d] Expected default step size %d but was %d", i, FingerprintBlockSize, p.stepSize)
+		}
+
+		if p.approxSearchStrategy == "none" && p.maxHammingDistance != 0 {
+			t.Errorf("[%d] Expected unused Hamming distance to be cleared but was %d", i, p.maxHammingDistance)
+		}
+	}
+}
+
+func TestSweepSpecRandomConfigurations(t *testing.T) {
+	spec := sweep_spec{
+		Mode:      "random",
+		Samples:   5,
+		Seed:      42,
+		BlockSize: []int{2, 4, 8, 16, 32, 64, 128, 256},
+		BER:       []float64{0.1, 0.2, 0.3, 0.35},
+	}
+
+	first, err := spec.configurations(defaultSearchParams())
+	if err != nil {
+		t.Fatalf("Generating configurations failed when it should not have: %s", err)
+	}
+
+	second, _ := spec.configurations(defaultSearchParams())
+	if len(first) != len(second) || len(first) > spec.Samples {
+		t.Fatalf("Expected the same number of at most %d configurations but got %d and %d", spec.Samples, len(first), len(second))
+	}
+
+	for i := range first {
+		if first[i] != second[i] {
+			t.Errorf("[%d] Expected reproducible configurations but got %+v and %+v", i, first[i], second[i])
+		}
+	}
+
+	spec.Samples = 0
+	if _, err := spec.configurations(defaultSearchParams()); err == nil {
+		t.Errorf("Expected an error for a random sweep without samples")
+	}
+}
+
+func TestOnParetoFrontier(t *testing.T) {
+	recall := []float64{0.5, 0.8, 0.8, 0.9, 0.4}
+	cost := []float64{1.0, 2.0, 3.0, 10.0, 1.0}
+	expected := []bool{true, true, false, true, false}
+
+	for i, e := range expected {
+		if got := onParetoFrontier(i, recall, cost); e != got {
+			t.Errorf("[%d] Expected %t but got %t", i, e, got)
+		}
+	}
+}
+
+func TestRunSweep(t *testing.T) {
+	corpus := buildTestCorpus()
+	idx := buildIndex(philips, corpus)
+
+	queries := []labelled_query{
+		labelled_query{fingerprint{"q1", corpus[2].sfps, fingerprint_meta{}, 0}, "0003", 0},
+	}
+
+	spec := sweep_spec{BlockSize: []int{1, 2, 4}, StepSize: []int{1}}
+	configs, _ := spec.configurations(defaultSearchParams())
+
+	results, err := runSweep(configs, queries, idx, 2, nil)
+	if err != nil {
+		t.Fatalf("Sweep failed when it should not have: %s", err)
+	}
+
+	if expected, got := len(configs), len(results); expected != got {
+		t.Fatalf("Expected %d results but got %d", expected, got)
+	}
+
+	for i, r := range results {
+		if r.Config != i || r.BlockSize != configs[i].blockSize {
+			t.Errorf("[%d] Expected result for configuration %d with block size %d but was %d with %d", i, i, configs[i].blockSize, r.Config, r.BlockSize)
+		}
+
+		if r.Recall != 1.0 {
+			t.Errorf("[%d] Expected full recall but was %f", i, r.Recall)
+		}
+	}
+
+	// a block size larger than the query fails the query, which is a miss
+	configs[0].blockSize = 5
+	results, err = runSweep(configs, queries, idx, 2, nil)
+	if err != nil || results[0].Recall != 0.0 {
+		t.Errorf("Expected no recall when every query fails but was %v: %v", results[0], err)
+	}
+
+	// while a configuration that can't search at all fails
+	configs[0].approxSearchStrategy = "unknown"
+	if _, err := runSweep(configs, queries, idx, 2, nil); err == nil {
+		t.Errorf("Expected an error when a configuration fails")
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	DefaultSpeedFactors = "1"
+)
+
+// Parses a comma separated list of speed factors, each greater than zero. A
+// query played at a different speed to its reference, as radio stations do by
+// 2-4%, has its sub-fingerprints dropped or duplicated, so that blocks no
+// longer align frame for frame. Searching with a speed factor stretches the
+// query back to the speed of the reference first. Each factor is a search of
+// its own, so the cost of a search grows with the number of factors.
+func parseSpeedFactors(value string) ([]float64, error) {
+	var factors []float64
+	for _, field := range strings.Split(value, ",") {
+		factor, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid speed factor: %s", err)
+		}
+
+		if factor <= 0 {
+			return nil, fmt.Errorf("Speed factor must be greater than zero: %f", factor)
+		}
+		factors = append(factors, factor)
+	}
+
+	return factors, nil
+}
+
+// Stretches a sequence of sub-fingerprints by a speed factor, taking the
+// nearest sub-fingerprint for each position in the stretched sequence. This
+// undoes a change of speed by the same factor, where a factor above one sped
+// the query up, so it is stretched to more sub-fingerprints. A factor of one
+// (1) leaves the sequence as it is.
+func stretchSubFingerprints(sfps []sub_fingerprint, factor float64) []sub_fingerprint {
+	if factor == 1.0 {
+		return sfps
+	}
+
+	stretched := make([]sub_fingerprint, int(float64(len(sfps))*factor))
+	for k := range stretched {
+		i := int(math.Floor(float64(k)/factor + 0.5))
+		if i >= len(sfps) {
+			i = len(sfps) - 1
+		}
+		stretched[k] = sfps[i]
+	}
+
+	return stretched
+}
+
+// The query fingerprint stretched by a speed factor, keeping its ID.
+func stretchFingerprint(fp fingerprint, factor float64) fingerprint {
+	return fingerprint{fp.id, stretchSubFingerprints(fp.sfps, factor), fp.meta, 0}
+}
+
+// Searches the windows of the query stretched by each of the speed factors,
+// keeping the results of all factors, each with the factor searched. Offsets
+// of windows are in the stretched query. Factors that stretch the query to
+// less than a block are skipped, but at least one factor must be searched.
+func searchSpeedFactors(
+	queryFp fingerprint,
+	factors []float64,
+	blockSize int,
+	search func(stretched fingerprint) ([]window_result, error)) ([]window_result, error) {
+
+	var results []window_result
+	searched := false
+	for _, factor := range factors {
+		stretched := stretchFingerprint(queryFp, factor)
+		if len(stretched.sfps) < blockSize {
+			continue
+		}
+
+		speedResults, err := search(stretched)
+		if err != nil {
+			return make([]window_result, 0), err
+		}
+
+		for i := range speedResults {
+			speedResults[i].speed = factor
+		}
+		results = append(results, speedResults...)
+		searched = true
+	}
+
+	if !searched {
+		err := fmt.Errorf(
+			"Query fingerprint must be greater than or equal to a block (%d) at some speed factor: %d",
+			blockSize,
+			len(queryFp.sfps),
+		)
+		return make([]window_result, 0), err
+	}
+
+	return results, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestParseSpeedFactors(t *testing.T) {
+	got, err := parseSpeedFactors("0.98, 1,1.02")
+	if err != nil {
+		t.Fatalf("Parsing failed when it should not have: %s", err)
+	}
+
+	expected := []float64{0.98, 1.0, 1.02}
+	if len(expected) != len(got) {
+		t.Fatalf("Expected %d speed factors but got %d", len(expected), len(got))
+	}
+
+	for i, e := range expected {
+		if e != got[i] {
+			t.Errorf("[%d] Expected speed factor %f but got %f", i, e, got[i])
+		}
+	}
+
+	for _, value := range []string{"", "1,", "fast", "0", "-1.02"} {
+		if _, err := parseSpeedFactors(value); err == nil {
+			t.Errorf("Expected an error parsing speed factors: %s", value)
+		}
+	}
+}
+
+func TestStretchSubFingerprints(t *testing.T) {
+	sfps := randomSubFingerprints(philips, 1, 100)
+
+	// stretching undoes a change of tempo, up to a sub-fingerprint either way
+	for i, factor := range []float64{0.96, 1.04} {
+		distorted, _ := tempoDistortion(factor)(rand.New(rand.NewSource(1)), sfps)
+		stretched := stretchSubFingerprints(distorted, factor)
+
+		if d := len(stretched) - len(sfps); d < -2 || d > 2 {
+			t.Errorf("[%d] Expected about %d sub-fingerprints but got %d", i, len(sfps), len(stretched))
+		}
+
+		for k := range stretched {
+			if k >= len(sfps) {
+				break
+			}
+
+			found := false
+			for j := k - 1; j <= k+1; j++ {
+				if j >= 0 && j < len(sfps) && sfps[j] == stretched[k] {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("[%d][%d] Expected a sub-fingerprint of the original within one position", i, k)
+				break
+			}
+		}
+	}
+
+	if got := stretchSubFingerprints(sfps, 1.0); len(got) != len(sfps) || got[0] != sfps[0] {
+		t.Errorf("Expected a factor of one to leave the sub-fingerprints as they are")
+	}
+}
+
+// A query sped up by 4% drifts out of alignment with its reference, so the
+// windows of a search frame for frame find it at scattered offsets. Searched
+// at a speed factor of 1.04 it is found at its offset, with the speed reported
+// with the match.
+func TestSearchWithSpeedFactors(t *testing.T) {
+	p := defaultCorpusParams()
+	p.size, p.minLength, p.maxLength, p.segmentLength = 20, 2000, 3000, 256
+	corpus, err := generateCorpus(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := buildIndex(philips, corpus)
+
+	reference := corpus[7]
+	queryFp := fingerprint{"query", reference.sfps[500:1500], fingerprint_meta{}, 0}
+	queryFp.sfps, _ = tempoDistortion(1.04)(rand.New(rand.NewSource(1)), queryFp.sfps)
+
+	params := defaultSearchParams()
+	params.blockSize, params.stepSize, params.ber = 128, 64, 0.25
+
+	fixtures := []struct {
+		speedFactors string
+		aligned      bool
+	}{
+		{"1", false},
+		{"0.96,0.98,1,1.02,1.04", true},
+	}
+
+	for i, fixture := range fixtures {
+		params.speedFactors = fixture.speedFactors
+		results, err := params.searchWindows(queryFp, idx)
+		if err != nil {
+			t.Fatalf("[%d] Search failed when it should not have: %s", i, err)
+		}
+
+		matches := rankMatches(philips, queryFp, results)
+		if len(matches) == 0 || matches[0].fp.id != reference.id {
+			t.Fatalf("[%d] Expected the reference to be the best match", i)
+		}
+
+		m := matches[0]
+		aligned := m.offset >= 499 && m.offset <= 501
+		if fixture.aligned != aligned {
+			t.Errorf("[%d] Expected aligned at offset 500 to be %t but the match was at %d", i, fixture.aligned, m.offset)
+		}
+
+		if aligned && m.speed != 1.04 {
+			t.Errorf("[%d] Expected a match at speed 1.04 but was %f", i, m.speed)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+const (
+	DefaultTimelineMaxDrift = 2 // sub-fingerprints
+)
+
+// The best match of a single window of the query, being the candidate with the
+// lowest BER. The window is of the query stretched by the speed, and the offset
+// is the position in the reference aligned with the start of the window.
+type window_match struct {
+	window query_window
+	fp     *fingerprint
+	offset int
+	ber    float32
+	speed  float64
+}
+
+// A contiguous segment of the query matching a reference, as found by
+// consecutive windows agreeing on the reference and its alignment. The query
+// start and end are positions in the query as it was given, while the
+// reference start and end are positions in the reference, each in
+// sub-fingerprints with the end exclusive. The BER is over the whole segment.
+type segment struct {
+	fp             *fingerprint
+	queryStart     int
+	queryEnd       int
+	referenceStart int
+	referenceEnd   int
+	windows        int
+	ber            float32
+	speed          float64
+}
+
+type window_matches_by_offset []window_match
+
+func (s window_matches_by_offset) Len() int      { return len(s) }
+func (s window_matches_by_offset) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s window_matches_by_offset) Less(i, j int) bool {
+	if s[i].speed != s[j].speed {
+		return s[i].speed < s[j].speed
+	}
+	return s[i].window.offset < s[j].window.offset
+}
+
+type segments_by_rank []segment
+
+func (s segments_by_rank) Len() int      { return len(s) }
+func (s segments_by_rank) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s segments_by_rank) Less(i, j int) bool {
+	if s[i].windows != s[j].windows {
+		return s[i].windows > s[j].windows
+	}
+	if s[i].ber != s[j].ber {
+		return s[i].ber < s[j].ber
+	}
+	return s[i].queryStart < s[j].queryStart
+}
+
+type segments_by_query_start []segment
+
+func (s segments_by_query_start) Len() int      { return len(s) }
+func (s segments_by_query_start) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s segments_by_query_start) Less(i, j int) bool {
+	if s[i].queryStart != s[j].queryStart {
+		return s[i].queryStart < s[j].queryStart
+	}
+	return s[i].fp.id < s[j].fp.id
+}
+
+// Finds the best match of each window of a query fingerprint, in the order of
+// the results, where windows without candidates have no reference. Ties in BER
+// go to the lowest ID and then offset, so that the timeline is deterministic.
+func bestWindowMatches(alg fingerprint_algorithm, queryFp fingerprint, results []window_result) []window_match {
+	stretched := make(map[float64]fingerprint)
+	matches := make([]window_match, len(results))
+	for i, result := range results {
+		matches[i] = window_match{window: result.window, speed: result.speed}
+		if len(result.candidates) == 0 {
+			continue
+		}
+
+		stretchedFp, found := stretched[result.speed]
+		if !found {
+			stretchedFp = stretchFingerprint(queryFp, result.speed)
+			stretched[result.speed] = stretchedFp
+		}
+
+		queryFpb, err := stretchedFp.extractFingerprintBlock(result.window.offset, result.window.size)
+		if err != nil {
+			continue
+		}
+
+		for _, c := range result.candidates {
+			m := window_match{result.window, c.fp, c.offset, candidateBitErrorRate(alg, queryFpb, c), result.speed}
+			best := matches[i]
+			if best.fp == nil || m.ber < best.ber ||
+				(m.ber == best.ber && (m.fp.id < best.fp.id || (m.fp.id == best.fp.id && m.offset < best.offset))) {
+				matches[i] = m
+			}
+		}
+	}
+
+	return matches
+}
+
+// Merges the best matches of windows into a timeline of the segments of the
+// query matching each reference, for example the tracks of a DJ mix along with
+// where each was cued from. Consecutive windows are merged when they match the
+// same reference at an alignment that drifted by no more than the maximum,
+// skipping over windows without a match. Windows searched at different speed
+// factors are merged separately, and of segments of the same reference that
+// overlap in the query only the one found by the most windows is kept.
+// Segments of different references can overlap where windows straddle both.
+func mergeWindowMatches(alg fingerprint_algorithm, queryFp fingerprint, windowMatches []window_match, maxDrift int) []segment {
+	var matches []window_match
+	for _, m := range windowMatches {
+		if m.fp != nil {
+			matches = append(matches, m)
+		}
+	}
+	sort.Sort(window_matches_by_offset(matches))
+
+	var segments []segment
+	for start := 0; start < len(matches); {
+		end := start + 1
+		for ; end < len(matches); end++ {
+			previous, next := matches[end-1], matches[end]
+			drift := (next.offset - next.window.offset) - (previous.offset - previous.window.offset)
+			if next.fp != previous.fp || next.speed != previous.speed || abs(drift) > maxDrift {
+				break
+			}
+		}
+
+		segments = append(segments, newSegment(alg, queryFp, matches[start:end]))
+		start = end
+	}
+
+	// keep the best of overlapping segments of the same reference
+	sort.Sort(segments_by_rank(segments))
+	var kept []segment
+	for _, s := range segments {
+		overlapped := false
+		for _, k := range kept {
+			if k.fp == s.fp && s.queryStart < k.queryEnd && k.queryStart < s.queryEnd {
+				overlapped = true
+				break
+			}
+		}
+
+		if !overlapped {
+			kept = append(kept, s)
+		}
+	}
+
+	sort.Sort(segments_by_query_start(kept))
+
+	return kept
+}
+
+// Creates a segment from consecutive window matches of the same reference and
+// speed, clipped to the bounds of the reference.
+func newSegment(alg fingerprint_algorithm, queryFp fingerprint, matches []window_match) segment {
+	first, last := matches[0], matches[len(matches)-1]
+	stretchedFp := stretchFingerprint(queryFp, first.speed)
+
+	// positions in the stretched query
+	queryStart, queryEnd := first.window.offset, last.window.offset+last.window.size
+	referenceStart, referenceEnd := first.offset, last.offset+last.window.size
+
+	if referenceStart < 0 {
+		queryStart, referenceStart = queryStart-referenceStart, 0
+	}
+	if l := len(first.fp.sfps); referenceEnd > l {
+		queryEnd, referenceEnd = queryEnd-(referenceEnd-l), l
+	}
+
+	// drift within the segment can leave the query and reference of different
+	// lengths, so compare only as much as both have
+	n := queryEnd - queryStart
+	if referenceEnd-referenceStart < n {
+		n = referenceEnd - referenceStart
+	}
+
+	var ber float32 = 1.0
+	if n > 0 {
+		queryFpb := fingerprint_block(stretchedFp.sfps[queryStart : queryStart+n])
+		referenceFpb := fingerprint_block(first.fp.sfps[referenceStart : referenceStart+n])
+		if b, err := queryFpb.bitErrorRateWith(alg, referenceFpb); err == nil {
+			ber = b
+		}
+	}
+
+	return segment{
+		first.fp,
+		unstretchPosition(queryStart, first.speed, len(queryFp.sfps)),
+		unstretchPosition(queryEnd, first.speed, len(queryFp.sfps)),
+		referenceStart,
+		referenceEnd,
+		len(matches),
+		ber,
+		first.speed,
+	}
+}
+
+// The position in the query as it was given of a position in the query
+// stretched by a speed factor, within the length of the query.
+func unstretchPosition(position int, speed float64, length int) int {
+	p := int(math.Floor(float64(position)/speed + 0.5))
+	if p > length {
+		return length
+	}
+	return p
+}
+
+// Merges the windows of a query into the segments matching every reference,
+// rather than only the best reference of each window, so that a query with
+// more than one reference at the same position has a segment of each. The
+// segments are in query order.
+func mergeWindowMatchesByReference(alg fingerprint_algorithm, queryFp fingerprint, results []window_result, maxDrift int) []segment {
+	byReference := make(map[*fingerprint][]window_result)
+	for _, result := range results {
+		windowCandidates := make(map[*fingerprint][]candidate)
+		for _, c := range result.candidates {
+			windowCandidates[c.fp] = append(windowCandidates[c.fp], c)
+		}
+
+		for fp, candidates := range windowCandidates {
+			referenceResult := result
+			referenceResult.candidates = candidates
+			byReference[fp] = append(byReference[fp], referenceResult)
+		}
+	}
+
+	var segments []segment
+	for _, referenceResults := range byReference {
+		windowMatches := bestWindowMatches(alg, queryFp, referenceResults)
+		segments = append(segments, mergeWindowMatches(alg, queryFp, windowMatches, maxDrift)...)
+	}
+
+	sort.Sort(segments_by_query_start(segments))
+
+	return segments
+}
@@ -0,0 +1,66 @@
+package main
+
+import "testing"
+
+// A query made up of parts of three references, like a DJ mix, has a timeline
+// of three segments, each aligned with where it was cued from in its reference.
+func TestMatchTimeline(t *testing.T) {
+	p := defaultCorpusParams()
+	p.size, p.minLength, p.maxLength, p.segmentLength = 20, 2000, 3000, 256
+	p.silenceFraction, p.repeatFraction, p.sharedFraction = 0, 0, 0
+	corpus, err := generateCorpus(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := buildIndex(philips, corpus)
+
+	expected := []segment{
+		{fp: &corpus[2], queryStart: 0, queryEnd: 800, referenceStart: 100, referenceEnd: 900},
+		{fp: &corpus[9], queryStart: 800, queryEnd: 1600, referenceStart: 300, referenceEnd: 1100},
+		{fp: &corpus[15], queryStart: 1600, queryEnd: 2100, referenceStart: 0, referenceEnd: 500},
+	}
+
+	var sfps []sub_fingerprint
+	for _, e := range expected {
+		sfps = append(sfps, e.fp.sfps[e.referenceStart:e.referenceEnd]...)
+	}
+	queryFp := fingerprint{"mix", sfps, fingerprint_meta{}, 0}
+
+	params := defaultSearchParams()
+	params.blockSize, params.stepSize = 128, 64
+	results, err := params.searchWindows(queryFp, idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	windowMatches := bestWindowMatches(philips, queryFp, results)
+	if len(windowMatches) != len(results) {
+		t.Fatalf("Expected a best match for each of %d windows but got %d", len(results), len(windowMatches))
+	}
+	if best := windowMatches[0]; best.fp != expected[0].fp || best.offset != 100 || best.ber != 0 {
+		t.Errorf("Expected the first window to best match %s@100 exactly", expected[0].fp.id)
+	}
+
+	segments := mergeWindowMatches(philips, queryFp, windowMatches, DefaultTimelineMaxDrift)
+	if len(expected) != len(segments) {
+		t.Fatalf("Expected %d segments but got %d", len(expected), len(segments))
+	}
+
+	// windows straddling two references can stretch a segment by up to a block
+	for i, e := range expected {
+		s := segments[i]
+		if e.fp != s.fp {
+			t.Errorf("[%d] Expected a segment of %s but was %s", i, e.fp.id, s.fp.id)
+			continue
+		}
+
+		if s.queryStart < e.queryStart-params.blockSize || s.queryEnd > e.queryEnd+params.blockSize ||
+			s.queryStart > e.queryStart+params.stepSize || s.queryEnd < e.queryEnd-params.stepSize {
+			t.Errorf("[%d] Expected the query from %d to %d but was %d to %d", i, e.queryStart, e.queryEnd, s.queryStart, s.queryEnd)
+		}
+
+		if e.referenceStart-e.queryStart != s.referenceStart-s.queryStart || e.referenceEnd-e.queryEnd != s.referenceEnd-s.queryEnd {
+			t.Errorf("[%d] Expected the reference aligned at %d but was %d to %d", i, e.referenceStart-e.queryStart, s.referenceStart, s.referenceEnd)
+		}
+	}
+}